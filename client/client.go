@@ -28,9 +28,18 @@ type Client struct {
 	dialer        *dialer.Dialer
 	closeIdleDone chan struct{}
 
+	// servers holds the transports of non-default servers selected by
+	// local users, keyed by "address:port".
+	servers map[string]*serverTransport
+
 	mu sync.RWMutex
 }
 
+type serverTransport struct {
+	transport *http2.HTTP2Transport
+	masterKey []byte
+}
+
 func New(cfg *config.ClientConfig) (*Client, error) {
 	masterKey, err := crypto.DeriveMasterKey(cfg.DefaultServer().Password)
 	if err != nil {
@@ -62,7 +71,6 @@ func New(cfg *config.ClientConfig) (*Client, error) {
 		"server_ipv6", serverIPV6,
 	)
 
-	tlsCfg := cfg.UTLSConfig()
 	directDialer, directIface := newDirectDialer()
 
 	shaperCfg := shaper.Config{
@@ -80,16 +88,33 @@ func New(cfg *config.ClientConfig) (*Client, error) {
 		masterKey:     masterKey,
 		dialer:        directDialer,
 		closeIdleDone: make(chan struct{}),
+		servers:       make(map[string]*serverTransport),
+	}
+
+	tr, err := client.newTransport(cfg.DefaultServer(), masterKey)
+	if err != nil {
+		return nil, err
 	}
 
+	client.transport = tr
+
+	log.Info("[CLIENT] transport initialized", "server_url", cfg.ServerURL(), "max_slots", cfg.Transport.ConnCountMax, "stream_threshold", cfg.Transport.StreamThreshold, "server_addr", cfg.DefaultServerAddr(), "direct_iface", directIface)
+
+	go client.closeIdleLoop()
+
+	return client, nil
+}
+
+func (c *Client) newTransport(svr *config.ServerProfile, masterKey []byte) (*http2.HTTP2Transport, error) {
 	probeToken, err := crypto.ProbeToken(masterKey)
 	if err != nil {
 		return nil, fmt.Errorf("probe token: %w", err)
 	}
 
-	tr, err := http2.New(http2.Config{
-		ServerURL:         cfg.ServerURL(),
-		TLSConfig:         tlsCfg,
+	cfg := c.cfg
+	return http2.New(http2.Config{
+		ServerURL:         svr.URL(),
+		TLSConfig:         svr.UTLSConfig(),
 		MaxSlotCount:      cfg.Transport.ConnCountMax,
 		StreamThreshold:   cfg.Transport.StreamThreshold,
 		PrioritySlotRatio: cfg.Transport.PrioritySlotRatio,
@@ -98,20 +123,35 @@ func New(cfg *config.ClientConfig) (*Client, error) {
 		Timeout:           cfg.TimeoutDuration(),
 		ProbeToken:        probeToken,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialWithConfig(ctx, cfg, client.dialer, rt, network, addr)
+			return dialWithConfig(ctx, cfg, c.dialer, c.router, network, addr)
 		},
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	client.transport = tr
-
-	log.Info("[CLIENT] transport initialized", "server_url", cfg.ServerURL(), "max_slots", cfg.Transport.ConnCountMax, "stream_threshold", cfg.Transport.StreamThreshold, "server_addr", cfg.DefaultServerAddr(), "direct_iface", directIface)
+}
 
-	go client.closeIdleLoop()
+// ServerTransport returns the transport and master key of svr. The default
+// server's are the client's own; the others are created on first use and
+// closed with the client.
+func (c *Client) ServerTransport(svr *config.ServerProfile) (transport.Transport, []byte, error) {
+	if svr == c.cfg.DefaultServer() {
+		return c.transport, c.masterKey, nil
+	}
 
-	return client, nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st, ok := c.servers[svr.Addr()]; ok {
+		return st.transport, st.masterKey, nil
+	}
+	masterKey, err := crypto.DeriveMasterKey(svr.Password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("server %s: %w", svr.Addr(), err)
+	}
+	tr, err := c.newTransport(svr, masterKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("server %s: %w", svr.Addr(), err)
+	}
+	c.servers[svr.Addr()] = &serverTransport{transport: tr, masterKey: masterKey}
+	log.Info("[CLIENT] transport initialized", "server_url", svr.URL(), "server_addr", svr.Addr())
+	return tr, masterKey, nil
 }
 
 func newDirectDialer() (*dialer.Dialer, string) {
@@ -233,6 +273,11 @@ func (c *Client) Transport() transport.Transport {
 	return c.transport
 }
 
+// PublicIP returns the client's public address as seen by the server.
+func (c *Client) PublicIP(ctx context.Context) (net.IP, error) {
+	return c.transport.PublicIP(ctx)
+}
+
 func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	return dialWithConfig(ctx, c.cfg, c.dialer, c.router, network, addr)
 }
@@ -254,6 +299,9 @@ func (c *Client) Close() error {
 	defer c.mu.Unlock()
 
 	close(c.closeIdleDone)
+	for _, st := range c.servers {
+		_ = st.transport.Close()
+	}
 	return c.transport.Close()
 }
 
@@ -264,6 +312,11 @@ func (c *Client) closeIdleLoop() {
 		select {
 		case <-ticker.C:
 			c.transport.CloseIdle()
+			c.mu.RLock()
+			for _, st := range c.servers {
+				st.transport.CloseIdle()
+			}
+			c.mu.RUnlock()
 		case <-c.closeIdleDone:
 			return
 		}
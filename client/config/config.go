@@ -37,12 +37,76 @@ type ServerProfile struct {
 type LocalConfig struct {
 	SocksPort        int             `json:"socks_port"`
 	HTTPPort         int             `json:"http_port"`
+	MixedPort        int             `json:"mixed_port"`
 	BindAll          bool            `json:"bind_all"`
 	DisableSysProxy  bool            `json:"disable_sys_proxy"`
+	SysProxyPAC      bool            `json:"sys_proxy_pac"`
 	EnableForwardDNS bool            `json:"enable_forward_dns"`
+	ForwardDNSAddr   string          `json:"forward_dns_addr"`
 	EnableTun2socks  bool            `json:"enable_tun2socks"`
 	EnableQUIC       bool            `json:"enable_quic"`
 	TunConfig        json.RawMessage `json:"tun_config,omitempty"`
+	// TransparentPort enables the transparent proxy inbound of a Linux
+	// gateway on all interfaces; TransparentMode is "redirect" (TCP via
+	// REDIRECT) or "tproxy" (TCP and UDP via TPROXY).
+	TransparentPort int    `json:"transparent_port"`
+	TransparentMode string `json:"transparent_mode"`
+	// Users replaces auth_username/auth_password with per-user credentials
+	// on the socks5, http and mixed inbounds.
+	Users []LocalUser `json:"users,omitempty"`
+	// Forwards are static port forwards carried through the server.
+	Forwards []LocalForward `json:"forwards,omitempty"`
+	Reverse  []LocalReverse `json:"reverse,omitempty"`
+	// MITM is the opt-in HTTPS interception of the http inbound, for
+	// debugging API calls carried through the tunnel.
+	MITM *LocalMITM `json:"mitm,omitempty"`
+}
+
+// LocalUser is a credential of the local inbounds with its own policy.
+// ProxyRule overrides routing.proxy_rule, Server ("address:port" of one of
+// the servers) picks the server the user's traffic is proxied through,
+// empty meaning the default one, and BandwidthLimit caps each direction in
+// bytes per second, 0 meaning unlimited.
+type LocalUser struct {
+	Username       string `json:"username"`
+	Password       string `json:"password"`
+	ProxyRule      string `json:"proxy_rule,omitempty"`
+	Server         string `json:"server,omitempty"`
+	BandwidthLimit int64  `json:"bandwidth_limit,omitempty"`
+}
+
+// LocalForward forwards Listen ("host:port") to Target through a server,
+// bypassing the routing rules, like ssh -L. Network is "tcp" (default) or
+// "udp"; Server ("address:port" of one of the servers) picks the server,
+// empty meaning the default one.
+type LocalForward struct {
+	Listen  string `json:"listen"`
+	Target  string `json:"target"`
+	Network string `json:"network,omitempty"`
+	Server  string `json:"server,omitempty"`
+}
+
+// LocalReverse exposes Target ("host:port", reachable from the client) on
+// RemotePort of a server, like ssh -R. The port must be in the server's
+// reverse_ports; Server picks the server as in LocalForward.
+type LocalReverse struct {
+	RemotePort int    `json:"remote_port"`
+	Target     string `json:"target"`
+	Server     string `json:"server,omitempty"`
+}
+
+// LocalMITM terminates TLS of the http inbound's CONNECT tunnels to Hosts
+// with certificates issued by a local CA, and records every exchange to
+// HARFile (bodies too with LogBodies) before re-encrypting it upstream.
+// Hosts are exact names or IPs, or "*.example.com" for subdomains. The CA
+// is generated into CACert/CAKey when those files do not exist.
+type LocalMITM struct {
+	Enable    bool     `json:"enable"`
+	Hosts     []string `json:"hosts"`
+	CACert    string   `json:"ca_cert,omitempty"`
+	CAKey     string   `json:"ca_key,omitempty"`
+	HARFile   string   `json:"har_file,omitempty"`
+	LogBodies bool     `json:"log_bodies,omitempty"`
 }
 
 type RoutingConfig struct {
@@ -52,6 +116,40 @@ type RoutingConfig struct {
 	ProxyFile  string `json:"proxy_file"`
 }
 
+// DNSConfig holds static DNS records answered locally by the socks5 and the
+// forward DNS servers. Hosts maps a name (or "*.example.com" wildcard) to a
+// comma separated IP list, a CNAME target or "nxdomain"; HostsFile is an
+// optional file in /etc/hosts format. Hosts entries override the file.
+// ForwardRouting makes the forward DNS server pick direct or proxied
+// resolution per name from the routing rules instead of always resolving
+// directly.
+//
+// CacheFile persists the DNS cache across restarts, StaleTTL (seconds) lets
+// expired entries be served while refreshed in the background (RFC 8767,
+// 0 disables it) and Prefetch refreshes hot entries shortly before expiry.
+//
+// ECS adds the EDNS Client Subnet to queries resolved through the tunnel.
+type DNSConfig struct {
+	Hosts          map[string]string `json:"hosts"`
+	HostsFile      string            `json:"hosts_file"`
+	ForwardRouting bool              `json:"forward_routing"`
+	CacheFile      string            `json:"cache_file"`
+	StaleTTL       int               `json:"stale_ttl"`
+	Prefetch       bool              `json:"prefetch"`
+	ECS            ECSConfig         `json:"ecs"`
+}
+
+// ECSConfig enables EDNS Client Subnet on proxied DNS queries, so that CDNs
+// answer for the client's network rather than the proxy server's. Subnet is
+// a CIDR; when empty it is derived from the public IP reported by the
+// server (/24 for IPv4, /56 for IPv6). ProxyRules limits injection to the
+// listed proxy rules ("auto", "proxy", ...); empty means every rule.
+type ECSConfig struct {
+	Enable     bool     `json:"enable"`
+	Subnet     string   `json:"subnet"`
+	ProxyRules []string `json:"proxy_rules"`
+}
+
 type TransportConfig struct {
 	Protocol          string  `json:"protocol"`
 	ConnCountMax      int     `json:"conn_count_max"`
@@ -77,6 +175,7 @@ type ClientConfig struct {
 	Servers       []*ServerProfile `json:"servers"`
 	Local         LocalConfig      `json:"local"`
 	Routing       RoutingConfig    `json:"routing"`
+	DNS           DNSConfig        `json:"dns"`
 	Transport     TransportConfig  `json:"transport"`
 	Shaper        ShaperConfig     `json:"shaper"`
 	Log           LogConfig        `json:"log"`
@@ -103,7 +202,26 @@ func (c *ClientConfig) ServerURL() string {
 	if srv == nil {
 		return ""
 	}
-	return fmt.Sprintf("https://%s:%d", srv.Address, srv.Port)
+	return srv.URL()
+}
+
+// ServerByAddr returns the server whose "address:port" is addr, or nil.
+func (c *ClientConfig) ServerByAddr(addr string) *ServerProfile {
+	for _, s := range c.Servers {
+		if s.Addr() == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// Addr returns the server's "address:port".
+func (s *ServerProfile) Addr() string {
+	return fmt.Sprintf("%s:%d", s.Address, s.Port)
+}
+
+func (s *ServerProfile) URL() string {
+	return fmt.Sprintf("https://%s:%d", s.Address, s.Port)
 }
 
 func (c *ClientConfig) TimeoutDuration() time.Duration {
@@ -118,10 +236,13 @@ func (c *ClientConfig) UTLSConfig() *utls.Config {
 	if srv == nil {
 		return nil
 	}
+	return srv.UTLSConfig()
+}
 
-	sni := srv.SNI
+func (s *ServerProfile) UTLSConfig() *utls.Config {
+	sni := s.SNI
 	if sni == "" {
-		sni = srv.Address
+		sni = s.Address
 	}
 
 	utlsCfg := &utls.Config{
@@ -129,19 +250,19 @@ func (c *ClientConfig) UTLSConfig() *utls.Config {
 		NextProtos: config.NextProtos,
 	}
 
-	if srv.CAPath != "" {
+	if s.CAPath != "" {
 		pool, err := x509.SystemCertPool()
 		if err != nil || pool == nil {
 			pool = x509.NewCertPool()
 		}
-		pem, err := os.ReadFile(srv.CAPath)
+		pem, err := os.ReadFile(s.CAPath)
 		if err != nil {
-			log.Warn("[CONFIG] load custom CA", "file", srv.CAPath, "err", err)
+			log.Warn("[CONFIG] load custom CA", "file", s.CAPath, "err", err)
 		} else if !pool.AppendCertsFromPEM(pem) {
-			log.Warn("[CONFIG] load custom CA: no valid PEM certs", "file", srv.CAPath)
+			log.Warn("[CONFIG] load custom CA: no valid PEM certs", "file", s.CAPath)
 		} else {
 			utlsCfg.RootCAs = pool
-			log.Info("[CONFIG] loaded custom CA", "file", srv.CAPath)
+			log.Info("[CONFIG] loaded custom CA", "file", s.CAPath)
 		}
 	}
 
@@ -219,6 +340,23 @@ func applyDefaults(c *ClientConfig) {
 	if c.Log.Level == "" {
 		c.Log.Level = config.DefaultLogLevel
 	}
+	if c.Local.ForwardDNSAddr == "" {
+		c.Local.ForwardDNSAddr = config.DefaultForwardDNSAddr
+	}
+	if c.Local.TransparentMode == "" {
+		c.Local.TransparentMode = config.DefaultTransparentMode
+	}
+	if m := c.Local.MITM; m != nil {
+		if m.CACert == "" {
+			m.CACert = config.DefaultMITMCACert
+		}
+		if m.CAKey == "" {
+			m.CAKey = config.DefaultMITMCAKey
+		}
+		if m.HARFile == "" {
+			m.HARFile = config.DefaultMITMHARFile
+		}
+	}
 	for _, srv := range c.Servers {
 		if srv.Port == 0 {
 			srv.Port = config.DefaultServerPort
@@ -237,6 +375,8 @@ func applyDefaults(c *ClientConfig) {
 func (c *ClientConfig) ResolveFilePaths() {
 	c.Routing.DirectFile = util.ResolvePath(c.Routing.DirectFile)
 	c.Routing.ProxyFile = util.ResolvePath(c.Routing.ProxyFile)
+	c.DNS.HostsFile = util.ResolvePath(c.DNS.HostsFile)
+	c.DNS.CacheFile = util.ResolvePath(c.DNS.CacheFile)
 	for _, srv := range c.Servers {
 		srv.CAPath = util.ResolvePath(srv.CAPath)
 	}
@@ -273,7 +413,7 @@ func (c *ClientConfig) DefaultServerAddr() string {
 	if srv == nil {
 		return ""
 	}
-	return fmt.Sprintf("%s:%d", srv.Address, srv.Port)
+	return srv.Addr()
 }
 
 func (c *ClientConfig) DefaultServerIndex() int {
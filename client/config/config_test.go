@@ -143,6 +143,21 @@ func TestServerURL(t *testing.T) {
 	})
 }
 
+func TestServerByAddr(t *testing.T) {
+	cfg := &ClientConfig{
+		Servers: []*ServerProfile{
+			{Address: "a.example.com", Port: 443, Default: true},
+			{Address: "b.example.com", Port: 8443},
+		},
+	}
+	if s := cfg.ServerByAddr("b.example.com:8443"); s != cfg.Servers[1] {
+		t.Errorf("ServerByAddr = %v, want second server", s)
+	}
+	if s := cfg.ServerByAddr("b.example.com:443"); s != nil {
+		t.Errorf("ServerByAddr = %v, want nil", s)
+	}
+}
+
 func TestTimeoutDuration(t *testing.T) {
 	t.Run("正值", func(t *testing.T) {
 		cfg := &ClientConfig{Timeout: 60}
@@ -602,6 +617,18 @@ func TestApplyDefaults(t *testing.T) {
 		}
 	})
 
+	t.Run("MITM 文件路径默认值", func(t *testing.T) {
+		cfg := &ClientConfig{Local: LocalConfig{MITM: &LocalMITM{Enable: true, HARFile: "debug.har"}}}
+		applyDefaults(cfg)
+		m := cfg.Local.MITM
+		if m.CACert != config.DefaultMITMCACert || m.CAKey != config.DefaultMITMCAKey {
+			t.Errorf("CA = %q / %q", m.CACert, m.CAKey)
+		}
+		if m.HARFile != "debug.har" {
+			t.Errorf("HARFile = %q, want debug.har (not overwritten)", m.HARFile)
+		}
+	})
+
 	t.Run("BatchWindowMS 上限", func(t *testing.T) {
 		cfg := &ClientConfig{Shaper: ShaperConfig{BatchWindowMS: 100}}
 		applyDefaults(cfg)
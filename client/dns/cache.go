@@ -1,10 +1,14 @@
 package dns
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/rand/v2"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coocood/freecache"
 	"github.com/miekg/dns"
@@ -16,14 +20,48 @@ const (
 	cacheSize   = 2 * 1024 * 1024
 	maxCacheTTL = 2 * 60 * 60
 	minCacheTTL = 30 * 60
+
+	// entryHeaderSize is the size of the fresh-until timestamp stored in
+	// front of every packed message.
+	entryHeaderSize = 8
+	// staleAnswerTTL is the TTL of records served from an expired entry,
+	// as recommended by RFC 8767.
+	staleAnswerTTL = 30
+	// prefetchWindow is how long (in seconds) before expiry a hot entry is
+	// refreshed in the background.
+	prefetchWindow = 5 * 60
+	// prefetchMinHits is how many hits since the last refresh make an entry
+	// hot enough to be prefetched.
+	prefetchMinHits = 3
+	// refreshHoldOff suppresses duplicate background refreshes of the same
+	// entry while one is in flight.
+	refreshHoldOff = 10 * time.Second
+	// maxTrackedKeys bounds the hit and refresh bookkeeping maps.
+	maxTrackedKeys = 8192
 )
 
 // Cache stores DNS query results in two separate caches: one for proxied
 // results and one for direct (non-proxied) results.
+//
+// Optionally an entry outlives its fresh lifetime by staleTTL seconds so it
+// can be served stale (RFC 8767) while the caller refreshes it, and hot
+// entries are reported for refresh shortly before they expire (prefetch).
+// See Lookup.
 type Cache struct {
 	proxied      *freecache.Cache
 	direct       *freecache.Cache
 	serverDomain string
+
+	staleTTL atomic.Int64
+	prefetch atomic.Bool
+
+	mu         sync.Mutex
+	hits       map[string]int
+	refreshing map[string]time.Time
+
+	persistFile string
+	persistStop chan struct{}
+	persistDone chan struct{}
 }
 
 // NewCache creates a new DNS cache with separate storage for proxied and
@@ -35,53 +73,154 @@ func NewCache(serverDomain string) *Cache {
 		proxied:      freecache.NewCache(cacheSize),
 		direct:       freecache.NewCache(cacheSize),
 		serverDomain: serverDomain,
+		hits:         make(map[string]int),
+		refreshing:   make(map[string]time.Time),
 	}
 }
 
+// SetServeStale keeps entries for d after they expire so they can still be
+// answered (with a short TTL) while being refreshed. Zero disables it. It
+// applies to entries stored afterwards.
+func (c *Cache) SetServeStale(d time.Duration) {
+	c.staleTTL.Store(int64(d / time.Second))
+}
+
+// SetPrefetch enables refreshing hot entries shortly before they expire.
+func (c *Cache) SetPrefetch(enabled bool) {
+	c.prefetch.Store(enabled)
+}
+
 // Get retrieves a cached DNS message by name and query type.
 // If isDirect is true, the direct cache is queried; otherwise the proxied cache.
 func (c *Cache) Get(name, qtype string, isDirect bool) *dns.Msg {
+	msg, _ := c.lookup(name, qtype, isDirect, false)
+	return msg
+}
+
+// Lookup is like Get, and additionally reports whether the caller should
+// refresh the entry in the background and Set the result: either the entry
+// was served stale, or it is hot and about to expire. At most one caller
+// is asked to refresh a given entry within refreshHoldOff.
+func (c *Cache) Lookup(name, qtype string, isDirect bool) (msg *dns.Msg, refresh bool) {
+	return c.lookup(name, qtype, isDirect, true)
+}
+
+func (c *Cache) lookup(name, qtype string, isDirect, track bool) (*dns.Msg, bool) {
 	cache := c.proxied
 	if isDirect {
 		cache = c.direct
 	}
-	v, err := cache.Get([]byte(name + qtype))
-	if err != nil || len(v) == 0 {
+	key := name + qtype
+	v, err := cache.Get([]byte(key))
+	if err != nil || len(v) <= entryHeaderSize {
 		stats.RecordDNSCacheMiss()
-		return nil
+		return nil, false
 	}
+	freshUntil := int64(binary.BigEndian.Uint64(v[:entryHeaderSize]))
 	msg := &dns.Msg{}
-	if err := msg.Unpack(v); err != nil {
+	if err := msg.Unpack(v[entryHeaderSize:]); err != nil {
 		stats.RecordDNSCacheMiss()
-		return nil
+		return nil, false
 	}
+	if freshUntil == 0 {
+		stats.RecordDNSCacheHit()
+		return msg, false
+	}
+
+	tk := trackKey(key, isDirect)
+	now := time.Now().Unix()
+	if now >= freshUntil {
+		if c.staleTTL.Load() <= 0 {
+			stats.RecordDNSCacheMiss()
+			return nil, false
+		}
+		for _, rr := range msg.Answer {
+			rr.Header().Ttl = staleAnswerTTL
+		}
+		stats.RecordDNSCacheHit()
+		stats.RecordDNSStaleServed()
+		return msg, track && c.beginRefresh(tk)
+	}
+
 	stats.RecordDNSCacheHit()
-	return msg
+	if !track || !c.prefetch.Load() {
+		return msg, false
+	}
+	c.mu.Lock()
+	if len(c.hits) >= maxTrackedKeys {
+		clear(c.hits)
+	}
+	c.hits[tk]++
+	hot := c.hits[tk] >= prefetchMinHits
+	c.mu.Unlock()
+	if hot && freshUntil-now <= prefetchWindow && c.beginRefresh(tk) {
+		stats.RecordDNSPrefetch()
+		return msg, true
+	}
+	return msg, false
+}
+
+// beginRefresh reports whether the caller may start refreshing the entry,
+// i.e. no other refresh of it started within refreshHoldOff.
+func (c *Cache) beginRefresh(tk string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.refreshing[tk]; ok && time.Since(t) < refreshHoldOff {
+		return false
+	}
+	if len(c.refreshing) >= maxTrackedKeys {
+		clear(c.refreshing)
+	}
+	c.refreshing[tk] = time.Now()
+	return true
+}
+
+func trackKey(key string, isDirect bool) string {
+	if isDirect {
+		return "d/" + key
+	}
+	return "p/" + key
 }
 
 // Set stores a DNS message in the appropriate cache using DNS TTL.
 // Only A and AAAA records are cached. If isDirect is true, the direct cache is used.
 // The effective cache lifetime is the base TTL plus a random jitter in
 // [0, baseTTL) so that entries with the same base TTL do not expire at the
-// same moment, avoiding bursts of concurrent DNS queries.
+// same moment, avoiding bursts of concurrent DNS queries. With serve-stale
+// enabled the entry is kept for the stale window beyond that lifetime.
 func (c *Cache) Set(msg *dns.Msg, isDirect bool) error {
 	if msg == nil || len(msg.Question) == 0 {
 		return nil
 	}
 	q := msg.Question[0]
-	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-		v, err := msg.Pack()
-		if err != nil {
-			return err
-		}
-		key := []byte(q.Name + dns.TypeToString[q.Qtype])
-		ttl := jitterTTL(dnsCacheTTL(msg, c.serverDomain))
-		if isDirect {
-			return c.direct.Set(key, v, ttl)
-		}
-		return c.proxied.Set(key, v, ttl)
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
 	}
-	return nil
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	key := q.Name + dns.TypeToString[q.Qtype]
+	ttl := jitterTTL(dnsCacheTTL(msg, c.serverDomain))
+
+	v := make([]byte, entryHeaderSize+len(packed))
+	expire := ttl
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(v, uint64(time.Now().Unix()+int64(ttl)))
+		expire += int(c.staleTTL.Load())
+	}
+	copy(v[entryHeaderSize:], packed)
+
+	tk := trackKey(key, isDirect)
+	c.mu.Lock()
+	delete(c.hits, tk)
+	delete(c.refreshing, tk)
+	c.mu.Unlock()
+
+	if isDirect {
+		return c.direct.Set([]byte(key), v, expire)
+	}
+	return c.proxied.Set([]byte(key), v, expire)
 }
 
 // dnsCacheTTL returns the cache lifetime in seconds for the given DNS
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/nange/easyss/v3/log"
+)
+
+// persistInterval is how often the cache is written to its file while
+// persistence is enabled, bounding what is lost on a crash.
+const persistInterval = 10 * time.Minute
+
+// persistedEntry is the on-disk form of a cache entry. Value is the raw
+// cache value (fresh-until header plus packed message).
+type persistedEntry struct {
+	Key      string `json:"key"`
+	Value    []byte `json:"value"`
+	ExpireAt uint32 `json:"expire_at"`
+	Direct   bool   `json:"direct,omitempty"`
+}
+
+// Load restores entries saved by Save. Entries that expired in the meantime
+// are skipped. A missing file is not an error.
+func (c *Cache) Load(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read dns cache file: %w", err)
+	}
+	var entries []persistedEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("decode dns cache file: %w", err)
+	}
+
+	now := uint32(time.Now().Unix())
+	n := 0
+	for _, e := range entries {
+		if e.ExpireAt <= now || len(e.Value) <= entryHeaderSize {
+			continue
+		}
+		cache := c.proxied
+		if e.Direct {
+			cache = c.direct
+		}
+		if err := cache.Set([]byte(e.Key), e.Value, int(e.ExpireAt-now)); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Save writes all expiring entries to file, replacing it atomically.
+// Entries that never expire (the proxy server's own domain) are left out so
+// a restart always re-resolves the server address.
+func (c *Cache) Save(file string) error {
+	var entries []persistedEntry
+	collect := func(cache *freecache.Cache, direct bool) {
+		it := cache.NewIterator()
+		for e := it.Next(); e != nil; e = it.Next() {
+			if e.ExpireAt == 0 {
+				continue
+			}
+			entries = append(entries, persistedEntry{
+				Key:      string(e.Key),
+				Value:    e.Value,
+				ExpireAt: e.ExpireAt,
+				Direct:   direct,
+			})
+		}
+	}
+	collect(c.proxied, false)
+	collect(c.direct, true)
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("write dns cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() //nolint:errcheck
+		return fmt.Errorf("write dns cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write dns cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("write dns cache file: %w", err)
+	}
+	return nil
+}
+
+// EnablePersistence loads file into the cache and keeps saving the cache to
+// it periodically until Close. It must be called at most once.
+func (c *Cache) EnablePersistence(file string) {
+	n, err := c.Load(file)
+	if err != nil {
+		log.Warn("[DNS] load cache file", "file", file, "err", err)
+	} else {
+		log.Info("[DNS] loaded cache file", "file", file, "entries", n)
+	}
+
+	c.persistFile = file
+	c.persistStop = make(chan struct{})
+	c.persistDone = make(chan struct{})
+	go func() {
+		defer close(c.persistDone)
+		ticker := time.NewTicker(persistInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.Save(file); err != nil {
+					log.Warn("[DNS] save cache file", "file", file, "err", err)
+				}
+			case <-c.persistStop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the periodic persistence, if enabled, and saves the cache one
+// last time.
+func (c *Cache) Close() error {
+	if c.persistStop == nil {
+		return nil
+	}
+	select {
+	case <-c.persistStop:
+		return nil
+	default:
+	}
+	close(c.persistStop)
+	<-c.persistDone
+	return c.Save(c.persistFile)
+}
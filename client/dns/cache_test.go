@@ -1,10 +1,13 @@
 package dns
 
 import (
+	"encoding/binary"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/stats"
 )
 
 func TestNewCache(t *testing.T) {
@@ -320,3 +323,174 @@ func TestCachePrePopulateWithFallbackAllFail(t *testing.T) {
 		t.Fatal("expected error")
 	}
 }
+
+// setCacheEntry stores msg in the proxied cache with the given fresh-until
+// time, bypassing Set so tests can create stale or nearly expired entries.
+func setCacheEntry(t *testing.T, c *Cache, msg *dns.Msg, freshUntil time.Time) {
+	t.Helper()
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := make([]byte, entryHeaderSize+len(packed))
+	binary.BigEndian.PutUint64(v, uint64(freshUntil.Unix()))
+	copy(v[entryHeaderSize:], packed)
+	q := msg.Question[0]
+	if err := c.proxied.Set([]byte(q.Name+dns.TypeToString[q.Qtype]), v, 3600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAMsg(t *testing.T, name, ip string) *dns.Msg {
+	t.Helper()
+	msg := &dns.Msg{}
+	msg.SetQuestion(name, dns.TypeA)
+	rr, err := dns.NewRR(name + " 600 IN A " + ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Answer = append(msg.Answer, rr)
+	return msg
+}
+
+func TestCache_ServeStale(t *testing.T) {
+	stats.ResetCounters()
+	c := NewCache("")
+	setCacheEntry(t, c, testAMsg(t, "stale.com.", "1.2.3.4"), time.Now().Add(-time.Minute))
+
+	// 未开启 serve-stale 时过期条目视为未命中
+	if got, _ := c.Lookup("stale.com.", "A", false); got != nil {
+		t.Fatal("expired entry should miss when serve-stale is disabled")
+	}
+
+	c.SetServeStale(time.Hour)
+	got, refresh := c.Lookup("stale.com.", "A", false)
+	if got == nil || !refresh {
+		t.Fatalf("expected stale answer with refresh, got %v refresh=%v", got, refresh)
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+		t.Errorf("stale answer ttl = %d, want %d", ttl, staleAnswerTTL)
+	}
+	// 刷新进行中时不再重复要求刷新
+	if _, refresh := c.Lookup("stale.com.", "A", false); refresh {
+		t.Error("refresh should be requested only once while in flight")
+	}
+	if snap := stats.Collect(); snap.DNSStaleServed != 2 {
+		t.Errorf("stale served = %d, want 2", snap.DNSStaleServed)
+	}
+
+	// 刷新结果写入后条目重新变为新鲜
+	if err := c.Set(testAMsg(t, "stale.com.", "5.6.7.8"), false); err != nil {
+		t.Fatal(err)
+	}
+	got, refresh = c.Lookup("stale.com.", "A", false)
+	if got == nil || refresh || got.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+		t.Errorf("expected fresh entry after Set, got %v refresh=%v", got, refresh)
+	}
+}
+
+func TestCache_Prefetch(t *testing.T) {
+	stats.ResetCounters()
+	c := NewCache("")
+	setCacheEntry(t, c, testAMsg(t, "hot.com.", "1.2.3.4"), time.Now().Add(time.Minute))
+	setCacheEntry(t, c, testAMsg(t, "far.com.", "1.2.3.4"), time.Now().Add(time.Hour))
+
+	// 未开启 prefetch 时不刷新
+	for i := 0; i < prefetchMinHits; i++ {
+		if _, refresh := c.Lookup("hot.com.", "A", false); refresh {
+			t.Fatal("prefetch disabled, no refresh expected")
+		}
+	}
+
+	c.SetPrefetch(true)
+	refreshes := 0
+	for i := 0; i < prefetchMinHits+2; i++ {
+		if _, refresh := c.Lookup("hot.com.", "A", false); refresh {
+			refreshes++
+			if i+1 < prefetchMinHits {
+				t.Errorf("refresh requested after %d hits, before the entry is hot", i+1)
+			}
+		}
+		if _, refresh := c.Lookup("far.com.", "A", false); refresh {
+			t.Error("entry far from expiry should not be prefetched")
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshes = %d, want 1", refreshes)
+	}
+	if snap := stats.Collect(); snap.DNSPrefetches != 1 {
+		t.Errorf("prefetches = %d, want 1", snap.DNSPrefetches)
+	}
+
+	// Get 不参与刷新统计
+	if got := c.Get("hot.com.", "A", false); got == nil {
+		t.Error("Get should still return the entry")
+	}
+}
+
+func TestCache_SaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dns-cache.json")
+
+	c := NewCache("server.com")
+	if err := c.Set(testAMsg(t, "example.com.", "1.2.3.4"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(testAMsg(t, "direct.com.", "2.2.2.2"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(testAMsg(t, "server.com.", "3.3.3.3"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewCache("server.com")
+	n, err := restored.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("loaded %d entries, want 2", n)
+	}
+	if got := restored.Get("example.com.", "A", false); got == nil || got.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("proxied entry not restored: %v", got)
+	}
+	if got := restored.Get("direct.com.", "A", true); got == nil {
+		t.Error("direct entry not restored")
+	}
+	// 服务器自身域名的条目不持久化
+	if got := restored.Get("server.com.", "A", true); got != nil {
+		t.Error("server domain entry should not be persisted")
+	}
+
+	// 文件不存在不是错误
+	if n, err := NewCache("").Load(filepath.Join(t.TempDir(), "missing.json")); err != nil || n != 0 {
+		t.Errorf("missing file: n=%d err=%v", n, err)
+	}
+}
+
+func TestCache_EnablePersistenceClose(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dns-cache.json")
+
+	c := NewCache("")
+	c.EnablePersistence(file)
+	if err := c.Set(testAMsg(t, "example.com.", "1.2.3.4"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	restored := NewCache("")
+	restored.EnablePersistence(file)
+	t.Cleanup(func() {
+		_ = restored.Close()
+	})
+	if got := restored.Get("example.com.", "A", false); got == nil {
+		t.Error("entry should survive a restart")
+	}
+}
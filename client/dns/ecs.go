@@ -0,0 +1,209 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/log"
+)
+
+const (
+	// ecsPrefixV4 and ecsPrefixV6 are the source prefix lengths of a subnet
+	// derived from the public address, the usual privacy-preserving choice
+	// of public resolvers (RFC 7871 section 11.1).
+	ecsPrefixV4 = 24
+	ecsPrefixV6 = 56
+	// ecsRefreshInterval is how often the public address is re-learned, so a
+	// changed uplink address is picked up; ecsRetryInterval paces retries
+	// while it is still unknown.
+	ecsRefreshInterval = 30 * time.Minute
+	ecsRetryInterval   = 30 * time.Second
+)
+
+// PublicIPFunc reports the public address the proxy server sees the client
+// connecting from.
+type PublicIPFunc func(ctx context.Context) (net.IP, error)
+
+// ECS adds an EDNS Client Subnet option (RFC 7871) to the queries resolved
+// through the tunnel, so that the proxy dns server answers with records close
+// to the client instead of the proxy server. The subnet is either configured
+// or derived from the client's public address. Injection can be restricted
+// to some proxy rules; it is then skipped while another rule is active.
+//
+// A nil *ECS is valid and never touches a query.
+type ECS struct {
+	subnet atomic.Pointer[net.IPNet]
+	rules  []router.ProxyRule
+	rt     *router.Router
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewECS creates an ECS. subnet is a CIDR such as "203.0.113.0/24"; when
+// empty the subnet stays unset until EnableAutoSubnet learns it. rules lists
+// the proxy rule names (see router.ParseProxyRule) under which the option is
+// injected; empty means all rules. rt provides the active proxy rule and may
+// be nil when rules is empty.
+func NewECS(subnet string, rules []string, rt *router.Router) (*ECS, error) {
+	e := &ECS{rt: rt}
+	if subnet != "" {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("dns ecs subnet: %w", err)
+		}
+		e.subnet.Store(n)
+	}
+	for _, name := range rules {
+		rule := router.ParseProxyRule(name)
+		// ParseProxyRule maps unknown names to auto, reject them instead.
+		if rule == router.ProxyRuleAuto && name != "auto" {
+			return nil, fmt.Errorf("dns ecs: unknown proxy rule %q", name)
+		}
+		e.rules = append(e.rules, rule)
+	}
+	if len(e.rules) > 0 && rt == nil {
+		return nil, fmt.Errorf("dns ecs: proxy rules need a router")
+	}
+	return e, nil
+}
+
+// Subnet returns the subnet currently injected, or nil when unknown.
+func (e *ECS) Subnet() *net.IPNet {
+	if e == nil {
+		return nil
+	}
+	return e.subnet.Load()
+}
+
+// SetPublicIP derives the subnet from the client's public address.
+func (e *ECS) SetPublicIP(ip net.IP) {
+	bits, size := ecsPrefixV6, net.IPv6len*8
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits, size = v4, ecsPrefixV4, net.IPv4len*8
+	}
+	mask := net.CIDRMask(bits, size)
+	e.subnet.Store(&net.IPNet{IP: ip.Mask(mask), Mask: mask})
+}
+
+func (e *ECS) active() *net.IPNet {
+	if e == nil {
+		return nil
+	}
+	if len(e.rules) > 0 && !slices.Contains(e.rules, e.rt.ProxyRule()) {
+		return nil
+	}
+	return e.subnet.Load()
+}
+
+// Apply returns msg with the client subnet option added. msg itself is
+// returned untouched when injection is disabled, the subnet is unknown or
+// the query already carries a subnet option (a client may opt out with a
+// zero source prefix, which must be respected).
+func (e *ECS) Apply(msg *dns.Msg) *dns.Msg {
+	n := e.active()
+	if n == nil || findSubnet(msg) != nil {
+		return msg
+	}
+	m := msg.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(upstreamUDPSize, false)
+		opt = m.IsEdns0()
+	}
+	ones, _ := n.Mask.Size()
+	family := uint16(2)
+	if n.IP.To4() != nil {
+		family = 1
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(ones),
+		Address:       n.IP,
+	})
+	return m
+}
+
+// Strip removes the subnet option echoed back for an injected query from
+// reply, reporting whether reply changed. Options carrying another subnet
+// (sent by the client itself) are kept.
+func (e *ECS) Strip(reply *dns.Msg) bool {
+	n := e.Subnet()
+	opt := reply.IsEdns0()
+	if n == nil || opt == nil {
+		return false
+	}
+	ones, _ := n.Mask.Size()
+	changed := false
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+		s, ok := o.(*dns.EDNS0_SUBNET)
+		if ok && int(s.SourceNetmask) == ones && n.Contains(s.Address) {
+			changed = true
+			return true
+		}
+		return false
+	})
+	return changed
+}
+
+func findSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// EnableAutoSubnet keeps the subnet derived from the public address reported
+// by publicIP, learning it in the background and refreshing it periodically
+// until Close. It must be called at most once.
+func (e *ECS) EnableAutoSubnet(publicIP PublicIPFunc, timeout time.Duration) {
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		for {
+			wait := ecsRetryInterval
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			ip, err := publicIP(ctx)
+			cancel()
+			if err != nil {
+				log.Warn("[DNS_ECS] learn public ip", "err", err)
+			} else {
+				e.SetPublicIP(ip)
+				log.Info("[DNS_ECS] client subnet", "subnet", e.Subnet().String())
+				wait = ecsRefreshInterval
+			}
+			select {
+			case <-time.After(wait):
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the background learning started by EnableAutoSubnet.
+func (e *ECS) Close() {
+	if e == nil || e.stop == nil {
+		return
+	}
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+	<-e.done
+}
@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/client/router"
+)
+
+func TestECSApply(t *testing.T) {
+	e, err := NewECS("203.0.113.77/24", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		query   func() *dns.Msg
+		inject  bool
+		netmask uint8
+		addr    string
+	}{
+		{
+			name:    "无 OPT 时添加 OPT 和子网",
+			query:   func() *dns.Msg { return hostsQuery("example.com", dns.TypeA) },
+			inject:  true,
+			netmask: 24,
+			addr:    "203.0.113.0",
+		},
+		{
+			name: "保留客户端的 OPT",
+			query: func() *dns.Msg {
+				m := hostsQuery("example.com", dns.TypeA)
+				m.SetEdns0(4096, true)
+				return m
+			},
+			inject:  true,
+			netmask: 24,
+			addr:    "203.0.113.0",
+		},
+		{
+			name: "客户端自带子网时不覆盖",
+			query: func() *dns.Msg {
+				m := hostsQuery("example.com", dns.TypeA)
+				m.SetEdns0(1232, false)
+				opt := m.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1})
+				return m
+			},
+			netmask: 0,
+			addr:    "<nil>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query()
+			got := e.Apply(q)
+			if (got != q) != tt.inject {
+				t.Fatalf("injected = %v, want %v", got != q, tt.inject)
+			}
+			if tt.inject && findSubnet(q) != nil {
+				t.Fatal("Apply must not modify the original query")
+			}
+			s := findSubnet(got)
+			if s == nil {
+				t.Fatal("missing subnet option")
+			}
+			if s.SourceNetmask != tt.netmask || s.Address.String() != tt.addr {
+				t.Errorf("subnet = %v/%d, want %s/%d", s.Address, s.SourceNetmask, tt.addr, tt.netmask)
+			}
+			if tt.inject {
+				if _, err := got.Pack(); err != nil {
+					t.Fatalf("pack injected query: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestECSStrip(t *testing.T) {
+	e, err := NewECS("2001:db8:1234::/56", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := e.Apply(hostsQuery("example.com", dns.TypeAAAA))
+	if s := findSubnet(q); s == nil || s.Family != 2 {
+		t.Fatalf("subnet option = %v, want IPv6 family", s)
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(q)
+	reply.SetEdns0(1232, false)
+	opt := reply.IsEdns0()
+	opt.Option = append(opt.Option, findSubnet(q))
+	if !e.Strip(reply) {
+		t.Fatal("expected the echoed subnet to be stripped")
+	}
+	if findSubnet(reply) != nil {
+		t.Error("subnet option still present")
+	}
+
+	// 客户端自己的子网应原样返回
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4(),
+	})
+	if e.Strip(reply) {
+		t.Error("foreign subnet must be kept")
+	}
+}
+
+func TestECSProxyRules(t *testing.T) {
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleAuto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewECS("203.0.113.0/24", []string{"auto", "reverse_auto"}, rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := hostsQuery("example.com", dns.TypeA)
+	if e.Apply(q) == q {
+		t.Error("auto rule should inject")
+	}
+	rt.SetProxyRule(router.ProxyRuleProxy)
+	if e.Apply(q) != q {
+		t.Error("proxy rule is not enabled and must not inject")
+	}
+
+	var nilECS *ECS
+	if nilECS.Apply(q) != q || nilECS.Strip(q) {
+		t.Error("nil ECS must be a no-op")
+	}
+}
+
+func TestNewECSInvalid(t *testing.T) {
+	if _, err := NewECS("203.0.113.0", nil, nil); err == nil {
+		t.Error("expected error for a subnet without prefix")
+	}
+	if _, err := NewECS("", []string{"bogus"}, nil); err == nil {
+		t.Error("expected error for an unknown proxy rule")
+	}
+	if _, err := NewECS("", []string{"proxy"}, nil); err == nil {
+		t.Error("expected error for proxy rules without router")
+	}
+}
+
+func TestECSSetPublicIP(t *testing.T) {
+	e, _ := NewECS("", nil, nil)
+	q := hostsQuery("example.com", dns.TypeA)
+	if e.Subnet() != nil || e.Apply(q) != q {
+		t.Fatal("unknown subnet must not inject")
+	}
+
+	e.SetPublicIP(net.ParseIP("198.51.100.200"))
+	if got := e.Subnet().String(); got != "198.51.100.0/24" {
+		t.Errorf("ipv4 subnet = %s", got)
+	}
+	e.SetPublicIP(net.ParseIP("2001:db8:aa:bbcc::1"))
+	if got := e.Subnet().String(); got != "2001:db8:aa:bb00::/56" {
+		t.Errorf("ipv6 subnet = %s", got)
+	}
+}
+
+func TestECSEnableAutoSubnet(t *testing.T) {
+	e, _ := NewECS("", nil, nil)
+	calls := make(chan struct{}, 4)
+	e.EnableAutoSubnet(func(ctx context.Context) (net.IP, error) {
+		calls <- struct{}{}
+		return net.ParseIP("192.0.2.9"), nil
+	}, time.Second)
+
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("public ip was not requested")
+	}
+	deadline := time.Now().Add(time.Second)
+	for e.Subnet() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := e.Subnet(); got == nil || got.String() != "192.0.2.0/24" {
+		t.Fatalf("subnet = %v, want 192.0.2.0/24", got)
+	}
+	e.Close()
+	e.Close()
+}
@@ -4,23 +4,40 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/router"
 	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/stats"
 )
 
+// upstreamUDPSize is the EDNS0 buffer size advertised to upstream servers
+// and to clients, the value recommended by DNS flag day 2020 to avoid IP
+// fragmentation.
+const upstreamUDPSize = 1232
+
+// ProxyExchangeFunc resolves a query through the tunnel.
+type ProxyExchangeFunc func(msg *dns.Msg) (*dns.Msg, error)
+
 type ForwardServer struct {
-	listenAddr  string
-	client      *dns.Client
-	dnsServers  []string
-	dnsServer   *dns.Server
-	disableIPV6 bool
-	mu          sync.Mutex
-	running     bool
+	listenAddr   string
+	client       *dns.Client
+	tcpClient    *dns.Client
+	dnsServers   []string
+	udpServer    *dns.Server
+	tcpServer    *dns.Server
+	disableIPV6  bool
+	hosts        *Hosts
+	router       *router.Router
+	serverDomain string
+	proxyQuery   ProxyExchangeFunc
+	mu           sync.Mutex
+	running      bool
 }
 
 func NewForwardServer(listenAddr string, disableIPV6 bool) *ForwardServer {
@@ -39,38 +56,79 @@ func NewForwardServer(listenAddr string, disableIPV6 bool) *ForwardServer {
 	return &ForwardServer{
 		listenAddr:  listenAddr,
 		client:      &dns.Client{Timeout: 5 * time.Second},
+		tcpClient:   &dns.Client{Net: "tcp", Timeout: 5 * time.Second},
 		dnsServers:  servers,
 		disableIPV6: disableIPV6,
 	}
 }
 
+// SetHosts installs static records answered before any upstream lookup. It
+// must be called before Start.
+func (s *ForwardServer) SetHosts(h *Hosts) {
+	s.hosts = h
+}
+
+// SetRouter makes the server resolve each query the way the socks5 server
+// does: blocked names get an empty answer, direct names (and serverDomain)
+// go to the direct dns servers, and everything else goes through the tunnel
+// via proxyQuery. Without a router every query uses the direct servers. It
+// must be called before Start.
+func (s *ForwardServer) SetRouter(rt *router.Router, serverDomain string, proxyQuery ProxyExchangeFunc) {
+	s.router = rt
+	s.serverDomain = serverDomain
+	s.proxyQuery = proxyQuery
+}
+
+// Start serves DNS on both UDP and TCP at the listen address, blocking until
+// the server is shut down or one of the listeners fails.
 func (s *ForwardServer) Start() error {
+	handler := dns.HandlerFunc(s.handleDNS)
 	s.mu.Lock()
-	s.dnsServer = &dns.Server{
-		Addr:    s.listenAddr,
-		Net:     "udp",
-		Handler: dns.HandlerFunc(s.handleDNS),
-	}
+	s.udpServer = &dns.Server{Addr: s.listenAddr, Net: "udp", Handler: handler}
+	s.tcpServer = &dns.Server{Addr: s.listenAddr, Net: "tcp", Handler: handler}
+	udpServer, tcpServer := s.udpServer, s.tcpServer
 	s.running = true
 	s.mu.Unlock()
 
 	log.Info("[DNS-FORWARD] starting forward dns server", "addr", s.listenAddr)
 
-	return s.dnsServer.ListenAndServe()
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- udpServer.ListenAndServe()
+	}()
+	go func() {
+		errCh <- tcpServer.ListenAndServe()
+	}()
+
+	err := <-errCh
+	if err != nil {
+		// Do not leave the other listener running alone.
+		_ = s.Shutdown()
+	}
+	return err
 }
 
 func (s *ForwardServer) Shutdown() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.dnsServer == nil {
+	if s.udpServer == nil || !s.running {
 		return nil
 	}
+	s.running = false
 
 	log.Info("[DNS-FORWARD] shutting down dns server")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	return s.dnsServer.ShutdownContext(ctx)
+	var errs []error
+	for _, srv := range []*dns.Server{s.udpServer, s.tcpServer} {
+		// A listener that failed to start reports "server not started",
+		// which is not a shutdown failure.
+		if err := srv.ShutdownContext(ctx); err != nil && !strings.Contains(err.Error(), "not started") {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (s *ForwardServer) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
@@ -80,7 +138,22 @@ func (s *ForwardServer) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 	q := r.Question[0]
 
-	reply, err := s.forwardQuery(r)
+	if local, next := s.hosts.Lookup(r); local != nil {
+		if next != "" {
+			chased, err := s.resolve(ChaseQuery(r, next))
+			if err != nil {
+				log.Debug("[DNS-FORWARD] chase hosts cname failed", "name", q.Name, "target", next, "err", err)
+				local.Rcode = dns.RcodeServerFailure
+			} else {
+				MergeChased(local, chased)
+			}
+		}
+		log.Debug("[DNS-FORWARD] answered from hosts", "name", q.Name, "qtype", dns.TypeToString[q.Qtype])
+		writeReply(w, r, local)
+		return
+	}
+
+	reply, err := s.resolve(upstreamQuery(r))
 	if err != nil {
 		log.Debug("[DNS-FORWARD] forward query failed", "name", q.Name, "err", err)
 		m := new(dns.Msg)
@@ -89,7 +162,110 @@ func (s *ForwardServer) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
+	writeReply(w, r, reply)
+}
+
+// resolve answers msg from the direct dns servers, or, when a router is
+// installed, from the path the router chooses for the queried name.
+func (s *ForwardServer) resolve(msg *dns.Msg) (*dns.Msg, error) {
+	if s.router == nil {
+		return s.forwardQuery(msg)
+	}
+
+	q := msg.Question[0]
+	domain := strings.TrimSuffix(q.Name, ".")
+	rule := s.router.MatchHostRule(domain)
+	if rule == router.HostRuleBlock {
+		log.Info("[DNS-FORWARD] blocked", "domain", domain, "qtype", dns.TypeToString[q.Qtype])
+		m := new(dns.Msg)
+		m.SetReply(msg)
+		return m, nil
+	}
+
+	isServerDomain := s.serverDomain != "" && strings.EqualFold(domain, s.serverDomain)
+	var reply *dns.Msg
+	var err error
+	if isServerDomain || rule == router.HostRuleDirect || s.proxyQuery == nil {
+		stats.RecordDNSDirectQuery()
+		reply, err = s.forwardQuery(msg)
+		if err == nil && s.router.IsCustomDirectDomain(domain) {
+			learnRoutes(reply, s.router.AddDirectIP, s.router.AddDirectDomain)
+		}
+	} else {
+		stats.RecordDNSProxyQuery()
+		reply, err = s.proxyQuery(msg)
+		if err == nil && s.router.IsCustomProxyDomain(domain) {
+			learnRoutes(reply, s.router.AddProxyIP, s.router.AddProxyDomain)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.disableIPV6 && q.Qtype == dns.TypeAAAA {
+		reply.Answer = nil
+	}
+	return reply, nil
+}
+
+// learnRoutes feeds the addresses and CNAME targets of reply into the
+// router, so connections to them follow the rule of the custom domain.
+func learnRoutes(reply *dns.Msg, addIP, addDomain func(string)) {
+	for _, ans := range reply.Answer {
+		switch a := ans.(type) {
+		case *dns.A:
+			addIP(a.A.String())
+		case *dns.AAAA:
+			addIP(a.AAAA.String())
+		case *dns.CNAME:
+			addDomain(strings.TrimSuffix(a.Target, "."))
+		}
+	}
+}
+
+// upstreamQuery returns a copy of r advertising an EDNS0 buffer of at least
+// upstreamUDPSize, so upstream servers can send answers larger than 512
+// bytes over UDP regardless of what the client supports.
+func upstreamQuery(r *dns.Msg) *dns.Msg {
+	m := r.Copy()
+	if opt := m.IsEdns0(); opt != nil {
+		if opt.UDPSize() < upstreamUDPSize {
+			opt.SetUDPSize(upstreamUDPSize)
+		}
+		return m
+	}
+	m.SetEdns0(upstreamUDPSize, false)
+	return m
+}
+
+// writeReply sends reply as the answer to r, adapted to what the client
+// can receive: the OPT record is only present when the client sent one, and
+// UDP answers are truncated (TC bit set) to the client's advertised EDNS0
+// buffer size, or 512 bytes without EDNS0, so the client retries over TCP.
+func writeReply(w dns.ResponseWriter, r, reply *dns.Msg) {
+	rcode := reply.Rcode
 	reply.SetReply(r)
+	reply.Rcode = rcode
+
+	clientOpt := r.IsEdns0()
+	if clientOpt == nil {
+		extra := reply.Extra[:0]
+		for _, rr := range reply.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		reply.Extra = extra
+	} else if reply.IsEdns0() == nil {
+		reply.SetEdns0(upstreamUDPSize, clientOpt.Do())
+	}
+
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		size := dns.MinMsgSize
+		if clientOpt != nil && int(clientOpt.UDPSize()) > size {
+			size = int(clientOpt.UDPSize())
+		}
+		reply.Truncate(size)
+	}
 	_ = w.WriteMsg(reply)
 }
 
@@ -105,6 +281,10 @@ func (s *ForwardServer) exchangeWithServers(servers []string, msg *dns.Msg) (*dn
 
 	for _, server := range servers {
 		reply, _, err := s.client.Exchange(msg, server)
+		if err == nil && reply != nil && reply.Truncated {
+			log.Debug("[DNS-FORWARD] truncated answer, retry over tcp", "server", server, "name", msg.Question[0].Name)
+			reply, _, err = s.tcpClient.Exchange(msg, server)
+		}
 		if err != nil {
 			lastErr = err
 			continue
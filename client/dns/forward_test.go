@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/client/router"
 )
 
 // startTestDNSServer starts a local udp dns server on a random port. When
@@ -109,3 +110,220 @@ func TestForwardQueryAllServersUnavailable(t *testing.T) {
 		t.Fatalf("expected nil reply, got %v", reply)
 	}
 }
+
+// startTruncatingDNSServer starts udp and tcp dns servers on the same port.
+// The udp one always answers with the TC bit set and no records, the tcp
+// one answers A queries with many records.
+func startTruncatingDNSServer(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close() //nolint:errcheck
+		t.Skipf("tcp port not available: %v", err)
+	}
+	udpSrv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		_ = w.WriteMsg(m)
+	})}
+	tcpSrv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = manyARecords(r.Question[0].Name, 60)
+		_ = w.WriteMsg(m)
+	})}
+	go func() {
+		_ = udpSrv.ActivateAndServe()
+	}()
+	go func() {
+		_ = tcpSrv.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = udpSrv.Shutdown()
+		_ = tcpSrv.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func manyARecords(name string, n int) []dns.RR {
+	rrs := make([]dns.RR, 0, n)
+	for i := 0; i < n; i++ {
+		rrs = append(rrs, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600},
+			A:   net.IPv4(10, 0, byte(i/256), byte(i%256)),
+		})
+	}
+	return rrs
+}
+
+func TestForwardQueryRetriesTruncatedOverTCP(t *testing.T) {
+	t.Cleanup(func() {
+		resetSystemDNSCache()
+		resetBuiltinDNSCircuit()
+	})
+	addr := startTruncatingDNSServer(t)
+
+	fs := NewForwardServer("127.0.0.1:0", false)
+	fs.dnsServers = []string{addr}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("big.example.", dns.TypeA)
+	reply, err := fs.forwardQuery(msg)
+	if err != nil {
+		t.Fatalf("forwardQuery error: %v", err)
+	}
+	if reply.Truncated || len(reply.Answer) != 60 {
+		t.Fatalf("expected full tcp answer, got tc=%v answers=%d", reply.Truncated, len(reply.Answer))
+	}
+}
+
+func TestWriteReplyHonorsClientBufferSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		edns      uint16
+		tcp       bool
+		truncated bool
+		maxLen    int
+	}{
+		{name: "无 EDNS 的 UDP 查询截断到 512 字节", truncated: true, maxLen: dns.MinMsgSize},
+		{name: "EDNS 缓冲区足够时不截断", edns: 4096},
+		{name: "EDNS 缓冲区较小时截断", edns: 700, truncated: true, maxLen: 700},
+		{name: "TCP 查询不截断", tcp: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion("big.example.", dns.TypeA)
+			if tt.edns > 0 {
+				r.SetEdns0(tt.edns, false)
+			}
+			reply := new(dns.Msg)
+			reply.SetReply(r)
+			reply.Answer = manyARecords("big.example.", 60)
+			reply.SetEdns0(upstreamUDPSize, false)
+
+			w := &recordingWriter{tcp: tt.tcp}
+			writeReply(w, r, reply)
+			if w.msg.Truncated != tt.truncated {
+				t.Errorf("truncated = %v, want %v", w.msg.Truncated, tt.truncated)
+			}
+			if tt.maxLen > 0 && w.msg.Len() > tt.maxLen {
+				t.Errorf("reply length %d exceeds %d", w.msg.Len(), tt.maxLen)
+			}
+			if hasOPT := w.msg.IsEdns0() != nil; hasOPT != (tt.edns > 0) {
+				t.Errorf("opt present = %v, want %v", hasOPT, tt.edns > 0)
+			}
+		})
+	}
+}
+
+func TestUpstreamQueryAdvertisesEDNS(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	if opt := upstreamQuery(r).IsEdns0(); opt == nil || opt.UDPSize() != upstreamUDPSize {
+		t.Errorf("expected edns0 size %d, got %v", upstreamUDPSize, opt)
+	}
+	if r.IsEdns0() != nil {
+		t.Error("client query must not be modified")
+	}
+
+	r.SetEdns0(4096, true)
+	opt := upstreamQuery(r).IsEdns0()
+	if opt == nil || opt.UDPSize() != 4096 || !opt.Do() {
+		t.Errorf("larger client buffer should be kept, got %v", opt)
+	}
+}
+
+func TestForwardServerRouting(t *testing.T) {
+	upstream := startTestDNSServer(t, false)
+	t.Cleanup(func() {
+		resetSystemDNSCache()
+		resetBuiltinDNSCircuit()
+	})
+
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleProxy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewForwardServer("127.0.0.1:0", false)
+	fs.dnsServers = []string{upstream}
+	proxied := 0
+	fs.SetRouter(rt, "server.example", func(msg *dns.Msg) (*dns.Msg, error) {
+		proxied++
+		m := new(dns.Msg)
+		m.SetReply(msg)
+		m.Answer = manyARecords(msg.Question[0].Name, 1)
+		return m, nil
+	})
+
+	query := func(name string) *dns.Msg {
+		w := &recordingWriter{}
+		fs.handleDNS(w, hostsQuery(name, dns.TypeA))
+		return w.msg
+	}
+
+	if got := answerStrings(query("www.example.com")); proxied != 1 || len(got) != 1 || got[0] != "10.0.0.0" {
+		t.Errorf("proxy rule: proxied=%d answers=%v", proxied, got)
+	}
+	// 服务器自身域名始终直连解析
+	if got := answerStrings(query("server.example")); proxied != 1 || len(got) != 1 || got[0] != "1.2.3.4" {
+		t.Errorf("server domain: proxied=%d answers=%v", proxied, got)
+	}
+	rt.SetProxyRule(router.ProxyRuleDirect)
+	if got := answerStrings(query("www.example.com")); proxied != 1 || len(got) != 1 || got[0] != "1.2.3.4" {
+		t.Errorf("direct rule: proxied=%d answers=%v", proxied, got)
+	}
+}
+
+func TestForwardServerServesUDPAndTCP(t *testing.T) {
+	upstream := startTestDNSServer(t, false)
+	t.Cleanup(func() {
+		resetSystemDNSCache()
+		resetBuiltinDNSCircuit()
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close() //nolint:errcheck
+
+	fs := NewForwardServer(addr, false)
+	fs.dnsServers = []string{upstream}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fs.Start()
+	}()
+	t.Cleanup(func() {
+		_ = fs.Shutdown()
+	})
+
+	for _, network := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: network, Timeout: 200 * time.Millisecond}
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		var reply *dns.Msg
+		for i := 0; i < 50; i++ {
+			if reply, _, err = c.Exchange(msg, addr); err == nil {
+				break
+			}
+			select {
+			case startErr := <-errCh:
+				t.Skipf("forward server failed to start: %v", startErr)
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s exchange: %v", network, err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Errorf("%s: expected 1 answer, got %d", network, len(reply.Answer))
+		}
+	}
+}
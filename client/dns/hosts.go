@@ -0,0 +1,284 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// hostsTTL is the TTL of locally answered records. It is kept short so
+	// that a restarted client with an edited hosts list takes effect quickly
+	// on downstream caches.
+	hostsTTL = 60
+	// maxCNAMEDepth bounds the local CNAME chain to guard against loops.
+	maxCNAMEDepth = 8
+	// hostsNXDomain is the map value that blocks a name with NXDOMAIN.
+	hostsNXDomain = "nxdomain"
+)
+
+type hostEntry struct {
+	ips   []net.IP
+	cname string
+	block bool
+}
+
+// Hosts holds static DNS records that are answered locally, before any cache
+// or upstream lookup. Names are matched exactly first, then against wildcard
+// entries ("*.example.com") from the most to the least specific parent.
+type Hosts struct {
+	exact    map[string]*hostEntry
+	wildcard map[string]*hostEntry
+}
+
+// NewHosts builds a Hosts from a hosts-format file and a name->value map.
+// Map entries take precedence over file entries for the same name.
+//
+// A map value is either a comma separated list of IPv4/IPv6 addresses, a
+// domain name (answered as CNAME) or "nxdomain". In the file every line is
+// "<ip> <name> [name...]"; the unspecified addresses 0.0.0.0 and :: block the
+// names with NXDOMAIN, following the common ad-blocking hosts convention.
+func NewHosts(entries map[string]string, file string) (*Hosts, error) {
+	h := &Hosts{
+		exact:    make(map[string]*hostEntry),
+		wildcard: make(map[string]*hostEntry),
+	}
+	if file != "" {
+		if err := h.loadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	for name, value := range entries {
+		e, err := parseHostValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("dns hosts %q: %w", name, err)
+		}
+		if err := h.set(name, e); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func parseHostValue(value string) (*hostEntry, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+	if strings.EqualFold(value, hostsNXDomain) {
+		return &hostEntry{block: true}, nil
+	}
+	if !strings.Contains(value, ",") && net.ParseIP(value) == nil {
+		if _, ok := dns.IsDomainName(value); !ok {
+			return nil, fmt.Errorf("invalid cname target %q", value)
+		}
+		return &hostEntry{cname: dns.Fqdn(strings.ToLower(value))}, nil
+	}
+	e := &hostEntry{}
+	for _, part := range strings.Split(value, ",") {
+		ip := net.ParseIP(strings.TrimSpace(part))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", part)
+		}
+		e.ips = append(e.ips, ip)
+	}
+	return e, nil
+}
+
+func (h *Hosts) loadFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("open dns hosts file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	lineNo := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		lineNo++
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("dns hosts file %s:%d: missing host name", file, lineNo)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return fmt.Errorf("dns hosts file %s:%d: invalid ip %q", file, lineNo, fields[0])
+		}
+		for _, name := range fields[1:] {
+			key, err := hostsKey(name)
+			if err != nil {
+				return fmt.Errorf("dns hosts file %s:%d: %w", file, lineNo, err)
+			}
+			if ip.IsUnspecified() {
+				h.put(key, &hostEntry{block: true})
+				continue
+			}
+			// Like /etc/hosts, repeated names accumulate addresses.
+			if e := h.get(key); e != nil && !e.block && e.cname == "" {
+				e.ips = append(e.ips, ip)
+				continue
+			}
+			h.put(key, &hostEntry{ips: []net.IP{ip}})
+		}
+	}
+	return sc.Err()
+}
+
+func hostsKey(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok || name == "" {
+		return "", fmt.Errorf("invalid host name %q", name)
+	}
+	return dns.Fqdn(name), nil
+}
+
+func (h *Hosts) set(name string, e *hostEntry) error {
+	key, err := hostsKey(name)
+	if err != nil {
+		return err
+	}
+	h.put(key, e)
+	return nil
+}
+
+func (h *Hosts) put(key string, e *hostEntry) {
+	if suffix, ok := strings.CutPrefix(key, "*."); ok {
+		h.wildcard[suffix] = e
+		return
+	}
+	h.exact[key] = e
+}
+
+func (h *Hosts) get(key string) *hostEntry {
+	if suffix, ok := strings.CutPrefix(key, "*."); ok {
+		return h.wildcard[suffix]
+	}
+	return h.exact[key]
+}
+
+// Len returns the number of configured entries.
+func (h *Hosts) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.exact) + len(h.wildcard)
+}
+
+func (h *Hosts) match(name string) *hostEntry {
+	if e, ok := h.exact[name]; ok {
+		return e
+	}
+	// "*.example.com" matches any name below example.com, but not the
+	// apex itself.
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if e, ok := h.wildcard[name[off:]]; ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// Lookup answers r from the static records. It returns nil when the queried
+// name is not covered. CNAME entries are followed while their targets are
+// also covered; when a chain leaves the static records, the partial reply
+// holding the CNAMEs is returned together with the name that still has to
+// be resolved upstream (see ChaseQuery and MergeChased).
+func (h *Hosts) Lookup(r *dns.Msg) (reply *dns.Msg, next string) {
+	if h.Len() == 0 || len(r.Question) == 0 {
+		return nil, ""
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil, ""
+	}
+
+	owner := q.Name
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	e := h.match(name)
+	if e == nil {
+		return nil, ""
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+
+	for depth := 0; ; depth++ {
+		if depth >= maxCNAMEDepth {
+			m.Answer = nil
+			m.Rcode = dns.RcodeServerFailure
+			return m, ""
+		}
+		switch {
+		case e.block:
+			m.Rcode = dns.RcodeNameError
+			return m, ""
+		case e.cname != "":
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: hostsTTL},
+				Target: e.cname,
+			})
+			if q.Qtype == dns.TypeCNAME {
+				return m, ""
+			}
+			owner, name = e.cname, e.cname
+			if e = h.match(name); e == nil {
+				return m, name
+			}
+		default:
+			m.Answer = append(m.Answer, addressRecords(owner, q.Qtype, e.ips)...)
+			return m, ""
+		}
+	}
+}
+
+// addressRecords returns the A or AAAA records of ips matching qtype. Other
+// query types get an empty (NODATA) answer so that a pinned name never leaks
+// records such as HTTPS hints from upstream.
+func addressRecords(owner string, qtype uint16, ips []net.IP) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range ips {
+		v4 := ip.To4()
+		switch {
+		case qtype == dns.TypeA && v4 != nil:
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: hostsTTL},
+				A:   v4,
+			})
+		case qtype == dns.TypeAAAA && v4 == nil:
+			rrs = append(rrs, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: owner, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: hostsTTL},
+				AAAA: ip,
+			})
+		}
+	}
+	return rrs
+}
+
+// ChaseQuery returns a copy of r asking for name instead, used to resolve the
+// target of a CNAME chain that left the static records.
+func ChaseQuery(r *dns.Msg, name string) *dns.Msg {
+	m := r.Copy()
+	m.Id = dns.Id()
+	m.Question[0].Name = name
+	return m
+}
+
+// MergeChased appends the upstream answer for a chased CNAME target to the
+// partial local reply and adopts its response code.
+func MergeChased(reply, chased *dns.Msg) {
+	reply.Answer = append(reply.Answer, chased.Answer...)
+	reply.Rcode = chased.Rcode
+}
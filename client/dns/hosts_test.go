@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func hostsQuery(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	return m
+}
+
+func answerStrings(m *dns.Msg) []string {
+	var out []string
+	for _, rr := range m.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			out = append(out, v.A.String())
+		case *dns.AAAA:
+			out = append(out, v.AAAA.String())
+		case *dns.CNAME:
+			out = append(out, "cname:"+v.Target)
+		}
+	}
+	return out
+}
+
+func TestHostsLookup(t *testing.T) {
+	h, err := NewHosts(map[string]string{
+		"api.internal":      "10.0.0.1, fd00::1",
+		"*.corp.example":    "10.0.0.2",
+		"alias.internal":    "api.internal",
+		"ext.internal":      "example.org",
+		"ads.example":       "NXDOMAIN",
+		"loop1.internal":    "loop2.internal",
+		"loop2.internal":    "loop1.internal",
+		"Upper.Internal":    "10.0.0.3",
+		"v6only.internal":   "fd00::2",
+		"deep.corp.example": "10.0.0.4",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		miss    bool
+		rcode   int
+		answers []string
+		next    string
+	}{
+		{name: "A 记录", qname: "api.internal", qtype: dns.TypeA, answers: []string{"10.0.0.1"}},
+		{name: "AAAA 记录", qname: "api.internal", qtype: dns.TypeAAAA, answers: []string{"fd00::1"}},
+		{name: "其他类型返回空应答", qname: "api.internal", qtype: dns.TypeHTTPS},
+		{name: "仅有 IPv6 时 A 查询为空", qname: "v6only.internal", qtype: dns.TypeA},
+		{name: "大小写不敏感", qname: "UPPER.internal", qtype: dns.TypeA, answers: []string{"10.0.0.3"}},
+		{name: "通配符匹配子域名", qname: "a.b.corp.example", qtype: dns.TypeA, answers: []string{"10.0.0.2"}},
+		{name: "精确匹配优先于通配符", qname: "deep.corp.example", qtype: dns.TypeA, answers: []string{"10.0.0.4"}},
+		{name: "通配符不匹配主域名", qname: "corp.example", qtype: dns.TypeA, miss: true},
+		{name: "本地 CNAME 链", qname: "alias.internal", qtype: dns.TypeA, answers: []string{"cname:api.internal.", "10.0.0.1"}},
+		{name: "外部 CNAME 需上游解析", qname: "ext.internal", qtype: dns.TypeA, answers: []string{"cname:example.org."}, next: "example.org."},
+		{name: "CNAME 查询直接返回", qname: "ext.internal", qtype: dns.TypeCNAME, answers: []string{"cname:example.org."}},
+		{name: "NXDOMAIN 屏蔽", qname: "ads.example", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "CNAME 循环", qname: "loop1.internal", qtype: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "未配置的域名", qname: "example.com", qtype: dns.TypeA, miss: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := hostsQuery(tt.qname, tt.qtype)
+			reply, next := h.Lookup(q)
+			if tt.miss {
+				if reply != nil {
+					t.Fatalf("expected miss, got %v", reply)
+				}
+				return
+			}
+			if reply == nil {
+				t.Fatal("expected local reply")
+			}
+			if reply.Id != q.Id || !reply.Response {
+				t.Error("reply should answer the query")
+			}
+			if reply.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[reply.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if next != tt.next {
+				t.Errorf("next = %q, want %q", next, tt.next)
+			}
+			got := answerStrings(reply)
+			if len(got) != len(tt.answers) {
+				t.Fatalf("answers = %v, want %v", got, tt.answers)
+			}
+			for i := range got {
+				if got[i] != tt.answers[i] {
+					t.Errorf("answers = %v, want %v", got, tt.answers)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	content := `# comment
+10.1.1.1   printer.lan nas.lan  # inline comment
+10.1.1.2   nas.lan
+fd00::10   nas.lan
+0.0.0.0    tracker.example
+api.lan    10.1.1.9
+`
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHosts(nil, file); err == nil {
+		t.Fatal("expected error for malformed line")
+	}
+
+	content = content[:len(content)-len("api.lan    10.1.1.9\n")]
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// map 中的配置覆盖文件中的同名记录
+	h, err := NewHosts(map[string]string{"printer.lan": "10.2.2.2"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, _ := h.Lookup(hostsQuery("nas.lan", dns.TypeA))
+	if got := answerStrings(reply); len(got) != 2 || got[0] != "10.1.1.1" || got[1] != "10.1.1.2" {
+		t.Errorf("nas.lan A = %v", got)
+	}
+	reply, _ = h.Lookup(hostsQuery("nas.lan", dns.TypeAAAA))
+	if got := answerStrings(reply); len(got) != 1 || got[0] != "fd00::10" {
+		t.Errorf("nas.lan AAAA = %v", got)
+	}
+	reply, _ = h.Lookup(hostsQuery("printer.lan", dns.TypeA))
+	if got := answerStrings(reply); len(got) != 1 || got[0] != "10.2.2.2" {
+		t.Errorf("printer.lan A = %v", got)
+	}
+	reply, _ = h.Lookup(hostsQuery("tracker.example", dns.TypeAAAA))
+	if reply == nil || reply.Rcode != dns.RcodeNameError {
+		t.Errorf("tracker.example should be blocked, got %v", reply)
+	}
+}
+
+func TestNewHostsInvalid(t *testing.T) {
+	for _, v := range []string{"", "10.0.0.1,bad", "bad..name"} {
+		if _, err := NewHosts(map[string]string{"a.example": v}, ""); err == nil {
+			t.Errorf("value %q: expected error", v)
+		}
+	}
+	if _, err := NewHosts(nil, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestForwardServerAnswersFromHosts(t *testing.T) {
+	upstream := startTestDNSServer(t, false)
+	old := systemDNSServersFunc
+	systemDNSServersFunc = func() []string {
+		return nil
+	}
+	t.Cleanup(func() {
+		systemDNSServersFunc = old
+		resetSystemDNSCache()
+		resetBuiltinDNSCircuit()
+	})
+
+	h, err := NewHosts(map[string]string{
+		"pinned.example": "10.9.9.9",
+		"alias.example":  "upstream.example",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewForwardServer("127.0.0.1:0", false)
+	s.dnsServers = []string{upstream}
+	s.SetHosts(h)
+
+	w := &recordingWriter{}
+	s.handleDNS(w, hostsQuery("pinned.example", dns.TypeA))
+	if got := answerStrings(w.msg); len(got) != 1 || got[0] != "10.9.9.9" {
+		t.Errorf("pinned answers = %v", got)
+	}
+
+	s.handleDNS(w, hostsQuery("alias.example", dns.TypeA))
+	if got := answerStrings(w.msg); len(got) != 2 || got[0] != "cname:upstream.example." || got[1] != "1.2.3.4" {
+		t.Errorf("alias answers = %v", got)
+	}
+}
+
+// recordingWriter is a dns.ResponseWriter that keeps the last written
+// message. tcp makes it look like a TCP client.
+type recordingWriter struct {
+	msg *dns.Msg
+	tcp bool
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *recordingWriter) RemoteAddr() net.Addr {
+	if w.tcp {
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+func (w *recordingWriter) Close() error        { return nil }
+func (w *recordingWriter) TsigStatus() error   { return nil }
+func (w *recordingWriter) TsigTimersOnly(bool) {}
+func (w *recordingWriter) Hijack()             {}
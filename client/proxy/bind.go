@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/stats"
+	"github.com/nange/easyss/v3/tunnel"
+	"github.com/nange/easyss/v3/util"
+	"github.com/txthinking/socks5"
+)
+
+// bindAcceptTimeout bounds how long a direct BIND waits for its peer,
+// matching the server's default for proxied ones.
+const bindAcceptTimeout = 30 * time.Second
+
+// OpenBindStream carries a SOCKS5 BIND to the server. peer is the address
+// the incoming connection is expected from. reply is called twice, with
+// the address the server listens on and then with the accepted peer's
+// address, before the peer's connection is relayed to localConn.
+func (h *StreamHandler) OpenBindStream(ctx context.Context, peer string, method protocol.Method, localConn net.Conn, reply func(addr string) error) error {
+	stats.RecordTCPConnection()
+	endpoint := config.EndpointBind
+	bs, err := h.openAndBootstrap(ctx, endpoint, protocol.ProtoBind, peer, method, nil)
+	if err != nil {
+		log.Error("[STREAM] bind bootstrap", "peer", peer, "err", err)
+		return err
+	}
+	stream := bs.Stream
+
+	dr, err := bs.Reader(method)
+	if err != nil {
+		stream.Close() //nolint:errcheck
+		return err
+	}
+
+	for i := range 2 {
+		addr, err := readReply(dr, i == 0, "bind")
+		if err == nil {
+			err = reply(addr)
+		}
+		if err != nil {
+			stream.Close() //nolint:errcheck
+			return err
+		}
+	}
+
+	w, err := bs.Writer(method)
+	if err != nil {
+		stream.Close() //nolint:errcheck
+		return err
+	}
+	txShaper := shaper.New(w, h.shaperCfg)
+	defer txShaper.Close() //nolint:errcheck
+
+	err = tunnel.Relay(peer, localConn, txShaper, dr, stream, h.streamIdleTimeout)
+	log.Debug("[STREAM] bind relay finished", "peer", peer, "err", err)
+	return err
+}
+
+// readReply reads the next DATA payload the server reports on a bind or
+// reverse stream; kind names the stream in errors.
+func readReply(dr *crypto.DecryptedReader, first bool, kind string) (string, error) {
+	for {
+		frame, err := dr.ReadFrame()
+		if first {
+			err = tunnel.ClassifyFirstReadError(err)
+			first = false
+		}
+		if err != nil {
+			return "", fmt.Errorf("read %s reply: %w", kind, err)
+		}
+		switch frame.Type {
+		case protocol.FrameDATA:
+			return string(frame.Payload), nil
+		case protocol.FrameRST:
+			return "", fmt.Errorf("%s rejected by server", kind)
+		case protocol.FramePADDING, protocol.FrameCOVER:
+			continue
+		default:
+			return "", fmt.Errorf("unexpected %s reply frame type: %d", kind, frame.Type)
+		}
+	}
+}
+
+// handleBind serves a SOCKS5 BIND: the bound address and the peer address
+// are sent as the two replies RFC 1928 requires, then the peer's
+// connection is relayed to c.
+func (s *Socks5Server) handleBind(c net.Conn, r *socks5.Request, rule router.HostRule, user *User) error {
+	peer := r.Address()
+	local := c.RemoteAddr().String()
+	switch rule {
+	case router.HostRuleBlock:
+		log.Info("[BIND_BLOCK] blocked", "peer", peer, "local", local)
+		return s.replyError(c, r, socks5.RepNotAllowed)
+	case router.HostRuleDirect:
+		log.Info("[BIND_DIRECT]", "peer", peer, "local", local)
+		pc, err := s.directBind(c, r, peer)
+		if err != nil {
+			log.Error("[BIND_DIRECT] accept", "peer", peer, "err", err)
+			return err
+		}
+		defer pc.Close() //nolint:errcheck
+		relayTCP(pc, c)
+		log.Debug("[BIND_DIRECT] relay finished", "peer", peer)
+		return nil
+	default:
+		log.Info("[BIND_PROXY]", "peer", peer, "local", local)
+		handler, method := user.streamHandler(s.handler, s.method)
+		var replies int
+		err := handler.OpenBindStream(context.Background(), peer, method, c, func(addr string) error {
+			replies++
+			return writeSocks5Reply(c, addr)
+		})
+		if err != nil {
+			// A failed accept is reported as the second reply.
+			if replies < 2 {
+				_ = s.replyError(c, r, socks5.RepServerFailure)
+			}
+			if isTransientStreamError(err) {
+				log.Debug("[BIND_PROXY] closed", "peer", peer, "err", err)
+				return nil
+			}
+			log.Error("[BIND_PROXY] stream", "peer", peer, "err", err)
+		}
+		return err
+	}
+}
+
+// directBind listens on the address c reached us on and returns the first
+// connection accepted from peer, replying to c for both steps.
+func (s *Socks5Server) directBind(c net.Conn, r *socks5.Request, peer string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.LocalAddr().String())
+	if err != nil {
+		_ = s.replyError(c, r, socks5.RepServerFailure)
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = s.replyError(c, r, socks5.RepServerFailure)
+		return nil, err
+	}
+	defer ln.Close() //nolint:errcheck
+	if err := writeSocks5Reply(c, ln.Addr().String()); err != nil {
+		return nil, err
+	}
+
+	want := util.BindPeerIP(peer)
+	_ = ln.(*net.TCPListener).SetDeadline(time.Now().Add(bindAcceptTimeout))
+	for {
+		pc, err := ln.Accept()
+		if err != nil {
+			_ = s.replyError(c, r, socks5.RepTTLExpired)
+			return nil, err
+		}
+		if want != nil && !pc.RemoteAddr().(*net.TCPAddr).IP.Equal(want) {
+			log.Warn("[BIND_DIRECT] rejected unexpected peer", "peer", peer, "remote", pc.RemoteAddr().String())
+			_ = pc.Close()
+			continue
+		}
+		if err := writeSocks5Reply(c, pc.RemoteAddr().String()); err != nil {
+			pc.Close() //nolint:errcheck
+			return nil, err
+		}
+		return pc, nil
+	}
+}
+
+// writeSocks5Reply writes a success reply carrying addr.
+func writeSocks5Reply(c net.Conn, addr string) error {
+	a, host, port, err := socks5.ParseAddress(addr)
+	if err != nil {
+		return err
+	}
+	if a == socks5.ATYPDomain {
+		host = host[1:]
+	}
+	_, err = socks5.NewReply(socks5.RepSuccess, a, host, port).WriteTo(c)
+	return err
+}
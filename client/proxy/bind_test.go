@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+// socks5Bind sends a BIND for peer on a new connection to addr and returns
+// the connection and the first reply.
+func socks5Bind(t *testing.T, addr, peer string) (net.Conn, *socks5.Reply) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := socks5.NewNegotiationRequest([]byte{socks5.MethodNone}).WriteTo(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := socks5.NewNegotiationReplyFrom(c); err != nil {
+		t.Fatal(err)
+	}
+	a, host, port, err := socks5.ParseAddress(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := socks5.NewRequest(socks5.CmdBind, a, host, port).WriteTo(c); err != nil {
+		t.Fatal(err)
+	}
+	rp, err := socks5.NewReplyFrom(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, rp
+}
+
+func TestSocks5BindDirect(t *testing.T) {
+	addr := startSocks5Server(t, newDirectRouter(t), nil)
+
+	t.Run("接受预期对端并转发", func(t *testing.T) {
+		c, rp := socks5Bind(t, addr, "127.0.0.1:0")
+		if rp.Rep != socks5.RepSuccess {
+			t.Fatalf("first reply = %d", rp.Rep)
+		}
+
+		peer, err := net.Dial("tcp", rp.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close() //nolint:errcheck
+		rp2, err := socks5.NewReplyFrom(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rp2.Rep != socks5.RepSuccess || rp2.Address() != peer.LocalAddr().String() {
+			t.Fatalf("second reply = %d %s, want peer %s", rp2.Rep, rp2.Address(), peer.LocalAddr())
+		}
+
+		if _, err := peer.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+		if _, err := c.Write([]byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+		_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "pong" {
+			t.Fatalf("peer read %q, %v", buf, err)
+		}
+	})
+
+	t.Run("拒绝非预期对端", func(t *testing.T) {
+		c, rp := socks5Bind(t, addr, "192.0.2.1:0")
+		if rp.Rep != socks5.RepSuccess {
+			t.Fatalf("first reply = %d", rp.Rep)
+		}
+		peer, err := net.Dial("tcp", rp.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close() //nolint:errcheck
+		_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := peer.Read(make([]byte, 1)); err == nil {
+			t.Fatal("unexpected peer should be disconnected")
+		}
+		_ = c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := socks5.NewReplyFrom(c); err == nil {
+			t.Fatal("no second reply expected for an unexpected peer")
+		}
+	})
+}
@@ -10,11 +10,10 @@ import (
 )
 
 // TestSocks5CloseRacingStart guards against closing a socks5 server right
-// after starting it, which races with the accept-loop setup inside the
-// txthinking/socks5 runnergroup library. GOMAXPROCS(1) forces the Close
-// call to run before the Start goroutine sets up its accept loop: without
-// synchronization the listener leaks (the port keeps accepting) or the
-// Shutdown deadlocks. After Close returns, the port must be closed.
+// after starting it. GOMAXPROCS(1) forces the Close call to run before the
+// Start goroutine binds its listeners: without synchronization Start would
+// bind after Close and leak the listener (the port keeps accepting). After
+// Close returns, the port must be closed.
 func TestSocks5CloseRacingStart(t *testing.T) {
 	old := runtime.GOMAXPROCS(1)
 	defer runtime.GOMAXPROCS(old)
@@ -32,7 +31,6 @@ func TestSocks5CloseRacingStart(t *testing.T) {
 		if err != nil {
 			t.Fatalf("NewSocks5Server #%d: %v", i, err)
 		}
-		srv.MarkStarted()
 		go srv.Start() //nolint:errcheck
 		_ = srv.Close()
 
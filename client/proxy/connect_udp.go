@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/relay"
+	"github.com/nange/easyss/v3/util"
+)
+
+// CONNECT-UDP (RFC 9298) over HTTP/1.1: the client upgrades a request for
+// the default URI template to the connect-udp protocol and then exchanges
+// UDP payloads as DATAGRAM capsules (RFC 9297).
+const (
+	masqueUDPPathPrefix = "/.well-known/masque/udp/"
+	connectUDPProtocol  = "connect-udp"
+
+	capsuleDatagram = 0x00
+	// maxCapsuleSize bounds a capsule's value: a context ID and a UDP
+	// payload, anything larger cannot be relayed as one datagram.
+	maxCapsuleSize = protocol.MaxUDPDataSize + 8
+
+	connectUDPIdleTimeout = 60 * time.Second
+)
+
+// isConnectUDP reports whether r asks for a CONNECT-UDP tunnel.
+func isConnectUDP(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		strings.HasPrefix(r.URL.Path, masqueUDPPathPrefix) &&
+		strings.EqualFold(r.Header.Get("Upgrade"), connectUDPProtocol)
+}
+
+// connectUDPTarget extracts host:port from the path of the default URI
+// template, /.well-known/masque/udp/{target_host}/{target_port}/.
+func connectUDPTarget(path string) (string, error) {
+	rest := strings.TrimSuffix(strings.TrimPrefix(path, masqueUDPPathPrefix), "/")
+	host, port, ok := strings.Cut(rest, "/")
+	if !ok || host == "" || strings.Contains(port, "/") {
+		return "", fmt.Errorf("invalid connect-udp path %q", path)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", fmt.Errorf("invalid connect-udp port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// udpSession carries the datagrams of one CONNECT-UDP tunnel, either a
+// proxied UDPExchange or a directUDPSession.
+type udpSession interface {
+	Send(data []byte) error
+	Receive() ([]byte, error)
+	Close() error
+}
+
+type directUDPSession struct {
+	net.Conn
+}
+
+func (d directUDPSession) Send(data []byte) error {
+	_, err := d.Write(data)
+	return err
+}
+
+func (d directUDPSession) Receive() ([]byte, error) {
+	buf := make([]byte, protocol.MaxUDPDataSize)
+	n, err := d.Read(buf)
+	return buf[:n], err
+}
+
+func (s *HTTPProxyServer) handleConnectUDP(w http.ResponseWriter, r *http.Request, user *User) {
+	target, err := connectUDPTarget(r.URL.Path)
+	if err != nil {
+		http.Error(w, "Bad CONNECT-UDP target", http.StatusBadRequest)
+		return
+	}
+	host, _, _ := net.SplitHostPort(target)
+	if s.router.ShouldIPV6Disable() && util.IsIPV6(host) {
+		log.Warn("[HTTP-PROXY] CONNECT-UDP ipv6 target rejected, ipv6 disabled", "target", target)
+		http.Error(w, "IPv6 disabled", http.StatusBadRequest)
+		return
+	}
+	rule := user.matchHostRule(s.router, host)
+	if rule == router.HostRuleBlock {
+		log.Info("[HTTP-PROXY] CONNECT-UDP blocked", "target", target)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	handler, method := user.streamHandler(s.handler, s.method)
+	if rule == router.HostRuleProxy && handler == nil {
+		http.Error(w, "CONNECT-UDP not available", http.StatusNotImplemented)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	hijConn, brw, err := rc.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Error("[HTTP-PROXY] hijack CONNECT-UDP", "target", target, "err", err)
+		return
+	}
+	defer hijConn.Close() //nolint:errcheck
+	conn := user.wrapConn(hijConn)
+	// Capsules sent right after the request may already be buffered.
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Connection: Upgrade\r\nUpgrade: "+connectUDPProtocol+"\r\nCapsule-Protocol: ?1\r\n\r\n"); err != nil {
+		log.Warn("[HTTP-PROXY] write CONNECT-UDP response", "target", target, "err", err)
+		return
+	}
+
+	// Open the session with the first datagram so the proxied exchange can
+	// merge it into its bootstrap record.
+	first, err := readUDPCapsule(br)
+	if err != nil {
+		log.Debug("[HTTP-PROXY] CONNECT-UDP closed before first datagram", "target", target, "err", err)
+		return
+	}
+	var sess udpSession
+	if rule == router.HostRuleDirect {
+		log.Info("[HTTP-PROXY] CONNECT-UDP direct", "target", target)
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		c, err := s.dial(ctx, "udp", target)
+		cancel()
+		if err == nil {
+			sess = directUDPSession{Conn: c}
+			err = sess.Send(first)
+		}
+		if err != nil {
+			log.Warn("[HTTP-PROXY] direct CONNECT-UDP", "target", target, "err", err)
+			if sess != nil {
+				_ = sess.Close()
+			}
+			return
+		}
+	} else {
+		log.Info("[HTTP-PROXY] CONNECT-UDP proxy", "target", target)
+		ue, err := handler.OpenUDPExchange(context.Background(), target, method, first)
+		if err != nil {
+			log.Warn("[HTTP-PROXY] CONNECT-UDP exchange", "target", target, "err", err)
+			return
+		}
+		sess = ue
+	}
+
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			_ = sess.Close()
+			_ = hijConn.Close()
+		})
+	}
+	result := relay.Bidirectional(connectUDPIdleTimeout, closeAll,
+		func(signal func()) error {
+			defer closeAll()
+			for {
+				payload, err := readUDPCapsule(br)
+				if err != nil {
+					return err
+				}
+				signal()
+				if err := sess.Send(payload); err != nil {
+					return err
+				}
+			}
+		},
+		func(signal func()) error {
+			defer closeAll()
+			var buf []byte
+			for {
+				payload, err := sess.Receive()
+				if err != nil {
+					return err
+				}
+				signal()
+				buf = appendUDPCapsule(buf[:0], payload)
+				if _, err := conn.Write(buf); err != nil {
+					return err
+				}
+			}
+		},
+	)
+	if result.Err != nil && !errors.Is(result.Err, net.ErrClosed) && !isTransientStreamError(result.Err) {
+		log.Debug("[HTTP-PROXY] CONNECT-UDP relay", "target", target, "err", result.Err)
+	}
+}
+
+// readUDPCapsule returns the UDP payload of the next DATAGRAM capsule with
+// context ID 0, skipping other capsules and context IDs as RFC 9298 asks.
+func readUDPCapsule(r *bufio.Reader) ([]byte, error) {
+	for {
+		typ, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		n, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxCapsuleSize {
+			return nil, fmt.Errorf("capsule too large: %d bytes", n)
+		}
+		value := make([]byte, n)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		if typ != capsuleDatagram {
+			continue
+		}
+		vr := bytes.NewReader(value)
+		ctxID, err := readVarint(vr)
+		if err != nil {
+			return nil, fmt.Errorf("datagram capsule: %w", err)
+		}
+		if ctxID != 0 {
+			continue
+		}
+		return value[len(value)-vr.Len():], nil
+	}
+}
+
+// appendUDPCapsule appends payload as a DATAGRAM capsule with context ID 0.
+func appendUDPCapsule(b, payload []byte) []byte {
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = appendVarint(b, 0)
+	return append(b, payload...)
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000, section 16).
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// appendVarint appends v as a QUIC variable-length integer in its
+// shortest form.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+		b := appendVarint(nil, v)
+		got, err := readVarint(bytes.NewReader(b))
+		if err != nil || got != v {
+			t.Fatalf("varint %d: got %d, %v (encoded %x)", v, got, err, b)
+		}
+	}
+	if _, err := readVarint(bytes.NewReader([]byte{0x40})); err == nil {
+		t.Fatal("truncated varint should fail")
+	}
+}
+
+func TestConnectUDPTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "IPv4", path: "/.well-known/masque/udp/192.0.2.6/443/", want: "192.0.2.6:443"},
+		{name: "IPv6", path: "/.well-known/masque/udp/2001:db8::42/53/", want: "[2001:db8::42]:53"},
+		{name: "域名且无结尾斜杠", path: "/.well-known/masque/udp/example.com/53", want: "example.com:53"},
+		{name: "缺少端口", path: "/.well-known/masque/udp/example.com/", wantErr: true},
+		{name: "端口为 0", path: "/.well-known/masque/udp/example.com/0/", wantErr: true},
+		{name: "多余路径段", path: "/.well-known/masque/udp/example.com/53/x/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := connectUDPTarget(tt.path)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("connectUDPTarget(%q) = %q, %v", tt.path, got, err)
+			}
+		})
+	}
+}
+
+func TestReadUDPCapsule(t *testing.T) {
+	var b []byte
+	// 未知类型的 capsule 与非 0 context ID 的数据报均被跳过
+	b = appendVarint(b, 0x2a)
+	b = appendVarint(b, 3)
+	b = append(b, "xyz"...)
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, 3)
+	b = append(b, 0x02, 'n', 'o')
+	b = appendUDPCapsule(b, []byte("hello"))
+
+	got, err := readUDPCapsule(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestHTTPProxyConnectUDPDirect(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close() //nolint:errcheck
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	s := NewHTTPProxyServer("127.0.0.1:5080", "", "", 2*time.Second, nil, newDirectRouter(t), 0, nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close() //nolint:errcheck
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	host, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	req := fmt.Sprintf("GET /.well-known/masque/udp/%s/%s/ HTTP/1.1\r\nHost: %s\r\n"+
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n", host, port, srv.Listener.Addr())
+	// 请求之后紧跟首个数据报，验证已缓冲的 capsule 不会丢失
+	if _, err := c.Write(appendUDPCapsule([]byte(req), []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Capsule-Protocol") != "?1" {
+		t.Fatalf("status = %d, headers = %v", resp.StatusCode, resp.Header)
+	}
+
+	for _, want := range []string{"ping", "pong"} {
+		if want == "pong" {
+			if _, err := c.Write(appendUDPCapsule(nil, []byte(want))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := readUDPCapsule(br)
+		if err != nil || string(got) != want {
+			t.Fatalf("got %q, %v, want %q", got, err, want)
+		}
+	}
+}
+
+func TestHTTPProxyConnectUDPIPv6Disabled(t *testing.T) {
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleDirect, IPV6Rule: router.IPV6RuleDisable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewHTTPProxyServer("127.0.0.1:5080", "", "", 2*time.Second, nil, rt, 0, nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/.well-known/masque/udp/2001:db8::1/53/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "connect-udp")
+	req.Header.Set("Capsule-Protocol", "?1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
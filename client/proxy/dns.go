@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/client/config"
+	easydns "github.com/nange/easyss/v3/client/dns"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+)
+
+// SetECS makes queries sent to the proxy dns server carry the client subnet.
+// It must be called before the handler serves any query.
+func (h *StreamHandler) SetECS(ecs *easydns.ECS) {
+	h.ecs = ecs
+}
+
+// ProxyDNSExchanger returns a function resolving queries with the proxy dns
+// server through the tunnel, each bounded by timeout.
+func (h *StreamHandler) ProxyDNSExchanger(method protocol.Method, timeout time.Duration) easydns.ProxyExchangeFunc {
+	return func(msg *dns.Msg) (*dns.Msg, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		reply, err := h.ExchangeDNS(ctx, config.ProxyDNSServer, method, h.ecs.Apply(msg))
+		if err != nil {
+			return nil, err
+		}
+		h.ecs.Strip(reply)
+		return reply, nil
+	}
+}
+
+// ExchangeDNS sends msg to the dns server (host:port) through the tunnel and
+// waits for the matching answer. A truncated UDP answer is retried over a TCP
+// stream so large responses are not lost.
+func (h *StreamHandler) ExchangeDNS(ctx context.Context, server string, method protocol.Method, msg *dns.Msg) (*dns.Msg, error) {
+	reply, err := h.exchangeDNSOverUDP(ctx, server, method, msg)
+	if err != nil {
+		return nil, err
+	}
+	if !reply.Truncated {
+		return reply, nil
+	}
+	log.Debug("[DNS_PROXY] truncated answer, retry over tcp", "name", msg.Question[0].Name)
+	return h.exchangeDNSOverTCP(ctx, server, method, msg)
+}
+
+func (h *StreamHandler) exchangeDNSOverUDP(ctx context.Context, server string, method protocol.Method, msg *dns.Msg) (*dns.Msg, error) {
+	data, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ue, err := h.OpenUDPExchange(ctx, server, method, data)
+	if err != nil {
+		return nil, err
+	}
+	defer ue.Close() //nolint:errcheck
+
+	stop := context.AfterFunc(ctx, func() {
+		ue.Close() //nolint:errcheck
+	})
+	defer stop()
+	for {
+		resp, err := ue.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		reply := &dns.Msg{}
+		if err := reply.Unpack(resp); err == nil && reply.Id == msg.Id {
+			return reply, nil
+		}
+	}
+}
+
+// exchangeDNSOverTCP runs a DNS-over-TCP exchange on a tunnel stream, using
+// an in-process pipe as the local end of the stream.
+func (h *StreamHandler) exchangeDNSOverTCP(ctx context.Context, server string, method protocol.Method, msg *dns.Msg) (*dns.Msg, error) {
+	local, remote := net.Pipe()
+	defer local.Close() //nolint:errcheck
+
+	errCh := make(chan error, 1)
+	go func() {
+		err := h.OpenTCPStream(ctx, server, method, remote)
+		remote.Close() //nolint:errcheck
+		errCh <- err
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = local.SetDeadline(deadline)
+	}
+	conn := &dns.Conn{Conn: local}
+	err := conn.WriteMsg(msg)
+	var reply *dns.Msg
+	if err == nil {
+		reply, err = conn.ReadMsg()
+	}
+	if err != nil {
+		select {
+		case streamErr := <-errCh:
+			if streamErr != nil {
+				return nil, errors.Join(err, streamErr)
+			}
+		default:
+		}
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/util/bytespool"
+)
+
+// ForwardServer is a static port forward, like ssh -L: every connection
+// (tcp) or client flow (udp) on the listen address is carried to one fixed
+// target through the server, without consulting the router.
+type ForwardServer struct {
+	listenAddr string
+	network    string
+	target     string
+	handler    *StreamHandler
+	method     protocol.Method
+
+	mu     sync.Mutex
+	ln     net.Listener
+	pc     *net.UDPConn
+	closed bool
+	quit   chan struct{}
+
+	udpFlows *udpFlows
+}
+
+// NewForwardServer returns a forward of network ("tcp" or "udp") from
+// listenAddr to target.
+func NewForwardServer(listenAddr, network, target string, handler *StreamHandler, method protocol.Method, udpIdleTimeout time.Duration) (*ForwardServer, error) {
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("unknown forward network %q (want tcp or udp)", network)
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("forward target %q: %w", target, err)
+	}
+	if udpIdleTimeout <= 0 {
+		udpIdleTimeout = 30 * time.Second
+	}
+	return &ForwardServer{
+		listenAddr: listenAddr,
+		network:    network,
+		target:     target,
+		handler:    handler,
+		method:     method,
+		quit:       make(chan struct{}),
+		udpFlows:   newUDPFlows("[FORWARD]", udpIdleTimeout),
+	}, nil
+}
+
+// Start listens and serves until Close.
+func (s *ForwardServer) Start() error {
+	var ln net.Listener
+	var pc *net.UDPConn
+	if s.network == "tcp" {
+		l, err := net.Listen("tcp", s.listenAddr)
+		if err != nil {
+			return err
+		}
+		ln = l
+	} else {
+		addr, err := net.ResolveUDPAddr("udp", s.listenAddr)
+		if err != nil {
+			return err
+		}
+		if pc, err = net.ListenUDP("udp", addr); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		if ln != nil {
+			ln.Close() //nolint:errcheck
+		}
+		if pc != nil {
+			pc.Close() //nolint:errcheck
+		}
+		return net.ErrClosed
+	}
+	s.ln, s.pc = ln, pc
+	s.mu.Unlock()
+
+	if pc != nil {
+		go s.udpFlows.cleanupLoop(s.quit)
+		return s.serveUDP(pc)
+	}
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCP(c)
+	}
+}
+
+func (s *ForwardServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.quit)
+	ln, pc := s.ln, s.pc
+	s.mu.Unlock()
+
+	var errs []error
+	if ln != nil {
+		errs = append(errs, ln.Close())
+	}
+	if pc != nil {
+		errs = append(errs, pc.Close())
+	}
+	s.udpFlows.closeAll()
+	return errors.Join(errs...)
+}
+
+func (s *ForwardServer) serveTCP(c net.Conn) {
+	defer c.Close() //nolint:errcheck
+	local := c.RemoteAddr().String()
+	log.Info("[FORWARD] tcp", "listen", s.listenAddr, "target", s.target, "local", local)
+	err := s.handler.OpenTCPStream(context.Background(), s.target, s.method, c)
+	switch {
+	case err == nil:
+		log.Debug("[FORWARD] tcp stream finished", "target", s.target)
+	case isTransientStreamError(err):
+		log.Debug("[FORWARD] tcp closed", "target", s.target, "err", err)
+	default:
+		log.Error("[FORWARD] tcp stream", "target", s.target, "err", err)
+	}
+}
+
+func (s *ForwardServer) serveUDP(pc *net.UDPConn) error {
+	buf := bytespool.Get(protocol.MaxUDPDataSize)
+	defer bytespool.MustPut(buf)
+	for {
+		n, src, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Debug("[FORWARD] read udp", "err", err)
+			continue
+		}
+		s.handleUDP(pc, src, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// handleUDP relays a datagram from src on the flow of its address.
+func (s *ForwardServer) handleUDP(pc *net.UDPConn, src *net.UDPAddr, payload []byte) {
+	key := src.String()
+	s.udpFlows.handle(key, payload, func(f *udpFlow, first []byte) error {
+		return s.openUDPFlow(pc, key, f, src, first)
+	})
+}
+
+func (s *ForwardServer) openUDPFlow(pc *net.UDPConn, key string, f *udpFlow, src *net.UDPAddr, first []byte) error {
+	log.Info("[FORWARD] udp", "listen", s.listenAddr, "target", s.target, "local", key)
+	// The exchange lives as long as the flow: a dial context would end it
+	// once cancelled.
+	ue, err := s.handler.OpenUDPExchange(context.Background(), s.target, s.method, first)
+	if err != nil {
+		log.Error("[FORWARD] open udp exchange", "target", s.target, "err", err)
+		return err
+	}
+	f.onClose(ue)
+	f.send = ue.Send
+	go s.udpFlows.relay(key, f, func(buf []byte) (int, error) {
+		data, err := ue.Receive()
+		return copy(buf, data), err
+	}, func(b []byte) error {
+		_, err := pc.WriteToUDP(b, src)
+		return err
+	})
+	return nil
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/transport"
+)
+
+// endpointTransport records the endpoint and context of every stream it
+// opens.
+type endpointTransport struct {
+	mockTransport
+	mu        sync.Mutex
+	endpoints []string
+	ctxs      []context.Context
+}
+
+func (e *endpointTransport) Open(ctx context.Context, req transport.OpenRequest) (transport.Stream, error) {
+	e.mu.Lock()
+	e.endpoints = append(e.endpoints, req.Endpoint)
+	e.ctxs = append(e.ctxs, ctx)
+	e.mu.Unlock()
+	return e.mockTransport.Open(ctx, req)
+}
+
+func (e *endpointTransport) waitEndpoint(t *testing.T) string {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		e.mu.Lock()
+		if len(e.endpoints) > 0 {
+			ep := e.endpoints[0]
+			e.mu.Unlock()
+			return ep
+		}
+		e.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no stream opened")
+	return ""
+}
+
+// streamCanceled reports whether the context of the first stream, which
+// the transport ends the stream with, is done.
+func (e *endpointTransport) streamCanceled() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.ctxs[0].Err() != nil
+}
+
+func TestNewForwardServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		target  string
+		wantErr bool
+	}{
+		{name: "tcp", network: "tcp", target: "db.internal:5432"},
+		{name: "udp", network: "udp", target: "10.0.0.53:53"},
+		{name: "未知网络类型", network: "sctp", target: "db.internal:5432", wantErr: true},
+		{name: "目标缺少端口", network: "tcp", target: "db.internal", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewForwardServer("127.0.0.1:0", tt.network, tt.target, nil, protocol.MethodAES256GCM, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func startForwardServer(t *testing.T, network string, tr transport.Transport) string {
+	t.Helper()
+	var addr string
+	if network == "tcp" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		l.Close() //nolint:errcheck
+	} else {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = pc.LocalAddr().String()
+		pc.Close() //nolint:errcheck
+	}
+	s, err := NewForwardServer(addr, network, "db.internal:5432", newTestStreamHandler(tr), protocol.MethodAES256GCM, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Start() }()
+	t.Cleanup(func() { _ = s.Close() })
+	time.Sleep(50 * time.Millisecond)
+	return addr
+}
+
+func TestForwardServerOpensStreams(t *testing.T) {
+	t.Run("TCP 连接走 tcp 端点", func(t *testing.T) {
+		tr := &endpointTransport{}
+		addr := startForwardServer(t, "tcp", tr)
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() //nolint:errcheck
+		_, _ = c.Write([]byte("hello"))
+		if ep := tr.waitEndpoint(t); ep != "/v3/tcp" {
+			t.Fatalf("endpoint = %q", ep)
+		}
+	})
+
+	t.Run("UDP 数据报走 udp 端点", func(t *testing.T) {
+		tr := &endpointTransport{}
+		addr := startForwardServer(t, "udp", tr)
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() //nolint:errcheck
+		if _, err := c.Write([]byte("query")); err != nil {
+			t.Fatal(err)
+		}
+		if ep := tr.waitEndpoint(t); ep != "/v3/udp" {
+			t.Fatalf("endpoint = %q", ep)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if tr.streamCanceled() {
+			t.Error("udp stream canceled after open")
+		}
+	})
+}
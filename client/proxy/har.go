@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+const (
+	// maxHAREntries bounds the entries of a HAR file, after which it is
+	// rotated.
+	maxHAREntries = 1000
+	// maxHARBodySize bounds the body bytes recorded per request or
+	// response; the sizes are still reported in full.
+	maxHARBodySize = 1 << 20
+)
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/), only the
+// fields the MITM mode fills in.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+const (
+	// harQueueSize bounds the entries waiting to be written; entries
+	// recorded while it is full are dropped rather than slowing down the
+	// intercepted traffic.
+	harQueueSize = 32
+
+	harHeader  = "{\n  \"log\": {\n    \"version\": \"1.2\",\n    \"creator\": {\"name\": \"easyss\", \"version\": \"3\"},\n    \"entries\": ["
+	harTrailer = "\n    ]\n  }\n}\n"
+)
+
+var errHARQueueFull = errors.New("har queue full, entry dropped")
+
+// harWriter appends the recorded entries to the HAR file from a single
+// goroutine. Each entry is written over the closing brackets, which follow
+// it again, so the file is a complete document after every write. A file
+// holding maxHAREntries is renamed with a ".1" suffix, replacing the
+// previous one, and a new file is started.
+type harWriter struct {
+	path  string
+	queue chan harEntry
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+
+	// Owned by run.
+	f     *os.File
+	end   int64
+	count int
+}
+
+func newHARWriter(path string) *harWriter {
+	w := &harWriter{
+		path:  path,
+		queue: make(chan harEntry, harQueueSize),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// add queues e for writing without blocking.
+func (w *harWriter) add(e harEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	select {
+	case w.queue <- e:
+		return nil
+	default:
+		return errHARQueueFull
+	}
+}
+
+// close writes the queued entries and closes the file.
+func (w *harWriter) close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
+
+func (w *harWriter) run() {
+	defer close(w.done)
+	for e := range w.queue {
+		if err := w.write(e); err != nil {
+			log.Warn("[MITM] write har", "path", w.path, "err", err)
+		}
+	}
+	if w.f != nil {
+		w.f.Close() //nolint:errcheck
+	}
+}
+
+func (w *harWriter) write(e harEntry) error {
+	if w.f == nil || w.count >= maxHAREntries {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(e, "      ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n      "
+	if w.count == 0 {
+		sep = "\n      "
+	}
+	buf := make([]byte, 0, len(sep)+len(data)+len(harTrailer))
+	buf = append(append(append(buf, sep...), data...), harTrailer...)
+	if _, err := w.f.WriteAt(buf, w.end); err != nil {
+		return err
+	}
+	w.end += int64(len(sep) + len(data))
+	w.count++
+	return nil
+}
+
+// rotate starts a new, empty file, keeping the full one, or the one of
+// the previous run, as path.1. The file holds cookies and credentials, so
+// only its owner may read it.
+func (w *harWriter) rotate() error {
+	if w.f != nil {
+		w.f.Close() //nolint:errcheck
+		w.f = nil
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(harHeader + harTrailer); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	w.f, w.end, w.count = f, int64(len(harHeader)), 0
+	return nil
+}
+
+// bodyRecorder counts the bytes read from a body, keeping the first
+// maxHARBodySize of them when keep is set.
+type bodyRecorder struct {
+	io.ReadCloser
+	keep bool
+	buf  bytes.Buffer
+	n    int64
+}
+
+func (r *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if r.keep && r.buf.Len() < maxHARBodySize {
+		r.buf.Write(p[:min(n, maxHARBodySize-r.buf.Len())])
+	}
+	return n, err
+}
+
+// harText returns body as HAR text, base64 encoded unless it is UTF-8.
+func harText(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	out := make([]harNameValue, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+func harQuery(u *url.URL) []harNameValue {
+	out := make([]harNameValue, 0)
+	for name, values := range u.Query() {
+		for _, v := range values {
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	out := make([]harNameValue, 0, len(cookies))
+	for _, c := range cookies {
+		out = append(out, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	return out
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func readHAR(t *testing.T, path string) []harEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("invalid har %s: %v", path, err)
+	}
+	return har.Log.Entries
+}
+
+func TestHARWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mitm.har")
+	w := newHARWriter(path)
+	for i := range 3 {
+		if err := w.add(harEntry{Request: harRequest{URL: "https://example.com/" + strconv.Itoa(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	entries := readHAR(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("entries = %d, want 3", len(entries))
+	}
+	for i, e := range entries {
+		if want := "https://example.com/" + strconv.Itoa(i); e.Request.URL != want {
+			t.Errorf("entry %d url = %s, want %s", i, e.Request.URL, want)
+		}
+	}
+	if err := w.add(harEntry{}); err == nil {
+		t.Error("add after close succeeded")
+	}
+}
+
+func TestHARWriterRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mitm.har")
+	w := newHARWriter(path)
+	defer w.close() //nolint:errcheck
+
+	// 直接调用 write，避免队列满时丢弃条目
+	for i := range maxHAREntries + 2 {
+		if err := w.write(harEntry{Request: harRequest{URL: strconv.Itoa(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		// 每次写入后文件都是完整的 HAR
+		if i == 0 || i == maxHAREntries {
+			readHAR(t, path)
+		}
+	}
+	if n := len(readHAR(t, path+".1")); n != maxHAREntries {
+		t.Errorf("rotated entries = %d, want %d", n, maxHAREntries)
+	}
+	entries := readHAR(t, path)
+	if len(entries) != 2 || entries[0].Request.URL != strconv.Itoa(maxHAREntries) {
+		t.Errorf("current entries = %+v", entries)
+	}
+}
+
+func TestHARWriterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mitm.har")
+	for run := range 2 {
+		w := newHARWriter(path)
+		if err := w.add(harEntry{Request: harRequest{URL: strconv.Itoa(run)}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("上次运行的记录保留为 .1", func(t *testing.T) {
+		if entries := readHAR(t, path+".1"); len(entries) != 1 || entries[0].Request.URL != "0" {
+			t.Errorf("previous entries = %+v", entries)
+		}
+		if entries := readHAR(t, path); len(entries) != 1 || entries[0].Request.URL != "1" {
+			t.Errorf("current entries = %+v", entries)
+		}
+	})
+
+	t.Run("文件仅所有者可读写", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Windows 不使用 Unix 权限位")
+		}
+		for _, p := range []string{path, path + ".1"} {
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := fi.Mode().Perm(); perm != 0o600 {
+				t.Errorf("%s mode = %o, want 600", p, perm)
+			}
+		}
+	})
+}
@@ -2,9 +2,6 @@ package proxy
 
 import (
 	"encoding/base64"
-	"errors"
-	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"testing"
@@ -13,36 +10,6 @@ import (
 	"github.com/nange/easyss/v3/util"
 )
 
-func TestIsLocalConnClosedError(t *testing.T) {
-	tests := []struct {
-		name string
-		err  error
-		want bool
-	}{
-		{"nil error", nil, false},
-		{"net.ErrClosed", net.ErrClosed, true},
-		{"io.ErrClosedPipe", io.ErrClosedPipe, true},
-		{"use of closed network connection", errors.New("use of closed network connection"), true},
-		{"Use Of Closed Network Connection", errors.New("Use Of Closed Network Connection"), true}, // 大小写不敏感
-		{"connection reset by peer", errors.New("connection reset by peer"), true},
-		{"forcibly closed by the remote host", errors.New("forcibly closed by the remote host"), true},
-		{"software caused connection abort", errors.New("software caused connection abort"), true},
-		{"connection was aborted", errors.New("connection was aborted"), true},
-		{"broken pipe", errors.New("broken pipe"), true},
-		{"normal error", errors.New("some other error"), false},
-		{"io.EOF", io.EOF, false},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := isLocalConnClosedError(tt.err)
-			if got != tt.want {
-				t.Errorf("isLocalConnClosedError(%v) = %v, want %v", tt.err, got, tt.want)
-			}
-		})
-	}
-}
-
 func TestParseBasicAuth(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -4,11 +4,11 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -19,7 +19,6 @@ import (
 	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/stats"
 	"github.com/nange/easyss/v3/util/bytespool"
-	"github.com/txthinking/socks5"
 )
 
 type reverseProxyBufferPool struct{}
@@ -34,16 +33,17 @@ func (reverseProxyBufferPool) Put(buf []byte) {
 
 type HTTPProxyServer struct {
 	listenAddr string
-	socksAddr  string
-	socksURL   *url.URL
 	username   string
 	password   string
+	users      *Users
 	timeout    time.Duration
 	handler    *StreamHandler
 	router     *router.Router
 	method     protocol.Method
 	dial       func(context.Context, string, string) (net.Conn, error)
 	rp         *httputil.ReverseProxy
+	userRPs    sync.Map // user name -> *httputil.ReverseProxy
+	mitm       *MITM
 	server     *http.Server
 	mu         sync.Mutex
 
@@ -68,10 +68,10 @@ type TunConfig struct {
 	MTU            int    `json:"mtu"`
 }
 
-func NewHTTPProxyServer(listenAddr, socksAddr, username, password string, timeout time.Duration, handler *StreamHandler, rt *router.Router, method protocol.Method, dial func(context.Context, string, string) (net.Conn, error)) (*HTTPProxyServer, error) {
-	if socksAddr == "" {
-		return nil, fmt.Errorf("http proxy requires a local socks5 address")
-	}
+// NewHTTPProxyServer returns an HTTP proxy routing each request itself:
+// CONNECT tunnels and plain HTTP requests alike are dialed directly or
+// carried by a tunnel stream, without going through the SOCKS5 server.
+func NewHTTPProxyServer(listenAddr, username, password string, timeout time.Duration, handler *StreamHandler, rt *router.Router, method protocol.Method, dial func(context.Context, string, string) (net.Conn, error)) *HTTPProxyServer {
 	if timeout <= 0 {
 		timeout = 30 * time.Second
 	}
@@ -79,28 +79,47 @@ func NewHTTPProxyServer(listenAddr, socksAddr, username, password string, timeou
 		dial = defaultDirectDialContext
 	}
 
-	socksURL := &url.URL{Scheme: "socks5", Host: socksAddr}
-	if username != "" || password != "" {
-		socksURL.User = url.UserPassword(username, password)
-	}
-
 	s := &HTTPProxyServer{
 		listenAddr: listenAddr,
-		socksAddr:  socksAddr,
-		socksURL:   socksURL,
 		username:   username,
 		password:   password,
+		users:      singleUser(username, password),
 		timeout:    timeout,
 		handler:    handler,
 		router:     rt,
 		method:     method,
 		dial:       dial,
 	}
-	s.rp = s.newReverseProxy()
-	return s, nil
+	s.rp = s.newReverseProxy(nil)
+	return s
+}
+
+// SetUsers replaces the auth_username/auth_password credential with a set
+// of users. It must be called before Start.
+func (s *HTTPProxyServer) SetUsers(us *Users) {
+	s.users = us
 }
 
-func (s *HTTPProxyServer) newReverseProxy() *httputil.ReverseProxy {
+// SetMITM enables HTTPS interception of m's hosts. It must be called
+// before Start.
+func (s *HTTPProxyServer) SetMITM(m *MITM) {
+	s.mitm = m
+}
+
+// reverseProxy returns the reverse proxy forwarding the requests of u.
+// Users get their own, so pooled connections never cross users.
+func (s *HTTPProxyServer) reverseProxy(u *User) *httputil.ReverseProxy {
+	if u == nil {
+		return s.rp
+	}
+	if rp, ok := s.userRPs.Load(u.Name); ok {
+		return rp.(*httputil.ReverseProxy)
+	}
+	rp, _ := s.userRPs.LoadOrStore(u.Name, s.newReverseProxy(u))
+	return rp.(*httputil.ReverseProxy)
+}
+
+func (s *HTTPProxyServer) newReverseProxy(u *User) *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{
 		Rewrite: func(pr *httputil.ProxyRequest) {
 			if pr.Out.URL.Scheme == "" {
@@ -114,12 +133,7 @@ func (s *HTTPProxyServer) newReverseProxy() *httputil.ReverseProxy {
 			pr.Out.Header.Del("Proxy-Authorization")
 			pr.Out.Header.Del("Proxy-Connection")
 		},
-		Transport: &http.Transport{
-			Proxy: func(*http.Request) (*url.URL, error) {
-				return s.socksURL, nil
-			},
-			TLSHandshakeTimeout: s.timeout / 3,
-		},
+		Transport:  s.newTransport(u),
 		BufferPool: reverseProxyBufferPool{},
 		ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
 			log.Warn("[HTTP-PROXY] reverse proxy request", "err", err)
@@ -128,13 +142,25 @@ func (s *HTTPProxyServer) newReverseProxy() *httputil.ReverseProxy {
 	}
 }
 
+// newTransport returns the transport of u's requests. Its connections are
+// in-process pipes or direct dials from dialRouted, pooled per upstream
+// host like any http.Transport.
+func (s *HTTPProxyServer) newTransport(u *User) *http.Transport {
+	return &http.Transport{
+		TLSHandshakeTimeout: s.timeout / 3,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.dialRouted(ctx, network, addr, u)
+		},
+	}
+}
+
 func (s *HTTPProxyServer) Start() error {
 	listener, err := net.Listen("tcp", s.listenAddr)
 	if err != nil {
 		return fmt.Errorf("http proxy listen: %w", err)
 	}
 
-	log.Info("[HTTP-PROXY] listening", "addr", s.listenAddr, "socks5", s.socksURL.Redacted())
+	log.Info("[HTTP-PROXY] listening", "addr", s.listenAddr)
 
 	httpServer := &http.Server{Handler: s}
 	s.mu.Lock()
@@ -144,7 +170,15 @@ func (s *HTTPProxyServer) Start() error {
 }
 
 func (s *HTTPProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !s.authOK(r) {
+	// Serve /proxy.pac without proxy auth: PAC fetchers (browsers, OS proxy
+	// settings) never send proxy credentials.
+	if r.URL.Host == "" && r.URL.Path == "/proxy.pac" {
+		s.servePAC(w, r)
+		return
+	}
+
+	user, ok := s.authenticate(r)
+	if !ok {
 		w.Header().Set("Proxy-Authenticate", `Basic realm="Easyss"`)
 		http.Error(w, "Proxy auth required", http.StatusProxyAuthRequired)
 		return
@@ -156,6 +190,12 @@ func (s *HTTPProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Serve /metrics in the Prometheus text format.
+	if r.URL.Host == "" && r.URL.Path == "/metrics" {
+		s.serveMetrics(w)
+		return
+	}
+
 	// Serve /tun for TUN configuration (macOS helper).
 	if r.URL.Host == "" && r.URL.Path == "/tun" {
 		if r.Method == http.MethodGet {
@@ -166,6 +206,13 @@ func (s *HTTPProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// CONNECT-UDP is addressed to the proxy itself, so it is matched
+	// before the forwarding loop check below.
+	if isConnectUDP(r) {
+		s.handleConnectUDP(w, r, user)
+		return
+	}
+
 	// Prevent forwarding loops: reject requests that would be forwarded
 	// back to the proxy itself (both relative and absolute URLs).
 	if s.isSelfTarget(r) {
@@ -174,12 +221,12 @@ func (s *HTTPProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodConnect {
-		s.handleConnect(w, r)
+		s.handleConnect(w, r, user)
 		return
 	}
 
-	log.Info("[HTTP-PROXY] forwarding via SOCKS5", "host", r.Host, "method", r.Method)
-	s.rp.ServeHTTP(w, r)
+	log.Info("[HTTP-PROXY] forwarding", "host", r.Host, "method", r.Method)
+	s.reverseProxy(user).ServeHTTP(w, r)
 }
 
 func (s *HTTPProxyServer) serveStats(w http.ResponseWriter) {
@@ -192,6 +239,35 @@ func (s *HTTPProxyServer) serveStats(w http.ResponseWriter) {
 	}
 }
 
+// serveMetrics serves the stats in the Prometheus text format.
+func (s *HTTPProxyServer) serveMetrics(w http.ResponseWriter) {
+	snap := stats.Collect()
+	snap.TransportStats = s.handler.Transport().Stats()
+
+	w.Header().Set("Content-Type", stats.MetricsContentType)
+	if err := stats.WriteMetrics(w, snap); err != nil {
+		log.Warn("[HTTP-PROXY] write metrics", "err", err)
+	}
+}
+
+// servePAC serves the routing rules as a proxy auto-config file pointing
+// at this proxy, addressed the way the client reached it.
+func (s *HTTPProxyServer) servePAC(w http.ResponseWriter, r *http.Request) {
+	if s.router == nil {
+		http.NotFound(w, r)
+		return
+	}
+	proxyAddr := r.Host
+	if proxyAddr == "" {
+		proxyAddr = s.listenAddr
+	}
+	w.Header().Set("Content-Type", router.PACContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(s.router.PAC("PROXY " + proxyAddr)); err != nil {
+		log.Debug("[HTTP-PROXY] write pac", "err", err)
+	}
+}
+
 // SetTunConfig stores the TUN configuration served at GET /tun.
 // Called before spawning the TUN helper on macOS.
 func (s *HTTPProxyServer) SetTunConfig(cfg *TunConfig) {
@@ -304,15 +380,20 @@ func localIPSet() map[string]struct{} {
 	return set
 }
 
-func (s *HTTPProxyServer) authOK(r *http.Request) bool {
-	if s.username == "" && s.password == "" {
-		return true
+// authenticate returns the user of the request's proxy credential, nil
+// when no credential is required.
+func (s *HTTPProxyServer) authenticate(r *http.Request) (*User, bool) {
+	if !s.users.Enabled() {
+		return nil, true
 	}
 	username, password, ok := basicAuth(r)
-	return ok && username == s.username && password == s.password
+	if !ok {
+		return nil, false
+	}
+	return s.users.Authenticate(username, password)
 }
 
-func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request, user *User) {
 	target := connectTarget(r)
 	host, _, err := net.SplitHostPort(target)
 	if err != nil {
@@ -320,15 +401,17 @@ func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	rule := router.HostRuleProxy
-	if s.router != nil {
-		rule = s.router.MatchHostRule(host)
-	}
+	rule := user.matchHostRule(s.router, host)
 	if rule == router.HostRuleBlock {
 		log.Info("[HTTP-PROXY] CONNECT blocked", "target", target)
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
+	handler, method := user.streamHandler(s.handler, s.method)
+	if rule == router.HostRuleProxy && handler == nil {
+		http.Error(w, "Proxy not available", http.StatusBadGateway)
+		return
+	}
 
 	rc := http.NewResponseController(w)
 	hijConn, _, err := rc.Hijack()
@@ -338,27 +421,23 @@ func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	defer hijConn.Close() //nolint:errcheck
+	hijConn = user.wrapConn(hijConn)
 
-	if rule == router.HostRuleDirect {
-		log.Info("[HTTP-PROXY] CONNECT direct", "target", target)
-		remote, err := s.directConnect(target)
-		if err != nil {
-			log.Warn("[HTTP-PROXY] direct CONNECT", "target", target, "err", err)
-			return
-		}
-		defer remote.Close() //nolint:errcheck
+	if s.mitm != nil && s.mitm.matches(host) {
+		log.Info("[HTTP-PROXY] CONNECT intercepted", "target", target)
 		if err := writeConnectEstablished(hijConn, target); err != nil {
 			return
 		}
-		relayTCP(remote, hijConn)
+		// Intercepted requests share the user's pooled upstream connections.
+		s.mitm.serve(hijConn, target, s.reverseProxy(user).Transport)
 		return
 	}
 
-	if s.handler == nil {
-		log.Info("[HTTP-PROXY] CONNECT via SOCKS5 (no handler)", "target", target)
-		remote, err := s.dialSOCKS5(target)
+	if rule == router.HostRuleDirect {
+		log.Info("[HTTP-PROXY] CONNECT direct", "target", target)
+		remote, err := s.directConnect(target)
 		if err != nil {
-			log.Warn("[HTTP-PROXY] socks5 CONNECT", "target", target, "err", err)
+			log.Warn("[HTTP-PROXY] direct CONNECT", "target", target, "err", err)
 			return
 		}
 		defer remote.Close() //nolint:errcheck
@@ -373,7 +452,7 @@ func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	log.Info("[HTTP-PROXY] CONNECT proxy", "target", target)
-	if err := s.handler.OpenTCPStream(context.Background(), target, s.method, hijConn); err != nil {
+	if err := handler.OpenTCPStream(context.Background(), target, method, hijConn); err != nil {
 		if isTransientStreamError(err) {
 			log.Debug("[HTTP-PROXY] CONNECT closed", "target", target, "err", err)
 			return
@@ -396,12 +475,37 @@ func (s *HTTPProxyServer) directConnect(target string) (net.Conn, error) {
 	return s.dial(ctx, "tcp", target)
 }
 
-func (s *HTTPProxyServer) dialSOCKS5(target string) (net.Conn, error) {
-	client, err := socks5.NewClient(s.socksAddr, s.username, s.password, int(s.timeout.Seconds()), int(s.timeout.Seconds()))
+// dialRouted dials addr the way a CONNECT to it by u is routed: directly,
+// or through an in-process pipe whose far end is carried by a tunnel stream.
+func (s *HTTPProxyServer) dialRouted(ctx context.Context, network, addr string, u *User) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	return client.Dial("tcp", target)
+	switch u.matchHostRule(s.router, host) {
+	case router.HostRuleBlock:
+		return nil, fmt.Errorf("target %s is blocked", addr)
+	case router.HostRuleDirect:
+		c, err := s.dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return u.wrapTarget(c), nil
+	}
+
+	handler, method := u.streamHandler(s.handler, s.method)
+	if handler == nil {
+		return nil, fmt.Errorf("no server to proxy %s through", addr)
+	}
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close() //nolint:errcheck
+		err := handler.OpenTCPStream(context.Background(), addr, method, remote)
+		if err != nil && !isTransientStreamError(err) {
+			log.Warn("[HTTP-PROXY] forward stream", "target", addr, "err", err)
+		}
+	}()
+	return u.wrapTarget(local), nil
 }
 
 func connectTarget(r *http.Request) string {
@@ -443,10 +547,14 @@ func parseBasicAuth(auth string) (username, password string, ok bool) {
 func (s *HTTPProxyServer) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	var err error
 	if s.server != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		return s.server.Shutdown(ctx)
+		err = s.server.Shutdown(ctx)
 	}
-	return nil
+	if s.mitm != nil {
+		err = errors.Join(err, s.mitm.Close())
+	}
+	return err
 }
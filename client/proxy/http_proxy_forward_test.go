@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/protocol"
+)
+
+func TestHTTPProxyForwardsWithoutSocks5(t *testing.T) {
+	t.Run("直连请求复用上游连接", func(t *testing.T) {
+		var conns atomic.Int32
+		upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "hello")
+		}))
+		upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		upstream.Start()
+		defer upstream.Close()
+
+		s := NewHTTPProxyServer("127.0.0.1:5080", "", "", 2*time.Second, nil, newDirectRouter(t), 0, nil)
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		proxyURL, _ := url.Parse(srv.URL)
+		hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 3 * time.Second}
+
+		for range 3 {
+			resp, err := hc.Get(upstream.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close() //nolint:errcheck
+			if string(body) != "hello" {
+				t.Fatalf("body = %q", body)
+			}
+		}
+		if n := conns.Load(); n != 1 {
+			t.Fatalf("upstream connections = %d, want 1", n)
+		}
+	})
+
+	t.Run("代理请求走 tcp 端点", func(t *testing.T) {
+		rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleProxy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := &endpointTransport{}
+		s := NewHTTPProxyServer("127.0.0.1:5080", "", "", time.Second, newTestStreamHandler(tr), rt, protocol.MethodAES256GCM, nil)
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		proxyURL, _ := url.Parse(srv.URL)
+		hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: time.Second}
+
+		// mock 传输层不返回响应，只检查请求经隧道流发出
+		go func() {
+			if resp, err := hc.Get("http://example.com/"); err == nil {
+				resp.Body.Close() //nolint:errcheck
+			}
+		}()
+		if ep := tr.waitEndpoint(t); ep != "/v3/tcp" {
+			t.Fatalf("endpoint = %q", ep)
+		}
+	})
+}
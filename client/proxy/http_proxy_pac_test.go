@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nange/easyss/v3/client/router"
+)
+
+func TestServePAC(t *testing.T) {
+	s := NewHTTPProxyServer("127.0.0.1:5080", "user", "pass", 0, nil, newDirectRouter(t), 0, nil)
+
+	// PAC 无需代理认证，代理地址取自请求的 Host
+	r := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+	r.Host = "192.168.1.5:5080"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != router.PACContentType {
+		t.Errorf("content type = %q", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `var proxy = "PROXY 192.168.1.5:5080";`) {
+		t.Errorf("unexpected pac:\n%s", body)
+	}
+
+	// 其他本地路径仍需认证
+	for _, path := range []string{"/stats", "/metrics"} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusProxyAuthRequired {
+			t.Errorf("%s status = %d, want %d", path, w.Code, http.StatusProxyAuthRequired)
+		}
+	}
+}
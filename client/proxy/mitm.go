@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+const (
+	mitmCAValidity   = 10 * 365 * 24 * time.Hour
+	mitmLeafValidity = 30 * 24 * time.Hour
+)
+
+// MITM is the opt-in HTTPS interception of the HTTP proxy, for debugging:
+// CONNECT tunnels to the listed hosts are terminated with certificates
+// issued by a local CA, and every exchange is recorded to a HAR file before
+// the request is re-encrypted upstream through the tunnel.
+type MITM struct {
+	hosts     []string
+	ca        *x509.Certificate
+	caKey     *ecdsa.PrivateKey
+	leafKey   *ecdsa.PrivateKey
+	har       *harWriter
+	logBodies bool
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewMITM returns the interception of hosts (exact names or IPs, or
+// "*.example.com" for subdomains), loading the CA from caCertPath and
+// caKeyPath or generating it there when they do not exist.
+func NewMITM(hosts []string, caCertPath, caKeyPath, harPath string, logBodies bool) (*MITM, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("mitm requires at least one host")
+	}
+	ca, caKey, err := loadOrCreateCA(caCertPath, caKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("mitm ca: %w", err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		normalized = append(normalized, normalizeMITMHost(h))
+	}
+	return &MITM{
+		hosts:     normalized,
+		ca:        ca,
+		caKey:     caKey,
+		leafKey:   leafKey,
+		har:       newHARWriter(harPath),
+		logBodies: logBodies,
+		certs:     make(map[string]*tls.Certificate),
+	}, nil
+}
+
+func normalizeMITMHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// matches reports whether host is one of the intercepted hosts.
+func (m *MITM) matches(host string) bool {
+	host = normalizeMITMHost(host)
+	for _, p := range m.hosts {
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == p {
+			return true
+		}
+	}
+	return false
+}
+
+// loadOrCreateCA loads the CA from certPath and keyPath, generating and
+// saving a new one when neither file exists.
+func loadOrCreateCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return createCA(certPath, keyPath)
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok || !ca.IsCA {
+		return nil, nil, fmt.Errorf("%s is not an ECDSA CA certificate", certPath)
+	}
+	return ca, key, nil
+}
+
+func createCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Easyss MITM CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(mitmCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Warn("[MITM] generated CA, trust it only on the devices being debugged", "cert", certPath)
+	return ca, key, nil
+}
+
+// certificate returns a certificate for host issued by the CA, reusing it
+// until it is about to expire.
+func (m *MITM) certificate(host string) (*tls.Certificate, error) {
+	host = normalizeMITMHost(host)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.certs[host]; ok && time.Until(c.Leaf.NotAfter) > time.Hour {
+		return c, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(mitmLeafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &m.leafKey.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{Certificate: [][]byte{der, m.ca.Raw}, PrivateKey: m.leafKey, Leaf: leaf}
+	m.certs[host] = c
+	return c, nil
+}
+
+// serve terminates the TLS of a CONNECT tunnel to target on conn and
+// forwards its requests with rt, recording each of them.
+func (m *MITM) serve(conn net.Conn, target string, rt http.RoundTripper) {
+	host, _, _ := net.SplitHostPort(target)
+	tlsConn := tls.Server(conn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return m.certificate(hello.ServerName)
+			}
+			return m.certificate(host)
+		},
+	})
+	defer tlsConn.Close() //nolint:errcheck
+	if err := tlsConn.Handshake(); err != nil {
+		log.Warn("[MITM] client handshake, is the CA trusted?", "target", target, "err", err)
+		return
+	}
+
+	br := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !isTransientStreamError(err) {
+				log.Debug("[MITM] read request", "target", target, "err", err)
+			}
+			return
+		}
+		if !m.roundTrip(tlsConn, req, target, rt) {
+			return
+		}
+	}
+}
+
+// roundTrip forwards req and writes the response to w, reporting whether
+// the connection can carry another request.
+func (m *MITM) roundTrip(w io.Writer, req *http.Request, target string, rt http.RoundTripper) bool {
+	req.URL.Scheme = "https"
+	req.URL.Host = req.Host
+	if req.URL.Host == "" {
+		req.URL.Host = target
+	}
+	req.RequestURI = ""
+	entry := harEntry{
+		StartedDateTime: time.Now(),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: harQuery(req.URL),
+			HeadersSize: -1,
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+		},
+	}
+	var reqBody *bodyRecorder
+	if req.Body != nil && req.Body != http.NoBody {
+		reqBody = &bodyRecorder{ReadCloser: req.Body, keep: m.logBodies}
+		req.Body = reqBody
+	}
+
+	resp, err := rt.RoundTrip(req)
+	waited := time.Since(entry.StartedDateTime)
+	if reqBody != nil {
+		entry.Request.BodySize = reqBody.n
+		if m.logBodies {
+			text, enc := harText(reqBody.buf.Bytes())
+			entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text, Encoding: enc}
+		}
+	}
+	if err != nil {
+		log.Warn("[MITM] upstream request", "url", entry.Request.URL, "err", err)
+		entry.Comment = err.Error()
+		entry.Time = millis(waited)
+		entry.Timings = harTimings{Wait: entry.Time}
+		m.record(entry)
+		_, _ = io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return false
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	respBody := &bodyRecorder{ReadCloser: resp.Body, keep: m.logBodies}
+	resp.Body = respBody
+	err = resp.Write(w)
+	total := time.Since(entry.StartedDateTime)
+
+	entry.Time = millis(total)
+	entry.Timings = harTimings{Wait: millis(waited), Receive: millis(total - waited)}
+	entry.Response.Status = resp.StatusCode
+	entry.Response.StatusText = strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" ")
+	entry.Response.HTTPVersion = resp.Proto
+	entry.Response.Cookies = harCookies(resp.Cookies())
+	entry.Response.Headers = harHeaders(resp.Header)
+	entry.Response.RedirectURL = resp.Header.Get("Location")
+	entry.Response.BodySize = respBody.n
+	entry.Response.Content = harContent{Size: respBody.n, MimeType: resp.Header.Get("Content-Type")}
+	if m.logBodies {
+		entry.Response.Content.Text, entry.Response.Content.Encoding = harText(respBody.buf.Bytes())
+	}
+	if err != nil {
+		entry.Comment = err.Error()
+	}
+	m.record(entry)
+	return err == nil && !req.Close && !resp.Close
+}
+
+func (m *MITM) record(e harEntry) {
+	log.Info("[MITM]", "method", e.Request.Method, "url", e.Request.URL, "status", e.Response.Status, "ms", int64(e.Time))
+	if err := m.har.add(e); err != nil {
+		log.Warn("[MITM] write har", "path", m.har.path, "err", err)
+	}
+}
+
+// Close writes the recorded entries still queued and closes the HAR file.
+func (m *MITM) Close() error {
+	return m.har.close()
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMITM(t *testing.T, hosts []string, logBodies bool) (*MITM, string) {
+	t.Helper()
+	dir := t.TempDir()
+	m, err := NewMITM(hosts, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), filepath.Join(dir, "mitm.har"), logBodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, dir
+}
+
+func TestMITMMatches(t *testing.T) {
+	m, _ := newTestMITM(t, []string{"api.example.com", "*.internal.test", "127.0.0.1"}, false)
+	tests := []struct {
+		name string
+		host string
+		want bool
+	}{
+		{name: "精确匹配", host: "api.example.com", want: true},
+		{name: "大小写与结尾点", host: "API.Example.com.", want: true},
+		{name: "精确匹配不含子域名", host: "v2.api.example.com", want: false},
+		{name: "通配符匹配子域名", host: "svc.internal.test", want: true},
+		{name: "通配符不匹配自身", host: "internal.test", want: false},
+		{name: "IP", host: "127.0.0.1", want: true},
+		{name: "未列出的主机", host: "example.com", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.matches(tt.host); got != tt.want {
+				t.Fatalf("matches(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMITM(t *testing.T) {
+	if _, err := NewMITM(nil, "ca.pem", "ca-key.pem", "mitm.har", false); err == nil {
+		t.Fatal("NewMITM without hosts should fail")
+	}
+
+	// 首次生成 CA，再次启动时复用同一个 CA
+	m1, dir := newTestMITM(t, []string{"example.com"}, false)
+	m2, err := NewMITM([]string{"example.com"}, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), filepath.Join(dir, "mitm.har"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m1.ca.Equal(m2.ca) {
+		t.Fatal("CA was regenerated")
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "ca-key.pem")); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("ca key: %v, mode %v", err, fi.Mode())
+	}
+
+	// 只有证书没有私钥时报错而不是覆盖
+	if err := os.Remove(filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMITM([]string{"example.com"}, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), filepath.Join(dir, "mitm.har"), false); err == nil {
+		t.Fatal("NewMITM should fail when the CA key is missing")
+	}
+}
+
+func TestHTTPProxyMITM(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "hello "+string(body))
+	}))
+	defer upstream.Close()
+
+	m, dir := newTestMITM(t, []string{"127.0.0.1"}, true)
+	s := NewHTTPProxyServer("127.0.0.1:5080", "", "", 2*time.Second, nil, newDirectRouter(t), 0, nil)
+	s.SetMITM(m)
+	upstreamRoots := x509.NewCertPool()
+	upstreamRoots.AddCert(upstream.Certificate())
+	s.rp.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: upstreamRoots}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// 客户端只信任本地 CA，能完成握手即说明 TLS 被终结
+	proxyURL, _ := url.Parse(srv.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(m.ca)
+	hc := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}},
+		Timeout:   3 * time.Second,
+	}
+	resp, err := hc.Post(upstream.URL+"/api?x=1", "text/plain", strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close() //nolint:errcheck
+	if string(body) != "hello world" {
+		t.Fatalf("body = %q", body)
+	}
+
+	var har harFile
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, "mitm.har"))
+		if err == nil && json.Unmarshal(data, &har) == nil && len(har.Log.Entries) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no har entry recorded: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	e := har.Log.Entries[0]
+	if e.Request.Method != http.MethodPost || e.Request.URL != upstream.URL+"/api?x=1" {
+		t.Errorf("request = %s %s", e.Request.Method, e.Request.URL)
+	}
+	if e.Request.PostData == nil || e.Request.PostData.Text != "world" {
+		t.Errorf("post data = %+v", e.Request.PostData)
+	}
+	if e.Response.Status != http.StatusOK || e.Response.Content.Text != "hello world" {
+		t.Errorf("response = %d %q", e.Response.Status, e.Response.Content.Text)
+	}
+}
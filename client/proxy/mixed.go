@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/util"
+	"github.com/txthinking/socks5"
+
+	easydns "github.com/nange/easyss/v3/client/dns"
+)
+
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+	socks4Granted    = 0x5a
+	socks4Rejected   = 0x5b
+)
+
+// MixedServer serves SOCKS4/4a, SOCKS5 and HTTP proxy clients on a single
+// port. Each connection is dispatched on its first byte, and every protocol
+// reaches the StreamHandler in-process, without a hop through the local
+// SOCKS5 server. SOCKS5 UDP ASSOCIATE is served on the same port over UDP.
+type MixedServer struct {
+	addr        string
+	dialTimeout time.Duration
+
+	socks *Socks5Server
+	http  *HTTPProxyServer
+
+	mu      sync.Mutex
+	ln      net.Listener
+	pc      *net.UDPConn
+	httpSrv *http.Server
+	closed  bool
+}
+
+// NewMixedServer creates the mixed listener. timeout is the HTTP proxy
+// timeout; direct dials time out after half of it, as on the socks5 inbound.
+func NewMixedServer(listenAddr, username, password string, handler *StreamHandler, rt *router.Router, serverDomain string, method protocol.Method, disableQUIC bool, timeout, udpIdleTimeout time.Duration, directDialContext func(context.Context, string, string) (net.Conn, error)) (*MixedServer, error) {
+	if timeout <= 0 {
+		timeout = 20 * time.Second
+	}
+	socks, err := NewSocks5Server(listenAddr, username, password, handler, rt, serverDomain, method, disableQUIC, timeout/2, udpIdleTimeout, directDialContext)
+	if err != nil {
+		return nil, err
+	}
+	return &MixedServer{
+		addr:        listenAddr,
+		dialTimeout: socks.dialTimeout,
+		socks:       socks,
+		http:        NewHTTPProxyServer(listenAddr, username, password, timeout, handler, rt, method, socks.directDialContext),
+	}, nil
+}
+
+// DNSCache returns the dns cache used by DNS queries relayed over SOCKS5 UDP,
+// so the caller can configure it like the socks5 inbound's cache.
+func (s *MixedServer) DNSCache() *easydns.Cache {
+	return s.socks.DNSCache()
+}
+
+// SetDNSHosts installs static DNS records, see Socks5Server.SetDNSHosts.
+func (s *MixedServer) SetDNSHosts(h *easydns.Hosts) {
+	s.socks.SetDNSHosts(h)
+}
+
+// SetUsers replaces the auth_username/auth_password credential with a set
+// of users on every protocol. It must be called before Start.
+func (s *MixedServer) SetUsers(us *Users) {
+	s.socks.SetUsers(us)
+	s.http.SetUsers(us)
+}
+
+func (s *MixedServer) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("mixed listen: %w", err)
+	}
+	uaddr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		ln.Close() //nolint:errcheck
+		return fmt.Errorf("mixed resolve udp: %w", err)
+	}
+	pc, err := net.ListenUDP("udp", uaddr)
+	if err != nil {
+		ln.Close() //nolint:errcheck
+		return fmt.Errorf("mixed listen udp: %w", err)
+	}
+
+	httpLn := newConnListener(ln.Addr())
+	httpSrv := &http.Server{Handler: s.http}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close() //nolint:errcheck
+		pc.Close() //nolint:errcheck
+		return net.ErrClosed
+	}
+	s.ln, s.pc, s.httpSrv = ln, pc, httpSrv
+	s.socks.srv.UDPConn = pc
+	s.mu.Unlock()
+
+	go s.socks.cleanupLoop()
+	go s.socks.serveUDP(pc)
+	go func() {
+		if err := httpSrv.Serve(httpLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("[MIXED] http server", "err", err)
+		}
+	}()
+
+	log.Info("[MIXED] listening", "addr", s.addr)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c, httpLn)
+	}
+}
+
+func (s *MixedServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	ln, pc, httpSrv := s.ln, s.pc, s.httpSrv
+	s.mu.Unlock()
+
+	if ln != nil {
+		ln.Close() //nolint:errcheck
+	}
+	if pc != nil {
+		pc.Close() //nolint:errcheck
+	}
+	if httpSrv != nil {
+		httpSrv.Close() //nolint:errcheck
+	}
+	return s.socks.Close()
+}
+
+// serveConn sniffs the protocol from the first byte: SOCKS requests start
+// with their version, anything else is handed to the HTTP server.
+func (s *MixedServer) serveConn(c net.Conn, httpLn *connListener) {
+	br := bufio.NewReader(c)
+	_ = c.SetReadDeadline(time.Now().Add(s.dialTimeout))
+	head, err := br.Peek(1)
+	_ = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Close() //nolint:errcheck
+		return
+	}
+
+	pc := &peekedConn{Conn: c, r: br}
+	switch head[0] {
+	case socks4Version:
+		defer c.Close() //nolint:errcheck
+		s.serveSocks4(pc)
+	case socks5.Ver:
+		s.socks.serveConn(pc)
+	default:
+		httpLn.push(pc)
+	}
+}
+
+func (s *MixedServer) serveSocks4(c *peekedConn) {
+	cmd, target, err := readSocks4Request(c.r)
+	if err != nil {
+		log.Debug("[MIXED] socks4 request", "client", c.RemoteAddr().String(), "err", err)
+		return
+	}
+	// SOCKS4 only carries a user id, so it can never satisfy a password.
+	if s.socks.users.Enabled() {
+		log.Warn("[MIXED] socks4 rejected, authentication is required", "client", c.RemoteAddr().String())
+		_ = writeSocks4Reply(c, socks4Rejected)
+		return
+	}
+	if cmd != socks4CmdConnect {
+		_ = writeSocks4Reply(c, socks4Rejected)
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(target)
+	rt := s.socks.router
+	if rt.ShouldIPV6Disable() && util.IsIPV6(host) {
+		log.Warn("[MIXED] ipv6 target rejected, ipv6 disabled", "target", target)
+		_ = writeSocks4Reply(c, socks4Rejected)
+		return
+	}
+
+	local := c.RemoteAddr().String()
+	switch rt.MatchHostRule(host) {
+	case router.HostRuleBlock:
+		log.Info("[TCP_BLOCK] blocked", "host", host, "target", target, "local", local)
+		_ = writeSocks4Reply(c, socks4Rejected)
+	case router.HostRuleDirect:
+		log.Info("[TCP_DIRECT]", "target", target, "local", local)
+		ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
+		rc, err := s.socks.directDialContext(ctx, "tcp", target)
+		cancel()
+		if err != nil {
+			log.Error("[TCP_DIRECT] connect", "target", target, "err", err)
+			_ = writeSocks4Reply(c, socks4Rejected)
+			return
+		}
+		defer rc.Close() //nolint:errcheck
+		if err := writeSocks4Reply(c, socks4Granted); err != nil {
+			return
+		}
+		relayTCP(rc, c)
+		log.Debug("[TCP_DIRECT] relay finished", "target", target)
+	case router.HostRuleProxy:
+		log.Info("[TCP_PROXY]", "target", target, "local", local)
+		if err := writeSocks4Reply(c, socks4Granted); err != nil {
+			return
+		}
+		err := s.socks.handler.OpenTCPStream(context.Background(), target, s.socks.method, c)
+		switch {
+		case err == nil:
+			log.Debug("[TCP_PROXY] stream finished", "target", target)
+		case isTransientStreamError(err):
+			log.Debug("[TCP_PROXY] closed", "target", target, "err", err)
+		default:
+			log.Error("[TCP_PROXY] stream", "target", target, "err", err)
+		}
+	}
+}
+
+// readSocks4Request parses a SOCKS4 request:
+// VN(1) CD(1) DSTPORT(2) DSTIP(4) USERID NUL, followed by HOST NUL for
+// SOCKS4a, which is signalled by a DSTIP of 0.0.0.x with x != 0.
+func readSocks4Request(r *bufio.Reader) (cmd byte, target string, err error) {
+	var hdr [8]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, "", err
+	}
+	if hdr[0] != socks4Version {
+		return 0, "", fmt.Errorf("socks4: unexpected version %d", hdr[0])
+	}
+	port := binary.BigEndian.Uint16(hdr[2:4])
+	ip := net.IP(hdr[4:8])
+	if _, err = readNulString(r); err != nil {
+		return 0, "", fmt.Errorf("socks4: read user id: %w", err)
+	}
+
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readNulString(r); err != nil {
+			return 0, "", fmt.Errorf("socks4a: read host: %w", err)
+		}
+		if host == "" {
+			return 0, "", errors.New("socks4a: empty host")
+		}
+	}
+	return hdr[1], net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// readNulString reads a NUL terminated string. Strings longer than the
+// reader's buffer are rejected with bufio.ErrBufferFull.
+func readNulString(r *bufio.Reader) (string, error) {
+	b, err := r.ReadSlice(0)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:len(b)-1]), nil
+}
+
+func writeSocks4Reply(c net.Conn, rep byte) error {
+	_, err := c.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// peekedConn replays the bytes buffered while sniffing the protocol before
+// reading from the underlying connection.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// connListener feeds connections accepted and sniffed by the mixed server to
+// an http.Server.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close() //nolint:errcheck
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
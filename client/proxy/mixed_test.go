@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+func TestReadSocks4Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     []byte
+		cmd     byte
+		target  string
+		wantErr bool
+	}{
+		{
+			name:   "SOCKS4 IPv4 地址",
+			req:    []byte{4, 1, 0x1f, 0x90, 192, 0, 2, 1, 'u', 0},
+			cmd:    socks4CmdConnect,
+			target: "192.0.2.1:8080",
+		},
+		{
+			name:   "SOCKS4a 域名",
+			req:    append([]byte{4, 1, 0x01, 0xbb, 0, 0, 0, 1, 0}, []byte("example.com\x00")...),
+			cmd:    socks4CmdConnect,
+			target: "example.com:443",
+		},
+		{
+			name:    "SOCKS4a 空域名",
+			req:     []byte{4, 1, 0, 80, 0, 0, 0, 1, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "版本错误",
+			req:     []byte{5, 1, 0, 80, 1, 2, 3, 4, 0},
+			wantErr: true,
+		},
+		{
+			name:    "缺少结尾 NUL",
+			req:     []byte{4, 1, 0, 80, 1, 2, 3, 4, 'u'},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, target, err := readSocks4Request(bufio.NewReader(bytes.NewReader(tt.req)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cmd != tt.cmd || target != tt.target {
+				t.Errorf("got cmd=%d target=%q, want cmd=%d target=%q", cmd, target, tt.cmd, tt.target)
+			}
+		})
+	}
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close() //nolint:errcheck
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+func startMixedServer(t *testing.T, username, password string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() //nolint:errcheck
+
+	s, err := NewMixedServer(addr, username, password, nil, newDirectRouter(t), "", 0, false, 2*time.Second, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Start() }()
+	t.Cleanup(func() { _ = s.Close() })
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close() //nolint:errcheck
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("mixed server did not start")
+	return ""
+}
+
+func assertEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("echo = %q", buf)
+	}
+}
+
+func TestMixedServerDispatch(t *testing.T) {
+	echo := startEchoServer(t)
+	echoAddr := echo.Addr().(*net.TCPAddr)
+	addr := startMixedServer(t, "", "")
+
+	t.Run("SOCKS4", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() //nolint:errcheck
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		req := []byte{4, 1, byte(echoAddr.Port >> 8), byte(echoAddr.Port)}
+		req = append(req, echoAddr.IP.To4()...)
+		req = append(req, 0)
+		if _, err := c.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(c, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[1] != socks4Granted {
+			t.Fatalf("reply = %#x, want granted", reply[1])
+		}
+		assertEcho(t, c)
+	})
+
+	t.Run("SOCKS4a", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() //nolint:errcheck
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		req := []byte{4, 1, byte(echoAddr.Port >> 8), byte(echoAddr.Port), 0, 0, 0, 1, 0}
+		req = append(req, []byte("127.0.0.1\x00")...)
+		if _, err := c.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(c, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[1] != socks4Granted {
+			t.Fatalf("reply = %#x, want granted", reply[1])
+		}
+		assertEcho(t, c)
+	})
+
+	t.Run("SOCKS5", func(t *testing.T) {
+		client, err := socks5.NewClient(addr, "", "", 3, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() //nolint:errcheck
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		assertEcho(t, c)
+	})
+
+	t.Run("HTTP CONNECT", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() //nolint:errcheck
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		target := echo.Addr().String()
+		if _, err := c.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d", resp.StatusCode)
+		}
+		assertEcho(t, c)
+	})
+
+	t.Run("HTTP 转发", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "hello "+r.URL.Path)
+		}))
+		defer upstream.Close()
+
+		proxyURL, _ := url.Parse("http://" + addr)
+		hc := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+			Timeout:   3 * time.Second,
+		}
+		resp, err := hc.Get(upstream.URL + "/mixed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() //nolint:errcheck
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "hello /mixed" {
+			t.Fatalf("body = %q", body)
+		}
+	})
+}
+
+func TestMixedServerSocks4RequiresNoAuth(t *testing.T) {
+	echo := startEchoServer(t)
+	echoAddr := echo.Addr().(*net.TCPAddr)
+	addr := startMixedServer(t, "user", "pass")
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close() //nolint:errcheck
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	req := []byte{4, 1, byte(echoAddr.Port >> 8), byte(echoAddr.Port)}
+	req = append(req, echoAddr.IP.To4()...)
+	req = append(req, []byte("user\x00")...)
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks4Rejected {
+		t.Fatalf("reply = %#x, want rejected", reply[1])
+	}
+
+	// HTTP 仍需认证
+	hc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hc.Close() //nolint:errcheck
+	_ = hc.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := hc.Write([]byte("GET http://" + echo.Addr().String() + "/ HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(hc), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired || !strings.Contains(resp.Header.Get("Proxy-Authenticate"), "Basic") {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+}
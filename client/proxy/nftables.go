@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// TProxyMark is the firewall mark set on TPROXY'ed packets, routed to
+	// the local host by the TProxyRouteTable policy routing table.
+	TProxyMark       = 0x1
+	TProxyRouteTable = 100
+)
+
+// bypass4 and bypass6 are destinations never sent to the transparent
+// inbound: local, private, link-local and multicast ranges.
+var (
+	bypass4 = []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4"}
+	bypass6 = []string{"::1/128", "fc00::/7", "fe80::/10", "ff00::/8"}
+)
+
+// NFTablesRules returns an nftables ruleset (for "nft -f") diverting the
+// traffic forwarded by this gateway to the transparent inbound on port.
+// Only the prerouting hook is used, so the gateway's own traffic, including
+// the tunnel to the easyss server, is never captured. The tproxy ruleset is
+// preceded by the policy routing commands it needs, as comments.
+func NFTablesRules(mode TransparentMode, port int) string {
+	var b strings.Builder
+	if mode == TransparentTProxy {
+		fmt.Fprintf(&b, "# TPROXY needs marked packets routed to the local host, run once:\n")
+		fmt.Fprintf(&b, "#   ip rule add fwmark %#x lookup %d\n", TProxyMark, TProxyRouteTable)
+		fmt.Fprintf(&b, "#   ip route add local 0.0.0.0/0 dev lo table %d\n", TProxyRouteTable)
+		fmt.Fprintf(&b, "#   ip -6 rule add fwmark %#x lookup %d\n", TProxyMark, TProxyRouteTable)
+		fmt.Fprintf(&b, "#   ip -6 route add local ::/0 dev lo table %d\n", TProxyRouteTable)
+	}
+	b.WriteString("table inet easyss {\n")
+	fmt.Fprintf(&b, "\tset bypass4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\telements = { %s }\n\t}\n", strings.Join(bypass4, ", "))
+	fmt.Fprintf(&b, "\tset bypass6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t\telements = { %s }\n\t}\n", strings.Join(bypass6, ", "))
+	b.WriteString("\tchain prerouting {\n")
+	if mode == TransparentTProxy {
+		b.WriteString("\t\ttype filter hook prerouting priority mangle; policy accept;\n")
+	} else {
+		b.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+	}
+	b.WriteString("\t\tfib daddr type local return\n")
+	b.WriteString("\t\tip daddr @bypass4 return\n")
+	b.WriteString("\t\tip6 daddr @bypass6 return\n")
+	if mode == TransparentTProxy {
+		fmt.Fprintf(&b, "\t\tmeta l4proto { tcp, udp } meta mark set %#x tproxy ip to :%d accept\n", TProxyMark, port)
+		fmt.Fprintf(&b, "\t\tmeta l4proto { tcp, udp } meta mark set %#x tproxy ip6 to :%d accept\n", TProxyMark, port)
+	} else {
+		fmt.Fprintf(&b, "\t\tmeta l4proto tcp redirect to :%d\n", port)
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+)
+
+const (
+	// reverseKeepalive is how often an idle control stream sends padding,
+	// so that intermediaries do not drop it.
+	reverseKeepalive = 30 * time.Second
+
+	reverseMinBackoff = time.Second
+	reverseMaxBackoff = 30 * time.Second
+)
+
+// ReverseTunnel exposes a local target on a port of the server, like
+// ssh -R. A control stream registers the port; for every connection the
+// server accepts on it, the tunnel dials the target and carries the
+// connection on a stream of its own. The control stream is re-established
+// with exponential backoff whenever it breaks.
+type ReverseTunnel struct {
+	remotePort  int
+	target      string
+	handler     *StreamHandler
+	method      protocol.Method
+	dialTimeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewReverseTunnel returns a tunnel exposing target on remotePort.
+func NewReverseTunnel(remotePort int, target string, handler *StreamHandler, method protocol.Method, dialTimeout time.Duration) (*ReverseTunnel, error) {
+	if remotePort <= 0 || remotePort > 65535 {
+		return nil, fmt.Errorf("invalid reverse remote port %d", remotePort)
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("reverse target %q: %w", target, err)
+	}
+	if dialTimeout <= 0 {
+		dialTimeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ReverseTunnel{
+		remotePort:  remotePort,
+		target:      target,
+		handler:     handler,
+		method:      method,
+		dialTimeout: dialTimeout,
+		ctx:         ctx,
+		cancel:      cancel,
+	}, nil
+}
+
+// Start keeps the port registered until Close.
+func (t *ReverseTunnel) Start() error {
+	backoff := reverseMinBackoff
+	for {
+		registered, err := t.serve()
+		if t.ctx.Err() != nil {
+			return net.ErrClosed
+		}
+		if registered {
+			backoff = reverseMinBackoff
+		}
+		log.Warn("[REVERSE] control stream ended, reconnecting", "remote_port", t.remotePort, "err", err, "retry_in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-t.ctx.Done():
+			return net.ErrClosed
+		}
+		backoff = min(2*backoff, reverseMaxBackoff)
+	}
+}
+
+func (t *ReverseTunnel) Close() error {
+	t.cancel()
+	return nil
+}
+
+// serve registers the port on a control stream and serves the connection
+// IDs announced on it until the stream breaks. registered reports whether
+// the server accepted the registration.
+func (t *ReverseTunnel) serve() (registered bool, err error) {
+	endpoint := config.EndpointReverse
+	bs, err := t.handler.openAndBootstrap(t.ctx, endpoint, protocol.ProtoReverse, net.JoinHostPort("", strconv.Itoa(t.remotePort)), t.method, nil)
+	if err != nil {
+		return false, err
+	}
+	stream := bs.Stream
+	defer stream.Close() //nolint:errcheck
+	stop := context.AfterFunc(t.ctx, func() { _ = stream.Close() })
+	defer stop()
+
+	dr, err := bs.Reader(t.method)
+	if err != nil {
+		return false, err
+	}
+	w, err := bs.Writer(t.method)
+	if err != nil {
+		return false, err
+	}
+	txShaper := shaper.New(w, t.handler.shaperCfg)
+	defer txShaper.Close() //nolint:errcheck
+
+	bound, err := readReply(dr, true, "reverse")
+	if err != nil {
+		return false, err
+	}
+	log.Info("[REVERSE] registered", "remote_port", t.remotePort, "bound", bound, "target", t.target)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(reverseKeepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := txShaper.PushFrame(protocol.NewFramePADDING(16))
+				if err == nil {
+					err = txShaper.Flush()
+				}
+				if err != nil {
+					_ = stream.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		id, err := readReply(dr, false, "reverse")
+		if err != nil {
+			return true, err
+		}
+		go t.serveConn(id)
+	}
+}
+
+// serveConn dials the target and claims the server connection id with it.
+func (t *ReverseTunnel) serveConn(id string) {
+	c, err := net.DialTimeout("tcp", t.target, t.dialTimeout)
+	if err != nil {
+		// The server closes the unclaimed connection on its own.
+		log.Warn("[REVERSE] dial target", "target", t.target, "err", err)
+		return
+	}
+	defer c.Close() //nolint:errcheck
+	log.Info("[REVERSE] connection", "remote_port", t.remotePort, "target", t.target)
+	err = t.handler.openStream(t.ctx, config.EndpointReverse, protocol.ProtoReverseConn, id, t.method, c)
+	switch {
+	case err == nil:
+		log.Debug("[REVERSE] stream finished", "target", t.target)
+	case isTransientStreamError(err):
+		log.Debug("[REVERSE] closed", "target", t.target, "err", err)
+	default:
+		log.Error("[REVERSE] stream", "target", t.target, "err", err)
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/protocol"
+)
+
+func TestNewReverseTunnel(t *testing.T) {
+	tests := []struct {
+		name       string
+		remotePort int
+		target     string
+		wantErr    bool
+	}{
+		{name: "正常", remotePort: 8022, target: "127.0.0.1:22"},
+		{name: "端口为0", remotePort: 0, target: "127.0.0.1:22", wantErr: true},
+		{name: "端口越界", remotePort: 70000, target: "127.0.0.1:22", wantErr: true},
+		{name: "目标缺少端口", remotePort: 8022, target: "127.0.0.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReverseTunnel(tt.remotePort, tt.target, nil, protocol.MethodAES256GCM, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReverseTunnelRegisters(t *testing.T) {
+	tr := &endpointTransport{}
+	rt, err := NewReverseTunnel(8022, "127.0.0.1:22", newTestStreamHandler(tr), protocol.MethodAES256GCM, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- rt.Start() }()
+
+	if ep := tr.waitEndpoint(t); ep != "/v3/reverse" {
+		t.Fatalf("endpoint = %q", ep)
+	}
+	_ = rt.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Start = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Close")
+	}
+}
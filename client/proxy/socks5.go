@@ -1,12 +1,14 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/nange/easyss/v3/client/router"
@@ -19,11 +21,13 @@ import (
 )
 
 type Socks5Server struct {
-	srv *socks5.Server
+	srv   *socks5.Server
+	users *Users
 
 	handler           *StreamHandler
 	router            *router.Router
 	dnsCache          *easydns.Cache
+	dnsHosts          *easydns.Hosts
 	serverDomain      string
 	method            protocol.Method
 	disableQUIC       bool
@@ -37,7 +41,16 @@ type Socks5Server struct {
 	quit           chan struct{}
 	closeOnce      sync.Once
 	udpIdleTimeout time.Duration
-	started        atomic.Bool
+
+	// assocs are the live UDP associations, by which datagrams, which
+	// carry no credential, are attributed to a user.
+	assocMu sync.Mutex
+	assocs  map[*udpAssociation]struct{}
+
+	mu     sync.Mutex
+	ln     net.Listener
+	pc     *net.UDPConn
+	closed bool
 }
 
 func NewSocks5Server(listenAddr, username, password string, handler *StreamHandler, rt *router.Router, serverDomain string, method protocol.Method, disableQUIC bool, dialTimeout, udpIdleTimeout time.Duration, directDialContext func(context.Context, string, string) (net.Conn, error)) (*Socks5Server, error) {
@@ -54,6 +67,7 @@ func NewSocks5Server(listenAddr, username, password string, handler *StreamHandl
 		serverDomain = ""
 	}
 	s := &Socks5Server{
+		users:             singleUser(username, password),
 		handler:           handler,
 		router:            rt,
 		dnsCache:          easydns.NewCache(serverDomain),
@@ -67,11 +81,14 @@ func NewSocks5Server(listenAddr, username, password string, handler *StreamHandl
 		directUDP:         make(map[string]net.Conn),
 		quit:              make(chan struct{}),
 		udpIdleTimeout:    udpIdleTimeout,
+		assocs:            make(map[*udpAssociation]struct{}),
 	}
-	srv, err := socks5.NewClassicServer(listenAddr, "127.0.0.1", username, password, 0, 0)
+	// Credentials are checked by negotiate, which knows the user set.
+	srv, err := socks5.NewClassicServer(listenAddr, "127.0.0.1", "", "", 0, 0)
 	if err != nil {
 		return nil, err
 	}
+	srv.SupportedCommands = append(srv.SupportedCommands, socks5.CmdBind)
 	s.srv = srv
 	return s, nil
 }
@@ -91,6 +108,24 @@ func (s *Socks5Server) PrePopulateDNS(domain string, dnsServers []string, requir
 	return s.dnsCache.PrePopulateWithFallback(domain, dnsServers, requireIPv4)
 }
 
+// DNSCache returns the dns cache shared by the socks5 DNS handling, so the
+// caller can enable serve-stale, prefetch or persistence before Start.
+func (s *Socks5Server) DNSCache() *easydns.Cache {
+	return s.dnsCache
+}
+
+// SetDNSHosts installs static DNS records that are answered locally before
+// the block rules, the cache and any upstream. It must be called before Start.
+func (s *Socks5Server) SetDNSHosts(h *easydns.Hosts) {
+	s.dnsHosts = h
+}
+
+// SetUsers replaces the auth_username/auth_password credential with a set
+// of users. It must be called before Start.
+func (s *Socks5Server) SetUsers(us *Users) {
+	s.users = us
+}
+
 // isServerDomain reports whether the given domain is the proxy server's own
 // hostname. DNS queries for it must never take the proxied path: resolving
 // the server domain would require opening a tunnel stream, which in turn
@@ -100,79 +135,62 @@ func (s *Socks5Server) isServerDomain(domain string) bool {
 	return s.serverDomain != "" && strings.EqualFold(domain, s.serverDomain)
 }
 
-// MarkStarted records that Start is about to be called. It must be called
-// synchronously before launching Start in a goroutine: the flag set inside
-// Start itself would race with a Close on a single-core scheduler, letting
-// the server goroutine leak its listener.
-func (s *Socks5Server) MarkStarted() {
-	s.started.Store(true)
-}
-
 func (s *Socks5Server) Start() error {
-	s.started.Store(true)
-	go s.cleanupLoop()
-	return s.srv.ListenAndServe(s)
-}
-
-// waitForAccept polls the listen address until the server has really
-// started accepting connections. A plain TCP dial is not enough: it
-// succeeds as soon as the listener is bound at the kernel level, before
-// the accept loop inside the txthinking/socks5 runnergroup library has
-// registered its runners. Calling Shutdown in that window either leaks
-// the listener (runnergroup.Done returns early when no runner has been
-// added yet) or deadlocks (Done skips runners whose start goroutine has
-// not run yet, then blocks forever waiting for a done signal that never
-// comes). Probing with a real SOCKS5 greeting and requiring a reply
-// only succeeds once the accept loop is up, so Close can never race
-// with the goroutine spawned by Start.
-func (s *Socks5Server) waitForAccept() {
-	if s.srv == nil {
-		return
-	}
-	addr := s.srv.Addr
-	if addr == "" {
-		return
-	}
-	// SOCKS5 greeting: version 5, one offered method, no auth. The
-	// server only answers after the accept loop accepted our connection
-	// and parsed the greeting.
-	greeting := []byte{0x05, 0x01, 0x00}
-	deadline := time.Now().Add(2 * time.Second)
-	for time.Now().Before(deadline) {
-		if probeSocks5Accept(addr, greeting) {
-			return
-		}
-		time.Sleep(20 * time.Millisecond)
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return fmt.Errorf("socks5 listen: %w", err)
 	}
-}
-
-// probeSocks5Accept dials addr and performs a SOCKS5 negotiation. It
-// reports whether the server accepted the connection and replied to the
-// greeting, which proves the accept loop is up and registered.
-func probeSocks5Accept(addr string, greeting []byte) bool {
-	c, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+	uaddr, err := net.ResolveUDPAddr("udp", s.srv.Addr)
 	if err != nil {
-		return false
+		ln.Close() //nolint:errcheck
+		return fmt.Errorf("socks5 resolve udp: %w", err)
 	}
-	defer c.Close() //nolint:errcheck
-	if err := c.SetDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
-		return false
+	pc, err := net.ListenUDP("udp", uaddr)
+	if err != nil {
+		ln.Close() //nolint:errcheck
+		return fmt.Errorf("socks5 listen udp: %w", err)
 	}
-	if _, err := c.Write(greeting); err != nil {
-		return false
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close() //nolint:errcheck
+		pc.Close() //nolint:errcheck
+		return net.ErrClosed
 	}
-	reply := make([]byte, 2)
-	if _, err := io.ReadFull(c, reply); err != nil {
-		return false
+	s.ln, s.pc = ln, pc
+	s.srv.UDPConn = pc
+	s.mu.Unlock()
+
+	go s.cleanupLoop()
+	go s.serveUDP(pc)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c)
 	}
-	return reply[0] == 0x05
 }
 
 func (s *Socks5Server) Close() error {
-	s.closeOnce.Do(func() { close(s.quit) })
-	if s.started.Load() {
-		s.waitForAccept()
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		if err := s.dnsCache.Close(); err != nil {
+			log.Warn("[SOCKS5] save dns cache", "err", err)
+		}
+	})
+	s.mu.Lock()
+	s.closed = true
+	ln, pc := s.ln, s.pc
+	s.mu.Unlock()
+	if ln != nil {
+		ln.Close() //nolint:errcheck
 	}
+	if pc != nil {
+		pc.Close() //nolint:errcheck
+	}
+
 	s.udpMu.Lock()
 	defer s.udpMu.Unlock()
 	for key, ue := range s.udpExch {
@@ -183,13 +201,73 @@ func (s *Socks5Server) Close() error {
 		conn.Close() //nolint:errcheck
 		delete(s.directUDP, key)
 	}
-	if s.srv != nil {
-		return s.srv.Shutdown()
-	}
 	return nil
 }
 
-func (s *Socks5Server) TCPHandle(srv *socks5.Server, c *net.TCPConn, r *socks5.Request) error {
+// serveConn serves a SOCKS5 client connection. It takes a plain net.Conn
+// so the mixed listener can hand over sniffed connections.
+func (s *Socks5Server) serveConn(c net.Conn) {
+	defer c.Close() //nolint:errcheck
+
+	_ = c.SetReadDeadline(time.Now().Add(s.dialTimeout))
+	user, err := s.negotiate(c)
+	if err != nil {
+		log.Debug("[SOCKS5] negotiate", "client", c.RemoteAddr().String(), "err", err)
+		return
+	}
+	r, err := s.srv.GetRequest(c)
+	if err != nil {
+		log.Debug("[SOCKS5] request", "client", c.RemoteAddr().String(), "err", err)
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+
+	if err := s.handleRequest(c, r, user); err != nil {
+		log.Debug("[SOCKS5] handle request", "target", r.Address(), "err", err)
+	}
+}
+
+// negotiate runs the method negotiation and, when users are configured,
+// the username/password authentication of RFC 1929. It returns the
+// authenticated user, nil for an anonymous client.
+func (s *Socks5Server) negotiate(c net.Conn) (*User, error) {
+	rq, err := socks5.NewNegotiationRequestFrom(c)
+	if err != nil {
+		return nil, err
+	}
+	method := socks5.MethodNone
+	if s.users.Enabled() {
+		method = socks5.MethodUsernamePassword
+	}
+	if !bytes.Contains(rq.Methods, []byte{method}) {
+		_, _ = socks5.NewNegotiationReply(socks5.MethodUnsupportAll).WriteTo(c)
+		return nil, fmt.Errorf("no acceptable method in %v", rq.Methods)
+	}
+	if _, err := socks5.NewNegotiationReply(method).WriteTo(c); err != nil {
+		return nil, err
+	}
+	if method == socks5.MethodNone {
+		return nil, nil
+	}
+
+	urq, err := socks5.NewUserPassNegotiationRequestFrom(c)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := s.users.Authenticate(string(urq.Uname), string(urq.Passwd))
+	if !ok {
+		_, _ = socks5.NewUserPassNegotiationReply(socks5.UserPassStatusFailure).WriteTo(c)
+		return nil, fmt.Errorf("user %q: %w", urq.Uname, socks5.ErrUserPassAuth)
+	}
+	if _, err := socks5.NewUserPassNegotiationReply(socks5.UserPassStatusSuccess).WriteTo(c); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// handleRequest serves a negotiated SOCKS5 request of user.
+func (s *Socks5Server) handleRequest(c net.Conn, r *socks5.Request, user *User) error {
+	srv := s.srv
 	if r.Cmd == socks5.CmdUDP {
 		caddr, err := r.UDP(c, srv.ServerAddr)
 		if err != nil {
@@ -197,15 +275,24 @@ func (s *Socks5Server) TCPHandle(srv *socks5.Server, c *net.TCPConn, r *socks5.R
 			return err
 		}
 		log.Debug("[SOCKS5] udp associate", "client", c.RemoteAddr().String(), "udp", caddr.String())
-		ch := make(chan byte)
-		srv.AssociatedUDP.Set(caddr.String(), ch, -1)
-		defer srv.AssociatedUDP.Delete(caddr.String())
+		if user != nil {
+			user.counters.RecordConnection()
+		}
+		assoc := newUDPAssociation(c.RemoteAddr(), r.Address(), user)
+		s.assocMu.Lock()
+		s.assocs[assoc] = struct{}{}
+		s.assocMu.Unlock()
+		defer func() {
+			s.assocMu.Lock()
+			delete(s.assocs, assoc)
+			s.assocMu.Unlock()
+		}()
 		io.Copy(io.Discard, c) //nolint:errcheck
 		log.Debug("[SOCKS5] udp associate tcp closed", "udp", caddr.String())
 		return nil
 	}
 
-	if r.Cmd != socks5.CmdConnect {
+	if r.Cmd != socks5.CmdConnect && r.Cmd != socks5.CmdBind {
 		return s.replyError(c, r, socks5.RepCommandNotSupported)
 	}
 
@@ -222,7 +309,11 @@ func (s *Socks5Server) TCPHandle(srv *socks5.Server, c *net.TCPConn, r *socks5.R
 	}
 
 	local := c.RemoteAddr().String()
-	rule := s.router.MatchHostRule(host)
+	c = user.wrapConn(c)
+	rule := user.matchHostRule(s.router, host)
+	if r.Cmd == socks5.CmdBind {
+		return s.handleBind(c, r, rule, user)
+	}
 	switch rule {
 	case router.HostRuleBlock:
 		log.Info("[TCP_BLOCK] blocked", "host", host, "target", target, "local", local)
@@ -253,7 +344,8 @@ func (s *Socks5Server) TCPHandle(srv *socks5.Server, c *net.TCPConn, r *socks5.R
 			log.Error("[TCP_PROXY] reply", "err", err)
 			return err
 		}
-		err = s.handler.OpenTCPStream(context.Background(), target, s.method, c)
+		handler, method := user.streamHandler(s.handler, s.method)
+		err = handler.OpenTCPStream(context.Background(), target, method, c)
 		if err != nil {
 			if isTransientStreamError(err) {
 				log.Debug("[TCP_PROXY] closed", "target", target, "err", err)
@@ -297,8 +389,81 @@ func (s *Socks5Server) directTCPConnect(c net.Conn, r *socks5.Request, target st
 	return rc, nil
 }
 
-func (s *Socks5Server) UDPHandle(srv *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram) error {
-	return s.handleUDP(srv, addr, d)
+func (s *Socks5Server) serveUDP(pc *net.UDPConn) {
+	for {
+		b := make([]byte, 65507)
+		n, addr, err := pc.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		go func(addr *net.UDPAddr, b []byte) {
+			d, err := socks5.NewDatagramFromBytes(b)
+			if err != nil || d.Frag != 0x00 {
+				return
+			}
+			user, ok := s.udpUser(addr)
+			if !ok {
+				log.Debug("[SOCKS5] udp from a client without association dropped", "client", addr.String())
+				return
+			}
+			if err := user.meterUp(len(d.Data)); err != nil {
+				return
+			}
+			if err := s.handleUDP(s.srv, addr, d, user); err != nil {
+				log.Debug("[SOCKS5] udp", "client", addr.String(), "err", err)
+			}
+		}(addr, b[:n])
+	}
+}
+
+// udpAssociation is a UDP ASSOCIATE of user. Datagrams from ip, and port
+// unless it is 0, belong to it.
+type udpAssociation struct {
+	ip   net.IP
+	port int
+	user *User
+}
+
+// newUDPAssociation returns the association requested on the control
+// connection from peer for the client address declared in the request,
+// whose unspecified parts default to the peer IP and any port.
+func newUDPAssociation(peer net.Addr, declared string, user *User) *udpAssociation {
+	a := &udpAssociation{user: user}
+	if tcp, ok := peer.(*net.TCPAddr); ok {
+		a.ip = tcp.IP
+	}
+	if host, port, err := net.SplitHostPort(declared); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			a.ip = ip
+		}
+		a.port, _ = strconv.Atoi(port)
+	}
+	return a
+}
+
+// udpUser returns the user of the association a datagram from src belongs
+// to, preferring one declaring the port of src. Without users every
+// datagram is accepted as the anonymous nil user.
+func (s *Socks5Server) udpUser(src *net.UDPAddr) (*User, bool) {
+	if !s.users.Enabled() {
+		return nil, true
+	}
+	s.assocMu.Lock()
+	defer s.assocMu.Unlock()
+	var match *udpAssociation
+	for a := range s.assocs {
+		if !a.ip.Equal(src.IP) || (a.port != 0 && a.port != src.Port) {
+			continue
+		}
+		if a.port != 0 {
+			return a.user, true
+		}
+		match = a
+	}
+	if match == nil {
+		return nil, false
+	}
+	return match.user, true
 }
 
 func (s *Socks5Server) replyError(c net.Conn, r *socks5.Request, rep byte) error {
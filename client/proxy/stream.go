@@ -2,44 +2,35 @@ package proxy
 
 import (
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
+	easydns "github.com/nange/easyss/v3/client/dns"
 	"github.com/nange/easyss/v3/config"
-	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
-	"github.com/nange/easyss/v3/relay"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/stats"
 	"github.com/nange/easyss/v3/transport"
+	"github.com/nange/easyss/v3/tunnel"
 	"github.com/nange/easyss/v3/util/bytespool"
 )
 
-var ErrStreamIdleTimeout = errors.New("stream idle timeout")
-
-var ErrStreamReset = errors.New("stream reset by peer")
-
-// ErrServerRejectedHandshake reports that the server answered the bootstrap
-// with a non-encrypted payload (typically a camouflaged fallback page after a
-// handshake decrypt failure), i.e. the handshake was rejected before any
-// session records were exchanged. Common cause: master key mismatch.
-var ErrServerRejectedHandshake = errors.New("handshake rejected by server")
-
-var errLocalConnClosed = errors.New("local connection closed")
+var (
+	ErrStreamIdleTimeout       = tunnel.ErrStreamIdleTimeout
+	ErrStreamReset             = tunnel.ErrStreamReset
+	ErrServerRejectedHandshake = tunnel.ErrServerRejectedHandshake
+)
 
 type StreamHandler struct {
 	transport         transport.Transport
 	masterKey         []byte
 	shaperCfg         shaper.Config
 	streamIdleTimeout time.Duration
+	ecs               *easydns.ECS
 }
 
 func NewStreamHandler(tr transport.Transport, masterKey []byte, shaperCfg shaper.Config, streamIdleTimeout time.Duration) *StreamHandler {
@@ -71,107 +62,10 @@ func (h *StreamHandler) OpenICMPStream(ctx context.Context, target string, echoP
 	return h.icmpStream(ctx, config.EndpointICMP, protocol.ProtoICMP, target, echoPayload, method)
 }
 
-type bootstrapSession struct {
-	stream transport.Stream
-	sk     *crypto.StreamKeys
-	salt   []byte
+// openAndBootstrap opens a stream and sends its handshake, see tunnel.Open.
+func (h *StreamHandler) openAndBootstrap(ctx context.Context, endpoint string, proto protocol.Proto, target string, method protocol.Method, extraFrames []protocol.Frame) (*tunnel.Session, error) {
+	return tunnel.Open(ctx, h.transport, h.masterKey, endpoint, proto, target, method, extraFrames)
 }
-
-func (h *StreamHandler) openAndBootstrap(ctx context.Context, endpoint string, proto protocol.Proto, target string, method protocol.Method, extraFrames []protocol.Frame) (*bootstrapSession, error) {
-	hsFrame := protocol.NewFrameHANDSHAKE(protocol.Handshake{
-		Version: protocol.Version3,
-		Proto:   proto,
-		Method:  method,
-		Target:  target,
-	})
-	frames := append([]protocol.Frame{hsFrame}, extraFrames...)
-
-	// Add random padding to obscure the target hostname length in the
-	// bootstrap record. Without this, the first record ciphertext length
-	// directly correlates with len(target).
-	if padFrame, ok := shaper.BuildPaddingFrame(encodedLen(frames)); ok {
-		frames = append(frames, padFrame)
-	}
-
-	plaintext := protocol.EncodeFrames(frames)
-
-	const maxRetries = 2
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		salt, err := crypto.GenerateSalt()
-		if err != nil {
-			return nil, fmt.Errorf("generate salt: %w", err)
-		}
-		saltB64 := base64.RawURLEncoding.EncodeToString(salt)
-
-		stream, err := h.transport.Open(ctx, transport.OpenRequest{
-			Endpoint:     endpoint,
-			Salt:         saltB64,
-			HighPriority: isInteractivePort(target),
-		})
-		if err != nil {
-			return nil, fmt.Errorf("transport open: %w", err)
-		}
-
-		sk, err := crypto.NewStreamKeys(h.masterKey, salt, endpoint)
-		if err != nil {
-			stream.Close() //nolint:errcheck
-			return nil, fmt.Errorf("stream keys: %w", err)
-		}
-
-		bootstrapEnc, bootstrapCounter, err := sk.Encryptor("c2s", "bootstrap", protocol.MethodAES256GCM)
-		if err != nil {
-			stream.Close() //nolint:errcheck
-			return nil, fmt.Errorf("bootstrap encryptor: %w", err)
-		}
-		aad := crypto.BuildAAD(endpoint, salt, "c2s", "bootstrap", protocol.MethodAES256GCM)
-		rw := crypto.NewRecordWriter(stream, bootstrapEnc, bootstrapCounter, aad)
-
-		if err := rw.WriteRecord(plaintext); err != nil {
-			stream.Close() //nolint:errcheck
-			if attempt < maxRetries-1 && errors.Is(err, io.ErrClosedPipe) {
-				log.Debug("[STREAM] handshake retry", "attempt", attempt+1, "target", target, "err", err)
-				continue
-			}
-			return nil, fmt.Errorf("write handshake: %w", err)
-		}
-		rw.Flush()
-
-		// Stamp the moment the bootstrap record left the client: the server
-		// answers with the response headers before dialing the origin, so the
-		// transport records the pure client<->server path RTT when they
-		// arrive (see HTTP2Stream.MarkBootstrapSent).
-		if m, ok := stream.(interface{ MarkBootstrapSent() }); ok {
-			m.MarkBootstrapSent()
-		}
-
-		return &bootstrapSession{stream: stream, sk: sk, salt: salt}, nil
-	}
-
-	// Unreachable: the loop always returns inside the body.
-	return nil, fmt.Errorf("write handshake: max retries exceeded")
-}
-
-// classifyFirstReadError maps first-record read failures caused by a
-// non-encrypted server response (e.g. a fallback page after the handshake was
-// rejected) to ErrServerRejectedHandshake with a diagnostic hint. Only the
-// very first read is classified: a failure mid-stream means real stream
-// corruption, not a handshake rejection.
-func classifyFirstReadError(err error) error {
-	if err == nil || errors.Is(err, ErrServerRejectedHandshake) {
-		return err
-	}
-	if transport.IsHandshakeRejected(err) {
-		return err
-	}
-	msg := err.Error()
-	for _, pat := range []string{"crypto: ciphertext exceeds max", "crypto: zero-length ciphertext", "crypto: decrypt record"} {
-		if strings.Contains(msg, pat) {
-			return fmt.Errorf("%w: server returned a non-encrypted payload (check master_key or server config)", ErrServerRejectedHandshake)
-		}
-	}
-	return err
-}
-
 func (h *StreamHandler) icmpStream(ctx context.Context, endpoint string, proto protocol.Proto, target string, echoPayload []byte, method protocol.Method) ([]byte, error) {
 	log.Debug("[STREAM] icmp open", "endpoint", endpoint, "target", target)
 
@@ -183,17 +77,15 @@ func (h *StreamHandler) icmpStream(ctx context.Context, endpoint string, proto p
 		return nil, err
 	}
 	log.Debug("[STREAM] merged ICMP echo payload into bootstrap record", "bytes", len(echoPayload))
-	defer bs.stream.Close() //nolint:errcheck
+	defer bs.Stream.Close() //nolint:errcheck
 
-	aadS2C := crypto.BuildAAD(endpoint, bs.salt, "s2c", "session", method)
-	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", method)
+	dr, err := bs.Reader(method)
 	if err != nil {
-		return nil, fmt.Errorf("s2c encryptor: %w", err)
+		return nil, err
 	}
-	dr := crypto.NewDecryptedReader(bs.stream, aadS2C, s2cEnc, s2cCounter)
 
 	frame, err := dr.ReadFrame()
-	err = classifyFirstReadError(err)
+	err = tunnel.ClassifyFirstReadError(err)
 	if err != nil {
 		log.Error("[STREAM] icmp read reply", "target", target, "err", err)
 		return nil, fmt.Errorf("read first reply frame: %w", err)
@@ -232,178 +124,13 @@ func (h *StreamHandler) openStream(ctx context.Context, endpoint string, proto p
 		log.Error("[STREAM] bootstrap", "endpoint", endpoint, "target", target, "err", err)
 		return err
 	}
-	stream := bs.stream
 	log.Debug("[STREAM] handshake sent", "target", target)
 
-	aadSession := crypto.BuildAAD(endpoint, bs.salt, "c2s", "session", method)
-	sessionEnc, sessionCounter, err := bs.sk.Encryptor("c2s", "session", method)
-	if err != nil {
-		stream.Close() //nolint:errcheck
-		return fmt.Errorf("session encryptor: %w", err)
-	}
-	sessionWriter := crypto.NewRecordWriter(stream, sessionEnc, sessionCounter, aadSession)
-
-	txShaper := shaper.New(sessionWriter, h.shaperCfg)
-	defer txShaper.Close() //nolint:errcheck
-
-	aadS2C := crypto.BuildAAD(endpoint, bs.salt, "s2c", "session", method)
-	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", method)
-	if err != nil {
-		stream.Close() //nolint:errcheck
-		return fmt.Errorf("s2c encryptor: %w", err)
-	}
-	dr := crypto.NewDecryptedReader(stream, aadS2C, s2cEnc, s2cCounter)
-
-	err = h.relay(target, localConn, txShaper, dr, stream)
+	err = bs.Relay(target, method, h.shaperCfg, h.streamIdleTimeout, localConn)
 	log.Debug("[STREAM] relay finished", "endpoint", endpoint, "target", target, "err", err)
 	return err
 }
 
-func (h *StreamHandler) relay(target string, localConn net.Conn, tx shaper.Shaper, rx *crypto.DecryptedReader, stream transport.Stream) error {
-	m := stats.NewStreamMeter("client", target)
-	defer m.Close()
-
-	closeAll := func() {
-		_ = stream.Close()
-		_ = localConn.Close()
-	}
-
-	result := relay.Bidirectional(h.streamIdleTimeout, closeAll,
-		func(signal func()) error { return h.copyLocalToRemote(localConn, tx, signal) },
-		func(signal func()) error { return h.copyRemoteToLocal(rx, localConn, signal, m) },
-	)
-
-	if result.TimedOut {
-		log.Debug("[STREAM] idle timeout", "timeout", h.streamIdleTimeout)
-		return fmt.Errorf("%w after %v", ErrStreamIdleTimeout, h.streamIdleTimeout)
-	}
-
-	if result.Err != nil && !errors.Is(result.Err, errLocalConnClosed) && !errors.Is(result.Err, io.ErrClosedPipe) {
-		log.Debug("[STREAM] relay copy error", "err", result.Err)
-		return result.Err
-	}
-	return nil
-}
-
-func (h *StreamHandler) copyLocalToRemote(src net.Conn, tx shaper.Shaper, signalActivity func()) error {
-	buf := bytespool.Get(config.TCPStreamBufferSize)
-	defer bytespool.MustPut(buf)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			signalActivity()
-			stats.RecordRawBytesSent(n)
-			if pErr := tx.PushData(buf[:n]); pErr != nil {
-				_ = tx.Flush()
-				if errors.Is(pErr, io.ErrClosedPipe) {
-					return nil
-				}
-				return pErr
-			}
-		}
-		if err != nil {
-			finFrame := protocol.NewFrameFIN()
-			_ = tx.PushFrame(finFrame)
-			_ = tx.Flush()
-			signalActivity()
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			if isLocalConnClosedError(err) {
-				log.Debug("[STREAM] local connection closed", "err", err)
-				return errLocalConnClosed
-			}
-			log.Debug("[STREAM] local read error", "err", err)
-			return err
-		}
-	}
-}
-
-func (h *StreamHandler) copyRemoteToLocal(rx *crypto.DecryptedReader, dst net.Conn, signalActivity func(), m *stats.StreamMeter) error {
-	type frameItem struct {
-		data []byte
-		fin  bool
-		rst  bool
-	}
-
-	ch := make(chan frameItem, 64)
-	readDone := make(chan error, 1)
-	done := make(chan struct{})
-	defer close(done)
-
-	go func() {
-		defer close(ch)
-		first := true
-		for {
-			frame, err := rx.ReadFrame()
-			if first {
-				first = false
-				err = classifyFirstReadError(err)
-			}
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					readDone <- nil
-				} else {
-					log.Debug("[STREAM] remote read error", "err", err)
-					readDone <- err
-				}
-				return
-			}
-
-			switch frame.Type {
-			case protocol.FrameDATA:
-				signalActivity()
-				if len(frame.Payload) > 0 {
-					select {
-					case ch <- frameItem{data: frame.Payload}:
-					case <-done:
-						readDone <- nil
-						return
-					}
-				}
-			case protocol.FrameFIN:
-				signalActivity()
-				select {
-				case ch <- frameItem{fin: true}:
-				case <-done:
-				}
-				readDone <- nil
-				return
-			case protocol.FrameRST:
-				select {
-				case ch <- frameItem{rst: true}:
-				case <-done:
-				}
-				readDone <- nil
-				return
-			case protocol.FramePADDING, protocol.FrameCOVER:
-				continue
-			}
-		}
-	}()
-
-	for item := range ch {
-		if item.rst {
-			return fmt.Errorf("%w", ErrStreamReset)
-		}
-		if item.fin {
-			return nil
-		}
-		m.SetState("write_local")
-		if _, wErr := dst.Write(item.data); wErr != nil {
-			if isLocalConnClosedError(wErr) {
-				log.Debug("[STREAM] local connection closed", "err", wErr)
-				return errLocalConnClosed
-			}
-			return wErr
-		}
-		stats.RecordRawBytesRecv(len(item.data))
-		m.Add(len(item.data), "read_remote")
-	}
-
-	return <-readDone
-}
-
 // isTransientStreamError reports whether a stream failure is transient or
 // expected (idle timeout, peer reset, handshake rejection, HTTP/2 connection
 // loss, closed stream). Such failures often hit many streams at once when a
@@ -427,41 +154,7 @@ func isTransientStreamError(err error) bool {
 		strings.Contains(msg, "connection was aborted")
 }
 
-func isLocalConnClosedError(err error) bool {
-	if err == nil {
-		return false
-	}
-	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
-		return true
-	}
-	msg := strings.ToLower(err.Error())
-	return strings.Contains(msg, "use of closed network connection") ||
-		strings.Contains(msg, "connection reset by peer") ||
-		strings.Contains(msg, "forcibly closed by the remote host") ||
-		strings.Contains(msg, "software caused connection abort") ||
-		strings.Contains(msg, "connection was aborted") ||
-		strings.Contains(msg, "broken pipe")
-}
-
-// encodedLen returns the total wire size of a list of frames (headers + payloads).
-func encodedLen(frames []protocol.Frame) int {
-	total := 0
-	for _, f := range frames {
-		total += f.EncodedLen()
-	}
-	return total
-}
-
-type UDPExchange struct {
-	stream    transport.Stream
-	tx        shaper.Shaper
-	reader    *crypto.DecryptedReader
-	target    string
-	lastSeen  atomic.Int64 // UnixNano, written by Send/Receive, read by LastSeen
-	firstRead atomic.Bool  // set on the first ReadFrame, enables rejection classification
-	mu        sync.Mutex
-	closeOnce sync.Once
-}
+type UDPExchange = tunnel.UDPExchange
 
 func (h *StreamHandler) OpenUDPExchange(ctx context.Context, target string, method protocol.Method, firstPayload []byte) (*UDPExchange, error) {
 	stats.RecordUDPAssociation()
@@ -478,108 +171,6 @@ func (h *StreamHandler) OpenUDPExchange(ctx context.Context, target string, meth
 		log.Error("[UDP_EXCHANGE] bootstrap", "target", target, "err", err)
 		return nil, err
 	}
-	stream := bs.stream
-
-	aadC2S := crypto.BuildAAD(config.EndpointUDP, bs.salt, "c2s", "session", method)
-	c2sEnc, c2sCounter, err := bs.sk.Encryptor("c2s", "session", method)
-	if err != nil {
-		stream.Close() //nolint:errcheck
-		return nil, fmt.Errorf("c2s session encryptor: %w", err)
-	}
-	c2sWriter := crypto.NewRecordWriter(stream, c2sEnc, c2sCounter, aadC2S)
-
-	aadS2C := crypto.BuildAAD(config.EndpointUDP, bs.salt, "s2c", "session", method)
-	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", method)
-	if err != nil {
-		stream.Close() //nolint:errcheck
-		return nil, fmt.Errorf("s2c session encryptor: %w", err)
-	}
-
-	dr := crypto.NewDecryptedReader(stream, aadS2C, s2cEnc, s2cCounter)
-
 	log.Debug("[UDP_EXCHANGE] opened", "target", target)
-	// UDP uses a short 1ms batch window instead of per-datagram forced
-	// flushes: bursts of datagrams are merged into a single encrypted
-	// record, while the idle-triggered timer keeps interaction latency
-	// bounded at ~1ms for sparse traffic (DNS, games).
-	udpShaperCfg := h.shaperCfg
-	udpShaperCfg.BatchWindowMS = 1
-	ue := &UDPExchange{
-		stream: stream,
-		tx:     shaper.New(c2sWriter, udpShaperCfg),
-		reader: dr,
-		target: target,
-	}
-	ue.lastSeen.Store(time.Now().UnixNano())
-	return ue, nil
-}
-
-func (ue *UDPExchange) Send(data []byte) error {
-	ue.mu.Lock()
-	defer ue.mu.Unlock()
-	ue.lastSeen.Store(time.Now().UnixNano())
-	frame := protocol.NewFrameDATAGRAM(data)
-	return ue.tx.PushFrame(frame)
-}
-
-func (ue *UDPExchange) Receive() ([]byte, error) {
-	for {
-		frame, err := ue.reader.ReadFrame()
-		if ue.firstRead.CompareAndSwap(false, true) {
-			err = classifyFirstReadError(err)
-		}
-		if err != nil {
-			return nil, err
-		}
-		ue.lastSeen.Store(time.Now().UnixNano())
-		switch frame.Type {
-		case protocol.FrameDATAGRAM:
-			return frame.Payload, nil
-		case protocol.FrameFIN:
-			return nil, io.EOF
-		case protocol.FrameRST:
-			return nil, fmt.Errorf("udp stream reset")
-		case protocol.FramePADDING, protocol.FrameCOVER:
-			continue
-		default:
-			return nil, fmt.Errorf("unexpected frame type: %d", frame.Type)
-		}
-	}
-}
-
-// Close terminates the exchange. It sends a FIN frame before closing the
-// shaper and stream so the server can reclaim its UDP association
-// immediately instead of waiting for the idle timeout. The FIN must be
-// pushed before tx.Close: once the shaper is closing, PushFrame drops
-// frames. Concurrent Close callers (idle cleanup, receiveLoop exit, send
-// failure) are serialized via closeOnce and mu. FIN delivery is best
-// effort; if it fails the server falls back to its idle timeout.
-func (ue *UDPExchange) Close() error {
-	ue.closeOnce.Do(func() {
-		ue.mu.Lock()
-		defer ue.mu.Unlock()
-		if ue.tx != nil {
-			_ = ue.tx.PushFrame(protocol.NewFrameFIN())
-			_ = ue.tx.Flush()
-			_ = ue.tx.Close()
-		}
-		_ = ue.stream.Close()
-	})
-	return nil
-}
-
-func (ue *UDPExchange) LastSeen() time.Time {
-	return time.Unix(0, ue.lastSeen.Load())
-}
-
-func isInteractivePort(target string) bool {
-	_, port, err := net.SplitHostPort(target)
-	if err != nil {
-		return false
-	}
-	switch port {
-	case "22", "80", "443", "8080", "8443":
-		return true
-	}
-	return false
+	return tunnel.NewUDPExchange(bs, target, method, h.shaperCfg)
 }
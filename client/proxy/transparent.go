@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/util"
+	"github.com/nange/easyss/v3/util/bytespool"
+)
+
+// TransparentMode selects how the transparent inbound learns the original
+// destination of the traffic redirected to it.
+type TransparentMode string
+
+const (
+	// TransparentRedirect serves TCP redirected by iptables/nftables
+	// REDIRECT, reading the destination with SO_ORIGINAL_DST.
+	TransparentRedirect TransparentMode = "redirect"
+	// TransparentTProxy serves TCP and UDP delivered by TPROXY to
+	// IP_TRANSPARENT sockets, where the destination is kept intact.
+	TransparentTProxy TransparentMode = "tproxy"
+)
+
+// ParseTransparentMode parses a mode name; empty means redirect.
+func ParseTransparentMode(s string) (TransparentMode, error) {
+	switch TransparentMode(s) {
+	case "", TransparentRedirect:
+		return TransparentRedirect, nil
+	case TransparentTProxy:
+		return TransparentTProxy, nil
+	default:
+		return "", fmt.Errorf("unknown transparent mode %q (want redirect or tproxy)", s)
+	}
+}
+
+// listenReplyUDP opens the socket answering a transparent UDP client. It
+// must be bound to the original destination so that replies look like they
+// come from it. Replaced in tests.
+var listenReplyUDP = listenTransparentReplyUDP
+
+// TransparentServer is the transparent proxy inbound of a Linux gateway.
+// Connections are routed like SOCKS5 requests: blocked, dialed directly or
+// carried through the tunnel by the StreamHandler, according to the Router
+// verdict for the destination IP.
+type TransparentServer struct {
+	addr              string
+	mode              TransparentMode
+	handler           *StreamHandler
+	router            *router.Router
+	method            protocol.Method
+	disableQUIC       bool
+	dialTimeout       time.Duration
+	directDialContext func(context.Context, string, string) (net.Conn, error)
+
+	mu     sync.Mutex
+	ln     net.Listener
+	pc     *net.UDPConn
+	closed bool
+	quit   chan struct{}
+
+	udpFlows *udpFlows
+}
+
+func NewTransparentServer(listenAddr string, mode TransparentMode, handler *StreamHandler, rt *router.Router, method protocol.Method, disableQUIC bool, dialTimeout, udpIdleTimeout time.Duration, directDialContext func(context.Context, string, string) (net.Conn, error)) *TransparentServer {
+	if dialTimeout <= 0 {
+		dialTimeout = 10 * time.Second
+	}
+	if udpIdleTimeout <= 0 {
+		udpIdleTimeout = 30 * time.Second
+	}
+	if directDialContext == nil {
+		directDialContext = defaultDirectDialContext
+	}
+	return &TransparentServer{
+		addr:              listenAddr,
+		mode:              mode,
+		handler:           handler,
+		router:            rt,
+		method:            method,
+		disableQUIC:       disableQUIC,
+		dialTimeout:       dialTimeout,
+		directDialContext: directDialContext,
+		quit:              make(chan struct{}),
+		udpFlows:          newUDPFlows("[TRANSPARENT]", udpIdleTimeout),
+	}
+}
+
+// Listen opens the sockets of the inbound, so that failures such as a
+// port in use or a missing CAP_NET_ADMIN for tproxy are reported before
+// Start. UDP is only served in tproxy mode, REDIRECT cannot recover UDP
+// destinations.
+func (s *TransparentServer) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return net.ErrClosed
+	}
+	if s.ln != nil {
+		return nil
+	}
+	ln, err := listenTransparentTCP(s.addr, s.mode == TransparentTProxy)
+	if err != nil {
+		return err
+	}
+	var pc *net.UDPConn
+	if s.mode == TransparentTProxy {
+		if pc, err = listenTransparentUDP(s.addr); err != nil {
+			ln.Close() //nolint:errcheck
+			return err
+		}
+	}
+	s.ln, s.pc = ln, pc
+	return nil
+}
+
+// Start serves until Close, listening first unless Listen was called.
+func (s *TransparentServer) Start() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	ln, pc := s.ln, s.pc
+	s.mu.Unlock()
+
+	if pc != nil {
+		go s.serveUDP(pc)
+		go s.udpFlows.cleanupLoop(s.quit)
+	}
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCP(c)
+	}
+}
+
+func (s *TransparentServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.quit)
+	ln, pc := s.ln, s.pc
+	s.mu.Unlock()
+
+	var errs []error
+	if ln != nil {
+		errs = append(errs, ln.Close())
+	}
+	if pc != nil {
+		errs = append(errs, pc.Close())
+	}
+	s.udpFlows.closeAll()
+	return errors.Join(errs...)
+}
+
+func (s *TransparentServer) serveTCP(c net.Conn) {
+	defer c.Close() //nolint:errcheck
+
+	var dst *net.TCPAddr
+	if s.mode == TransparentTProxy {
+		// TPROXY keeps the original destination as the socket's local
+		// address.
+		dst, _ = c.LocalAddr().(*net.TCPAddr)
+	} else {
+		var err error
+		if dst, err = originalDst(c); err != nil {
+			log.Warn("[TRANSPARENT] original destination", "local", c.RemoteAddr().String(), "err", err)
+			return
+		}
+	}
+	if dst == nil || s.isSelfTarget(dst.IP, dst.Port) {
+		log.Warn("[TRANSPARENT] connection to the listener itself rejected", "local", c.RemoteAddr().String())
+		return
+	}
+	s.handleTCP(c, dst.String())
+}
+
+// handleTCP relays c to target (ip:port) on the path picked by the router.
+func (s *TransparentServer) handleTCP(c net.Conn, target string) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return
+	}
+	if s.router.ShouldIPV6Disable() && util.IsIPV6(host) {
+		log.Warn("[TRANSPARENT] ipv6 target rejected, ipv6 disabled", "target", target)
+		return
+	}
+
+	local := c.RemoteAddr().String()
+	switch s.router.MatchHostRule(host) {
+	case router.HostRuleBlock:
+		log.Info("[TCP_BLOCK] blocked", "host", host, "target", target, "local", local)
+	case router.HostRuleDirect:
+		log.Info("[TCP_DIRECT]", "target", target, "local", local)
+		ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
+		rc, err := s.directDialContext(ctx, "tcp", target)
+		cancel()
+		if err != nil {
+			log.Error("[TCP_DIRECT] connect", "target", target, "err", err)
+			return
+		}
+		defer rc.Close() //nolint:errcheck
+		relayTCP(rc, c)
+		log.Debug("[TCP_DIRECT] relay finished", "target", target)
+	case router.HostRuleProxy:
+		log.Info("[TCP_PROXY]", "target", target, "local", local)
+		err := s.handler.OpenTCPStream(context.Background(), target, s.method, c)
+		switch {
+		case err == nil:
+			log.Debug("[TCP_PROXY] stream finished", "target", target)
+		case isTransientStreamError(err):
+			log.Debug("[TCP_PROXY] closed", "target", target, "err", err)
+		default:
+			log.Error("[TCP_PROXY] stream", "target", target, "err", err)
+		}
+	}
+}
+
+// isSelfTarget reports whether ip:port is this listener, which would make
+// the inbound forward traffic to itself.
+func (s *TransparentServer) isSelfTarget(ip net.IP, port int) bool {
+	_, lp, err := net.SplitHostPort(s.addr)
+	if err != nil || lp != strconv.Itoa(port) {
+		return false
+	}
+	_, local := localIPSet()[ip.String()]
+	return ip.IsLoopback() || ip.IsUnspecified() || local
+}
+
+func (s *TransparentServer) serveUDP(pc *net.UDPConn) {
+	buf := bytespool.Get(protocol.MaxUDPDataSize)
+	defer bytespool.MustPut(buf)
+	oob := make([]byte, 256)
+	for {
+		n, src, dst, err := readFromUDPWithDst(pc, buf, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Debug("[TRANSPARENT] read udp", "err", err)
+			continue
+		}
+		s.handleUDP(src, dst, buf[:n])
+	}
+}
+
+// handleUDP relays a datagram from src addressed to dst on the flow of the
+// pair.
+func (s *TransparentServer) handleUDP(src, dst *net.UDPAddr, data []byte) {
+	if s.disableQUIC && dst.Port == 443 {
+		return
+	}
+	if s.router.ShouldIPV6Disable() && dst.IP.To4() == nil {
+		log.Warn("[TRANSPARENT] ipv6 target rejected, ipv6 disabled", "target", dst.String())
+		return
+	}
+	if s.isSelfTarget(dst.IP, dst.Port) {
+		return
+	}
+	key := src.String() + "_" + dst.String()
+	s.udpFlows.handle(key, append([]byte(nil), data...), func(f *udpFlow, first []byte) error {
+		return s.openUDPFlow(key, f, src, dst, first)
+	})
+}
+
+// openUDPFlow opens the flow from src to dst on the path picked by the
+// router. Replies are written through a socket bound to the original
+// destination.
+func (s *TransparentServer) openUDPFlow(key string, f *udpFlow, src, dst *net.UDPAddr, first []byte) error {
+	target := dst.String()
+	host := dst.IP.String()
+
+	rule := s.router.MatchHostRule(host)
+	if rule == router.HostRuleBlock {
+		log.Info("[UDP_BLOCK] blocked", "host", host, "target", target)
+		return errors.New("blocked")
+	}
+
+	reply, err := listenReplyUDP(dst)
+	if err != nil {
+		log.Error("[TRANSPARENT] reply socket", "target", target, "err", err)
+		return err
+	}
+	f.onClose(reply)
+	writeReply := func(b []byte) error {
+		_, err := reply.WriteToUDP(b, src)
+		return err
+	}
+
+	switch rule {
+	case router.HostRuleDirect:
+		log.Info("[UDP_DIRECT]", "target", target)
+		ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
+		rc, err := s.directDialContext(ctx, "udp", target)
+		cancel()
+		if err != nil {
+			log.Error("[UDP_DIRECT] dial", "target", target, "err", err)
+			return err
+		}
+		f.onClose(rc)
+		if _, err := rc.Write(first); err != nil {
+			return err
+		}
+		f.send = func(b []byte) error {
+			_, err := rc.Write(b)
+			return err
+		}
+		go s.udpFlows.relay(key, f, rc.Read, writeReply)
+	default:
+		log.Info("[UDP_PROXY]", "target", target)
+		// The exchange lives as long as the flow: a dial context would end
+		// it once cancelled.
+		ue, err := s.handler.OpenUDPExchange(context.Background(), target, s.method, first)
+		if err != nil {
+			log.Error("[UDP_PROXY] open exchange", "target", target, "err", err)
+			return err
+		}
+		f.onClose(ue)
+		f.send = ue.Send
+		go s.udpFlows.relay(key, f, func(buf []byte) (int, error) {
+			data, err := ue.Receive()
+			return copy(buf, data), err
+		}, writeReply)
+	}
+	return nil
+}
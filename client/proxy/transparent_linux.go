@@ -0,0 +1,213 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSOOriginalDst is IP6T_SO_ORIGINAL_DST, the IPv6 counterpart of
+// SO_ORIGINAL_DST (not exported by x/sys/unix).
+const ip6tSOOriginalDst = 80
+
+// originalDst returns the destination of a connection before it was
+// redirected by iptables/nftables REDIRECT, as recorded by conntrack.
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("original dst: not a tcp connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := tc.LocalAddr().(*net.TCPAddr)
+	v4 := local != nil && local.IP.To4() != nil
+
+	var addr *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if v4 {
+			// The kernel writes a sockaddr_in; IPv6Mreq is just a buffer
+			// large enough to hold it.
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				serr = err
+				return
+			}
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(binary.BigEndian.Uint16(b[2:4])),
+			}
+			return
+		}
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSOOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		addr = &net.TCPAddr{
+			IP:   net.IP(info.Addr.Addr[:]),
+			Port: int(networkPort(info.Addr.Port)),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("original dst: %w", serr)
+	}
+	return addr, nil
+}
+
+// networkPort converts a port stored in network byte order in a native
+// integer field.
+func networkPort(p uint16) uint16 {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], p)
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// transparentControl marks a socket IP_TRANSPARENT (both families for dual
+// stack sockets) and, with recvOrigDst, asks for the original destination
+// of every received datagram.
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = setTransparent(int(fd), recvOrigDst)
+		})
+		return errors.Join(err, serr)
+	}
+}
+
+func setTransparent(fd int, recvOrigDst bool) error {
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return err
+	}
+	if domain == unix.AF_INET6 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			return fmt.Errorf("set IPV6_TRANSPARENT: %w", err)
+		}
+		if recvOrigDst {
+			if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+				return fmt.Errorf("set IPV6_RECVORIGDSTADDR: %w", err)
+			}
+		}
+		// IPv4 traffic reaches dual stack sockets too; those options are
+		// best effort on IPv6-only sockets.
+		_ = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		if recvOrigDst {
+			_ = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+		}
+		return nil
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+		return fmt.Errorf("set IP_TRANSPARENT: %w", err)
+	}
+	if recvOrigDst {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+			return fmt.Errorf("set IP_RECVORIGDSTADDR: %w", err)
+		}
+	}
+	return nil
+}
+
+func listenTransparentTCP(addr string, tproxy bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tproxy {
+		lc.Control = transparentControl(false)
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentUDPControl(true)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// transparentUDPControl is transparentControl plus SO_REUSEADDR: reply
+// sockets bind to addresses the listener may also cover, and several clients
+// talking to the same destination each get their own reply socket.
+func transparentUDPControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr == nil {
+				serr = setTransparent(int(fd), recvOrigDst)
+			}
+		})
+		return errors.Join(err, serr)
+	}
+}
+
+// listenTransparentReplyUDP binds a socket to the (non-local) original
+// destination of a TPROXY flow, so replies carry it as their source.
+func listenTransparentReplyUDP(dst *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if dst.IP.To4() != nil {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{Control: transparentUDPControl(false)}
+	pc, err := lc.ListenPacket(context.Background(), network, dst.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// readFromUDPWithDst reads a datagram together with its original
+// destination, taken from the IP(V6)_ORIGDSTADDR control message.
+func readFromUDPWithDst(pc *net.UDPConn, buf, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	n, oobn, _, src, err := pc.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	dst, err := parseOrigDst(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if v4 := src.IP.To4(); v4 != nil {
+		src.IP = v4
+	}
+	return n, src, dst, nil
+}
+
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			return &net.UDPAddr{
+				IP:   net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]).To4(),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			ip := net.IP(append([]byte(nil), m.Data[8:24]...))
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			return &net.UDPAddr{
+				IP:   ip,
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, errors.New("missing original destination")
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOrigDst(t *testing.T) {
+	cmsg := func(level, typ int, data []byte) []byte {
+		b := make([]byte, unix.CmsgSpace(len(data)))
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+		h.Level = int32(level)
+		h.Type = int32(typ)
+		h.SetLen(unix.CmsgLen(len(data)))
+		copy(b[unix.CmsgLen(0):], data)
+		return b
+	}
+
+	v4 := []byte{2, 0, 0x01, 0xbb, 203, 0, 113, 5, 0, 0, 0, 0, 0, 0, 0, 0}
+	addr, err := parseOrigDst(cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, v4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "203.0.113.5:443" {
+		t.Errorf("ipv4 dst = %s", addr)
+	}
+
+	v6 := make([]byte, 28)
+	v6[0] = 10
+	v6[2], v6[3] = 0x00, 0x35
+	copy(v6[8:24], net.ParseIP("2001:db8::53"))
+	addr, err = parseOrigDst(cmsg(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, v6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "[2001:db8::53]:53" {
+		t.Errorf("ipv6 dst = %s", addr)
+	}
+
+	if _, err := parseOrigDst(nil); err == nil {
+		t.Error("expected error without control message")
+	}
+}
+
+// TestListenTransparentUDP needs CAP_NET_ADMIN; without TPROXY rules the
+// original destination is simply the listener address.
+func TestListenTransparentUDP(t *testing.T) {
+	pc, err := listenTransparentUDP("127.0.0.1:0")
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("IP_TRANSPARENT needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close() //nolint:errcheck
+
+	client, err := net.DialUDP("udp", nil, pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() //nolint:errcheck
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1500)
+	n, src, dst, err := readFromUDPWithDst(pc, buf, make([]byte, 256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("payload = %q", buf[:n])
+	}
+	if src.String() != client.LocalAddr().String() {
+		t.Errorf("src = %s, want %s", src, client.LocalAddr())
+	}
+	if dst.String() != pc.LocalAddr().String() {
+		t.Errorf("dst = %s, want %s", dst, pc.LocalAddr())
+	}
+
+	reply, err := listenTransparentReplyUDP(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close() //nolint:errcheck
+	if _, err := reply.WriteToUDP([]byte("world"), src); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Errorf("reply = %q", buf[:n])
+	}
+}
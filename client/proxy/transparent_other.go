@@ -0,0 +1,30 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on linux")
+
+func originalDst(net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentTCP(string, bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDP(string) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentReplyUDP(*net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func readFromUDPWithDst(*net.UDPConn, []byte, []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errTransparentUnsupported
+}
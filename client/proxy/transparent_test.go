@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/protocol"
+)
+
+func newDirectRouter(t *testing.T) *router.Router {
+	t.Helper()
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestParseTransparentMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TransparentMode
+		wantErr bool
+	}{
+		{"", TransparentRedirect, false},
+		{"redirect", TransparentRedirect, false},
+		{"tproxy", TransparentTProxy, false},
+		{"TPROXY", "", true},
+		{"nat", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTransparentMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTransparentMode(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestNFTablesRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    TransparentMode
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "REDIRECT 模式",
+			mode:    TransparentRedirect,
+			want:    []string{"type nat hook prerouting", "meta l4proto tcp redirect to :12345", "ip daddr @bypass4 return"},
+			notWant: []string{"tproxy", "ip rule"},
+		},
+		{
+			name: "TPROXY 模式",
+			mode: TransparentTProxy,
+			want: []string{
+				"type filter hook prerouting priority mangle",
+				"meta mark set 0x1 tproxy ip to :12345 accept",
+				"meta mark set 0x1 tproxy ip6 to :12345 accept",
+				"ip rule add fwmark 0x1 lookup 100",
+				"ip -6 route add local ::/0 dev lo table 100",
+			},
+			notWant: []string{"redirect"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := NFTablesRules(tt.mode, 12345)
+			for _, w := range tt.want {
+				if !strings.Contains(rules, w) {
+					t.Errorf("rules missing %q:\n%s", w, rules)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(rules, w) {
+					t.Errorf("rules should not contain %q:\n%s", w, rules)
+				}
+			}
+		})
+	}
+}
+
+func TestTransparentIsSelfTarget(t *testing.T) {
+	s := NewTransparentServer(":12345", TransparentRedirect, nil, newDirectRouter(t), 0, false, 0, 0, nil)
+	tests := []struct {
+		ip   string
+		port int
+		want bool
+	}{
+		{"127.0.0.1", 12345, true},
+		{"::1", 12345, true},
+		{"127.0.0.1", 443, false},
+		{"203.0.113.10", 12345, false},
+	}
+	for _, tt := range tests {
+		if got := s.isSelfTarget(net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("isSelfTarget(%s, %d) = %v, want %v", tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestTransparentTCPDirect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close() //nolint:errcheck
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close() //nolint:errcheck
+		_, _ = io.Copy(c, c)
+	}()
+
+	s := NewTransparentServer(":0", TransparentRedirect, nil, newDirectRouter(t), 0, false, time.Second, 0, nil)
+	client, inbound := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleTCP(inbound, ln.Addr().String())
+		inbound.Close() //nolint:errcheck
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("echo = %q", buf)
+	}
+	client.Close() //nolint:errcheck
+	<-done
+}
+
+func TestTransparentUDPDirect(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close() //nolint:errcheck
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	// 测试环境无法绑定非本机地址，用普通 socket 代替透明回包 socket
+	var replies atomic.Int32
+	old := listenReplyUDP
+	listenReplyUDP = func(*net.UDPAddr) (*net.UDPConn, error) {
+		replies.Add(1)
+		return net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	}
+	t.Cleanup(func() { listenReplyUDP = old })
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() //nolint:errcheck
+
+	s := NewTransparentServer(":0", TransparentTProxy, nil, newDirectRouter(t), 0, false, time.Second, 0, nil)
+	defer s.Close() //nolint:errcheck
+	src := client.LocalAddr().(*net.UDPAddr)
+	dst := echo.LocalAddr().(*net.UDPAddr)
+
+	buf := make([]byte, 1500)
+	for _, msg := range []string{"first", "second"} {
+		s.handleUDP(src, dst, []byte(msg))
+		_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", msg, err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("reply = %q, want %q", buf[:n], msg)
+		}
+	}
+	if n := replies.Load(); n != 1 {
+		t.Errorf("reply sockets = %d, want one per flow", n)
+	}
+}
+
+func TestTransparentUDPProxy(t *testing.T) {
+	old := listenReplyUDP
+	listenReplyUDP = func(*net.UDPAddr) (*net.UDPConn, error) {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	}
+	t.Cleanup(func() { listenReplyUDP = old })
+
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleProxy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &endpointTransport{}
+	s := NewTransparentServer(":0", TransparentTProxy, newTestStreamHandler(tr), rt, protocol.MethodAES256GCM, false, time.Second, 0, nil)
+	defer s.Close() //nolint:errcheck
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	dst := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 53), Port: 53}
+	s.handleUDP(src, dst, []byte("query"))
+	if ep := tr.waitEndpoint(t); ep != "/v3/udp" {
+		t.Fatalf("endpoint = %q", ep)
+	}
+	// 流的生命周期不受拨号超时约束
+	time.Sleep(50 * time.Millisecond)
+	if tr.streamCanceled() {
+		t.Error("udp stream canceled after open")
+	}
+}
+
+func TestTransparentListen(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close() //nolint:errcheck
+
+	// 端口被占用时 Listen 直接返回错误，而不是在 Start 的协程里记录日志
+	s := NewTransparentServer(busy.Addr().String(), TransparentRedirect, nil, newDirectRouter(t), 0, false, time.Second, 0, nil)
+	if err := s.Listen(); err == nil {
+		t.Fatal("Listen on a busy port succeeded")
+	}
+
+	s = NewTransparentServer("127.0.0.1:0", TransparentRedirect, nil, newDirectRouter(t), 0, false, time.Second, 0, nil)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	s.Close() //nolint:errcheck
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Start = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Start did not return after Close")
+	}
+}
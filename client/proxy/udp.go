@@ -3,6 +3,7 @@ package proxy
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strings"
@@ -20,13 +21,11 @@ import (
 	"github.com/txthinking/socks5"
 )
 
-func (s *Socks5Server) handleUDP(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram) error {
-	src := clientAddr.String()
+// handleUDP relays a datagram of user, the user of the association the
+// datagram belongs to.
+func (s *Socks5Server) handleUDP(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, user *User) error {
 	dst := d.Address()
 
-	_, hasAssoc := srv.AssociatedUDP.Get(src)
-	_ = hasAssoc
-
 	host, port, _ := net.SplitHostPort(dst)
 	if s.disableQUIC && port == "443" {
 		return nil
@@ -39,18 +38,32 @@ func (s *Socks5Server) handleUDP(srv *socks5.Server, clientAddr *net.UDPAddr, d
 
 	msg := &dns.Msg{}
 	if err := msg.Unpack(d.Data); err == nil && util.IsDNSRequest(msg) {
-		return s.handleDNS(srv, clientAddr, d, msg)
+		return s.handleDNS(srv, clientAddr, d, msg, user)
 	}
 
-	return s.handleRegularUDP(srv, clientAddr, d, dst)
+	return s.handleRegularUDP(srv, clientAddr, d, dst, user)
 }
 
-func (s *Socks5Server) handleDNS(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, msg *dns.Msg) error {
+func (s *Socks5Server) handleDNS(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, msg *dns.Msg, user *User) error {
 	question := msg.Question[0]
 	domain := strings.TrimSuffix(question.Name, ".")
 	qtype := dns.TypeToString[question.Qtype]
 
-	rule := s.router.MatchHostRule(domain)
+	if local, next := s.dnsHosts.Lookup(msg); local != nil {
+		log.Info("[DNS_HOSTS] local", "domain", domain, "qtype", qtype)
+		if next != "" {
+			chased, err := s.exchangeDNS(easydns.ChaseQuery(msg, next))
+			if err != nil {
+				log.Error("[DNS_HOSTS] chase cname", "domain", domain, "target", next, "err", err)
+				local.Rcode = dns.RcodeServerFailure
+			} else {
+				easydns.MergeChased(local, chased)
+			}
+		}
+		return responseDNSMsg(srv.UDPConn, clientAddr, local, d.Address())
+	}
+
+	rule := user.matchHostRule(s.router, domain)
 	if rule == router.HostRuleBlock {
 		log.Info("[DNS_BLOCK] blocked", "domain", domain, "qtype", qtype)
 		return responseBlockedDNSMsg(srv.UDPConn, clientAddr, msg, d.Address())
@@ -66,8 +79,11 @@ func (s *Socks5Server) handleDNS(srv *socks5.Server, clientAddr *net.UDPAddr, d
 	}
 	isDirect := isServerDomain || rule == router.HostRuleDirect
 
-	if cached := s.dnsCache.Get(question.Name, qtype, isDirect); cached != nil {
-		log.Info("[DNS_CACHE] hit", "domain", domain, "qtype", qtype, "direct", isDirect)
+	if cached, refresh := s.dnsCache.Lookup(question.Name, qtype, isDirect); cached != nil {
+		log.Info("[DNS_CACHE] hit", "domain", domain, "qtype", qtype, "direct", isDirect, "refresh", refresh)
+		if refresh {
+			go s.refreshDNSCache(msg.Copy(), isDirect)
+		}
 		if s.router.ShouldIPV6Disable() && cached.Question[0].Qtype == dns.TypeAAAA {
 			cached.Answer = nil
 		}
@@ -83,7 +99,7 @@ func (s *Socks5Server) handleDNS(srv *socks5.Server, clientAddr *net.UDPAddr, d
 
 	log.Info("[DNS_PROXY]", "domain", domain, "qtype", qtype)
 	stats.RecordDNSProxyQuery()
-	return s.proxyDNSQuery(srv, clientAddr, d, msg, domain)
+	return s.proxyDNSQuery(srv, clientAddr, d, msg, user)
 }
 
 func (s *Socks5Server) directDNSQuery(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, msg *dns.Msg, domain string) error {
@@ -117,6 +133,58 @@ func (s *Socks5Server) directDNSQuery(srv *socks5.Server, clientAddr *net.UDPAdd
 	return responseDNSMsg(srv.UDPConn, clientAddr, resp, d.Address())
 }
 
+// refreshDNSCache re-resolves a cached query in the background, on the same
+// path the entry was cached from, and stores the fresh answer.
+func (s *Socks5Server) refreshDNSCache(msg *dns.Msg, isDirect bool) {
+	domain := strings.TrimSuffix(msg.Question[0].Name, ".")
+	msg.Id = dns.Id()
+	var resp *dns.Msg
+	var err error
+	if isDirect {
+		resp, err = s.exchangeDirectDNSWithFallback(msg, config.DirectDNSServers)
+	} else {
+		resp, err = s.exchangeProxyDNS(msg)
+	}
+	if err == nil && resp.Rcode != dns.RcodeSuccess {
+		err = fmt.Errorf("dns server returned %s", dns.RcodeToString[resp.Rcode])
+	}
+	if err != nil {
+		// Keep serving the existing entry rather than replacing it with
+		// a failure.
+		log.Debug("[DNS_CACHE] refresh", "domain", domain, "direct", isDirect, "err", err)
+		return
+	}
+	if s.router.ShouldIPV6Disable() && msg.Question[0].Qtype == dns.TypeAAAA {
+		resp.Answer = nil
+	}
+	_ = s.dnsCache.Set(resp, isDirect)
+	log.Debug("[DNS_CACHE] refreshed", "domain", domain, "direct", isDirect, "answers", util.DNSAnswerStrings(resp))
+}
+
+// exchangeDNS resolves msg synchronously, taking the direct or the proxied
+// path according to the routing rules of the queried name. Unlike
+// handleDNS it waits for the answer, so it suits internal lookups such as
+// chasing a CNAME from the static hosts.
+func (s *Socks5Server) exchangeDNS(msg *dns.Msg) (*dns.Msg, error) {
+	domain := strings.TrimSuffix(msg.Question[0].Name, ".")
+	switch rule := s.router.MatchHostRule(domain); {
+	case rule == router.HostRuleBlock:
+		m := new(dns.Msg)
+		m.SetRcode(msg, dns.RcodeNameError)
+		return m, nil
+	case rule == router.HostRuleDirect || s.isServerDomain(domain):
+		return s.exchangeDirectDNSWithFallback(msg, config.DirectDNSServers)
+	default:
+		return s.exchangeProxyDNS(msg)
+	}
+}
+
+// exchangeProxyDNS resolves msg with the proxy dns server through the
+// tunnel and waits for the answer.
+func (s *Socks5Server) exchangeProxyDNS(msg *dns.Msg) (*dns.Msg, error) {
+	return s.handler.ProxyDNSExchanger(s.method, s.dialTimeout)(msg)
+}
+
 // exchangeDirectDNSWithFallback exchanges msg with each of the given dns
 // servers in order, falling back to the system dns servers when all of them
 // fail. The builtin servers are skipped entirely during the circuit breaker
@@ -164,21 +232,31 @@ func (s *Socks5Server) exchangeDirectDNS(ctx context.Context, msg *dns.Msg, addr
 	return dnsConn.ReadMsg()
 }
 
-func (s *Socks5Server) proxyDNSQuery(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, msg *dns.Msg, domain string) error {
+func (s *Socks5Server) proxyDNSQuery(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, msg *dns.Msg, user *User) error {
 	dst := config.ProxyDNSServer
 	key := clientAddr.String() + "_" + dst
 
-	ue, created, err := s.getOrCreateUDPExchange(key, dst, d.Data)
+	data := d.Data
+	if q := s.handler.ecs.Apply(msg); q != msg {
+		packed, err := q.Pack()
+		if err != nil {
+			return err
+		}
+		data = packed
+	}
+
+	handler, method := user.streamHandler(s.handler, s.method)
+	ue, created, err := s.getOrCreateUDPExchange(key, dst, handler, method, data)
 	if err != nil {
 		log.Error("[UDP_PROXY] open exchange", "dst", dst, "err", err)
 		return err
 	}
 	if created {
-		go s.receiveLoop(ue, srv, clientAddr, dst, key)
+		go s.receiveLoop(ue, srv, clientAddr, dst, key, user)
 		return nil // first payload already sent in handshake
 	}
 
-	if err := ue.Send(d.Data); err != nil {
+	if err := ue.Send(data); err != nil {
 		log.Error("[UDP_PROXY] send", "err", err)
 		s.udpMu.Lock()
 		delete(s.udpExch, key)
@@ -204,7 +282,7 @@ type udpExchangeFactory struct {
 // the exchange already existed, firstPayload is ignored. If this call created
 // the exchange, created is true and the caller MUST NOT call ue.Send for the
 // first payload (it was already sent in the handshake).
-func (s *Socks5Server) getOrCreateUDPExchange(key, dst string, firstPayload []byte) (ue *UDPExchange, created bool, err error) {
+func (s *Socks5Server) getOrCreateUDPExchange(key, dst string, handler *StreamHandler, method protocol.Method, firstPayload []byte) (ue *UDPExchange, created bool, err error) {
 	s.udpMu.Lock()
 	if existing, ok := s.udpExch[key]; ok {
 		s.udpMu.Unlock()
@@ -219,7 +297,7 @@ func (s *Socks5Server) getOrCreateUDPExchange(key, dst string, firstPayload []by
 	s.udpInflight[key] = f
 	s.udpMu.Unlock()
 
-	ue, err = s.handler.OpenUDPExchange(context.Background(), dst, s.method, firstPayload)
+	ue, err = handler.OpenUDPExchange(context.Background(), dst, method, firstPayload)
 	f.ue, f.err = ue, err
 	close(f.done)
 
@@ -236,7 +314,7 @@ func (s *Socks5Server) getOrCreateUDPExchange(key, dst string, firstPayload []by
 	return ue, true, nil
 }
 
-func (s *Socks5Server) receiveLoop(ue *UDPExchange, srv *socks5.Server, clientAddr *net.UDPAddr, target, key string) {
+func (s *Socks5Server) receiveLoop(ue *UDPExchange, srv *socks5.Server, clientAddr *net.UDPAddr, target, key string, user *User) {
 	defer func() {
 		s.udpMu.Lock()
 		delete(s.udpExch, key)
@@ -255,8 +333,12 @@ func (s *Socks5Server) receiveLoop(ue *UDPExchange, srv *socks5.Server, clientAd
 
 		msg := &dns.Msg{}
 		if err := msg.Unpack(data); err == nil && util.IsDNSResponse(msg) {
+			changed := s.handler.ecs.Strip(msg)
 			if s.router.ShouldIPV6Disable() && msg.Question[0].Qtype == dns.TypeAAAA {
 				msg.Answer = nil
+				changed = true
+			}
+			if changed {
 				if packed, packErr := msg.Pack(); packErr == nil {
 					data = packed
 				}
@@ -280,11 +362,16 @@ func (s *Socks5Server) receiveLoop(ue *UDPExchange, srv *socks5.Server, clientAd
 				}
 			}
 		}
-		s.sendToClient(srv, clientAddr, data, target)
+		s.sendToClient(srv, clientAddr, data, target, user)
 	}
 }
 
-func (s *Socks5Server) sendToClient(srv *socks5.Server, clientAddr *net.UDPAddr, data []byte, target string) {
+// sendToClient relays a reply of target to the client, metered as the
+// download of user.
+func (s *Socks5Server) sendToClient(srv *socks5.Server, clientAddr *net.UDPAddr, data []byte, target string, user *User) {
+	if err := user.meterDown(len(data)); err != nil {
+		return
+	}
 	a, addr, port, err := socks5.ParseAddress(target)
 	if err != nil {
 		return
@@ -298,28 +385,28 @@ func (s *Socks5Server) sendToClient(srv *socks5.Server, clientAddr *net.UDPAddr,
 	}
 }
 
-func (s *Socks5Server) handleRegularUDP(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst string) error {
+func (s *Socks5Server) handleRegularUDP(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst string, user *User) error {
 	host, _, err := net.SplitHostPort(dst)
 	if err != nil {
 		return err
 	}
 
-	rule := s.router.MatchHostRule(host)
+	rule := user.matchHostRule(s.router, host)
 	switch rule {
 	case router.HostRuleBlock:
 		log.Info("[UDP_BLOCK] blocked", "host", host, "target", dst)
 		return nil
 	case router.HostRuleDirect:
 		log.Info("[UDP_DIRECT]", "target", dst)
-		return s.directUDPRelay(srv, clientAddr, d, dst)
+		return s.directUDPRelay(srv, clientAddr, d, dst, user)
 	case router.HostRuleProxy:
 		log.Info("[UDP_PROXY]", "target", dst)
-		return s.proxyUDPRelay(srv, clientAddr, d, dst)
+		return s.proxyUDPRelay(srv, clientAddr, d, dst, user)
 	}
 	return nil
 }
 
-func (s *Socks5Server) directUDPRelay(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst string) error {
+func (s *Socks5Server) directUDPRelay(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst string, user *User) error {
 	key := "direct_" + clientAddr.String() + "_" + dst
 
 	s.udpMu.RLock()
@@ -357,7 +444,7 @@ func (s *Socks5Server) directUDPRelay(srv *socks5.Server, clientAddr *net.UDPAdd
 			if err != nil {
 				return
 			}
-			s.sendToClient(srv, clientAddr, buf[:n], dst)
+			s.sendToClient(srv, clientAddr, buf[:n], dst, user)
 		}
 	}()
 
@@ -365,16 +452,17 @@ func (s *Socks5Server) directUDPRelay(srv *socks5.Server, clientAddr *net.UDPAdd
 	return err
 }
 
-func (s *Socks5Server) proxyUDPRelay(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst string) error {
+func (s *Socks5Server) proxyUDPRelay(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst string, user *User) error {
 	key := clientAddr.String() + "_" + dst
 
-	ue, created, err := s.getOrCreateUDPExchange(key, dst, d.Data)
+	handler, method := user.streamHandler(s.handler, s.method)
+	ue, created, err := s.getOrCreateUDPExchange(key, dst, handler, method, d.Data)
 	if err != nil {
 		log.Error("[UDP_PROXY] open exchange", "dst", dst, "err", err)
 		return err
 	}
 	if created {
-		go s.receiveLoop(ue, srv, clientAddr, dst, key)
+		go s.receiveLoop(ue, srv, clientAddr, dst, key, user)
 		return nil // first payload already sent in handshake
 	}
 
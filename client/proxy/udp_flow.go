@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/util/bytespool"
+)
+
+// udpFlow carries the datagrams of one client flow. It is opened in the
+// background by the first datagram; send and the closers are set by the
+// open function before ready closes.
+type udpFlow struct {
+	ready    chan struct{}
+	send     func([]byte) error
+	closers  []io.Closer
+	lastSeen atomic.Int64
+	once     sync.Once
+}
+
+func (f *udpFlow) touch() {
+	f.lastSeen.Store(time.Now().UnixNano())
+}
+
+// onClose registers c to be closed with the flow.
+func (f *udpFlow) onClose(c io.Closer) {
+	f.closers = append(f.closers, c)
+}
+
+func (f *udpFlow) close() {
+	f.once.Do(func() {
+		for _, c := range f.closers {
+			c.Close() //nolint:errcheck
+		}
+	})
+}
+
+// udpFlows is the flow table of a UDP inbound relaying each client flow
+// over its own exchange, expiring flows idle for longer than idleTimeout.
+type udpFlows struct {
+	tag         string
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+}
+
+func newUDPFlows(tag string, idleTimeout time.Duration) *udpFlows {
+	return &udpFlows{tag: tag, idleTimeout: idleTimeout, flows: make(map[string]*udpFlow)}
+}
+
+// handle relays payload on the flow of key. The first datagram of a flow
+// opens it with open in the background; datagrams arriving before it is
+// ready are sent once it is. A flow failing to open is removed.
+func (t *udpFlows) handle(key string, payload []byte, open func(f *udpFlow, first []byte) error) {
+	t.mu.Lock()
+	f, ok := t.flows[key]
+	if !ok {
+		f = &udpFlow{ready: make(chan struct{})}
+		f.touch()
+		t.flows[key] = f
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		go func() {
+			defer close(f.ready)
+			if err := open(f, payload); err != nil {
+				f.send = nil
+				t.remove(key, f)
+			}
+		}()
+		return
+	}
+	select {
+	case <-f.ready:
+		t.send(key, f, payload)
+	default:
+		go func() {
+			<-f.ready
+			t.send(key, f, payload)
+		}()
+	}
+}
+
+func (t *udpFlows) send(key string, f *udpFlow, data []byte) {
+	if f.send == nil {
+		return
+	}
+	f.touch()
+	if err := f.send(data); err != nil {
+		log.Debug(t.tag+" send udp", "key", key, "err", err)
+		t.remove(key, f)
+	}
+}
+
+func (t *udpFlows) remove(key string, f *udpFlow) {
+	t.mu.Lock()
+	if t.flows[key] == f {
+		delete(t.flows, key)
+	}
+	t.mu.Unlock()
+	f.close()
+}
+
+// relay copies the replies read from the flow's upstream to the client
+// with write until either fails, then removes the flow.
+func (t *udpFlows) relay(key string, f *udpFlow, read func([]byte) (int, error), write func([]byte) error) {
+	defer t.remove(key, f)
+	buf := bytespool.Get(protocol.MaxUDPDataSize)
+	defer bytespool.MustPut(buf)
+	for {
+		n, err := read(buf)
+		if err != nil {
+			return
+		}
+		f.touch()
+		if err := write(buf[:n]); err != nil {
+			log.Debug(t.tag+" write udp reply", "key", key, "err", err)
+			return
+		}
+	}
+}
+
+// cleanupLoop closes the idle flows until quit closes.
+func (t *udpFlows) cleanupLoop(quit <-chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(-t.idleTimeout).UnixNano()
+			t.mu.Lock()
+			for key, f := range t.flows {
+				select {
+				case <-f.ready:
+				default:
+					continue
+				}
+				if f.lastSeen.Load() < deadline {
+					log.Debug(t.tag+" udp idle cleanup", "key", key)
+					f.close()
+					delete(t.flows, key)
+				}
+			}
+			t.mu.Unlock()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// closeAll removes and closes every flow.
+func (t *udpFlows) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, f := range t.flows {
+		delete(t.flows, key)
+		// A flow still being opened owns its closers until ready.
+		go func() {
+			<-f.ready
+			f.close()
+		}()
+	}
+}
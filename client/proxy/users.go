@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/stats"
+	"golang.org/x/time/rate"
+)
+
+// User is an authenticated client of the local inbounds and its policy. A
+// nil *User is the anonymous client of an inbound without credentials and
+// follows the inbound's defaults.
+type User struct {
+	Name     string
+	password string
+	rule     router.ProxyRule
+	handler  *StreamHandler
+	method   protocol.Method
+	up, down *rate.Limiter
+	counters *stats.UserCounters
+}
+
+// UserPolicy is what a user may change from the inbound's defaults.
+type UserPolicy struct {
+	// ProxyRule overrides the router's proxy rule, 0 keeps it.
+	ProxyRule router.ProxyRule
+	// Handler carries the user's proxied streams with Method, the cipher
+	// of the handler's server; nil uses the inbound's handler and method.
+	Handler *StreamHandler
+	Method  protocol.Method
+	// BandwidthLimit caps each direction in bytes per second, 0 is unlimited.
+	BandwidthLimit int64
+}
+
+// Users holds the credentials accepted by an inbound. An empty set accepts
+// every client without authentication.
+type Users struct {
+	byName map[string]*User
+}
+
+func NewUsers() *Users {
+	return &Users{byName: make(map[string]*User)}
+}
+
+// singleUser returns the set holding the legacy auth_username/auth_password
+// credential, empty when neither is set.
+func singleUser(username, password string) *Users {
+	us := NewUsers()
+	if username != "" || password != "" {
+		_ = us.Add(username, password, UserPolicy{})
+	}
+	return us
+}
+
+func (us *Users) Add(name, password string, p UserPolicy) error {
+	if _, ok := us.byName[name]; ok {
+		return fmt.Errorf("duplicate local user %q", name)
+	}
+	u := &User{
+		Name:     name,
+		password: password,
+		rule:     p.ProxyRule,
+		handler:  p.Handler,
+		method:   p.Method,
+		counters: stats.User(name),
+	}
+	if p.BandwidthLimit > 0 {
+		u.up = newBandwidthLimiter(p.BandwidthLimit)
+		u.down = newBandwidthLimiter(p.BandwidthLimit)
+	}
+	us.byName[name] = u
+	return nil
+}
+
+// Enabled reports whether clients must authenticate.
+func (us *Users) Enabled() bool {
+	return us != nil && len(us.byName) > 0
+}
+
+// Authenticate returns the user matching the credential. Without users
+// every client is accepted as the anonymous nil user.
+func (us *Users) Authenticate(name, password string) (*User, bool) {
+	if !us.Enabled() {
+		return nil, true
+	}
+	u, ok := us.byName[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(u.password), []byte(password)) != 1 {
+		return nil, false
+	}
+	return u, true
+}
+
+// matchHostRule routes host under the user's proxy rule.
+func (u *User) matchHostRule(rt *router.Router, host string) router.HostRule {
+	if rt == nil {
+		return router.HostRuleProxy
+	}
+	if u != nil && u.rule != 0 {
+		return rt.MatchHostRuleFor(host, u.rule)
+	}
+	return rt.MatchHostRule(host)
+}
+
+// streamHandler returns the handler carrying the user's proxied streams
+// and the cipher method to open them with.
+func (u *User) streamHandler(def *StreamHandler, defMethod protocol.Method) (*StreamHandler, protocol.Method) {
+	if u != nil && u.handler != nil {
+		return u.handler, u.method
+	}
+	return def, defMethod
+}
+
+// wrapConn records a connection of the user and returns c, a connection
+// from the user, metered and rate limited by the user's policy.
+func (u *User) wrapConn(c net.Conn) net.Conn {
+	if u == nil {
+		return c
+	}
+	u.counters.RecordConnection()
+	return &userConn{Conn: c, u: u}
+}
+
+// wrapTarget is wrapConn for a connection towards the user's target, as
+// dialed for forwarded HTTP requests.
+func (u *User) wrapTarget(c net.Conn) net.Conn {
+	if u == nil {
+		return c
+	}
+	u.counters.RecordConnection()
+	return &userConn{Conn: c, u: u, target: true}
+}
+
+// meterUp records n bytes relayed from the user, such as a datagram, and
+// waits for its upload limit.
+func (u *User) meterUp(n int) error {
+	if u == nil {
+		return nil
+	}
+	u.counters.RecordBytesUp(n)
+	return waitBandwidth(u.up, n)
+}
+
+// meterDown is meterUp for n bytes relayed to the user.
+func (u *User) meterDown(n int) error {
+	if u == nil {
+		return nil
+	}
+	u.counters.RecordBytesDown(n)
+	return waitBandwidth(u.down, n)
+}
+
+// bandwidthBurst bounds the burst of a bandwidth limiter, so slow limits
+// still let a full read through in a few waits.
+const bandwidthBurst = 64 * 1024
+
+func newBandwidthLimiter(limit int64) *rate.Limiter {
+	burst := bandwidthBurst
+	if limit < int64(burst) {
+		burst = int(limit)
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// waitBandwidth blocks until l allows n bytes, in chunks of its burst.
+func waitBandwidth(l *rate.Limiter, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		if err := l.WaitN(context.Background(), chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// userConn is a connection of a user. Reads from the user are its upload
+// and writes its download; target reverses both.
+type userConn struct {
+	net.Conn
+	u      *User
+	target bool
+}
+
+func (c *userConn) Read(p []byte) (int, error) {
+	lim, record := c.u.up, c.u.counters.RecordBytesUp
+	if c.target {
+		lim, record = c.u.down, c.u.counters.RecordBytesDown
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		record(n)
+		if werr := waitBandwidth(lim, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *userConn) Write(p []byte) (int, error) {
+	lim, record := c.u.down, c.u.counters.RecordBytesDown
+	if c.target {
+		lim, record = c.u.up, c.u.counters.RecordBytesUp
+	}
+	if lim == nil {
+		n, err := c.Conn.Write(p)
+		record(n)
+		return n, err
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), lim.Burst())]
+		if err := waitBandwidth(lim, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		record(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *userConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
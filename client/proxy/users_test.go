@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/stats"
+	"github.com/txthinking/socks5"
+)
+
+func TestUsersAuthenticate(t *testing.T) {
+	us := NewUsers()
+	if err := us.Add("alice", "secret", UserPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Add("alice", "other", UserPolicy{}); err == nil {
+		t.Fatal("duplicate user should be rejected")
+	}
+
+	tests := []struct {
+		name     string
+		users    *Users
+		username string
+		password string
+		wantOK   bool
+		wantUser string
+	}{
+		{name: "无用户时匿名通过", users: NewUsers(), wantOK: true},
+		{name: "nil 用户集匿名通过", users: nil, username: "x", wantOK: true},
+		{name: "密码正确", users: us, username: "alice", password: "secret", wantOK: true, wantUser: "alice"},
+		{name: "密码错误", users: us, username: "alice", password: "wrong"},
+		{name: "用户不存在", users: us, username: "bob", password: "secret"},
+		{name: "有用户时不允许匿名", users: us},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, ok := tt.users.Authenticate(tt.username, tt.password)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			var name string
+			if u != nil {
+				name = u.Name
+			}
+			if name != tt.wantUser {
+				t.Fatalf("user = %q, want %q", name, tt.wantUser)
+			}
+		})
+	}
+}
+
+func userStats(t *testing.T, name string) stats.UserStats {
+	t.Helper()
+	for _, u := range stats.Collect().Users {
+		if u.Name == name {
+			return u
+		}
+	}
+	t.Fatalf("user %q not in stats", name)
+	return stats.UserStats{}
+}
+
+func TestUserConnCounters(t *testing.T) {
+	us := NewUsers()
+	if err := us.Add("conn-counter", "", UserPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := us.Authenticate("conn-counter", "")
+
+	// 客户端连接：读为上行，写为下行
+	a, b := net.Pipe()
+	defer b.Close() //nolint:errcheck
+	c := u.wrapConn(a)
+	go func() {
+		_, _ = b.Write([]byte("hello"))
+		_, _ = io.ReadFull(b, make([]byte, 3))
+	}()
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	got := userStats(t, "conn-counter")
+	if got.Connections != 1 || got.BytesUp != 5 || got.BytesDown != 3 {
+		t.Fatalf("client conn stats = %+v", got)
+	}
+
+	// 目标连接：方向相反
+	a2, b2 := net.Pipe()
+	defer b2.Close() //nolint:errcheck
+	tc := u.wrapTarget(a2)
+	go func() {
+		_, _ = io.ReadFull(b2, make([]byte, 4))
+		_, _ = b2.Write([]byte("xy"))
+	}()
+	if _, err := tc.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(tc, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	got = userStats(t, "conn-counter")
+	if got.Connections != 2 || got.BytesUp != 9 || got.BytesDown != 5 {
+		t.Fatalf("target conn stats = %+v", got)
+	}
+}
+
+func TestUserConnBandwidthLimit(t *testing.T) {
+	us := NewUsers()
+	if err := us.Add("limited", "", UserPolicy{BandwidthLimit: 32 * 1024}); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := us.Authenticate("limited", "")
+
+	a, b := net.Pipe()
+	defer b.Close() //nolint:errcheck
+	go func() { _, _ = io.Copy(io.Discard, b) }()
+	c := u.wrapConn(a)
+
+	// 首个突发免等待，其余 64KiB 需约 2 秒
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 96*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 1500*time.Millisecond {
+		t.Fatalf("write took %v, bandwidth limit not applied", d)
+	}
+}
+
+func startSocks5Server(t *testing.T, rt *router.Router, users *Users) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() //nolint:errcheck
+
+	s, err := NewSocks5Server(addr, "", "", nil, rt, "", protocol.MethodAES256GCM, false, 2*time.Second, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetUsers(users)
+	go func() { _ = s.Start() }()
+	t.Cleanup(func() { _ = s.Close() })
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close() //nolint:errcheck
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("socks5 server did not start")
+	return ""
+}
+
+func TestSocks5ServerUsers(t *testing.T) {
+	echo := startEchoServer(t)
+
+	// 全局规则为 proxy，alice 自己的 direct 规则使其直连
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleProxy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	us := NewUsers()
+	if err := us.Add("socks-alice", "secret", UserPolicy{ProxyRule: router.ProxyRuleDirect}); err != nil {
+		t.Fatal(err)
+	}
+	addr := startSocks5Server(t, rt, us)
+
+	t.Run("认证成功并按用户规则直连", func(t *testing.T) {
+		client, err := socks5.NewClient(addr, "socks-alice", "secret", 3, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		assertEcho(t, c)
+		c.Close() //nolint:errcheck
+
+		deadline := time.Now().Add(2 * time.Second)
+		for userStats(t, "socks-alice").BytesDown < 4 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := userStats(t, "socks-alice"); got.Connections < 1 || got.BytesUp < 4 || got.BytesDown < 4 {
+			t.Fatalf("stats = %+v", got)
+		}
+	})
+
+	t.Run("UDP 关联归属用户", func(t *testing.T) {
+		udpEcho, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer udpEcho.Close() //nolint:errcheck
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, from, err := udpEcho.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				_, _ = udpEcho.WriteToUDP(buf[:n], from)
+			}
+		}()
+
+		before := userStats(t, "socks-alice")
+		client, err := socks5.NewClient(addr, "socks-alice", "secret", 3, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 全局规则为 proxy 且没有隧道，只有按 alice 的 direct 规则才能收到回包
+		c, err := client.Dial("udp", udpEcho.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() //nolint:errcheck
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "ping" {
+			t.Fatalf("reply = %q", buf[:n])
+		}
+		if got := userStats(t, "socks-alice"); got.BytesUp < before.BytesUp+4 || got.BytesDown < before.BytesDown+4 {
+			t.Fatalf("stats = %+v, before %+v", got, before)
+		}
+
+		// 没有关联的来源地址发来的数据报被丢弃
+		stray, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+		if err != nil {
+			t.Skip("127.0.0.2 unavailable:", err)
+		}
+		defer stray.Close() //nolint:errcheck
+		a, dstAddr, dstPort, err := socks5.ParseAddress(udpEcho.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := socks5.NewDatagram(a, dstAddr, dstPort, []byte("ping"))
+		server, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stray.WriteToUDP(d.Bytes(), server); err != nil {
+			t.Fatal(err)
+		}
+		_ = stray.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, _, err := stray.ReadFromUDP(buf); err == nil {
+			t.Fatal("datagram without association relayed")
+		}
+	})
+
+	t.Run("密码错误", func(t *testing.T) {
+		client, err := socks5.NewClient(addr, "socks-alice", "wrong", 3, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, err := client.Dial("tcp", echo.Addr().String()); err == nil {
+			c.Close() //nolint:errcheck
+			t.Fatal("dial with a wrong password should fail")
+		}
+	})
+
+	t.Run("不允许匿名", func(t *testing.T) {
+		client, err := socks5.NewClient(addr, "", "", 3, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, err := client.Dial("tcp", echo.Addr().String()); err == nil {
+			c.Close() //nolint:errcheck
+			t.Fatal("anonymous dial should fail")
+		}
+	})
+}
+
+func TestHTTPProxyUsers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	us := NewUsers()
+	if err := us.Add("http-bob", "secret", UserPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	// 用户请求在进程内转发
+	s := NewHTTPProxyServer("127.0.0.1:5080", "", "", 2*time.Second, nil, newDirectRouter(t), 0, nil)
+	s.SetUsers(us)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	get := func(user *url.Userinfo) *http.Response {
+		t.Helper()
+		proxyURL, _ := url.Parse(srv.URL)
+		proxyURL.User = user
+		hc := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+			Timeout:   3 * time.Second,
+		}
+		resp, err := hc.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get(url.UserPassword("http-bob", "secret"))
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("status = %d, body = %q", resp.StatusCode, body)
+	}
+	if got := userStats(t, "http-bob"); got.Connections != 1 || got.BytesUp == 0 || got.BytesDown == 0 {
+		t.Fatalf("stats = %+v", got)
+	}
+
+	resp = get(url.UserPassword("http-bob", "wrong"))
+	resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+	}
+}
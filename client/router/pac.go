@@ -0,0 +1,234 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"regexp"
+	"sort"
+)
+
+// PACContentType is the MIME type of a proxy auto-config file.
+const PACContentType = "application/x-ns-proxy-autoconfig"
+
+// String returns the configuration name of the rule.
+func (p ProxyRule) String() string {
+	switch p {
+	case ProxyRuleAuto:
+		return "auto"
+	case ProxyRuleReverseAuto:
+		return "reverse_auto"
+	case ProxyRuleProxy:
+		return "proxy"
+	case ProxyRuleDirect:
+		return "direct"
+	case ProxyRuleAutoBlock:
+		return "auto_block"
+	default:
+		return "unknown"
+	}
+}
+
+// PAC returns a proxy auto-config script mirroring MatchHostRule: hosts the
+// router connects directly get DIRECT, everything else gets proxy, a PAC
+// directive such as "PROXY 127.0.0.1:5080". Hosts the script cannot classify
+// exactly, e.g. IP addresses that need the GeoIP database or domains the
+// auto_block rule may block, are left to the proxy, which applies the full
+// rules.
+func (r *Router) PAC(proxy string) []byte {
+	rule := r.ProxyRule()
+
+	var b bytes.Buffer
+	b.WriteString("// Generated by Easyss from the routing rules, proxy rule: " + rule.String() + ".\n")
+	b.WriteString("var proxy = " + jsValue(proxy) + ";\n")
+	b.WriteString("var rule = " + jsValue(rule.String()) + ";\n")
+
+	r.customMu.RLock()
+	var directIPs []string
+	for ip := range r.customDirectIPs {
+		directIPs = append(directIPs, ip)
+	}
+	directNets := [][2]string{}
+	for _, n := range r.customDirectCIDRIPs {
+		if ip4 := n.IP.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+			directNets = append(directNets, [2]string{ip4.String(), net.IP(n.Mask).String()})
+		}
+	}
+	directDomains := sortedKeys(r.customDirectDomains)
+	proxyDomains := sortedKeys(r.customProxyDomains)
+	directPatterns := regexpSources(r.customDirectRegexps)
+	proxyPatterns := regexpSources(r.customProxyRegexps)
+	r.customMu.RUnlock()
+	sort.Strings(directIPs)
+
+	b.WriteString("var directIPs = " + jsSet(directIPs) + ";\n")
+	b.WriteString("var directNets = " + jsValue(directNets) + ";\n")
+	b.WriteString("var directDomains = " + jsSet(directDomains) + ";\n")
+	b.WriteString("var directPatterns = " + jsValue(directPatterns) + ";\n")
+	b.WriteString("var proxyDomains = " + jsSet(proxyDomains) + ";\n")
+	b.WriteString("var proxyPatterns = " + jsValue(proxyPatterns) + ";\n")
+
+	// The geosite list is only consulted by the rules matching by location.
+	if rule == ProxyRuleAuto || rule == ProxyRuleReverseAuto || rule == ProxyRuleAutoBlock {
+		b.WriteString(r.geoSiteDirect.pacVars())
+	} else {
+		b.WriteString("var geoFull = {};\nvar geoDomains = {};\nvar geoPatterns = [];\n")
+	}
+	b.WriteString(pacScript)
+	return b.Bytes()
+}
+
+// pacVars returns the site list as PAC variables. It is built once: the
+// embedded list is large and never changes.
+func (gs *GeoSite) pacVars() string {
+	gs.pacOnce.Do(func() {
+		gs.pac = "var geoFull = " + jsSet(sortedKeys(gs.fullDomain)) + ";\n" +
+			"var geoDomains = " + jsSet(sortedKeys(gs.domain)) + ";\n" +
+			"var geoPatterns = " + jsValue(regexpSources(gs.regexpDomain)) + ";\n"
+	})
+	return gs.pac
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsSet renders keys as an object literal used as a set.
+func jsSet(keys []string) string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(jsValue(k))
+		b.WriteString(":1")
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// jsValue renders v as a JavaScript literal. JSON is valid JavaScript and
+// escapes every character that could end a string or the script.
+func jsValue(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func regexpSources(res []*regexp.Regexp) []string {
+	sources := make([]string, 0, len(res))
+	for _, re := range res {
+		sources = append(sources, re.String())
+	}
+	return sources
+}
+
+// pacScript implements FindProxyForURL on top of the variables emitted by
+// PAC, following the order of MatchHostRule. Patterns are Go regular
+// expressions; the few that JavaScript cannot compile are skipped, so the
+// hosts they match are left to the proxy.
+const pacScript = `var lanNets = [["0.0.0.0", "255.255.255.255"], ["10.0.0.0", "255.0.0.0"], ["127.0.0.0", "255.0.0.0"],
+	["169.254.0.0", "255.255.0.0"], ["172.16.0.0", "255.240.0.0"], ["192.168.0.0", "255.255.0.0"], ["224.0.0.0", "240.0.0.0"]];
+
+function compile(sources) {
+	var res = [];
+	for (var i = 0; i < sources.length; i++) {
+		try {
+			res.push(new RegExp(sources[i]));
+		} catch (e) {}
+	}
+	return res;
+}
+
+var directRes = compile(directPatterns);
+var proxyRes = compile(proxyPatterns);
+var geoRes = compile(geoPatterns);
+
+function has(set, key) {
+	return Object.prototype.hasOwnProperty.call(set, key);
+}
+
+// hasDomain matches host and its parent domains, except the top-level one.
+function hasDomain(set, host) {
+	if (has(set, host)) {
+		return true;
+	}
+	for (var i = host.indexOf("."); i > 0; i = host.indexOf(".")) {
+		host = host.substring(i + 1);
+		if (host.indexOf(".") > 0 && has(set, host)) {
+			return true;
+		}
+	}
+	return false;
+}
+
+function matchAny(res, host) {
+	for (var i = 0; i < res.length; i++) {
+		if (res[i].test(host)) {
+			return true;
+		}
+	}
+	return false;
+}
+
+function isIPv4(host) {
+	return /^\d{1,3}(\.\d{1,3}){3}$/.test(host);
+}
+
+function inNets(host, nets) {
+	for (var i = 0; i < nets.length; i++) {
+		if (isInNet(host, nets[i][0], nets[i][1])) {
+			return true;
+		}
+	}
+	return false;
+}
+
+function isLAN(host) {
+	if (host === "localhost") {
+		return true;
+	}
+	if (isIPv4(host)) {
+		return inNets(host, lanNets);
+	}
+	return host === "::" || host === "::1" || /^(f[cd][0-9a-f]{2}|fe[89ab][0-9a-f]|ff[0-9a-f]{2}):/.test(host);
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (host.charAt(0) === "[") {
+		host = host.substring(1, host.length - 1);
+	}
+	if (rule === "direct" || isLAN(host)) {
+		return "DIRECT";
+	}
+	if (rule === "proxy") {
+		return proxy;
+	}
+	if (isIPv4(host) || host.indexOf(":") >= 0) {
+		if (has(directIPs, host) || (isIPv4(host) && inNets(host, directNets))) {
+			return "DIRECT";
+		}
+		return proxy;
+	}
+	if (hasDomain(directDomains, host) || matchAny(directRes, host)) {
+		return "DIRECT";
+	}
+	if (hasDomain(proxyDomains, host) || matchAny(proxyRes, host)) {
+		return proxy;
+	}
+	if (rule === "auto_block") {
+		return has(geoFull, host) || has(geoDomains, host) ? "DIRECT" : proxy;
+	}
+	var cn = /\.cn$/.test(host) || has(geoFull, host) || hasDomain(geoDomains, host) || matchAny(geoRes, host);
+	if (rule === "reverse_auto") {
+		return cn ? proxy : "DIRECT";
+	}
+	return cn ? "DIRECT" : proxy;
+}
+`
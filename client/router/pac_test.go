@@ -0,0 +1,92 @@
+package router
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProxyRule_String(t *testing.T) {
+	for _, name := range []string{"auto", "reverse_auto", "proxy", "direct", "auto_block"} {
+		if got := ParseProxyRule(name).String(); got != name {
+			t.Errorf("ParseProxyRule(%q).String() = %q", name, got)
+		}
+	}
+	if got := ProxyRule(0).String(); got != "unknown" {
+		t.Errorf("ProxyRule(0).String() = %q", got)
+	}
+}
+
+func TestRouter_PAC(t *testing.T) {
+	dir := t.TempDir()
+	directFile := filepath.Join(dir, "direct.txt")
+	proxyFile := filepath.Join(dir, "proxy.txt")
+	if err := os.WriteFile(directFile, []byte("direct.example.com\n10.9.0.0/16\n2001:db8::/32\n*.glob.net\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(proxyFile, []byte("proxy.cn\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		rule    ProxyRule
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "auto 包含自定义规则和 geosite",
+			rule: ProxyRuleAuto,
+			want: []string{
+				`var proxy = "PROXY 127.0.0.1:5080";`,
+				`var rule = "auto";`,
+				`var directDomains = {"direct.example.com":1};`,
+				`var directNets = [["10.9.0.0","255.255.0.0"]];`,
+				`var directPatterns = ["^.*\\.glob\\.net$"];`,
+				`var proxyDomains = {"proxy.cn":1};`,
+				`"baidu.com":1`,
+				"function FindProxyForURL(url, host)",
+			},
+			notWant: []string{"2001:db8"},
+		},
+		{
+			name:    "proxy 规则不输出 geosite",
+			rule:    ProxyRuleProxy,
+			want:    []string{`var rule = "proxy";`, "var geoDomains = {};"},
+			notWant: []string{`"baidu.com":1`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(Config{ProxyRule: tt.rule, DirectFile: directFile, ProxyFile: proxyFile})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pac := string(r.PAC("PROXY 127.0.0.1:5080"))
+			for _, w := range tt.want {
+				if !strings.Contains(pac, w) {
+					t.Errorf("PAC missing %q", w)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(pac, w) {
+					t.Errorf("PAC should not contain %q", w)
+				}
+			}
+		})
+	}
+}
+
+func TestRouter_PACEscapes(t *testing.T) {
+	r, err := New(Config{ProxyRule: ProxyRuleDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddDirectDomain(`evil";alert(1);//`)
+	pac := string(r.PAC("PROXY 127.0.0.1:5080"))
+	if !strings.Contains(pac, `{"evil\";alert(1);//":1}`) {
+		t.Errorf("domain not escaped:\n%s", pac[:400])
+	}
+}
@@ -72,6 +72,9 @@ type GeoSite struct {
 	domain       map[string]struct{}
 	fullDomain   map[string]struct{}
 	regexpDomain []*regexp.Regexp
+
+	pacOnce sync.Once
+	pac     string
 }
 
 func NewGeoSite(data []byte) *GeoSite {
@@ -279,7 +282,12 @@ func (r *Router) loadCustomIPDomains() error {
 }
 
 func (r *Router) MatchHostRule(host string) HostRule {
-	rule := ProxyRule(r.proxyRule.Load())
+	return r.MatchHostRuleFor(host, r.ProxyRule())
+}
+
+// MatchHostRuleFor is MatchHostRule under the given proxy rule instead of
+// the router's own, for clients with a rule of their own.
+func (r *Router) MatchHostRuleFor(host string, rule ProxyRule) HostRule {
 	if rule == ProxyRuleDirect || r.isLANHost(host) {
 		return HostRuleDirect
 	}
@@ -252,6 +252,40 @@ func TestRouter_SetProxyRule(t *testing.T) {
 	}
 }
 
+func TestRouter_MatchHostRuleFor(t *testing.T) {
+	r := &Router{
+		customDirectIPs:     make(map[string]struct{}),
+		customDirectDomains: map[string]struct{}{"example.com": {}},
+		customProxyIPs:      make(map[string]struct{}),
+		customProxyDomains:  make(map[string]struct{}),
+	}
+	r.proxyRule.Store(int32(ProxyRuleAuto))
+
+	tests := []struct {
+		name string
+		host string
+		rule ProxyRule
+		want HostRule
+	}{
+		{name: "auto 命中自定义直连", host: "www.example.com", rule: ProxyRuleAuto, want: HostRuleDirect},
+		{name: "proxy 规则全部代理", host: "www.example.com", rule: ProxyRuleProxy, want: HostRuleProxy},
+		{name: "direct 规则全部直连", host: "www.google.com", rule: ProxyRuleDirect, want: HostRuleDirect},
+		{name: "局域网始终直连", host: "192.168.1.1", rule: ProxyRuleProxy, want: HostRuleDirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.MatchHostRuleFor(tt.host, tt.rule); got != tt.want {
+				t.Errorf("MatchHostRuleFor(%q, %d) = %d, want %d", tt.host, tt.rule, got, tt.want)
+			}
+		})
+	}
+
+	// 不影响路由器自身的规则
+	if r.ProxyRule() != ProxyRuleAuto {
+		t.Errorf("ProxyRule = %d, want %d", r.ProxyRule(), ProxyRuleAuto)
+	}
+}
+
 func TestRouter_SetIPV6Info(t *testing.T) {
 	r := &Router{}
 	r.SetIPV6Info(true, "2001:db8::1")
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"syscall"
 	"time"
 	_ "time/tzdata"
@@ -88,6 +89,7 @@ func main() {
 		"listen", cfg.Listen,
 		"domain", cfg.Domain,
 		"next_proxy_file", cfg.NextProxy.NextProxyFile,
+		"next_proxies", len(cfg.NextProxies),
 		"cert", cfg.CertPath,
 		"key", cfg.KeyPath,
 	)
@@ -109,19 +111,34 @@ func main() {
 	}()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-	select {
-	case err := <-startErrCh:
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Error("[EASYSS-SERVER-V3] start server", "err", err)
-			os.Exit(1)
+	signal.Notify(c, append([]os.Signal{os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT}, upgradeSignals...)...)
+
+wait:
+	for {
+		select {
+		case err := <-startErrCh:
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("[EASYSS-SERVER-V3] start server", "err", err)
+				os.Exit(1)
+			}
+			break wait
+		case sig := <-c:
+			if !slices.Contains(upgradeSignals, sig) {
+				log.Info("[EASYSS-SERVER-V3] got signal to exit", "signal", sig)
+				break wait
+			}
+			log.Info("[EASYSS-SERVER-V3] got signal to upgrade", "signal", sig)
+			if err := srv.Upgrade(upgradeTimeout); err != nil {
+				log.Error("[EASYSS-SERVER-V3] upgrade", "err", err)
+				continue
+			}
+			break wait
 		}
-	case sig := <-c:
-		log.Info("[EASYSS-SERVER-V3] got signal to exit", "signal", sig)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Streams get the drain timeout to finish; the new process of an
+	// upgrade already serves the new ones.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.GetDrainTimeout())
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Error("[EASYSS-SERVER-V3] shutdown server", "err", err)
@@ -132,6 +149,9 @@ func main() {
 	os.Exit(0)
 }
 
+// upgradeTimeout bounds the start of the new process of an upgrade.
+const upgradeTimeout = time.Minute
+
 func exampleV3ServerConfig() string {
 	cfg := config.FileConfig{
 		ConfigVersion: 3,
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals ask the server to hand its sockets to a new binary.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
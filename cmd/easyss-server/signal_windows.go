@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// upgradeSignals is empty: handing sockets over needs inherited file
+// descriptors, which Windows does not pass on.
+var upgradeSignals []os.Signal
@@ -332,9 +332,7 @@ func newTestHarness(t *testing.T) *testHarness {
 
 	// Start HTTP proxy
 	httpAddr := testServerAddr + ":" + strconv.Itoa(testHTTPPort)
-	socksProxyAddr := testServerAddr + ":" + strconv.Itoa(testSocks5Port)
-	httpProxy, err := proxy.NewHTTPProxyServer(httpAddr, socksProxyAddr, "", "", timeout, handler, cli.Router(), method, cli.DialContext)
-	require.NoError(t, err)
+	httpProxy := proxy.NewHTTPProxyServer(httpAddr, "", "", timeout, handler, cli.Router(), method, cli.DialContext)
 	h.httpProxy = httpProxy
 
 	go func() {
@@ -17,6 +17,7 @@ import (
 	_ "time/tzdata"
 
 	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/proxy"
 	"github.com/nange/easyss/v3/client/tun"
 	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/log"
@@ -31,7 +32,7 @@ import (
 func main() {
 	var printVer, showConfigExample, showConfigExampleSimple, daemon, disableTray, enableTun2socks, tunHelper bool
 	var configFile, cmdOutboundProto string
-	var pprofEnabled bool
+	var pprofEnabled, printNFTables bool
 	var logFile string
 
 	// TUN helper flags (used when --tun-helper is set).
@@ -65,6 +66,7 @@ func main() {
 	flag.StringVar(&sc.DirectFile, "direct-file", "", "custom direct file (IPs/CIDRs/domains/regexps mixed, one per line; supports regexp: prefix and * glob)")
 	flag.StringVar(&sc.ProxyFile, "proxy-file", "", "custom proxy file (IPs/CIDRs/domains/regexps mixed, one per line; supports regexp: prefix and * glob)")
 	flag.BoolVar(&pprofEnabled, "pprof", false, "enable pprof debug server on :6060")
+	flag.BoolVar(&printNFTables, "print-nftables", false, "print the nftables rules for the transparent proxy (local.transparent_port) and exit")
 
 	flag.Parse()
 
@@ -114,6 +116,10 @@ func main() {
 	// can still find the files placed next to the binary/.app bundle.
 	cfg.ResolveFilePaths()
 
+	if printNFTables {
+		os.Exit(printTransparentRules(cfg))
+	}
+
 	if cfg.Log.FilePath != "" && !filepath.IsAbs(cfg.Log.FilePath) {
 		if dir := util.CurrentDir(); dir != "" {
 			cfg.Log.FilePath = filepath.Join(dir, cfg.Log.FilePath)
@@ -153,6 +159,11 @@ func main() {
 		"server", cfg.DefaultServerAddr(),
 		"socks_port", cfg.Local.SocksPort,
 		"http_port", cfg.Local.HTTPPort,
+		"mixed_port", cfg.Local.MixedPort,
+		"local_users", len(cfg.Local.Users),
+		"local_forwards", len(cfg.Local.Forwards),
+		"local_reverse", len(cfg.Local.Reverse),
+		"local_mitm", cfg.Local.MITM != nil && cfg.Local.MITM.Enable,
 		"proxy_rule", cfg.Routing.ProxyRule,
 		"ipv6_rule", cfg.Routing.IPV6Rule,
 		"timeout", cfg.Timeout,
@@ -315,6 +326,8 @@ func (a *App) statsLoop() {
 				"udp_assoc", snap.UDPAssociations,
 				"dns(hit)", snap.DNSCacheHits,
 				"dns(miss)", snap.DNSCacheMisses,
+				"dns(prefetch)", snap.DNSPrefetches,
+				"dns(stale)", snap.DNSStaleServed,
 				"dns(proxy)", snap.DNSProxyQueries,
 				"dns(direct)", snap.DNSDirectQueries,
 				"padding", stats.HumanBytes(snap.PaddingBytes),
@@ -332,15 +345,44 @@ func (a *App) statsLoop() {
 	}
 }
 
+// printTransparentRules prints the nftables ruleset matching the transparent
+// proxy configuration.
+func printTransparentRules(cfg *config.ClientConfig) int {
+	if cfg.Local.TransparentPort <= 0 {
+		fmt.Fprintln(os.Stderr, "local.transparent_port is not configured")
+		return 1
+	}
+	mode, err := proxy.ParseTransparentMode(cfg.Local.TransparentMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(proxy.NFTablesRules(mode, cfg.Local.TransparentPort))
+	return 0
+}
+
 // tunDNS returns the DNS server to set on the system during TUN mode.
-// When the built-in DNS forward server is enabled, queries should go to
-// 127.0.0.1 so they are handled and logged by EasySS. Otherwise a public
-// DNS server is used and queries go through the TUN device as raw UDP.
+// When the built-in DNS forward server is enabled, queries should go to it
+// so they are handled and logged by EasySS. Otherwise a public DNS server is
+// used and queries go through the TUN device as raw UDP. System resolvers
+// only speak to port 53, so a forward server on another port is not usable
+// here.
 func tunDNS(cfg *config.ClientConfig) string {
-	if cfg.Local.EnableForwardDNS {
+	if !cfg.Local.EnableForwardDNS {
+		return config.DefaultSystemDNS
+	}
+	addr := cfg.Local.ForwardDNSAddr
+	if addr == "" {
+		addr = sharedconfig.DefaultForwardDNSAddr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != "53" {
+		return config.DefaultSystemDNS
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
 		return "127.0.0.1"
 	}
-	return config.DefaultSystemDNS
+	return host
 }
 
 func exampleV3Config() string {
@@ -358,11 +400,16 @@ func exampleV3Config() string {
 		Local: config.LocalConfig{
 			SocksPort:        sharedconfig.DefaultSocksPort,
 			HTTPPort:         sharedconfig.DefaultHTTPPort,
+			MixedPort:        0,
 			BindAll:          false,
 			DisableSysProxy:  false,
+			SysProxyPAC:      false,
 			EnableForwardDNS: false,
+			ForwardDNSAddr:   sharedconfig.DefaultForwardDNSAddr,
 			EnableTun2socks:  false,
 			EnableQUIC:       false,
+			TransparentPort:  0,
+			TransparentMode:  sharedconfig.DefaultTransparentMode,
 		},
 		Routing: config.RoutingConfig{
 			ProxyRule:  sharedconfig.DefaultProxyRule,
@@ -370,6 +417,15 @@ func exampleV3Config() string {
 			DirectFile: "",
 			ProxyFile:  "",
 		},
+		DNS: config.DNSConfig{
+			Hosts:          map[string]string{},
+			HostsFile:      "",
+			ForwardRouting: false,
+			CacheFile:      "",
+			StaleTTL:       0,
+			Prefetch:       false,
+			ECS:            config.ECSConfig{ProxyRules: []string{}},
+		},
 		Transport: config.TransportConfig{
 			Protocol:          sharedconfig.DefaultProtocol,
 			ConnCountMax:      sharedconfig.DefaultConnCountMax,
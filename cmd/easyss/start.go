@@ -52,7 +52,7 @@ func runApp(disableTray, daemon bool, app *App) {
 	} else {
 		proxyWasSet := false
 		if !app.cfg.Local.DisableSysProxy && app.cfg.Local.HTTPPort > 0 {
-			if err := setSysProxy(app.cfg.Local.HTTPPort); err != nil {
+			if err := setSysProxy(app.cfg.Local.HTTPPort, app.cfg.Local.SysProxyPAC); err != nil {
 				log.Warn("[EASYSS-V3] set system proxy failed, you may need to configure it manually", "err", err)
 			} else {
 				proxyWasSet = true
@@ -62,14 +62,14 @@ func runApp(disableTray, daemon bool, app *App) {
 		if err := app.Start(); err != nil {
 			log.Error("[EASYSS-V3] start", "err", err)
 			if proxyWasSet {
-				_ = unsetSysProxy()
+				_ = unsetSysProxy(app.cfg.Local.SysProxyPAC)
 			}
 			os.Exit(1)
 		}
 		sigWait()
 
 		if proxyWasSet {
-			_ = unsetSysProxy()
+			_ = unsetSysProxy(app.cfg.Local.SysProxyPAC)
 		}
 		app.Stop()
 		os.Exit(0)
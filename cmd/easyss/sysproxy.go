@@ -10,7 +10,17 @@ import (
 	"github.com/wzshiming/sysproxy"
 )
 
-func setSysProxy(port int) error {
+// setSysProxy points the system proxy at the local HTTP proxy, or at its
+// /proxy.pac when pac is set so direct traffic skips the proxy entirely.
+func setSysProxy(port int, pac bool) error {
+	if pac {
+		pacURL := fmt.Sprintf("http://127.0.0.1:%d/proxy.pac", port)
+		if err := sysproxy.OnPAC(pacURL); err != nil {
+			return fmt.Errorf("set pac proxy: %w", err)
+		}
+		log.Info("[SYSPROXY] pac proxy enabled", "url", pacURL)
+		return nil
+	}
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
 	if err := sysproxy.OnHTTP(addr); err != nil {
 		return fmt.Errorf("set http proxy: %w", err)
@@ -22,7 +32,14 @@ func setSysProxy(port int) error {
 	return nil
 }
 
-func unsetSysProxy() error {
+func unsetSysProxy(pac bool) error {
+	if pac {
+		if err := sysproxy.OffPAC(); err != nil {
+			return fmt.Errorf("unset pac proxy: %w", err)
+		}
+		log.Info("[SYSPROXY] pac proxy disabled")
+		return nil
+	}
 	if err := sysproxy.OffHTTP(); err != nil {
 		return fmt.Errorf("unset http proxy: %w", err)
 	}
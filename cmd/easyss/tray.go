@@ -410,11 +410,11 @@ func (a *TrayApp) exitApp() {
 }
 
 func (a *TrayApp) setSysProxyOn() error {
-	return setSysProxy(a.cfg.Local.HTTPPort)
+	return setSysProxy(a.cfg.Local.HTTPPort, a.cfg.Local.SysProxyPAC)
 }
 
 func (a *TrayApp) setSysProxyOff() error {
-	return unsetSysProxy()
+	return unsetSysProxy(a.cfg.Local.SysProxyPAC)
 }
 
 func (a *TrayApp) createTun2socks() error {
@@ -563,11 +563,6 @@ func (a *TrayApp) closeService() {
 }
 
 func (a *TrayApp) startLocalService() {
-	if a.cfg.Local.SocksPort > 0 && a.cfg.Local.HTTPPort > 0 {
-		pacPort := a.cfg.Local.HTTPPort
-		_ = pacPort
-	}
-
 	if a.BrowserMenu() != nil && a.BrowserMenu().IsChecked() {
 		if err := a.setSysProxyOn(); err != nil {
 			log.Error("[SYSTRAY] start local: set sysproxy on", "err", err)
@@ -26,6 +26,11 @@ const (
 	DefaultProxyRule         = "auto"
 	DefaultIPV6Rule          = "auto"
 	DefaultLogLevel          = "info"
+	DefaultForwardDNSAddr    = "127.0.0.1:53"
+	DefaultTransparentMode   = "redirect"
+	DefaultMITMCACert        = "mitm-ca.pem"
+	DefaultMITMCAKey         = "mitm-ca-key.pem"
+	DefaultMITMHARFile       = "mitm.har"
 
 	// Heavy-stream detection: a stream is considered "heavy" (monopolizing
 	// its shared TCP connection under packet loss) when either condition
@@ -94,6 +99,23 @@ const (
 	EndpointICMP  = "/v3/icmp"
 	EndpointProbe = "/v3/probe"
 
+	// EndpointBind carries a SOCKS5 BIND: the server listens on a fresh
+	// port and relays the first connection it accepts. The first two DATA
+	// frames from the server are the listening and the peer address.
+	EndpointBind = "/v3/bind"
+
+	// EndpointReverse carries reverse tunnels. A ProtoReverse stream
+	// registers a port the server listens on; its first DATA frame from the
+	// server is the listening address and every later one the ID of an
+	// accepted connection, which the client claims with a ProtoReverseConn
+	// stream whose target is that ID.
+	EndpointReverse = "/v3/reverse"
+
+	// HeaderClientAddr carries the client's public IP as seen by the
+	// server, answered to an authenticated HEAD on EndpointProbe. The client
+	// uses it to derive the EDNS Client Subnet of proxied DNS queries.
+	HeaderClientAddr = "x-es-addr"
+
 	// Active slot probing: a slot suspected of degradation (passive
 	// throughput below DegradedThroughputThreshold) is confirmed by
 	// downloading a pre-generated random payload over the slot's own
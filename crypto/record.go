@@ -104,8 +104,26 @@ func NewRecordReader(r io.Reader, enc Encryptor, counter *CounterNonce, aad []by
 }
 
 func (rr *RecordReader) ReadRecord() ([]byte, error) {
+	ciphertext, err := readCiphertext(rr.r)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := rr.counter.Next()
+	plaintext, err := rr.enc.Decrypt(ciphertext, rr.aad, nonce[:])
+	bytespool.MustPut(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: decrypt record: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// readCiphertext reads the ciphertext of one record from r into a buffer
+// from bytespool, which the caller must return.
+func readCiphertext(r io.Reader) ([]byte, error) {
 	var lenBuf [protocol.MaxCipherLenSize]byte
-	if _, err := io.ReadFull(rr.r, lenBuf[:]); err != nil {
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
 		if errors.Is(err, io.EOF) {
 			return nil, io.EOF
 		}
@@ -121,19 +139,12 @@ func (rr *RecordReader) ReadRecord() ([]byte, error) {
 	}
 
 	ciphertext := bytespool.Get(cipherLen)
-	if _, err := io.ReadFull(rr.r, ciphertext); err != nil {
+	if _, err := io.ReadFull(r, ciphertext); err != nil {
 		bytespool.MustPut(ciphertext)
 		return nil, fmt.Errorf("crypto: read ciphertext: %w", err)
 	}
 
-	nonce := rr.counter.Next()
-	plaintext, err := rr.enc.Decrypt(ciphertext, rr.aad, nonce[:])
-	bytespool.MustPut(ciphertext)
-	if err != nil {
-		return nil, fmt.Errorf("crypto: decrypt record: %w", err)
-	}
-
 	stats.RecordBytesRecv(protocol.MaxCipherLenSize + cipherLen)
 
-	return plaintext, nil
+	return ciphertext, nil
 }
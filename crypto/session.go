@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/util/bytespool"
 )
 
 const (
@@ -211,16 +212,52 @@ func decodeFrame(data []byte) (protocol.Frame, error) {
 }
 
 func (sk *StreamKeys) ReadFirstRecord(src io.Reader) (FirstRecord, error) {
+	record, err := ReadBootstrapRecord(src)
+	if err != nil {
+		return FirstRecord{}, err
+	}
+	return sk.OpenFirstRecord(record)
+}
+
+// BootstrapRecord is a bootstrap record read but not yet decrypted, so a
+// server with several users can try it against each of their keys.
+type BootstrapRecord struct {
+	ciphertext []byte
+}
+
+// ReadBootstrapRecord reads the bootstrap record from src.
+func ReadBootstrapRecord(src io.Reader) (BootstrapRecord, error) {
+	ciphertext, err := readCiphertext(src)
+	if err != nil {
+		return BootstrapRecord{}, fmt.Errorf("crypto: read first record: %w", err)
+	}
+	// Trial decryption keeps the record around, so it is not pooled.
+	record := BootstrapRecord{ciphertext: append([]byte(nil), ciphertext...)}
+	bytespool.MustPut(ciphertext)
+	return record, nil
+}
+
+// ReadBootstrapRecordWithTimeout is ReadBootstrapRecord bounded by timeout,
+// failing with ErrHandshakeTimeout like ReadFirstRecordWithTimeout.
+func ReadBootstrapRecordWithTimeout(ctx context.Context, src io.Reader, timeout time.Duration) (BootstrapRecord, error) {
+	return readWithTimeout(ctx, src, timeout, func() (BootstrapRecord, error) {
+		return ReadBootstrapRecord(src)
+	})
+}
+
+// OpenFirstRecord decrypts record with the bootstrap key of sk. A record
+// sealed with another key fails with a decrypt error.
+func (sk *StreamKeys) OpenFirstRecord(record BootstrapRecord) (FirstRecord, error) {
 	bootstrapEnc, bootstrapCounter, err := sk.Encryptor("c2s", bootstrapPhase, protocol.MethodAES256GCM)
 	if err != nil {
 		return FirstRecord{}, fmt.Errorf("crypto: read first record: %w", err)
 	}
 	aad := BuildAAD(sk.Endpoint, sk.salt, "c2s", bootstrapPhase, protocol.MethodAES256GCM)
 
-	rr := NewRecordReader(src, bootstrapEnc, bootstrapCounter, aad)
-	plaintext, err := rr.ReadRecord()
+	nonce := bootstrapCounter.Next()
+	plaintext, err := bootstrapEnc.Decrypt(record.ciphertext, aad, nonce[:])
 	if err != nil {
-		return FirstRecord{}, fmt.Errorf("crypto: read first record: %w", err)
+		return FirstRecord{}, fmt.Errorf("crypto: decrypt first record: %w", err)
 	}
 
 	reader := &rawFrameReader{data: plaintext}
@@ -258,28 +295,37 @@ func decodeFramesFromPlaintextAllowEmpty(plaintext []byte) ([]protocol.Frame, er
 }
 
 func (sk *StreamKeys) ReadFirstRecordWithTimeout(ctx context.Context, src io.Reader, timeout time.Duration) (FirstRecord, error) {
+	return readWithTimeout(ctx, src, timeout, func() (FirstRecord, error) {
+		return sk.ReadFirstRecord(src)
+	})
+}
+
+// readWithTimeout runs read, closing src to unblock it when ctx is done or
+// timeout expires first.
+func readWithTimeout[T any](ctx context.Context, src io.Reader, timeout time.Duration, read func() (T, error)) (T, error) {
 	type result struct {
-		fr  FirstRecord
+		v   T
 		err error
 	}
 	ch := make(chan result, 1)
 	go func() {
-		fr, err := sk.ReadFirstRecord(src)
-		ch <- result{fr, err}
+		v, err := read()
+		ch <- result{v, err}
 	}()
 
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
+	var zero T
 	select {
 	case <-ctx.Done():
 		closeReader(src)
-		return FirstRecord{}, ctx.Err()
+		return zero, ctx.Err()
 	case <-timer.C:
 		closeReader(src)
-		return FirstRecord{}, fmt.Errorf("%w after %v", ErrHandshakeTimeout, timeout)
+		return zero, fmt.Errorf("%w after %v", ErrHandshakeTimeout, timeout)
 	case res := <-ch:
-		return res.fr, res.err
+		return res.v, res.err
 	}
 }
 
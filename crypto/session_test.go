@@ -1,12 +1,14 @@
 package crypto
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
 	"testing"
 	"time"
 
+	"github.com/nange/easyss/v3/protocol"
 	"github.com/stretchr/testify/require"
 )
 
@@ -51,3 +53,35 @@ func TestReadFirstRecordWithTimeout_ReturnsReaderError(t *testing.T) {
 type eofReader struct{}
 
 func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+func TestOpenFirstRecordTrial(t *testing.T) {
+	salt, err := GenerateSalt()
+	require.NoError(t, err)
+	endpoint := "/v3/tcp"
+
+	var keys []*StreamKeys
+	for _, password := range []string{"alice-password", "bob-password"} {
+		masterKey, err := DeriveMasterKey(password)
+		require.NoError(t, err)
+		sk, err := NewStreamKeys(masterKey, salt, endpoint)
+		require.NoError(t, err)
+		keys = append(keys, sk)
+	}
+
+	// The record is sealed with bob's key.
+	enc, ctr, err := keys[1].Encryptor("c2s", "bootstrap", protocol.MethodAES256GCM)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := NewRecordWriter(&buf, enc, ctr, BuildAAD(endpoint, salt, "c2s", "bootstrap", protocol.MethodAES256GCM))
+	hs := protocol.Handshake{Version: protocol.Version3, Proto: protocol.ProtoTCP, Method: protocol.MethodAES256GCM, Target: "example.com:443"}
+	require.NoError(t, w.WriteRecord(protocol.EncodeFrames([]protocol.Frame{protocol.NewFrameHANDSHAKE(hs)})))
+
+	record, err := ReadBootstrapRecordWithTimeout(context.Background(), &buf, time.Second)
+	require.NoError(t, err)
+
+	_, err = keys[0].OpenFirstRecord(record)
+	require.Error(t, err, "alice's key must not open bob's record")
+	first, err := keys[1].OpenFirstRecord(record)
+	require.NoError(t, err)
+	require.Equal(t, "example.com:443", first.Handshake.Target)
+}
@@ -39,6 +39,11 @@ func SetLevel(level slog.Level) {
 	atomicLevel.SetLevel(level)
 }
 
+// GetLevel returns the current log level.
+func GetLevel() slog.Level {
+	return atomicLevel.Level()
+}
+
 func SetLogger(l *slog.Logger) {
 	logger = l
 }
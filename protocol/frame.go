@@ -36,6 +36,11 @@ const (
 	ProtoTCP  Proto = 1
 	ProtoUDP  Proto = 2
 	ProtoICMP Proto = 3
+	ProtoBind Proto = 4
+	// ProtoReverse registers a reverse tunnel, ProtoReverseConn claims
+	// one connection accepted on it; both use EndpointReverse.
+	ProtoReverse     Proto = 5
+	ProtoReverseConn Proto = 6
 )
 
 func (p Proto) String() string {
@@ -46,6 +51,12 @@ func (p Proto) String() string {
 		return "udp"
 	case ProtoICMP:
 		return "icmp"
+	case ProtoBind:
+		return "bind"
+	case ProtoReverse:
+		return "reverse"
+	case ProtoReverseConn:
+		return "reverse-conn"
 	default:
 		return "unknown"
 	}
@@ -127,6 +138,10 @@ func (h Handshake) MatchesEndpoint(endpoint string) bool {
 		return endpoint == config.EndpointUDP
 	case ProtoICMP:
 		return endpoint == config.EndpointICMP
+	case ProtoBind:
+		return endpoint == config.EndpointBind
+	case ProtoReverse, ProtoReverseConn:
+		return endpoint == config.EndpointReverse
 	default:
 		return false
 	}
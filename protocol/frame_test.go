@@ -61,6 +61,15 @@ func TestHandshakeMatchesEndpoint(t *testing.T) {
 	if hs.MatchesEndpoint("/v3/udp") {
 		t.Error("expected no match for /v3/udp")
 	}
+	bind := Handshake{Proto: ProtoBind}
+	if !bind.MatchesEndpoint("/v3/bind") || bind.MatchesEndpoint("/v3/tcp") {
+		t.Error("bind handshake should only match /v3/bind")
+	}
+	for _, p := range []Proto{ProtoReverse, ProtoReverseConn} {
+		if !(Handshake{Proto: p}).MatchesEndpoint("/v3/reverse") {
+			t.Errorf("%s handshake should match /v3/reverse", p)
+		}
+	}
 }
 
 func TestEncodeFrames(t *testing.T) {
@@ -6,29 +6,44 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/nange/easyss/v3/client"
 	"github.com/nange/easyss/v3/client/config"
 	"github.com/nange/easyss/v3/client/dns"
 	"github.com/nange/easyss/v3/client/proxy"
+	"github.com/nange/easyss/v3/client/router"
+	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/stats"
 )
 
-var errSocksRequired = errors.New("http proxy requires socks_port to be enabled")
-
 type Core struct {
 	Cfg           *config.ClientConfig
 	Client        *client.Client
 	SocksServer   *proxy.Socks5Server
 	HTTPServer    *proxy.HTTPProxyServer
+	MixedServer   *proxy.MixedServer
 	StreamHandler *proxy.StreamHandler
 	DNSServer     *dns.ForwardServer
+	Transparent   *proxy.TransparentServer
+	Forwards      []*proxy.ForwardServer
+	Reverse       []*proxy.ReverseTunnel
+
+	ecs *dns.ECS
 }
 
 func Run(cfg *config.ClientConfig) (*Core, error) {
+	hosts, err := dns.NewHosts(cfg.DNS.Hosts, cfg.DNS.HostsFile)
+	if err != nil {
+		return nil, err
+	}
+	if hosts.Len() > 0 {
+		log.Info("[EASYSS] loaded dns hosts", "entries", hosts.Len())
+	}
+
 	cli, err := client.New(cfg)
 	if err != nil {
 		return nil, err
@@ -60,10 +75,24 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 		StreamHandler: streamHandler,
 	}
 
+	if cfg.DNS.ECS.Enable {
+		ecs, err := dns.NewECS(cfg.DNS.ECS.Subnet, cfg.DNS.ECS.ProxyRules, cli.Router())
+		if err != nil {
+			c.cleanup()
+			return nil, err
+		}
+		if ecs.Subnet() == nil {
+			ecs.EnableAutoSubnet(cli.PublicIP, dialTimeout)
+		}
+		streamHandler.SetECS(ecs)
+		c.ecs = ecs
+		log.Info("[EASYSS] dns client subnet enabled", "subnet", cfg.DNS.ECS.Subnet, "proxy_rules", cfg.DNS.ECS.ProxyRules)
+	}
+
 	// Pre-bind all local listen addresses before starting any server
 	// goroutine, so a listen failure (e.g. port already in use) aborts
 	// startup with an error instead of being logged and silently ignored.
-	var socksAddr, httpAddr, dnsAddr string
+	var socksAddr, httpAddr, mixedAddr, dnsAddr, transparentAddr string
 	if cfg.Local.SocksPort > 0 {
 		socksAddr = "127.0.0.1:" + strconv.Itoa(cfg.Local.SocksPort)
 		if cfg.Local.BindAll {
@@ -75,10 +104,6 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 		}
 	}
 	if cfg.Local.HTTPPort > 0 {
-		if cfg.Local.SocksPort <= 0 {
-			_ = cli.Close()
-			return nil, errSocksRequired
-		}
 		httpAddr = "127.0.0.1:" + strconv.Itoa(cfg.Local.HTTPPort)
 		if cfg.Local.BindAll {
 			httpAddr = "[::]:" + strconv.Itoa(cfg.Local.HTTPPort)
@@ -88,28 +113,96 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 			return nil, fmt.Errorf("http proxy server listen %s: %w", httpAddr, err)
 		}
 	}
+	if cfg.Local.MixedPort > 0 {
+		mixedAddr = "127.0.0.1:" + strconv.Itoa(cfg.Local.MixedPort)
+		if cfg.Local.BindAll {
+			mixedAddr = "[::]:" + strconv.Itoa(cfg.Local.MixedPort)
+		}
+		if err := prebindTCP(mixedAddr); err != nil {
+			c.cleanup()
+			return nil, fmt.Errorf("mixed server listen %s: %w", mixedAddr, err)
+		}
+		if err := prebindUDP(mixedAddr); err != nil {
+			c.cleanup()
+			return nil, fmt.Errorf("mixed server listen udp %s: %w", mixedAddr, err)
+		}
+	}
 	if cfg.Local.EnableForwardDNS {
-		dnsAddr = "127.0.0.1:53"
+		dnsAddr = cfg.Local.ForwardDNSAddr
+		if dnsAddr == "" {
+			dnsAddr = sharedconfig.DefaultForwardDNSAddr
+		}
 		if err := prebindUDP(dnsAddr); err != nil {
 			c.cleanup()
 			return nil, fmt.Errorf("dns forward server listen %s: %w", dnsAddr, err)
 		}
+		if err := prebindTCP(dnsAddr); err != nil {
+			c.cleanup()
+			return nil, fmt.Errorf("dns forward server listen tcp %s: %w", dnsAddr, err)
+		}
 	}
 
-	if socksAddr != "" {
-		serverDomain := ""
-		if svr := cfg.DefaultServer(); svr != nil && net.ParseIP(svr.Address) == nil {
-			serverDomain = svr.Address
+	var transparentMode proxy.TransparentMode
+	if cfg.Local.TransparentPort > 0 {
+		transparentMode, err = proxy.ParseTransparentMode(cfg.Local.TransparentMode)
+		if err != nil {
+			c.cleanup()
+			return nil, err
 		}
+		// Redirected traffic arrives on the LAN-facing addresses, so the
+		// inbound always listens on all of them.
+		transparentAddr = ":" + strconv.Itoa(cfg.Local.TransparentPort)
+		// The tproxy sockets need IP_TRANSPARENT, which a plain prebind
+		// does not check, so the inbound opens its sockets here.
+		c.Transparent = proxy.NewTransparentServer(transparentAddr, transparentMode, streamHandler, cli.Router(),
+			method, !cfg.Local.EnableQUIC, dialTimeout, udpIdleTimeout, cli.DialContext)
+		if err := c.Transparent.Listen(); err != nil {
+			c.cleanup()
+			return nil, fmt.Errorf("transparent proxy listen %s: %w", transparentAddr, err)
+		}
+	}
+
+	handlers := newServerHandlers(cfg, cli, shaperCfg, streamIdleTimeout, c.ecs)
+	users, err := newLocalUsers(cfg, handlers)
+	if err != nil {
+		c.cleanup()
+		return nil, err
+	}
+	forwards, err := newForwards(cfg, handlers, streamHandler, method, udpIdleTimeout)
+	if err != nil {
+		c.cleanup()
+		return nil, err
+	}
+	reverse, err := newReverseTunnels(cfg, handlers, streamHandler, method, dialTimeout)
+	if err != nil {
+		c.cleanup()
+		return nil, err
+	}
+
+	serverDomain := ""
+	if svr := cfg.DefaultServer(); svr != nil && net.ParseIP(svr.Address) == nil {
+		serverDomain = svr.Address
+	}
+
+	if socksAddr != "" {
 		socksServer, err := proxy.NewSocks5Server(socksAddr, cfg.AuthUsername, cfg.AuthPassword,
 			streamHandler, cli.Router(), serverDomain, method, !cfg.Local.EnableQUIC, dialTimeout, udpIdleTimeout, cli.DialContext)
 		if err != nil {
 			_ = cli.Close()
 			return nil, err
 		}
+		socksServer.SetDNSHosts(hosts)
+		if users != nil {
+			socksServer.SetUsers(users)
+		}
+		dnsCache := socksServer.DNSCache()
+		dnsCache.SetServeStale(time.Duration(cfg.DNS.StaleTTL) * time.Second)
+		dnsCache.SetPrefetch(cfg.DNS.Prefetch)
+		if cfg.DNS.CacheFile != "" {
+			dnsCache.EnablePersistence(cfg.DNS.CacheFile)
+		}
 		c.SocksServer = socksServer
 		log.Info("[EASYSS] starting socks5 server", "addr", socksAddr)
-		c.SocksServer.MarkStarted()
 		go func() {
 			if err := c.SocksServer.Start(); err != nil && !errors.Is(err, net.ErrClosed) {
 				log.Error("[EASYSS] socks5 server", "err", err)
@@ -118,12 +211,19 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 	}
 
 	if httpAddr != "" {
-		socksAddr := "127.0.0.1:" + strconv.Itoa(cfg.Local.SocksPort)
-		httpServer, err := proxy.NewHTTPProxyServer(httpAddr, socksAddr, cfg.AuthUsername, cfg.AuthPassword,
+		httpServer := proxy.NewHTTPProxyServer(httpAddr, cfg.AuthUsername, cfg.AuthPassword,
 			timeout, streamHandler, cli.Router(), method, cli.DialContext)
-		if err != nil {
-			c.cleanup()
-			return nil, err
+		if m := cfg.Local.MITM; m != nil && m.Enable {
+			mitm, err := proxy.NewMITM(m.Hosts, m.CACert, m.CAKey, m.HARFile, m.LogBodies)
+			if err != nil {
+				c.cleanup()
+				return nil, err
+			}
+			httpServer.SetMITM(mitm)
+			log.Warn("[EASYSS] https interception enabled on the http proxy", "hosts", m.Hosts, "har", m.HARFile, "bodies", m.LogBodies)
+		}
+		if users != nil {
+			httpServer.SetUsers(users)
 		}
 		c.HTTPServer = httpServer
 		log.Info("[EASYSS] starting http proxy server", "addr", httpAddr)
@@ -134,8 +234,66 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 		}()
 	}
 
+	if mixedAddr != "" {
+		mixedServer, err := proxy.NewMixedServer(mixedAddr, cfg.AuthUsername, cfg.AuthPassword,
+			streamHandler, cli.Router(), serverDomain, method, !cfg.Local.EnableQUIC, timeout, udpIdleTimeout, cli.DialContext)
+		if err != nil {
+			c.cleanup()
+			return nil, err
+		}
+		mixedServer.SetDNSHosts(hosts)
+		if users != nil {
+			mixedServer.SetUsers(users)
+		}
+		dnsCache := mixedServer.DNSCache()
+		dnsCache.SetServeStale(time.Duration(cfg.DNS.StaleTTL) * time.Second)
+		dnsCache.SetPrefetch(cfg.DNS.Prefetch)
+		// The cache file has a single owner, the socks5 inbound when enabled.
+		if cfg.DNS.CacheFile != "" && c.SocksServer == nil {
+			dnsCache.EnablePersistence(cfg.DNS.CacheFile)
+		}
+		c.MixedServer = mixedServer
+		log.Info("[EASYSS] starting mixed server", "addr", mixedAddr)
+		go func() {
+			if err := c.MixedServer.Start(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Error("[EASYSS] mixed server", "err", err)
+			}
+		}()
+	}
+
+	if c.Transparent != nil {
+		log.Info("[EASYSS] starting transparent proxy", "addr", transparentAddr, "mode", transparentMode)
+		go func() {
+			if err := c.Transparent.Start(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Error("[EASYSS] transparent proxy", "err", err)
+			}
+		}()
+	}
+
+	for _, fs := range forwards {
+		c.Forwards = append(c.Forwards, fs)
+		go func() {
+			if err := fs.Start(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Error("[EASYSS] forward", "err", err)
+			}
+		}()
+	}
+
+	for _, rt := range reverse {
+		c.Reverse = append(c.Reverse, rt)
+		go func() {
+			if err := rt.Start(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Error("[EASYSS] reverse tunnel", "err", err)
+			}
+		}()
+	}
+
 	if dnsAddr != "" {
 		c.DNSServer = dns.NewForwardServer(dnsAddr, cli.Router().ShouldIPV6Disable())
+		c.DNSServer.SetHosts(hosts)
+		if cfg.DNS.ForwardRouting {
+			c.DNSServer.SetRouter(cli.Router(), serverDomain, streamHandler.ProxyDNSExchanger(method, dialTimeout))
+		}
 		log.Info("[EASYSS] starting dns forward server", "addr", dnsAddr)
 		go func() {
 			if err := c.DNSServer.Start(); err != nil {
@@ -154,6 +312,155 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 	return c, nil
 }
 
+// serverHandlers hands out the stream handlers of the configured servers,
+// building the handler of each non-default server once on first use.
+type serverHandlers struct {
+	cfg               *config.ClientConfig
+	cli               *client.Client
+	shaperCfg         shaper.Config
+	streamIdleTimeout time.Duration
+	ecs               *dns.ECS
+	byAddr            map[string]*proxy.StreamHandler
+}
+
+func newServerHandlers(cfg *config.ClientConfig, cli *client.Client, shaperCfg shaper.Config, streamIdleTimeout time.Duration, ecs *dns.ECS) *serverHandlers {
+	return &serverHandlers{
+		cfg:               cfg,
+		cli:               cli,
+		shaperCfg:         shaperCfg,
+		streamIdleTimeout: streamIdleTimeout,
+		ecs:               ecs,
+		byAddr:            make(map[string]*proxy.StreamHandler),
+	}
+}
+
+// get returns the handler of the server at addr and its cipher method. A
+// nil handler means the default server, whose handler the caller owns.
+func (sh *serverHandlers) get(addr string) (*proxy.StreamHandler, protocol.Method, error) {
+	if addr == "" {
+		return nil, 0, nil
+	}
+	svr := sh.cfg.ServerByAddr(addr)
+	if svr == nil {
+		return nil, 0, fmt.Errorf("unknown server %q", addr)
+	}
+	if svr == sh.cfg.DefaultServer() {
+		return nil, 0, nil
+	}
+	method := protocol.MethodFromString(svr.Method)
+	if method == 0 {
+		method = protocol.MethodAES256GCM
+	}
+	if h := sh.byAddr[addr]; h != nil {
+		return h, method, nil
+	}
+	tr, masterKey, err := sh.cli.ServerTransport(svr)
+	if err != nil {
+		return nil, 0, err
+	}
+	h := proxy.NewStreamHandler(tr, masterKey, sh.shaperCfg, sh.streamIdleTimeout)
+	if sh.ecs != nil {
+		h.SetECS(sh.ecs)
+	}
+	sh.byAddr[addr] = h
+	return h, method, nil
+}
+
+// newLocalUsers builds the users of local.users, nil when the inbounds keep
+// the auth_username/auth_password credential. Users selecting the same
+// server share its stream handler.
+func newLocalUsers(cfg *config.ClientConfig, handlers *serverHandlers) (*proxy.Users, error) {
+	if len(cfg.Local.Users) == 0 {
+		return nil, nil
+	}
+	if cfg.AuthUsername != "" || cfg.AuthPassword != "" {
+		log.Warn("[EASYSS] local users configured, auth_username and auth_password are ignored")
+	}
+
+	users := proxy.NewUsers()
+	for _, u := range cfg.Local.Users {
+		if u.Username == "" {
+			return nil, errors.New("local user without username")
+		}
+		var p proxy.UserPolicy
+		if u.ProxyRule != "" {
+			p.ProxyRule = router.ParseProxyRule(u.ProxyRule)
+			// ParseProxyRule falls back to auto, so compare the names.
+			if p.ProxyRule.String() != u.ProxyRule {
+				return nil, fmt.Errorf("local user %q: unknown proxy rule %q", u.Username, u.ProxyRule)
+			}
+		}
+		h, method, err := handlers.get(u.Server)
+		if err != nil {
+			return nil, fmt.Errorf("local user %q: %w", u.Username, err)
+		}
+		p.Handler, p.Method = h, method
+		if u.BandwidthLimit < 0 {
+			return nil, fmt.Errorf("local user %q: negative bandwidth_limit", u.Username)
+		}
+		p.BandwidthLimit = u.BandwidthLimit
+		if err := users.Add(u.Username, u.Password, p); err != nil {
+			return nil, err
+		}
+	}
+	log.Info("[EASYSS] local users enabled", "users", len(cfg.Local.Users))
+	return users, nil
+}
+
+// newForwards builds the port forwards of local.forwards after checking
+// their listen addresses are free.
+func newForwards(cfg *config.ClientConfig, handlers *serverHandlers, def *proxy.StreamHandler, defMethod protocol.Method, udpIdleTimeout time.Duration) ([]*proxy.ForwardServer, error) {
+	var forwards []*proxy.ForwardServer
+	for _, f := range cfg.Local.Forwards {
+		network := f.Network
+		if network == "" {
+			network = "tcp"
+		}
+		h, method, err := handlers.get(f.Server)
+		if err != nil {
+			return nil, fmt.Errorf("forward %s: %w", f.Listen, err)
+		}
+		if h == nil {
+			h, method = def, defMethod
+		}
+		fs, err := proxy.NewForwardServer(f.Listen, network, f.Target, h, method, udpIdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("forward %s: %w", f.Listen, err)
+		}
+		prebind := prebindTCP
+		if network == "udp" {
+			prebind = prebindUDP
+		}
+		if err := prebind(f.Listen); err != nil {
+			return nil, fmt.Errorf("forward listen %s %s: %w", network, f.Listen, err)
+		}
+		log.Info("[EASYSS] starting forward", "listen", f.Listen, "network", network, "target", f.Target, "server", f.Server)
+		forwards = append(forwards, fs)
+	}
+	return forwards, nil
+}
+
+// newReverseTunnels builds the reverse tunnels of local.reverse.
+func newReverseTunnels(cfg *config.ClientConfig, handlers *serverHandlers, def *proxy.StreamHandler, defMethod protocol.Method, dialTimeout time.Duration) ([]*proxy.ReverseTunnel, error) {
+	var tunnels []*proxy.ReverseTunnel
+	for _, r := range cfg.Local.Reverse {
+		h, method, err := handlers.get(r.Server)
+		if err != nil {
+			return nil, fmt.Errorf("reverse %d: %w", r.RemotePort, err)
+		}
+		if h == nil {
+			h, method = def, defMethod
+		}
+		rt, err := proxy.NewReverseTunnel(r.RemotePort, r.Target, h, method, dialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("reverse %d: %w", r.RemotePort, err)
+		}
+		log.Info("[EASYSS] starting reverse tunnel", "remote_port", r.RemotePort, "target", r.Target, "server", r.Server)
+		tunnels = append(tunnels, rt)
+	}
+	return tunnels, nil
+}
+
 func (c *Core) Stop() {
 	c.cleanup()
 	log.Info("[EASYSS] stopped")
@@ -171,7 +478,7 @@ func prebindTCP(addr string) error {
 }
 
 // prebindUDP is the UDP counterpart of prebindTCP, used by the DNS
-// forward server which listens on UDP.
+// forward server which listens on UDP (and on TCP at the same address).
 func prebindUDP(addr string) error {
 	pc, err := net.ListenPacket("udp", addr)
 	if err != nil {
@@ -187,9 +494,22 @@ func (c *Core) cleanup() {
 	if c.HTTPServer != nil {
 		_ = c.HTTPServer.Close()
 	}
+	if c.MixedServer != nil {
+		_ = c.MixedServer.Close()
+	}
 	if c.DNSServer != nil {
 		_ = c.DNSServer.Shutdown()
 	}
+	if c.Transparent != nil {
+		_ = c.Transparent.Close()
+	}
+	for _, fs := range c.Forwards {
+		_ = fs.Close()
+	}
+	for _, rt := range c.Reverse {
+		_ = rt.Close()
+	}
+	c.ecs.Close()
 	if c.Client != nil {
 		_ = c.Client.Close()
 	}
@@ -2,11 +2,15 @@ package runner
 
 import (
 	"net"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
 )
 
 func testConfig() *config.ClientConfig {
@@ -146,3 +150,199 @@ func TestRunOKWhenPortsAreFree(t *testing.T) {
 	}
 	core.Stop()
 }
+
+func TestRunHTTPProxyWithoutSocks(t *testing.T) {
+	cfg := testConfig()
+	cfg.Local.SocksPort = 0
+	cfg.Local.HTTPPort = freePort(t)
+
+	core, err := Run(cfg)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if core.HTTPServer == nil || core.SocksServer != nil {
+		t.Fatalf("http server = %v, socks server = %v", core.HTTPServer, core.SocksServer)
+	}
+	core.Stop()
+}
+
+func TestRunMITM(t *testing.T) {
+	cfg := testConfig()
+	cfg.Local.SocksPort = 0
+	cfg.Local.HTTPPort = freePort(t)
+	cfg.Local.MITM = &config.LocalMITM{Enable: true}
+
+	core, err := Run(cfg)
+	if err == nil {
+		core.Stop()
+		t.Fatal("expected error when mitm has no hosts")
+	}
+
+	dir := t.TempDir()
+	cfg.Local.MITM = &config.LocalMITM{
+		Enable:  true,
+		Hosts:   []string{"api.example.com"},
+		CACert:  filepath.Join(dir, "ca.pem"),
+		CAKey:   filepath.Join(dir, "ca-key.pem"),
+		HARFile: filepath.Join(dir, "mitm.har"),
+	}
+	core, err = Run(cfg)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	core.Stop()
+	if _, err := os.Stat(cfg.Local.MITM.CACert); err != nil {
+		t.Fatalf("ca not generated: %v", err)
+	}
+}
+
+func TestNewLocalUsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		users   []config.LocalUser
+		wantErr string
+	}{
+		{name: "no users"},
+		{
+			name:  "default server and rule",
+			users: []config.LocalUser{{Username: "alice", Password: "a", ProxyRule: "proxy", Server: "example.com:443", BandwidthLimit: 1 << 20}},
+		},
+		{
+			name:    "missing username",
+			users:   []config.LocalUser{{Password: "a"}},
+			wantErr: "without username",
+		},
+		{
+			name:    "unknown proxy rule",
+			users:   []config.LocalUser{{Username: "alice", ProxyRule: "global"}},
+			wantErr: "unknown proxy rule",
+		},
+		{
+			name:    "unknown server",
+			users:   []config.LocalUser{{Username: "alice", Server: "other.example.com:443"}},
+			wantErr: "unknown server",
+		},
+		{
+			name:    "duplicate user",
+			users:   []config.LocalUser{{Username: "alice"}, {Username: "alice"}},
+			wantErr: "duplicate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Local.Users = tt.users
+			users, err := newLocalUsers(cfg, newServerHandlers(cfg, nil, shaper.Config{}, 0, nil))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newLocalUsers: %v", err)
+			}
+			if got := users.Enabled(); got != (len(tt.users) > 0) {
+				t.Fatalf("Enabled = %v", got)
+			}
+		})
+	}
+}
+
+func TestNewForwards(t *testing.T) {
+	l, _ := occupyTCPPort(t)
+	tests := []struct {
+		name     string
+		forwards []config.LocalForward
+		wantErr  string
+	}{
+		{name: "no forwards"},
+		{
+			name: "tcp and udp on the default server",
+			forwards: []config.LocalForward{
+				{Listen: "127.0.0.1:0", Target: "db.internal:5432"},
+				{Listen: "127.0.0.1:0", Target: "10.0.0.53:53", Network: "udp", Server: "example.com:443"},
+			},
+		},
+		{
+			name:     "unknown server",
+			forwards: []config.LocalForward{{Listen: "127.0.0.1:0", Target: "db.internal:5432", Server: "other.example.com:443"}},
+			wantErr:  "unknown server",
+		},
+		{
+			name:     "unknown network",
+			forwards: []config.LocalForward{{Listen: "127.0.0.1:0", Target: "db.internal:5432", Network: "sctp"}},
+			wantErr:  "unknown forward network",
+		},
+		{
+			name:     "listen address in use",
+			forwards: []config.LocalForward{{Listen: l.Addr().String(), Target: "db.internal:5432"}},
+			wantErr:  "forward listen",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Local.Forwards = tt.forwards
+			forwards, err := newForwards(cfg, newServerHandlers(cfg, nil, shaper.Config{}, 0, nil), nil, protocol.MethodAES256GCM, 0, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newForwards: %v", err)
+			}
+			if len(forwards) != len(tt.forwards) {
+				t.Fatalf("got %d forwards, want %d", len(forwards), len(tt.forwards))
+			}
+		})
+	}
+}
+
+func TestNewReverseTunnels(t *testing.T) {
+	tests := []struct {
+		name    string
+		reverse []config.LocalReverse
+		wantErr string
+	}{
+		{name: "no reverse tunnels"},
+		{
+			name: "default and named server",
+			reverse: []config.LocalReverse{
+				{RemotePort: 8022, Target: "127.0.0.1:22"},
+				{RemotePort: 8080, Target: "127.0.0.1:80", Server: "example.com:443"},
+			},
+		},
+		{
+			name:    "unknown server",
+			reverse: []config.LocalReverse{{RemotePort: 8022, Target: "127.0.0.1:22", Server: "other.example.com:443"}},
+			wantErr: "unknown server",
+		},
+		{
+			name:    "invalid remote port",
+			reverse: []config.LocalReverse{{RemotePort: 70000, Target: "127.0.0.1:22"}},
+			wantErr: "invalid reverse remote port",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Local.Reverse = tt.reverse
+			tunnels, err := newReverseTunnels(cfg, newServerHandlers(cfg, nil, shaper.Config{}, 0, nil), nil, protocol.MethodAES256GCM, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newReverseTunnels: %v", err)
+			}
+			if len(tunnels) != len(tt.reverse) {
+				t.Fatalf("got %d tunnels, want %d", len(tunnels), len(tt.reverse))
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/nange/easyss/v3/server/acmedns"
+	"github.com/nange/easyss/v3/server/config"
+)
+
+// applyACMEConfig sets the directory, external account binding and DNS-01
+// solver of ac on iss.
+func applyACMEConfig(iss *certmagic.ACMEIssuer, ac *config.ACMEConfig) error {
+	if ac == nil {
+		return nil
+	}
+	if err := ac.Validate(); err != nil {
+		return err
+	}
+	if ac.Directory != "" {
+		// The staging directory only goes with Let's Encrypt.
+		iss.CA, iss.TestCA = ac.Directory, ""
+	}
+	if ac.CARoot != "" {
+		pem, err := os.ReadFile(ac.CARoot)
+		if err != nil {
+			return fmt.Errorf("acme ca root: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("acme ca root: no certificate found")
+		}
+		iss.TrustedRoots = pool
+	}
+	if ac.EABKeyID != "" {
+		iss.ExternalAccount = &acme.EAB{KeyID: ac.EABKeyID, MACKey: ac.EABMACKey}
+	}
+	if ac.DNSProvider != "" {
+		provider, err := acmedns.New(ac.DNSProvider, ac.DNSOptions)
+		if err != nil {
+			return err
+		}
+		iss.DNS01Solver = &certmagic.DNS01Solver{DNSManager: certmagic.DNSManager{
+			DNSProvider:        provider,
+			Resolvers:          ac.DNSResolvers,
+			PropagationTimeout: time.Duration(ac.DNSPropagationTimeout) * time.Second,
+		}}
+	}
+	return nil
+}
+
+// acmeDirectory returns the ACME directory URL in use.
+func acmeDirectory(ac *config.ACMEConfig) string {
+	if ac != nil && ac.Directory != "" {
+		return ac.Directory
+	}
+	return certmagic.DefaultACME.CA
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyACMEConfig(t *testing.T) {
+	iss := certmagic.DefaultACME
+	require.NoError(t, applyACMEConfig(&iss, nil))
+	require.Equal(t, certmagic.DefaultACME.CA, iss.CA)
+	require.Nil(t, iss.DNS01Solver)
+
+	iss = certmagic.DefaultACME
+	require.NoError(t, applyACMEConfig(&iss, &config.ACMEConfig{
+		Directory:   "https://acme.zerossl.com/v2/DV90",
+		EABKeyID:    "kid",
+		EABMACKey:   "mac",
+		Domains:     []string{"*.example.com"},
+		DNSProvider: "rfc2136",
+		DNSOptions:  map[string]string{"server": "127.0.0.1"},
+	}))
+	require.Equal(t, "https://acme.zerossl.com/v2/DV90", iss.CA)
+	require.Empty(t, iss.TestCA)
+	require.Equal(t, "kid", iss.ExternalAccount.KeyID)
+	require.Equal(t, "mac", iss.ExternalAccount.MACKey)
+	require.IsType(t, &certmagic.DNS01Solver{}, iss.DNS01Solver)
+}
+
+func TestApplyACMEConfigInvalid(t *testing.T) {
+	emptyRoot := filepath.Join(t.TempDir(), "root.pem")
+	require.NoError(t, os.WriteFile(emptyRoot, []byte("not a certificate"), 0o600))
+
+	tests := []struct {
+		name string
+		ac   config.ACMEConfig
+	}{
+		{"half eab", config.ACMEConfig{EABKeyID: "kid"}},
+		{"wildcard without dns", config.ACMEConfig{Domains: []string{"*.example.com"}}},
+		{"unknown provider", config.ACMEConfig{DNSProvider: "route53"}},
+		{"missing ca root", config.ACMEConfig{CARoot: "/nonexistent/root.pem"}},
+		{"empty ca root", config.ACMEConfig{CARoot: emptyRoot}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss := certmagic.DefaultACME
+			require.Error(t, applyACMEConfig(&iss, &tt.ac))
+		})
+	}
+}
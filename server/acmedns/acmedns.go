@@ -0,0 +1,62 @@
+// Package acmedns provides the DNS providers solving the ACME DNS-01
+// challenge: they create and delete the TXT records proving control of a
+// domain. Providers are registered by name and built from the options of
+// the configuration.
+package acmedns
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/libdns/libdns"
+)
+
+// Provider creates and deletes records in a DNS zone.
+type Provider interface {
+	libdns.RecordAppender
+	libdns.RecordDeleter
+}
+
+// Factory builds a provider from its options.
+type Factory func(options map[string]string) (Provider, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a provider available under name, replacing any provider
+// of the same name.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[name] = f
+}
+
+// New builds the provider registered under name.
+func New(name string, options map[string]string) (Provider, error) {
+	mu.RLock()
+	f, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown dns provider %q, available: %v", name, Names())
+	}
+	p, err := f(options)
+	if err != nil {
+		return nil, fmt.Errorf("dns provider %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// Names returns the names of the registered providers, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
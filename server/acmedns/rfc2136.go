@@ -0,0 +1,166 @@
+package acmedns
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+func init() {
+	Register("rfc2136", func(options map[string]string) (Provider, error) {
+		return NewRFC2136(options)
+	})
+}
+
+// defaultRecordTTL is the TTL of records created without one.
+const defaultRecordTTL = 60 * time.Second
+
+// RFC2136 updates a zone through DNS UPDATE messages (RFC 2136) sent to
+// its primary server, such as BIND, Knot or PowerDNS, signed with TSIG
+// when a key is set.
+type RFC2136 struct {
+	// Server is the host:port of the primary server, port 53 by default.
+	Server string
+	// KeyName, KeyAlg and Secret (base64) are the TSIG key; KeyAlg is
+	// hmac-sha256 by default.
+	KeyName string
+	KeyAlg  string
+	Secret  string
+	// Network is "udp" (the default) or "tcp".
+	Network string
+	Timeout time.Duration
+}
+
+// NewRFC2136 builds an RFC2136 provider from the options server, key_name,
+// key_alg, key (the base64 secret) and network.
+func NewRFC2136(options map[string]string) (*RFC2136, error) {
+	p := &RFC2136{
+		Server:  options["server"],
+		KeyName: options["key_name"],
+		KeyAlg:  options["key_alg"],
+		Secret:  options["key"],
+		Network: options["network"],
+		Timeout: 10 * time.Second,
+	}
+	if p.Server == "" {
+		return nil, errors.New("server is required")
+	}
+	if _, _, err := net.SplitHostPort(p.Server); err != nil {
+		p.Server = net.JoinHostPort(p.Server, "53")
+	}
+	if (p.KeyName == "") != (p.Secret == "") {
+		return nil, errors.New("key_name and key must be set together")
+	}
+	if p.Secret != "" {
+		if _, err := base64.StdEncoding.DecodeString(p.Secret); err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+	}
+	switch p.KeyAlg = strings.ToLower(p.KeyAlg); p.KeyAlg {
+	case "":
+		p.KeyAlg = dns.HmacSHA256
+	case "hmac-sha1", "hmac-sha224", "hmac-sha256", "hmac-sha384", "hmac-sha512":
+		p.KeyAlg = dns.Fqdn(p.KeyAlg)
+	default:
+		return nil, fmt.Errorf("unsupported key_alg %q", options["key_alg"])
+	}
+	switch p.Network {
+	case "", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", p.Network)
+	}
+	return p, nil
+}
+
+// AppendRecords adds recs to zone.
+func (p *RFC2136) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := toRRs(zone, recs, defaultRecordTTL)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.Insert(rrs)
+	if err := p.update(ctx, m); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// DeleteRecords removes recs from zone.
+func (p *RFC2136) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := toRRs(zone, recs, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.Remove(rrs)
+	if err := p.update(ctx, m); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+func (p *RFC2136) update(ctx context.Context, m *dns.Msg) error {
+	c := &dns.Client{Net: p.Network, Timeout: p.Timeout}
+	if p.KeyName != "" {
+		name := dns.CanonicalName(p.KeyName)
+		c.TsigSecret = map[string]string{name: p.Secret}
+		m.SetTsig(name, p.KeyAlg, 300, time.Now().Unix())
+	}
+	resp, _, err := c.ExchangeContext(ctx, m, p.Server)
+	if err != nil {
+		return fmt.Errorf("dns update %s: %w", p.Server, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dns update %s: %s", p.Server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// toRRs converts recs, named relative to zone, to resource records; a zero
+// TTL becomes ttl.
+func toRRs(zone string, recs []libdns.Record, ttl time.Duration) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(recs))
+	for _, rec := range recs {
+		r := rec.RR()
+		if r.TTL == 0 {
+			r.TTL = ttl
+		}
+		hdr := dns.RR_Header{
+			Name:  dns.Fqdn(libdns.AbsoluteName(r.Name, zone)),
+			Class: dns.ClassINET,
+			Ttl:   uint32(r.TTL / time.Second),
+		}
+		if r.Type == "TXT" {
+			hdr.Rrtype = dns.TypeTXT
+			rrs = append(rrs, &dns.TXT{Hdr: hdr, Txt: splitTXT(r.Data)})
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, hdr.Ttl, r.Type, r.Data))
+		if err != nil {
+			return nil, fmt.Errorf("record %s %s: %w", r.Name, r.Type, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// splitTXT splits s into the strings of at most 255 bytes a TXT record is
+// made of.
+func splitTXT(s string) []string {
+	var out []string
+	for len(s) > 255 {
+		out = append(out, s[:255])
+		s = s[255:]
+	}
+	return append(out, s)
+}
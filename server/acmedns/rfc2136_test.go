@@ -0,0 +1,157 @@
+package acmedns
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testKeyName = "acme-key."
+
+var testSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+// updateServer is a primary server applying the TXT updates it accepts.
+type updateServer struct {
+	mu   sync.Mutex
+	txt  map[string][]string
+	addr string
+}
+
+func startUpdateServer(t *testing.T) *updateServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	us := &updateServer{txt: map[string][]string{}, addr: pc.LocalAddr().String()}
+	srv := &dns.Server{
+		PacketConn: pc,
+		TsigSecret: map[string]string{testKeyName: testSecret},
+		Handler:    dns.HandlerFunc(us.serve),
+		// The default accept function answers UPDATE with NOTIMP.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe() //nolint:errcheck
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return us
+}
+
+func (us *updateServer) serve(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeNotAuth
+		_ = w.WriteMsg(m)
+		return
+	}
+	m.SetTsig(testKeyName, dns.HmacSHA256, 300, time.Now().Unix())
+	us.mu.Lock()
+	for _, rr := range r.Ns {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		name := txt.Hdr.Name
+		switch txt.Hdr.Class {
+		case dns.ClassINET:
+			us.txt[name] = append(us.txt[name], txt.Txt...)
+		case dns.ClassNONE:
+			delete(us.txt, name)
+		}
+	}
+	us.mu.Unlock()
+	_ = w.WriteMsg(m)
+}
+
+func (us *updateServer) get(name string) []string {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.txt[name]
+}
+
+func TestNewRFC2136(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		wantErr bool
+		check   func(t *testing.T, p *RFC2136)
+	}{
+		{"默认端口与算法", map[string]string{"server": "ns1.example.com", "key_name": "k", "key": testSecret}, false,
+			func(t *testing.T, p *RFC2136) {
+				require.Equal(t, "ns1.example.com:53", p.Server)
+				require.Equal(t, dns.HmacSHA256, p.KeyAlg)
+			}},
+		{"指定算法", map[string]string{"server": "127.0.0.1:5353", "key_name": "k", "key": testSecret, "key_alg": "HMAC-SHA512"}, false,
+			func(t *testing.T, p *RFC2136) { require.Equal(t, dns.HmacSHA512, p.KeyAlg) }},
+		{"无 TSIG", map[string]string{"server": "127.0.0.1"}, false, nil},
+		{"缺少 server", map[string]string{"key_name": "k", "key": testSecret}, true, nil},
+		{"只有 key_name", map[string]string{"server": "127.0.0.1", "key_name": "k"}, true, nil},
+		{"key 非 base64", map[string]string{"server": "127.0.0.1", "key_name": "k", "key": "!!"}, true, nil},
+		{"不支持的算法", map[string]string{"server": "127.0.0.1", "key_name": "k", "key": testSecret, "key_alg": "hmac-md5"}, true, nil},
+		{"不支持的 network", map[string]string{"server": "127.0.0.1", "network": "quic"}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewRFC2136(tt.options)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.check != nil {
+				tt.check(t, p)
+			}
+		})
+	}
+}
+
+func TestRFC2136Update(t *testing.T) {
+	us := startUpdateServer(t)
+	p, err := New("rfc2136", map[string]string{"server": us.addr, "key_name": "acme-key", "key": testSecret})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	rec := libdns.TXT{Name: "_acme-challenge.www", Text: "token-value"}
+	got, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{rec})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	require.Equal(t, []string{"token-value"}, us.get("_acme-challenge.www.example.com."))
+
+	_, err = p.DeleteRecords(ctx, "example.com.", []libdns.Record{rec})
+	require.NoError(t, err)
+	require.Empty(t, us.get("_acme-challenge.www.example.com."))
+
+	// 密钥错误时服务器拒绝更新。
+	bad, err := NewRFC2136(map[string]string{"server": us.addr, "key_name": "other-key", "key": testSecret})
+	require.NoError(t, err)
+	_, err = bad.AppendRecords(ctx, "example.com.", []libdns.Record{rec})
+	require.Error(t, err)
+}
+
+func TestSplitTXT(t *testing.T) {
+	require.Equal(t, []string{"abc"}, splitTXT("abc"))
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'a'
+	}
+	parts := splitTXT(string(long))
+	require.Len(t, parts, 2)
+	require.Len(t, parts[0], 255)
+	require.Len(t, parts[1], 45)
+}
+
+func TestRegistry(t *testing.T) {
+	require.Contains(t, Names(), "rfc2136")
+	_, err := New("route53", nil)
+	require.ErrorContains(t, err, "unknown dns provider")
+	_, err = New("rfc2136", nil)
+	require.ErrorContains(t, err, "server is required")
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/handler"
+	"github.com/nange/easyss/v3/stats"
+)
+
+// maxAdminBody bounds the JSON bodies the admin API reads.
+const maxAdminBody = 64 * 1024
+
+// startAdmin serves the admin API on its own listener, a TCP address or a
+// Unix socket, so it is never reachable through the proxy's public port.
+func (s *Server) startAdmin() error {
+	cfg := s.cfg.Admin
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// The socket may be handed over by the process this one upgrades.
+	ln, err := s.upgradeSocket(adminSocketKey)
+	if err == nil && ln == nil {
+		ln, err = listenAdmin(cfg.Listen)
+	}
+	if err != nil {
+		return fmt.Errorf("admin listen: %w", err)
+	}
+
+	s.adminListener = ln
+	s.adminServer = &http.Server{
+		Handler:           s.adminHandler(),
+		ErrorLog:          stdErrorLog(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Info("[ADMIN] listening", "addr", cfg.Listen)
+	go func() {
+		if err := s.adminServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("[ADMIN] serve", "err", err)
+		}
+	}()
+	return nil
+}
+
+// listenAdmin opens the admin API socket at addr, a TCP address or "unix:"
+// followed by a socket path only the owner may connect to.
+func listenAdmin(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// A socket left behind by an unclean exit would fail the listen.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/stats", s.adminStats)
+	mux.HandleFunc("GET /metrics", s.adminMetrics)
+	mux.HandleFunc("GET /v1/streams", s.adminStreams)
+	mux.HandleFunc("DELETE /v1/streams/{id}", s.adminKillStream)
+	mux.HandleFunc("GET /v1/users", s.adminUsers)
+	mux.HandleFunc("POST /v1/users", s.adminAddUser)
+	mux.HandleFunc("DELETE /v1/users/{name}", s.adminRemoveUser)
+	mux.HandleFunc("POST /v1/reload/next-proxy", s.adminReloadNextProxy)
+	mux.HandleFunc("POST /v1/reload/fallback", s.adminReloadFallback)
+	mux.HandleFunc("POST /v1/reload/certs", s.adminReloadCerts)
+	mux.HandleFunc("GET /v1/log-level", s.adminLogLevel)
+	mux.HandleFunc("PUT /v1/log-level", s.adminSetLogLevel)
+
+	token := []byte("Bearer " + s.cfg.Admin.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+			log.Warn("[ADMIN] unauthorized request", "remote", r.RemoteAddr, "path", r.URL.Path)
+			writeAdminError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// readAdminJSON decodes the request body into v; an empty body leaves v
+// unchanged.
+func readAdminJSON(r *http.Request, v any) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAdminBody)).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) adminStats(w http.ResponseWriter, _ *http.Request) {
+	writeAdminJSON(w, http.StatusOK, stats.Collect())
+}
+
+func (s *Server) adminMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", stats.MetricsContentType)
+	if err := stats.WriteMetrics(w, stats.Collect()); err != nil {
+		log.Warn("[ADMIN] write metrics", "err", err)
+	}
+}
+
+func (s *Server) adminStreams(w http.ResponseWriter, _ *http.Request) {
+	writeAdminJSON(w, http.StatusOK, s.proxyHandler.Streams())
+}
+
+func (s *Server) adminKillStream(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid stream id %q", r.PathValue("id")))
+		return
+	}
+	if !s.proxyHandler.KillStream(id) {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("stream %d not found", id))
+		return
+	}
+	log.Info("[ADMIN] stream killed", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminUsers(w http.ResponseWriter, _ *http.Request) {
+	writeAdminJSON(w, http.StatusOK, s.proxyHandler.Users())
+}
+
+// adminAddUser adds a user until the next restart; the config file is not
+// rewritten.
+func (s *Server) adminAddUser(w http.ResponseWriter, r *http.Request) {
+	var u config.ServerUser
+	if err := readAdminJSON(r, &u); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := u.Validate(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	masterKey, err := crypto.DeriveMasterKey(u.Password)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	if err := s.proxyHandler.AddUser(handlerUser(u, masterKey)); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	s.masterKeys[u.Name] = masterKey
+	if err := s.probeHandler.SetMasterKeys(s.probeKeys()); err != nil {
+		log.Error("[ADMIN] update probe tokens", "err", err)
+	}
+	log.Info("[ADMIN] user added", "user", u.Name)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) adminRemoveUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	if !s.proxyHandler.RemoveUser(name) {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("user %q not found", name))
+		return
+	}
+	delete(s.masterKeys, name)
+	if err := s.probeHandler.SetMasterKeys(s.probeKeys()); err != nil {
+		log.Error("[ADMIN] update probe tokens", "err", err)
+	}
+	log.Info("[ADMIN] user removed", "user", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminReloadNextProxy(w http.ResponseWriter, _ *http.Request) {
+	if s.nextProxies == nil {
+		writeAdminError(w, http.StatusConflict, errors.New("no next proxy configured"))
+		return
+	}
+	if err := s.nextProxies.ReloadProxyFiles(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Info("[ADMIN] next proxy files reloaded", "proxies", len(s.nextProxies.List()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminReloadCerts re-reads the certificate files that changed, without
+// waiting for the next check of the watcher.
+func (s *Server) adminReloadCerts(w http.ResponseWriter, _ *http.Request) {
+	if s.certStore == nil {
+		writeAdminError(w, http.StatusConflict, errors.New("no certificate files configured"))
+		return
+	}
+	n, err := s.certStore.Reload()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Info("[ADMIN] certificates reloaded", "count", n)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fallbackReload optionally replaces the configured fallback settings.
+type fallbackReload struct {
+	Target       *string  `json:"target"`
+	PreserveHost *bool    `json:"preserve_host"`
+	CDNDomains   []string `json:"cdn_domains"`
+}
+
+// adminReloadFallback re-reads the fallback target, or switches to the one
+// in the body.
+func (s *Server) adminReloadFallback(w http.ResponseWriter, r *http.Request) {
+	var req fallbackReload
+	if err := readAdminJSON(r, &req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	target, preserveHost, cdnDomains := s.cfg.FallbackTarget, s.cfg.FallbackPreserveHost, s.cfg.FallbackCDNDomains
+	if req.Target != nil {
+		target = *req.Target
+	}
+	if req.PreserveHost != nil {
+		preserveHost = *req.PreserveHost
+	}
+	if req.CDNDomains != nil {
+		cdnDomains = req.CDNDomains
+	}
+	if err := handler.SetFallbackTarget(target, preserveHost, cdnDomains); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.cfg.FallbackTarget, s.cfg.FallbackPreserveHost, s.cfg.FallbackCDNDomains = target, preserveHost, cdnDomains
+	log.Info("[ADMIN] fallback target reloaded", "target", target, "preserve_host", preserveHost, "cdn_domains", cdnDomains)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (s *Server) adminLogLevel(w http.ResponseWriter, _ *http.Request) {
+	writeAdminJSON(w, http.StatusOK, logLevel{Level: strings.ToLower(log.GetLevel().String())})
+}
+
+func (s *Server) adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevel
+	if err := readAdminJSON(r, &req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid log level %q", req.Level))
+		return
+	}
+	log.SetLevel(level)
+	log.Info("[ADMIN] log level changed", "level", level.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// probeKeys returns the master keys of the current users. The caller must
+// hold s.adminMu.
+func (s *Server) probeKeys() [][]byte {
+	keys := make([][]byte, 0, len(s.masterKeys))
+	for _, k := range s.masterKeys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func handlerUser(u config.ServerUser, masterKey []byte) handler.User {
+	return handler.User{
+		Name:           u.Name,
+		MasterKey:      masterKey,
+		ReversePorts:   u.ReversePorts,
+		BandwidthLimit: u.BandwidthLimit,
+		MaxStreams:     u.MaxStreams,
+		DailyQuota:     u.DailyQuota,
+		MonthlyQuota:   u.MonthlyQuota,
+	}
+}
+
+// stopAdmin shuts the admin API down.
+func (s *Server) stopAdmin(ctx context.Context) {
+	if s.adminServer == nil {
+		return
+	}
+	if err := s.adminServer.Shutdown(ctx); err != nil {
+		log.Error("[ADMIN] shutdown", "err", err)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/handler"
+	"github.com/nange/easyss/v3/stats"
+	"github.com/stretchr/testify/require"
+)
+
+const testAdminToken = "admin-secret"
+
+func newAdminTestServer(t *testing.T) *Server {
+	t.Helper()
+	masterKey, err := crypto.DeriveMasterKey("alice-password")
+	require.NoError(t, err)
+
+	s := &Server{
+		cfg: &config.ServerConfig{
+			Admin: &config.AdminConfig{Listen: "127.0.0.1:0", Token: testAdminToken},
+		},
+		masterKeys: map[string][]byte{"alice": masterKey},
+	}
+	s.proxyHandler = handler.NewProxyHandler(handler.ProxyHandlerConfig{
+		Users:             []handler.User{{Name: "alice", MasterKey: masterKey}},
+		HandshakeTimeout:  time.Second,
+		StreamIdleTimeout: time.Second,
+		UDPIdleTimeout:    time.Second,
+	})
+	s.probeHandler, err = handler.NewProbeHandler(s.probeKeys(), make([]byte, 32))
+	require.NoError(t, err)
+	return s
+}
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	h := newAdminTestServer(t).adminHandler()
+
+	for _, auth := range []string{"", "Bearer wrong", testAdminToken} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/stats", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code, "auth %q", auth)
+	}
+
+	rec := adminRequest(t, h, http.MethodGet, "/v1/stats", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+	rec = adminRequest(t, h, http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, stats.MetricsContentType, rec.Header().Get("Content-Type"))
+	require.Contains(t, rec.Body.String(), "# TYPE easyss_server_handshake_errors_total counter")
+}
+
+func TestAdminUsers(t *testing.T) {
+	s := newAdminTestServer(t)
+	h := s.adminHandler()
+
+	rec := adminRequest(t, h, http.MethodPost, "/v1/users", `{"name":"bob","password":"bob-password","max_streams":2}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	require.Contains(t, s.masterKeys, "bob")
+
+	rec = adminRequest(t, h, http.MethodPost, "/v1/users", `{"name":"bob","password":"other-password"}`)
+	require.Equal(t, http.StatusConflict, rec.Code)
+	rec = adminRequest(t, h, http.MethodPost, "/v1/users", `{"name":"carol"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = adminRequest(t, h, http.MethodPost, "/v1/users", `{"name":`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = adminRequest(t, h, http.MethodGet, "/v1/users", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var users []handler.UserInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &users))
+	require.Len(t, users, 2)
+	require.Equal(t, "bob", users[1].Name)
+	require.Equal(t, 2, users[1].MaxStreams)
+	require.NotContains(t, rec.Body.String(), "password")
+
+	rec = adminRequest(t, h, http.MethodDelete, "/v1/users/bob", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.NotContains(t, s.masterKeys, "bob")
+	rec = adminRequest(t, h, http.MethodDelete, "/v1/users/bob", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAdminStreams(t *testing.T) {
+	h := newAdminTestServer(t).adminHandler()
+
+	rec := adminRequest(t, h, http.MethodGet, "/v1/streams", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, "[]", rec.Body.String())
+
+	rec = adminRequest(t, h, http.MethodDelete, "/v1/streams/abc", "")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = adminRequest(t, h, http.MethodDelete, "/v1/streams/42", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAdminReload(t *testing.T) {
+	s := newAdminTestServer(t)
+	h := s.adminHandler()
+
+	rec := adminRequest(t, h, http.MethodPost, "/v1/reload/next-proxy", "")
+	require.Equal(t, http.StatusConflict, rec.Code)
+	rec = adminRequest(t, h, http.MethodPost, "/v1/reload/certs", "")
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = adminRequest(t, h, http.MethodPost, "/v1/reload/fallback", `{"target":"/nonexistent/fallback.html"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Empty(t, s.cfg.FallbackTarget)
+
+	page := filepath.Join(t.TempDir(), "index.html")
+	require.NoError(t, os.WriteFile(page, []byte("<html>hello</html>"), 0o600))
+	t.Cleanup(func() { _ = handler.SetFallbackTarget("", false, nil) })
+	rec = adminRequest(t, h, http.MethodPost, "/v1/reload/fallback", `{"target":"`+page+`"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	require.Equal(t, page, s.cfg.FallbackTarget)
+
+	fallback := httptest.NewRecorder()
+	handler.ServeFallback(fallback, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, "<html>hello</html>", fallback.Body.String())
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	h := newAdminTestServer(t).adminHandler()
+	prev := log.GetLevel()
+	t.Cleanup(func() { log.SetLevel(prev) })
+
+	rec := adminRequest(t, h, http.MethodPut, "/v1/log-level", `{"level":"debug"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, slog.LevelDebug, log.GetLevel())
+
+	rec = adminRequest(t, h, http.MethodGet, "/v1/log-level", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"level":"debug"}`, rec.Body.String())
+
+	rec = adminRequest(t, h, http.MethodPut, "/v1/log-level", `{"level":"verbose"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, slog.LevelDebug, log.GetLevel())
+}
+
+func TestAdminUnixSocket(t *testing.T) {
+	s := newAdminTestServer(t)
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	s.cfg.Admin.Listen = "unix:" + sock
+	require.NoError(t, s.startAdmin())
+	t.Cleanup(func() { s.stopAdmin(context.Background()) })
+
+	fi, err := os.Stat(sock)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	req, err := http.NewRequest(http.MethodGet, "http://admin/v1/users", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,207 @@
+// Package certstore serves file-based TLS certificates selected by SNI and
+// reloads them when their files change, so a certificate renewed by an
+// external tool takes effect without a restart.
+package certstore
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+// DefaultWatchInterval is how often the certificate files are checked for
+// changes.
+const DefaultWatchInterval = 10 * time.Second
+
+// Pair is the paths of a PEM certificate chain and its private key.
+type Pair struct {
+	CertPath string
+	KeyPath  string
+}
+
+// Store holds the certificates of its pairs, the first being the default
+// one. Certificates are swapped atomically on reload, so handshakes in
+// flight keep the certificate they got.
+type Store struct {
+	pairs []Pair
+	state atomic.Pointer[state]
+
+	// mu serializes reloads; mtimes are the modification times of the
+	// files of the loaded certificates.
+	mu     sync.Mutex
+	mtimes []fileTimes
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+type fileTimes struct {
+	cert, key time.Time
+}
+
+func (t fileTimes) equal(o fileTimes) bool {
+	return t.cert.Equal(o.cert) && t.key.Equal(o.key)
+}
+
+type state struct {
+	certs []*tls.Certificate
+	// names maps lowercase DNS names, wildcards included, to the first
+	// certificate covering them.
+	names map[string]*tls.Certificate
+}
+
+// New loads the certificates of pairs.
+func New(pairs []Pair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	s := &Store{pairs: pairs, mtimes: make([]fileTimes, len(pairs)), stop: make(chan struct{})}
+	certs := make([]*tls.Certificate, len(pairs))
+	for i, p := range pairs {
+		cert, times, err := load(p)
+		if err != nil {
+			return nil, err
+		}
+		certs[i], s.mtimes[i] = cert, times
+	}
+	s.state.Store(newState(certs))
+	return s, nil
+}
+
+func load(p Pair) (*tls.Certificate, fileTimes, error) {
+	times, err := modTimes(p)
+	if err != nil {
+		return nil, times, fmt.Errorf("load cert: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(p.CertPath, p.KeyPath)
+	if err != nil {
+		return nil, times, fmt.Errorf("load cert %s: %w", p.CertPath, err)
+	}
+	return &cert, times, nil
+}
+
+func modTimes(p Pair) (fileTimes, error) {
+	certInfo, err := os.Stat(p.CertPath)
+	if err != nil {
+		return fileTimes{}, err
+	}
+	keyInfo, err := os.Stat(p.KeyPath)
+	if err != nil {
+		return fileTimes{}, err
+	}
+	return fileTimes{cert: certInfo.ModTime(), key: keyInfo.ModTime()}, nil
+}
+
+func newState(certs []*tls.Certificate) *state {
+	st := &state{certs: certs, names: make(map[string]*tls.Certificate)}
+	for _, c := range certs {
+		if c.Leaf == nil {
+			continue
+		}
+		names := c.Leaf.DNSNames
+		if len(names) == 0 && c.Leaf.Subject.CommonName != "" {
+			names = []string{c.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := st.names[name]; !ok {
+				st.names[name] = c
+			}
+		}
+	}
+	return st
+}
+
+// Match returns the certificate covering the server name of hello, nil
+// when none does.
+func (s *Store) Match(hello *tls.ClientHelloInfo) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil
+	}
+	st := s.state.Load()
+	if c, ok := st.names[name]; ok {
+		return c
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		return st.names["*."+parent]
+	}
+	return nil
+}
+
+// Default returns the certificate of the first pair.
+func (s *Store) Default() *tls.Certificate {
+	return s.state.Load().certs[0]
+}
+
+// GetCertificate is a tls.Config.GetCertificate answering with the
+// certificate matching the server name, or the default one.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := s.Match(hello); c != nil {
+		return c, nil
+	}
+	return s.Default(), nil
+}
+
+// Reload re-reads the pairs whose files changed and returns how many
+// certificates it replaced. A pair failing to load, such as one caught
+// between the writes of its certificate and key, keeps its certificate
+// and is retried by the next reload.
+func (s *Store) Reload() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	certs := append([]*tls.Certificate(nil), s.state.Load().certs...)
+	var errs []error
+	reloaded := 0
+	for i, p := range s.pairs {
+		if times, err := modTimes(p); err == nil && times.equal(s.mtimes[i]) {
+			continue
+		}
+		cert, times, err := load(p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		certs[i], s.mtimes[i] = cert, times
+		reloaded++
+	}
+	if reloaded > 0 {
+		s.state.Store(newState(certs))
+	}
+	return reloaded, errors.Join(errs...)
+}
+
+// Watch reloads the certificates every interval until Close.
+func (s *Store) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				n, err := s.Reload()
+				if err != nil {
+					log.Warn("[CERT] reload failed, keeping the loaded certificate", "err", err)
+				}
+				if n > 0 {
+					log.Info("[CERT] certificates reloaded", "count", n)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops watching the certificate files.
+func (s *Store) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
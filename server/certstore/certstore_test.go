@@ -0,0 +1,130 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writePair writes a self-signed certificate for names and its key under
+// dir, returning their paths.
+func writePair(t *testing.T, dir, base string, names ...string) Pair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	p := Pair{CertPath: filepath.Join(dir, base+".crt"), KeyPath: filepath.Join(dir, base+".key")}
+	require.NoError(t, os.WriteFile(p.CertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(p.KeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return p
+}
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New([]Pair{
+		writePair(t, dir, "a", "a.example.com"),
+		writePair(t, dir, "b", "b.example.org", "*.b.example.org"),
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		serverName string
+		want       string
+		wantMatch  bool
+	}{
+		{"精确匹配", "b.example.org", "b.example.org", true},
+		{"通配符", "www.b.example.org", "b.example.org", true},
+		{"大小写与末尾点", "A.Example.COM.", "a.example.com", true},
+		{"通配符只匹配一级", "x.www.b.example.org", "a.example.com", false},
+		{"未知域名回退默认证书", "unknown.example.net", "a.example.com", false},
+		{"无 SNI 回退默认证书", "", "a.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := &tls.ClientHelloInfo{ServerName: tt.serverName}
+			require.Equal(t, tt.wantMatch, s.Match(hello) != nil)
+			c, err := s.GetCertificate(hello)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, c.Leaf.Subject.CommonName)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(nil)
+	require.Error(t, err)
+	_, err = New([]Pair{{CertPath: "/nonexistent.crt", KeyPath: "/nonexistent.key"}})
+	require.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	p := writePair(t, dir, "a", "a.example.com")
+	s, err := New([]Pair{p})
+	require.NoError(t, err)
+	hello := &tls.ClientHelloInfo{ServerName: "a.example.com"}
+	old := s.Match(hello)
+
+	n, err := s.Reload()
+	require.NoError(t, err)
+	require.Zero(t, n, "文件未变化时不重新加载")
+
+	// 证书已更新而私钥尚未写入：保留原证书。
+	newer := writePair(t, t.TempDir(), "a", "a.example.com")
+	data, err := os.ReadFile(newer.CertPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(p.CertPath, data, 0o600))
+	touch(t, p.CertPath)
+	_, err = s.Reload()
+	require.Error(t, err)
+	require.Same(t, old, s.Match(hello))
+
+	data, err = os.ReadFile(newer.KeyPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(p.KeyPath, data, 0o600))
+	touch(t, p.KeyPath)
+	n, err = s.Reload()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.NotSame(t, old, s.Match(hello))
+}
+
+// touch moves the modification time of path forward, so the change is
+// seen even on file systems with coarse timestamps.
+func touch(t *testing.T, path string) {
+	t.Helper()
+	mt := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, mt, mt))
+}
+
+func TestWatchClose(t *testing.T) {
+	s, err := New([]Pair{writePair(t, t.TempDir(), "a", "a.example.com")})
+	require.NoError(t, err)
+	s.Watch(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	s.Close()
+	s.Close()
+}
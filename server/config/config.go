@@ -1,6 +1,28 @@
 package config
 
-import "github.com/nange/easyss/v3/util"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nange/easyss/v3/util"
+)
+
+const (
+	// DefaultUserName names the user of the top-level password.
+	DefaultUserName = "default"
+	// DefaultQuotaFile is where the users' traffic is kept for their quotas.
+	DefaultQuotaFile = "quota.json"
+	// DefaultNextProxyName names the next proxy of the next_proxy section.
+	DefaultNextProxyName = "default"
+	// DefaultDrainTimeout is how long, in seconds, a stopping server waits
+	// for the active streams to finish.
+	DefaultDrainTimeout = 30
+)
 
 type LogConfig struct {
 	Level    string `json:"level"`
@@ -11,45 +33,306 @@ type TransportConfig struct {
 	Protocol string `json:"protocol"`
 }
 
+// NextProxyConfig is an upstream proxy: a socks5://, http://, https://
+// (HTTP CONNECT) or easyss:// URL. Name identifies it in outbound rules
+// and failover lists; the next_proxy section is named "default" unless it
+// sets one. Failover are the names of the proxies tried in order when
+// dialing through this one fails. When HealthCheckInterval (in seconds) is
+// positive the proxy is checked by fetching HealthCheckTarget through it,
+// and unhealthy proxies are tried last.
 type NextProxyConfig struct {
-	URL           string `json:"url"`
-	NextProxyFile string `json:"next_proxy_file"`
-	EnableUDP     bool   `json:"enable_udp"`
-	AllHost       bool   `json:"all_host"`
+	Name                string   `json:"name,omitempty"`
+	URL                 string   `json:"url"`
+	NextProxyFile       string   `json:"next_proxy_file"`
+	EnableUDP           bool     `json:"enable_udp"`
+	AllHost             bool     `json:"all_host"`
+	Failover            []string `json:"failover,omitempty"`
+	HealthCheckInterval int      `json:"health_check_interval,omitempty"`
+	HealthCheckTarget   string   `json:"health_check_target,omitempty"`
 }
 
 type ServerConfig struct {
-	Listen               string          `json:"listen"`
-	Domain               string          `json:"domain"`
-	Password             string          `json:"password"`
-	AllowedMethods       []string        `json:"allowed_methods"`
-	CertPath             string          `json:"cert_path"`
-	KeyPath              string          `json:"key_path"`
-	Email                string          `json:"email"`
-	FallbackTarget       string          `json:"fallback_target"`
-	FallbackPreserveHost bool            `json:"fallback_preserve_host"`
-	FallbackCDNDomains   []string        `json:"fallback_cdn_domains"`
-	Timeout              int             `json:"-"`
-	BatchWindowMS        int             `json:"batch_window_ms"`
-	CoverBudgetRatio     float64         `json:"cover_budget_ratio"`
-	CoverBudgetCap       int             `json:"cover_budget_cap"`
-	NextProxy            NextProxyConfig `json:"-"`
-	PprofEnabled         bool            `json:"pprof_enabled"`
+	Listen               string               `json:"listen"`
+	Domain               string               `json:"domain"`
+	Password             string               `json:"password"`
+	AllowedMethods       []string             `json:"allowed_methods"`
+	CertPath             string               `json:"cert_path"`
+	KeyPath              string               `json:"key_path"`
+	Email                string               `json:"email"`
+	FallbackTarget       string               `json:"fallback_target"`
+	FallbackPreserveHost bool                 `json:"fallback_preserve_host"`
+	FallbackCDNDomains   []string             `json:"fallback_cdn_domains"`
+	Timeout              int                  `json:"-"`
+	BatchWindowMS        int                  `json:"batch_window_ms"`
+	CoverBudgetRatio     float64              `json:"cover_budget_ratio"`
+	CoverBudgetCap       int                  `json:"cover_budget_cap"`
+	NextProxy            NextProxyConfig      `json:"-"`
+	NextProxies          []NextProxyConfig    `json:"-"`
+	PprofEnabled         bool                 `json:"pprof_enabled"`
+	ReversePorts         []int                `json:"reverse_ports"`
+	Users                []ServerUser         `json:"users,omitempty"`
+	QuotaFile            string               `json:"quota_file,omitempty"`
+	Admin                *AdminConfig         `json:"admin,omitempty"`
+	OutboundRules        []OutboundRule       `json:"outbound_rules,omitempty"`
+	GeoIPFile            string               `json:"geoip_file,omitempty"`
+	DNS                  *DNSConfig           `json:"dns,omitempty"`
+	ProxyProtocol        *ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+	Listeners            []ListenerConfig     `json:"listeners,omitempty"`
+	Certificates         []CertificateConfig  `json:"certificates,omitempty"`
+	ACME                 *ACMEConfig          `json:"acme,omitempty"`
+	DrainTimeout         int                  `json:"drain_timeout,omitempty"`
+}
+
+// ACMEConfig customizes how the certificate of Domain is obtained.
+// Directory is the ACME directory URL, Let's Encrypt by default; CARoot a
+// PEM file of the roots trusted when talking to it, for a private CA.
+// EABKeyID and EABMACKey are the external account binding some CAs, such
+// as ZeroSSL, require. Domains are more names on the certificate, such as
+// "*.example.com".
+//
+// DNSProvider enables the DNS-01 challenge, instead of TLS-ALPN-01, through
+// the named provider configured by DNSOptions; it is required for wildcard
+// names and lets a server unreachable on port 443 get a certificate.
+// DNSResolvers are the resolvers checking the challenge record has
+// propagated, and DNSPropagationTimeout (in seconds) how long to wait for
+// it.
+type ACMEConfig struct {
+	Directory             string            `json:"directory,omitempty"`
+	CARoot                string            `json:"ca_root,omitempty"`
+	EABKeyID              string            `json:"eab_key_id,omitempty"`
+	EABMACKey             string            `json:"eab_mac_key,omitempty"`
+	Domains               []string          `json:"domains,omitempty"`
+	DNSProvider           string            `json:"dns_provider,omitempty"`
+	DNSOptions            map[string]string `json:"dns_options,omitempty"`
+	DNSResolvers          []string          `json:"dns_resolvers,omitempty"`
+	DNSPropagationTimeout int               `json:"dns_propagation_timeout,omitempty"`
+}
+
+// Validate checks that the external account binding is complete and that
+// wildcard names use the DNS-01 challenge.
+func (c *ACMEConfig) Validate() error {
+	if (c.EABKeyID == "") != (c.EABMACKey == "") {
+		return errors.New("acme eab_key_id and eab_mac_key must be set together")
+	}
+	if c.DNSPropagationTimeout < 0 {
+		return errors.New("acme dns_propagation_timeout must not be negative")
+	}
+	for _, d := range c.Domains {
+		if strings.HasPrefix(d, "*.") && c.DNSProvider == "" {
+			return fmt.Errorf("acme wildcard domain %s requires dns_provider", d)
+		}
+	}
+	return nil
+}
+
+// CertificateConfig is a PEM certificate chain and its private key, served
+// to the TLS clients asking for one of the names it covers. The files are
+// watched and reloaded when they change.
+type CertificateConfig struct {
+	CertPath string `json:"cert_path"`
+	KeyPath  string `json:"key_path"`
+}
+
+const (
+	// ListenerTLS serves TLS with the server certificate.
+	ListenerTLS = "tls"
+	// ListenerH2C serves cleartext HTTP/2 (prior knowledge) and HTTP/1.1
+	// to a reverse proxy, such as nginx or Caddy, terminating TLS.
+	ListenerH2C = "h2c"
+)
+
+// ListenerConfig is an address the server accepts connections on. Type is
+// ListenerTLS (the default) or ListenerH2C. Address is a TCP address,
+// "unix:" followed by a socket path, or "systemd:" followed by the name
+// (FileDescriptorName) of a socket inherited through systemd socket
+// activation. SocketMode is the octal permission of a Unix socket, "0660"
+// by default. An h2c listener on TCP must be on a loopback address unless
+// AllowRemote confirms serving the proxy in cleartext to other hosts.
+//
+// TrustedProxies are the CIDRs, or single IPs, of the reverse proxies
+// whose X-Forwarded-For or X-Real-IP header gives the client address;
+// the peers of a Unix socket are trusted with TrustUnixPeers.
+type ListenerConfig struct {
+	Type           string   `json:"type,omitempty"`
+	Address        string   `json:"address"`
+	SocketMode     string   `json:"socket_mode,omitempty"`
+	AllowRemote    bool     `json:"allow_remote,omitempty"`
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	TrustUnixPeers bool     `json:"trust_unix_peers,omitempty"`
+}
+
+// Validate checks the type and the address of the listener.
+func (c *ListenerConfig) Validate() error {
+	switch c.Type {
+	case "", ListenerTLS, ListenerH2C:
+	default:
+		return fmt.Errorf("unsupported listener type %q", c.Type)
+	}
+	switch c.Address {
+	case "", "unix:", "systemd:":
+		return errors.New("listener address is required")
+	}
+	if c.SocketMode != "" {
+		if _, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil {
+			return fmt.Errorf("listener %s: invalid socket mode %q", c.Address, c.SocketMode)
+		}
+	}
+	if c.Type == ListenerH2C && !c.AllowRemote && !strings.HasPrefix(c.Address, "systemd:") && !isLocalAddress(c.Address) {
+		return fmt.Errorf("listener %s: h2c serves the proxy in cleartext, listen on a loopback address or set allow_remote", c.Address)
+	}
+	return nil
+}
+
+// isLocalAddress reports whether addr is a loopback TCP address or "unix:"
+// followed by a socket path.
+func isLocalAddress(addr string) bool {
+	if strings.HasPrefix(addr, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// IsTLS reports whether the listener serves TLS.
+func (c *ListenerConfig) IsTLS() bool {
+	return c.Type == "" || c.Type == ListenerTLS
+}
+
+// ProxyProtocolConfig makes the listener read the PROXY protocol (v1 or
+// v2) header load balancers in TrustedCIDRs (CIDRs or single IPs) must
+// send, and use the client address in it. Connections from other
+// addresses get the fallback page.
+type ProxyProtocolConfig struct {
+	TrustedCIDRs []string `json:"trusted_cidrs"`
+}
+
+// Validate checks that some sender is trusted.
+func (c *ProxyProtocolConfig) Validate() error {
+	if len(c.TrustedCIDRs) == 0 {
+		return errors.New("proxy protocol trusted_cidrs is required")
+	}
+	return nil
+}
+
+// DNSConfig resolves the domain targets of streams, instead of the system
+// resolver. Servers are tried in order; each is an IP or host with an
+// optional port for plain DNS over UDP, or a URL: udp://, tcp://, tls://
+// (DNS over TLS) or https:// (DNS over HTTPS). Strategy is "ipv4_first",
+// "ipv6_first" or "ipv4_only", empty keeping the order of the answers.
+// Hosts maps names to comma separated IPs answered without a query.
+// Timeout is the per-query timeout in seconds.
+type DNSConfig struct {
+	Servers      []string          `json:"servers"`
+	Strategy     string            `json:"strategy,omitempty"`
+	Hosts        map[string]string `json:"hosts,omitempty"`
+	DisableCache bool              `json:"disable_cache,omitempty"`
+	Timeout      int               `json:"timeout,omitempty"`
+}
+
+// OutboundRule routes the streams matching all its conditions; a condition
+// with several values matches any of them, and an empty one matches all.
+// Domains cover their subdomains and accept "*" globs and "regexp:"
+// patterns; Ports are ports or "lo-hi" ranges; GeoIP are country codes.
+// Action is "block", "direct", "via:<next proxy name>" or
+// "bind:<local IP or interface>".
+type OutboundRule struct {
+	Domains []string `json:"domain,omitempty"`
+	CIDRs   []string `json:"cidr,omitempty"`
+	Ports   []string `json:"port,omitempty"`
+	GeoIP   []string `json:"geoip,omitempty"`
+	Users   []string `json:"user,omitempty"`
+	Network string   `json:"network,omitempty"`
+	Action  string   `json:"action"`
+}
+
+// AdminConfig enables the admin API on its own listener: Listen is a
+// loopback TCP address, or "unix:" followed by a socket path; AllowRemote
+// confirms serving it in cleartext on another address. Every request must
+// carry Token as a bearer token.
+type AdminConfig struct {
+	Listen      string `json:"listen"`
+	Token       string `json:"token"`
+	AllowRemote bool   `json:"allow_remote,omitempty"`
+}
+
+// Validate checks that the admin API is reachable and protected.
+func (c *AdminConfig) Validate() error {
+	switch {
+	case c.Listen == "" || c.Listen == "unix:":
+		return errors.New("admin listen address is required")
+	case c.Token == "":
+		return errors.New("admin token is required")
+	case !c.AllowRemote && !isLocalAddress(c.Listen):
+		return fmt.Errorf("admin listen %s: the admin API is served in cleartext, listen on a loopback address or set allow_remote", c.Listen)
+	}
+	return nil
+}
+
+// ServerUser is a client credential of its own, so one client can be
+// revoked without rotating the others. Enabled defaults to true; a
+// disabled user is rejected like a wrong password. ReversePorts are the
+// ports the user may register reverse tunnels on.
+//
+// BandwidthLimit caps each direction of all the user's streams in bytes
+// per second, MaxStreams its concurrent streams, and DailyQuota and
+// MonthlyQuota the bytes it relays per calendar day and month; 0 means
+// unlimited.
+type ServerUser struct {
+	Name           string `json:"name"`
+	Password       string `json:"password"`
+	Enabled        *bool  `json:"enabled,omitempty"`
+	ReversePorts   []int  `json:"reverse_ports,omitempty"`
+	BandwidthLimit int64  `json:"bandwidth_limit,omitempty"`
+	MaxStreams     int    `json:"max_streams,omitempty"`
+	DailyQuota     int64  `json:"daily_quota,omitempty"`
+	MonthlyQuota   int64  `json:"monthly_quota,omitempty"`
+}
+
+// Validate checks the fields of u on their own; uniqueness among users is
+// checked by EnabledUsers.
+func (u *ServerUser) Validate() error {
+	switch {
+	case u.Name == "":
+		return errors.New("server user without name")
+	case u.Password == "":
+		return fmt.Errorf("server user %q without password", u.Name)
+	case u.BandwidthLimit < 0 || u.MaxStreams < 0 || u.DailyQuota < 0 || u.MonthlyQuota < 0:
+		return fmt.Errorf("server user %q has a negative limit", u.Name)
+	}
+	return nil
+}
+
+// HasQuota reports whether the user has a daily or monthly quota.
+func (u *ServerUser) HasQuota() bool {
+	return u.DailyQuota > 0 || u.MonthlyQuota > 0
+}
+
+func (u *ServerUser) IsEnabled() bool {
+	return u.Enabled == nil || *u.Enabled
 }
 
 type FileConfig struct {
-	ConfigVersion int             `json:"version"`
-	Server        ServerConfig    `json:"server"`
-	Log           LogConfig       `json:"log"`
-	Transport     TransportConfig `json:"transport"`
-	NextProxy     NextProxyConfig `json:"next_proxy"`
-	Timeout       int             `json:"timeout"`
+	ConfigVersion int               `json:"version"`
+	Server        ServerConfig      `json:"server"`
+	Log           LogConfig         `json:"log"`
+	Transport     TransportConfig   `json:"transport"`
+	NextProxy     NextProxyConfig   `json:"next_proxy"`
+	NextProxies   []NextProxyConfig `json:"next_proxies,omitempty"`
+	Timeout       int               `json:"timeout"`
 }
 
 func (fc *FileConfig) EffectiveServerConfig() ServerConfig {
 	cfg := fc.Server
 	cfg.Timeout = fc.Timeout
 	cfg.NextProxy = fc.NextProxy
+	cfg.NextProxies = fc.NextProxies
 	return cfg
 }
 
@@ -64,6 +347,146 @@ func (fc *FileConfig) ResolveFilePaths() {
 	fc.Server.CertPath = util.ResolvePath(fc.Server.CertPath)
 	fc.Server.KeyPath = util.ResolvePath(fc.Server.KeyPath)
 	fc.NextProxy.NextProxyFile = util.ResolvePath(fc.NextProxy.NextProxyFile)
+	for i := range fc.NextProxies {
+		fc.NextProxies[i].NextProxyFile = util.ResolvePath(fc.NextProxies[i].NextProxyFile)
+	}
+	for i := range fc.Server.Certificates {
+		fc.Server.Certificates[i].CertPath = util.ResolvePath(fc.Server.Certificates[i].CertPath)
+		fc.Server.Certificates[i].KeyPath = util.ResolvePath(fc.Server.Certificates[i].KeyPath)
+	}
+	if fc.Server.ACME != nil {
+		fc.Server.ACME.CARoot = util.ResolvePath(fc.Server.ACME.CARoot)
+	}
+	fc.Server.QuotaFile = util.ResolvePath(fc.Server.QuotaFile)
+	fc.Server.GeoIPFile = util.ResolvePath(fc.Server.GeoIPFile)
+}
+
+// AllNextProxies returns the next proxy of the next_proxy section, when it
+// has a URL, followed by those of next_proxies. Names must be unique and
+// failover lists must name other configured proxies.
+func (c *ServerConfig) AllNextProxies() ([]NextProxyConfig, error) {
+	var out []NextProxyConfig
+	if c.NextProxy.URL != "" {
+		np := c.NextProxy
+		if np.Name == "" {
+			np.Name = DefaultNextProxyName
+		}
+		out = append(out, np)
+	}
+	out = append(out, c.NextProxies...)
+
+	names := make(map[string]bool, len(out))
+	for _, np := range out {
+		switch {
+		case np.Name == "":
+			return nil, errors.New("next proxy without name")
+		case np.URL == "":
+			return nil, fmt.Errorf("next proxy %q without url", np.Name)
+		case names[np.Name]:
+			return nil, fmt.Errorf("duplicate next proxy %q", np.Name)
+		case np.HealthCheckInterval < 0:
+			return nil, fmt.Errorf("next proxy %q has a negative health check interval", np.Name)
+		}
+		names[np.Name] = true
+	}
+	for _, np := range out {
+		for _, name := range np.Failover {
+			if !names[name] || name == np.Name {
+				return nil, fmt.Errorf("next proxy %q: invalid failover %q", np.Name, name)
+			}
+		}
+	}
+	return out, nil
+}
+
+// CertificateFiles returns the certificate of cert_path and key_path, when
+// both are set, followed by those of the certificates section.
+func (c *ServerConfig) CertificateFiles() ([]CertificateConfig, error) {
+	var out []CertificateConfig
+	if c.CertPath != "" && c.KeyPath != "" {
+		out = append(out, CertificateConfig{CertPath: c.CertPath, KeyPath: c.KeyPath})
+	}
+	for _, cc := range c.Certificates {
+		if cc.CertPath == "" || cc.KeyPath == "" {
+			return nil, errors.New("certificate requires cert_path and key_path")
+		}
+		out = append(out, cc)
+	}
+	return out, nil
+}
+
+// Validate checks the sections only used once the server starts serving,
+// such as the acme section used when the certificate is obtained.
+func (c *ServerConfig) Validate() error {
+	if c.ACME != nil {
+		if !c.UseCertmagic() {
+			return errors.New("acme section is unused, the certificate is loaded from cert_path and key_path or certificates")
+		}
+		if err := c.ACME.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseCertmagic reports whether the certificate of Domain is obtained and
+// renewed through ACME: when cert_path and key_path are not set, unless
+// only the certificates section is configured.
+func (c *ServerConfig) UseCertmagic() bool {
+	if c.CertPath != "" && c.KeyPath != "" {
+		return false
+	}
+	return c.Domain != "" || len(c.Certificates) == 0
+}
+
+// ManagedDomains returns the names on the certificate obtained through
+// ACME: Domain followed by the more names of the acme section.
+func (c *ServerConfig) ManagedDomains() []string {
+	domains := []string{c.Domain}
+	if c.ACME != nil {
+		for _, d := range c.ACME.Domains {
+			if !slices.Contains(domains, d) {
+				domains = append(domains, d)
+			}
+		}
+	}
+	return domains
+}
+
+// AllListeners returns the listeners to serve on: those of the listeners
+// section, or a TLS listener on Listen when there are none.
+func (c *ServerConfig) AllListeners() ([]ListenerConfig, error) {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{{Type: ListenerTLS, Address: c.Listen}}, nil
+	}
+	seen := make(map[string]bool, len(c.Listeners))
+	for _, lc := range c.Listeners {
+		if err := lc.Validate(); err != nil {
+			return nil, err
+		}
+		if seen[lc.Address] {
+			return nil, fmt.Errorf("duplicate listener %s", lc.Address)
+		}
+		seen[lc.Address] = true
+	}
+	return c.Listeners, nil
+}
+
+// GetDrainTimeout returns how long a stopping server waits for the active
+// streams to finish, DefaultDrainTimeout seconds when unset.
+func (c *ServerConfig) GetDrainTimeout() time.Duration {
+	if c.DrainTimeout <= 0 {
+		return DefaultDrainTimeout * time.Second
+	}
+	return time.Duration(c.DrainTimeout) * time.Second
+}
+
+// GetQuotaFile returns the quota file, DefaultQuotaFile when unset.
+func (c *ServerConfig) GetQuotaFile() string {
+	if c.QuotaFile == "" {
+		return util.ResolvePath(DefaultQuotaFile)
+	}
+	return c.QuotaFile
 }
 
 func (c *ServerConfig) GetAllowedMethods() []string {
@@ -72,3 +495,37 @@ func (c *ServerConfig) GetAllowedMethods() []string {
 	}
 	return c.AllowedMethods
 }
+
+// EnabledUsers returns the enabled users, led by the top-level password
+// (with the top-level reverse_ports) as DefaultUserName when it is set.
+// Names and passwords must be unique, so every stream has one owner.
+func (c *ServerConfig) EnabledUsers() ([]ServerUser, error) {
+	var out []ServerUser
+	if c.Password != "" {
+		out = append(out, ServerUser{Name: DefaultUserName, Password: c.Password, ReversePorts: c.ReversePorts})
+	}
+	names := make(map[string]bool)
+	passwords := make(map[string]bool)
+	for _, u := range out {
+		names[u.Name], passwords[u.Password] = true, true
+	}
+	for _, u := range c.Users {
+		if err := u.Validate(); err != nil {
+			return nil, err
+		}
+		switch {
+		case names[u.Name]:
+			return nil, fmt.Errorf("duplicate server user %q", u.Name)
+		case passwords[u.Password]:
+			return nil, fmt.Errorf("server user %q reuses another user's password", u.Name)
+		}
+		names[u.Name], passwords[u.Password] = true, true
+		if u.IsEnabled() {
+			out = append(out, u)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no password or enabled user configured")
+	}
+	return out, nil
+}
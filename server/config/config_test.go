@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -53,6 +54,7 @@ func TestResolveFilePaths(t *testing.T) {
 		NextProxy: NextProxyConfig{
 			NextProxyFile: relNextProxy,
 		},
+		NextProxies: []NextProxyConfig{{Name: "backup", NextProxyFile: relNextProxy}},
 	}
 
 	fc.ResolveFilePaths()
@@ -66,6 +68,9 @@ func TestResolveFilePaths(t *testing.T) {
 	if want := filepath.Join(util.CurrentDir(), relNextProxy); fc.NextProxy.NextProxyFile != want {
 		t.Errorf("NextProxyFile = %q, want %q", fc.NextProxy.NextProxyFile, want)
 	}
+	if want := filepath.Join(util.CurrentDir(), relNextProxy); fc.NextProxies[0].NextProxyFile != want {
+		t.Errorf("NextProxies[0].NextProxyFile = %q, want %q", fc.NextProxies[0].NextProxyFile, want)
+	}
 }
 
 func TestResolveFilePathsEmpty(t *testing.T) {
@@ -102,3 +107,330 @@ func TestEffectiveServerConfigCarriesResolvedPaths(t *testing.T) {
 		t.Errorf("Timeout = %d, want 30", cfg.Timeout)
 	}
 }
+
+func TestEnabledUsers(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name      string
+		cfg       ServerConfig
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "only password",
+			cfg:       ServerConfig{Password: "secret", ReversePorts: []int{8022}},
+			wantNames: []string{DefaultUserName},
+		},
+		{
+			name: "password and users, disabled skipped",
+			cfg: ServerConfig{Password: "secret", Users: []ServerUser{
+				{Name: "alice", Password: "a"},
+				{Name: "bob", Password: "b", Enabled: &disabled},
+			}},
+			wantNames: []string{DefaultUserName, "alice"},
+		},
+		{
+			name:      "users without password",
+			cfg:       ServerConfig{Users: []ServerUser{{Name: "alice", Password: "a"}}},
+			wantNames: []string{"alice"},
+		},
+		{name: "nothing configured", cfg: ServerConfig{}, wantErr: "no password or enabled user"},
+		{
+			name:    "all users disabled",
+			cfg:     ServerConfig{Users: []ServerUser{{Name: "alice", Password: "a", Enabled: &disabled}}},
+			wantErr: "no password or enabled user",
+		},
+		{
+			name:    "duplicate name",
+			cfg:     ServerConfig{Password: "secret", Users: []ServerUser{{Name: DefaultUserName, Password: "a"}}},
+			wantErr: "duplicate server user",
+		},
+		{
+			name:    "shared password",
+			cfg:     ServerConfig{Password: "secret", Users: []ServerUser{{Name: "alice", Password: "secret"}}},
+			wantErr: "reuses another user's password",
+		},
+		{
+			name:    "missing password",
+			cfg:     ServerConfig{Users: []ServerUser{{Name: "alice"}}},
+			wantErr: "without password",
+		},
+		{
+			name:    "negative limit",
+			cfg:     ServerConfig{Users: []ServerUser{{Name: "alice", Password: "a", DailyQuota: -1}}},
+			wantErr: "negative limit",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := tt.cfg.EnabledUsers()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			var names []string
+			for _, u := range users {
+				names = append(names, u.Name)
+			}
+			require.Equal(t, tt.wantNames, names)
+		})
+	}
+	cfg := ServerConfig{Password: "secret", ReversePorts: []int{8022}}
+	users, err := cfg.EnabledUsers()
+	require.NoError(t, err)
+	require.Equal(t, []int{8022}, users[0].ReversePorts)
+}
+
+func TestAdminConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     AdminConfig
+		wantErr string
+	}{
+		{name: "tcp address", cfg: AdminConfig{Listen: "127.0.0.1:9090", Token: "t"}},
+		{name: "unix socket", cfg: AdminConfig{Listen: "unix:/run/easyss-admin.sock", Token: "t"}},
+		{name: "missing listen", cfg: AdminConfig{Token: "t"}, wantErr: "listen address is required"},
+		{name: "empty socket path", cfg: AdminConfig{Listen: "unix:", Token: "t"}, wantErr: "listen address is required"},
+		{name: "missing token", cfg: AdminConfig{Listen: "127.0.0.1:9090"}, wantErr: "token is required"},
+		{name: "localhost", cfg: AdminConfig{Listen: "localhost:9090", Token: "t"}},
+		{name: "all addresses", cfg: AdminConfig{Listen: ":9090", Token: "t"}, wantErr: "allow_remote"},
+		{name: "public address", cfg: AdminConfig{Listen: "0.0.0.0:9090", Token: "t"}, wantErr: "allow_remote"},
+		{name: "remote allowed", cfg: AdminConfig{Listen: "0.0.0.0:9090", Token: "t", AllowRemote: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestAllNextProxies(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       ServerConfig
+		wantNames []string
+		wantErr   string
+	}{
+		{name: "none"},
+		{
+			name:      "next_proxy is default",
+			cfg:       ServerConfig{NextProxy: NextProxyConfig{URL: "socks5://127.0.0.1:1080"}},
+			wantNames: []string{"default"},
+		},
+		{
+			name: "next_proxy followed by next_proxies",
+			cfg: ServerConfig{
+				NextProxy: NextProxyConfig{URL: "socks5://127.0.0.1:1080", Failover: []string{"backup"}},
+				NextProxies: []NextProxyConfig{
+					{Name: "backup", URL: "http://127.0.0.1:8080"},
+					{Name: "chain", URL: "easyss://:secret@easyss.example.com:443", Failover: []string{"default", "backup"}},
+				},
+			},
+			wantNames: []string{"default", "backup", "chain"},
+		},
+		{
+			name:    "missing name",
+			cfg:     ServerConfig{NextProxies: []NextProxyConfig{{URL: "http://127.0.0.1:8080"}}},
+			wantErr: "next proxy without name",
+		},
+		{
+			name:    "missing url",
+			cfg:     ServerConfig{NextProxies: []NextProxyConfig{{Name: "a"}}},
+			wantErr: `next proxy "a" without url`,
+		},
+		{
+			name: "duplicate name",
+			cfg: ServerConfig{
+				NextProxy:   NextProxyConfig{URL: "socks5://127.0.0.1:1080"},
+				NextProxies: []NextProxyConfig{{Name: "default", URL: "http://127.0.0.1:8080"}},
+			},
+			wantErr: `duplicate next proxy "default"`,
+		},
+		{
+			name:    "unknown failover",
+			cfg:     ServerConfig{NextProxies: []NextProxyConfig{{Name: "a", URL: "http://127.0.0.1:8080", Failover: []string{"b"}}}},
+			wantErr: `invalid failover "b"`,
+		},
+		{
+			name:    "failover to itself",
+			cfg:     ServerConfig{NextProxies: []NextProxyConfig{{Name: "a", URL: "http://127.0.0.1:8080", Failover: []string{"a"}}}},
+			wantErr: `invalid failover "a"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.AllNextProxies()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			var names []string
+			for _, np := range got {
+				names = append(names, np.Name)
+			}
+			require.Equal(t, tt.wantNames, names)
+		})
+	}
+}
+
+func TestAllListeners(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ServerConfig
+		want    []ListenerConfig
+		wantErr string
+	}{
+		{name: "listen only", cfg: ServerConfig{Listen: ":443"}, want: []ListenerConfig{{Type: ListenerTLS, Address: ":443"}}},
+		{
+			name: "listeners",
+			cfg: ServerConfig{Listen: ":443", Listeners: []ListenerConfig{
+				{Address: ":8443"},
+				{Type: ListenerH2C, Address: "unix:/run/easyss.sock", SocketMode: "0660"},
+				{Type: ListenerH2C, Address: "systemd:easyss-h2c", TrustedProxies: []string{"127.0.0.1"}},
+			}},
+			want: []ListenerConfig{
+				{Address: ":8443"},
+				{Type: ListenerH2C, Address: "unix:/run/easyss.sock", SocketMode: "0660"},
+				{Type: ListenerH2C, Address: "systemd:easyss-h2c", TrustedProxies: []string{"127.0.0.1"}},
+			},
+		},
+		{name: "unknown type", cfg: ServerConfig{Listeners: []ListenerConfig{{Type: "quic", Address: ":443"}}}, wantErr: "unsupported listener type"},
+		{name: "missing address", cfg: ServerConfig{Listeners: []ListenerConfig{{Type: ListenerH2C, Address: "unix:"}}}, wantErr: "address is required"},
+		{name: "invalid socket mode", cfg: ServerConfig{Listeners: []ListenerConfig{{Type: ListenerH2C, Address: "unix:/run/easyss.sock", SocketMode: "rw"}}}, wantErr: "invalid socket mode"},
+		{name: "duplicate", cfg: ServerConfig{Listeners: []ListenerConfig{{Address: ":443"}, {Type: ListenerH2C, Address: ":443", AllowRemote: true}}}, wantErr: "duplicate listener"},
+		{name: "h2c on all addresses", cfg: ServerConfig{Listeners: []ListenerConfig{{Type: ListenerH2C, Address: ":8080"}}}, wantErr: "allow_remote"},
+		{name: "h2c on public address", cfg: ServerConfig{Listeners: []ListenerConfig{{Type: ListenerH2C, Address: "203.0.113.7:8080"}}}, wantErr: "allow_remote"},
+		{
+			name: "h2c on loopback",
+			cfg: ServerConfig{Listeners: []ListenerConfig{
+				{Type: ListenerH2C, Address: "127.0.0.1:8080"},
+				{Type: ListenerH2C, Address: "[::1]:8080"},
+				{Type: ListenerH2C, Address: "localhost:8081"},
+			}},
+			want: []ListenerConfig{
+				{Type: ListenerH2C, Address: "127.0.0.1:8080"},
+				{Type: ListenerH2C, Address: "[::1]:8080"},
+				{Type: ListenerH2C, Address: "localhost:8081"},
+			},
+		},
+		{
+			name: "h2c remote allowed",
+			cfg:  ServerConfig{Listeners: []ListenerConfig{{Type: ListenerH2C, Address: ":8080", AllowRemote: true}}},
+			want: []ListenerConfig{{Type: ListenerH2C, Address: ":8080", AllowRemote: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.AllListeners()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCertificateFiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           ServerConfig
+		want          []CertificateConfig
+		wantCertmagic bool
+		wantErr       bool
+	}{
+		{name: "certmagic", cfg: ServerConfig{Domain: "example.com"}, wantCertmagic: true},
+		{
+			name: "cert files",
+			cfg: ServerConfig{Domain: "example.com", CertPath: "a.crt", KeyPath: "a.key",
+				Certificates: []CertificateConfig{{CertPath: "b.crt", KeyPath: "b.key"}}},
+			want: []CertificateConfig{{CertPath: "a.crt", KeyPath: "a.key"}, {CertPath: "b.crt", KeyPath: "b.key"}},
+		},
+		{
+			name:          "certmagic with cert files",
+			cfg:           ServerConfig{Domain: "example.com", Certificates: []CertificateConfig{{CertPath: "b.crt", KeyPath: "b.key"}}},
+			want:          []CertificateConfig{{CertPath: "b.crt", KeyPath: "b.key"}},
+			wantCertmagic: true,
+		},
+		{
+			name: "certificates only",
+			cfg:  ServerConfig{Certificates: []CertificateConfig{{CertPath: "b.crt", KeyPath: "b.key"}}},
+			want: []CertificateConfig{{CertPath: "b.crt", KeyPath: "b.key"}},
+		},
+		{name: "missing key", cfg: ServerConfig{Certificates: []CertificateConfig{{CertPath: "b.crt"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.CertificateFiles()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.wantCertmagic, tt.cfg.UseCertmagic())
+		})
+	}
+}
+
+func TestManagedDomains(t *testing.T) {
+	cfg := ServerConfig{Domain: "example.com"}
+	require.Equal(t, []string{"example.com"}, cfg.ManagedDomains())
+
+	cfg.ACME = &ACMEConfig{Domains: []string{"*.example.com", "example.com", "example.org"}}
+	require.Equal(t, []string{"example.com", "*.example.com", "example.org"}, cfg.ManagedDomains())
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ServerConfig
+		wantErr string
+	}{
+		{name: "no acme", cfg: ServerConfig{Domain: "example.com", CertPath: "a.crt", KeyPath: "a.key"}},
+		{name: "acme", cfg: ServerConfig{Domain: "example.com", ACME: &ACMEConfig{Domains: []string{"*.example.com"}, DNSProvider: "rfc2136"}}},
+		{
+			name:    "incomplete eab",
+			cfg:     ServerConfig{Domain: "example.com", ACME: &ACMEConfig{EABKeyID: "kid"}},
+			wantErr: "must be set together",
+		},
+		{
+			name:    "wildcard without dns provider",
+			cfg:     ServerConfig{Domain: "example.com", ACME: &ACMEConfig{Domains: []string{"*.example.com"}}},
+			wantErr: "requires dns_provider",
+		},
+		{
+			name:    "acme with cert files",
+			cfg:     ServerConfig{Domain: "example.com", CertPath: "a.crt", KeyPath: "a.key", ACME: &ACMEConfig{}},
+			wantErr: "acme section is unused",
+		},
+		{
+			name:    "acme with certificates only",
+			cfg:     ServerConfig{Certificates: []CertificateConfig{{CertPath: "b.crt", KeyPath: "b.key"}}, ACME: &ACMEConfig{}},
+			wantErr: "acme section is unused",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestGetDrainTimeout(t *testing.T) {
+	require.Equal(t, DefaultDrainTimeout*time.Second, (&ServerConfig{}).GetDrainTimeout())
+	require.Equal(t, 5*time.Second, (&ServerConfig{DrainTimeout: 5}).GetDrainTimeout())
+}
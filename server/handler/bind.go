@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/util"
+)
+
+// HandleBind serves a SOCKS5 BIND stream. It listens on a fresh port of
+// localIP, the address the client reached the server on, and reports it as
+// the first DATA frame. The first connection accepted from target's IP (any
+// peer when target's host is unspecified or a domain) is reported as the
+// second DATA frame and then relayed like a CONNECT stream.
+func (h *TCPHandler) HandleBind(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target, localIP string, user *proxyUser, cancelRead func()) error {
+	sendRST := func() {
+		_ = s2c.PushFrame(protocol.NewFrameRST())
+		_ = s2c.Flush()
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(localIP, "0"))
+	if err != nil {
+		log.Error("[BIND_HANDLE] listen failed", "target", target, "err", err)
+		sendRST()
+		return fmt.Errorf("bind listen: %w", err)
+	}
+	defer ln.Close() //nolint:errcheck
+	bound := ln.Addr().String()
+	log.Info("[BIND_HANDLE] listening", "target", target, "bound", bound)
+	if err := s2c.PushData([]byte(bound)); err != nil {
+		return err
+	}
+	if err := s2c.Flush(); err != nil {
+		return err
+	}
+
+	peer, err := h.acceptPeer(ctx, ln.(*net.TCPListener), util.BindPeerIP(target))
+	if err != nil {
+		log.Info("[BIND_HANDLE] accept failed", "target", target, "bound", bound, "err", err)
+		sendRST()
+		return fmt.Errorf("bind accept: %w", err)
+	}
+	defer peer.Close() //nolint:errcheck
+	remote := peer.RemoteAddr().String()
+	log.Info("[BIND_HANDLE] peer connected", "target", target, "bound", bound, "remote", remote)
+	if err := s2c.PushData([]byte(remote)); err != nil {
+		return err
+	}
+	return h.relay(ctx, dr, s2c, peer, target, remote, user, cancelRead)
+}
+
+// acceptPeer waits up to acceptTimeout for a connection from want, closing
+// connections from other addresses. A nil want accepts any peer. It gives
+// up early when ctx is done, i.e. the client went away.
+func (h *TCPHandler) acceptPeer(ctx context.Context, ln *net.TCPListener, want net.IP) (net.Conn, error) {
+	stop := context.AfterFunc(ctx, func() { _ = ln.SetDeadline(time.Now()) })
+	defer stop()
+	if err := ln.SetDeadline(time.Now().Add(h.acceptTimeout)); err != nil {
+		return nil, err
+	}
+	for {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if want == nil || c.RemoteAddr().(*net.TCPAddr).IP.Equal(want) {
+			return c, nil
+		}
+		log.Warn("[BIND_HANDLE] rejected unexpected peer", "want", want.String(), "remote", c.RemoteAddr().String())
+		_ = c.Close()
+	}
+}
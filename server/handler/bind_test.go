@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	sharedconfig "github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+)
+
+// bindStream returns the c2s reader and the s2c shaper of a BIND stream
+// whose s2c records are readable from the returned reader.
+func bindStream(t *testing.T) (*crypto.DecryptedReader, *io.PipeWriter, shaper.Shaper, *crypto.DecryptedReader) {
+	t.Helper()
+	salt := make([]byte, 16)
+	sk, err := crypto.NewStreamKeys([]byte("0123456789abcdef0123456789abcdef"), salt, sharedconfig.EndpointBind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := protocol.MethodAES256GCM
+	newReader := func(r io.Reader, dir string) *crypto.DecryptedReader {
+		enc, counter, err := sk.Encryptor(dir, "session", method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crypto.NewDecryptedReader(r, crypto.BuildAAD(sharedconfig.EndpointBind, salt, dir, "session", method), enc, counter)
+	}
+
+	c2sR, c2sW := io.Pipe()
+	s2cR, s2cW := io.Pipe()
+	enc, counter, err := sk.Encryptor("s2c", "session", method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aad := crypto.BuildAAD(sharedconfig.EndpointBind, salt, "s2c", "session", method)
+	s2c := shaper.New(crypto.NewRecordWriter(s2cW, enc, counter, aad), shaper.Config{BatchWindowMS: 1})
+	t.Cleanup(func() {
+		_ = c2sW.Close()
+		_ = s2cR.Close()
+	})
+	return newReader(c2sR, "c2s"), c2sW, s2c, newReader(s2cR, "s2c")
+}
+
+func readDataFrame(t *testing.T, dr *crypto.DecryptedReader) string {
+	t.Helper()
+	for {
+		f, err := dr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f.Type {
+		case protocol.FrameDATA:
+			return string(f.Payload)
+		case protocol.FramePADDING, protocol.FrameCOVER:
+			continue
+		default:
+			t.Fatalf("unexpected frame %v", f.Type)
+		}
+	}
+}
+
+// drainFrames consumes the rest of the stream so the handler's final
+// frames never block on the pipe.
+func drainFrames(dr *crypto.DecryptedReader) {
+	for {
+		if _, err := dr.ReadFrame(); err != nil {
+			return
+		}
+	}
+}
+
+func TestTCPHandler_HandleBind(t *testing.T) {
+	h := NewTCPHandler(5*time.Second, 5*time.Second, nil)
+	dr, c2sW, s2c, client := bindStream(t)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.HandleBind(context.Background(), dr, s2c, "127.0.0.1:0", "127.0.0.1", nil, nil)
+	}()
+
+	bound := readDataFrame(t, client)
+	peer, err := net.Dial("tcp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close() //nolint:errcheck
+	if got := readDataFrame(t, client); got != peer.LocalAddr().String() {
+		t.Fatalf("peer addr = %q, want %q", got, peer.LocalAddr().String())
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDataFrame(t, client); got != "ping" {
+		t.Fatalf("relayed %q, want %q", got, "ping")
+	}
+
+	go drainFrames(client)
+	_ = peer.Close()
+	_ = c2sW.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleBind did not return")
+	}
+}
+
+func TestTCPHandler_HandleBindAcceptTimeout(t *testing.T) {
+	h := NewTCPHandler(5*time.Second, 5*time.Second, nil)
+	h.acceptTimeout = 100 * time.Millisecond
+	dr, _, s2c, client := bindStream(t)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.HandleBind(context.Background(), dr, s2c, "127.0.0.1:0", "127.0.0.1", nil, nil)
+	}()
+	readDataFrame(t, client)
+	go drainFrames(client)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("HandleBind should fail when no peer connects")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleBind did not time out")
+	}
+}
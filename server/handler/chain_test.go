@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/nextproxy/easyss"
+	"github.com/nange/easyss/v3/tunnel"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNextProxyEasyssChain chains streams through an easyss:// next proxy
+// to a real upstream server, which dials every target to a local web
+// server.
+func TestNextProxyEasyssChain(t *testing.T) {
+	masterKey, err := crypto.DeriveMasterKey("secret")
+	require.NoError(t, err)
+	up := NewProxyHandler(ProxyHandlerConfig{
+		MasterKey:         masterKey,
+		HandshakeTimeout:  time.Second,
+		Timeout:           5 * time.Second,
+		StreamIdleTimeout: 300 * time.Second,
+		UDPIdleTimeout:    30 * time.Second,
+	})
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "pong")
+	}))
+	t.Cleanup(web.Close)
+	up.tcpHandler.dialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, web.Listener.Addr().String())
+	}
+	srv := newRejectTestServer(t, up)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caPath, caPEM, 0o600))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	downAddr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	newProxy := func(name, password, addr string) *nextproxy.NextProxy {
+		q := url.Values{"ca": {caPath}, "sni": {"example.com"}}
+		raw := fmt.Sprintf("easyss://:%s@%s?%s", password, addr, q.Encode())
+		np, err := nextproxy.New(raw, false, true)
+		require.NoError(t, err)
+		np.SetName(name)
+		upstream, err := easyss.New(np.URL(), 5*time.Second)
+		require.NoError(t, err)
+		np.SetUpstream(upstream)
+		t.Cleanup(func() { _ = np.Close() })
+		return np
+	}
+	good := newProxy("good", "secret", srv.Listener.Addr().String())
+	down := newProxy("down", "secret", downAddr)
+	down.SetFailover([]string{"good"})
+	wrongKey := newProxy("wrong", "other", srv.Listener.Addr().String())
+	g := nextproxy.NewGroup(down, good, wrongKey)
+
+	const target = "8.8.8.8:80"
+	get := func(t *testing.T, conn net.Conn) string {
+		t.Helper()
+		defer conn.Close() //nolint:errcheck
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req, err := http.NewRequest(http.MethodGet, "http://"+target+"/", nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		defer resp.Body.Close() //nolint:errcheck
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("经上游服务器转发", func(t *testing.T) {
+		conn, err := good.DialContext(context.Background(), "tcp", target)
+		require.NoError(t, err)
+		require.Equal(t, "pong", get(t, conn))
+	})
+
+	t.Run("上游不可达时拨号失败", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := down.DialContext(ctx, "tcp", target)
+		require.Error(t, err)
+		require.NoError(t, ctx.Err())
+	})
+
+	t.Run("密钥错误时拨号失败", func(t *testing.T) {
+		_, err := wrongKey.DialContext(context.Background(), "tcp", target)
+		require.ErrorIs(t, err, tunnel.ErrServerRejectedHandshake)
+	})
+
+	t.Run("上游不可达时切换到备用代理", func(t *testing.T) {
+		conn, used, err := g.DialContext(context.Background(), down, "tcp", target)
+		require.NoError(t, err)
+		require.Same(t, good, used)
+		require.Equal(t, "pong", get(t, conn))
+	})
+
+	t.Run("健康检查反映上游状态", func(t *testing.T) {
+		good.SetHealthCheck(0, target)
+		down.SetHealthCheck(0, target)
+		require.NoError(t, good.CheckHealth(context.Background()))
+		require.True(t, good.Healthy())
+		require.Error(t, down.CheckHealth(context.Background()))
+		require.False(t, down.Healthy())
+	})
+}
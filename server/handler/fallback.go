@@ -451,6 +451,10 @@ var (
 	// lowercased hostnames; a request to /__cdn__/github.githubassets.com/x
 	// is only proxied if "github.githubassets.com" is in this set.
 	fallbackCDNHosts map[string]bool
+
+	// fallbackMu guards the fallback configuration above, which the admin
+	// API can reload while requests are being served.
+	fallbackMu sync.RWMutex
 )
 
 const (
@@ -465,13 +469,15 @@ const (
 )
 
 // SetFallbackHTML overrides the built-in fallback system with custom HTML.
-// Must be called before the server starts accepting requests.
 func SetFallbackHTML(html []byte) {
 	if len(html) == 0 {
 		return
 	}
-	customFallback = make([]byte, len(html))
-	copy(customFallback, html)
+	page := make([]byte, len(html))
+	copy(page, html)
+	fallbackMu.Lock()
+	customFallback = page
+	fallbackMu.Unlock()
 }
 
 // SetFallbackDir loads all .html files from a directory as multi-route fallback
@@ -482,9 +488,21 @@ func SetFallbackHTML(html []byte) {
 //   - <sub>/<name>.html  → "/<sub>/<name>"
 //   - <sub>/index.html   → "/<sub>"
 //
-// Non-.html files are ignored. Must be called before the server starts
-// accepting requests.
+// Non-.html files are ignored.
 func SetFallbackDir(dir string) error {
+	pages, page404, err := loadFallbackDir(dir)
+	if err != nil {
+		return err
+	}
+	fallbackMu.Lock()
+	fallbackPages = pages
+	fallback404 = page404
+	fallbackMu.Unlock()
+	return nil
+}
+
+// loadFallbackDir reads the pages of a fallback directory, see SetFallbackDir.
+func loadFallbackDir(dir string) (map[string][]byte, []byte, error) {
 	pages := make(map[string][]byte)
 	var page404 []byte
 
@@ -533,12 +551,9 @@ func SetFallbackDir(dir string) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-
-	fallbackPages = pages
-	fallback404 = page404
-	return nil
+	return pages, page404, nil
 }
 
 // SetFallbackProxy configures a reverse proxy to forward non-proxy requests to
@@ -582,14 +597,27 @@ func SetFallbackDir(dir string) error {
 // does not accept gzip, the upstream request advertises "identity" only, so
 // no decompression/recompression is needed.
 func SetFallbackProxy(targetURL string, preserveHost bool, cdnDomains []string) error {
-	if targetURL == "" {
-		fallbackProxy = nil
-		fallbackCDNHosts = nil
-		return nil
+	var proxy *httputil.ReverseProxy
+	var cdnSet map[string]bool
+	if targetURL != "" {
+		var err error
+		if proxy, cdnSet, err = newFallbackProxy(targetURL, preserveHost, cdnDomains); err != nil {
+			return err
+		}
 	}
+	fallbackMu.Lock()
+	fallbackProxy = proxy
+	fallbackCDNHosts = cdnSet
+	fallbackMu.Unlock()
+	return nil
+}
+
+// newFallbackProxy builds the reverse proxy of SetFallbackProxy and its
+// allowed CDN host set.
+func newFallbackProxy(targetURL string, preserveHost bool, cdnDomains []string) (*httputil.ReverseProxy, map[string]bool, error) {
 	u, err := url.Parse(targetURL)
 	if err != nil {
-		return fmt.Errorf("parse fallback proxy url: %w", err)
+		return nil, nil, fmt.Errorf("parse fallback proxy url: %w", err)
 	}
 	targetHost := u.Host
 
@@ -598,9 +626,8 @@ func SetFallbackProxy(targetURL string, preserveHost bool, cdnDomains []string)
 	for _, d := range cdnDomains {
 		cdnSet[strings.ToLower(strings.TrimSpace(d))] = true
 	}
-	fallbackCDNHosts = cdnSet
 
-	fallbackProxy = &httputil.ReverseProxy{
+	proxy := &httputil.ReverseProxy{
 		Rewrite: func(pr *httputil.ProxyRequest) {
 			// Check if this is a CDN-routed request (/__cdn__/<host>/...).
 			if cdnTarget, ok := routeCDN(pr, cdnSet); ok {
@@ -647,7 +674,14 @@ func SetFallbackProxy(targetURL string, preserveHost bool, cdnDomains []string)
 			return rewriteResponseBody(resp, effectiveHost)
 		},
 	}
-	return nil
+	return proxy, cdnSet, nil
+}
+
+// currentCDNHosts returns the allowed CDN hosts of the fallback proxy.
+func currentCDNHosts() map[string]bool {
+	fallbackMu.RLock()
+	defer fallbackMu.RUnlock()
+	return fallbackCDNHosts
 }
 
 // setAcceptEncoding sets the outbound Accept-Encoding header based on what
@@ -845,7 +879,7 @@ func rewriteLocationHeader(resp *http.Response, targetHost string) error {
 	// redirect through the proxy instead of going directly to the CDN.
 	// This handles cases like GitHub's /raw/ URLs redirecting to
 	// raw.githubusercontent.com.
-	if cdnHostMatches(locURL.Host, fallbackCDNHosts) {
+	if cdnHostMatches(locURL.Host, currentCDNHosts()) {
 		cdnHost := locURL.Host
 		locURL.Scheme = origScheme
 		locURL.Host = origHost
@@ -1115,7 +1149,7 @@ func rewriteCSPHeader(resp *http.Response, targetHost string) {
 	}
 	origOrigin := origScheme + "://" + origHost
 	csp = rewriteCSP(csp, targetHost, origOrigin)
-	csp = rewriteCDNInCSP(csp, origScheme, origHost, fallbackCDNHosts)
+	csp = rewriteCDNInCSP(csp, origScheme, origHost, currentCDNHosts())
 	resp.Header.Set("Content-Security-Policy", csp)
 }
 
@@ -1206,7 +1240,7 @@ func rewriteResponseBody(resp *http.Response, targetHost string) error {
 	// the CDN host. This matches both the configured domain exactly and
 	// any subdomain (e.g. "githubassets.com" matches both
 	// "githubassets.com" and "github.githubassets.com").
-	replaced = rewriteCDNURLs(replaced, origOrigin, fallbackCDNHosts)
+	replaced = rewriteCDNURLs(replaced, origOrigin, currentCDNHosts())
 
 	// Note: Content-Security-Policy header rewriting is handled
 	// independently by rewriteCSPHeader in ModifyResponse, not here,
@@ -1251,36 +1285,49 @@ func rewriteResponseBody(resp *http.Response, targetHost string) error {
 //
 // preserveHost and cdnDomains only affect the reverse-proxy mode (see
 // SetFallbackProxy); they are ignored for the directory/file/built-in modes.
+// The new target replaces the previous one at once, and an error keeps the
+// previous one, so it can be reloaded while requests are being served.
 func SetFallbackTarget(target string, preserveHost bool, cdnDomains []string) error {
-	// Reset all fallback state.
-	fallbackProxy = nil
-	fallbackCDNHosts = nil
-	fallbackPages = nil
-	fallback404 = nil
-	customFallback = nil
-
-	if target == "" {
-		return nil
-	}
-
-	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
-		return SetFallbackProxy(target, preserveHost, cdnDomains)
-	}
-
-	info, err := os.Stat(target)
-	if err != nil {
-		return fmt.Errorf("stat fallback target: %w", err)
-	}
-
-	if info.IsDir() {
-		return SetFallbackDir(target)
+	var (
+		proxy  *httputil.ReverseProxy
+		cdnSet map[string]bool
+		pages  map[string][]byte
+		page   []byte
+		custom []byte
+	)
+	switch {
+	case target == "":
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		var err error
+		if proxy, cdnSet, err = newFallbackProxy(target, preserveHost, cdnDomains); err != nil {
+			return err
+		}
+	default:
+		info, err := os.Stat(target)
+		if err != nil {
+			return fmt.Errorf("stat fallback target: %w", err)
+		}
+		if info.IsDir() {
+			if pages, page, err = loadFallbackDir(target); err != nil {
+				return err
+			}
+			break
+		}
+		if custom, err = os.ReadFile(target); err != nil {
+			return fmt.Errorf("read fallback target: %w", err)
+		}
+		if len(custom) == 0 {
+			custom = nil
+		}
 	}
 
-	data, err := os.ReadFile(target)
-	if err != nil {
-		return fmt.Errorf("read fallback target: %w", err)
-	}
-	SetFallbackHTML(data)
+	fallbackMu.Lock()
+	defer fallbackMu.Unlock()
+	fallbackProxy = proxy
+	fallbackCDNHosts = cdnSet
+	fallbackPages = pages
+	fallback404 = page
+	customFallback = custom
 	return nil
 }
 
@@ -1296,8 +1343,12 @@ func ServeFallback(w http.ResponseWriter, r *http.Request) {
 		selectedTheme = themes[rand.IntN(len(themes))]
 	})
 
+	fallbackMu.RLock()
+	proxy, pages, page404, custom := fallbackProxy, fallbackPages, fallback404, customFallback
+	fallbackMu.RUnlock()
+
 	// Priority 0 (highest): reverse proxy to upstream HTTP service.
-	if fallbackProxy != nil {
+	if proxy != nil {
 		scheme := "http"
 		if r.TLS != nil {
 			scheme = "https"
@@ -1309,7 +1360,7 @@ func ServeFallback(w http.ResponseWriter, r *http.Request) {
 		ctx := context.WithValue(r2.Context(), ctxOrigHost, r2.Host)
 		ctx = context.WithValue(ctx, ctxOrigScheme, scheme)
 		ctx = context.WithValue(ctx, ctxOrigAcceptEncoding, r2.Header.Get("Accept-Encoding"))
-		fallbackProxy.ServeHTTP(w, r2.WithContext(ctx))
+		proxy.ServeHTTP(w, r2.WithContext(ctx))
 		return
 	}
 
@@ -1318,14 +1369,14 @@ func ServeFallback(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
 	// Priority 1: directory-based multi-file fallback.
-	if len(fallbackPages) > 0 {
-		content, ok := fallbackPages[cleanPath(r.URL.Path)]
+	if len(pages) > 0 {
+		content, ok := pages[cleanPath(r.URL.Path)]
 		if !ok {
-			content = fallback404
+			content = page404
 		}
 		if !ok && len(content) == 0 {
 			// No matching page and no 404.html — fall back to index.
-			content = fallbackPages["/"]
+			content = pages["/"]
 		}
 		if len(content) > 0 {
 			w.Write(content) //nolint:errcheck
@@ -1334,8 +1385,8 @@ func ServeFallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Priority 2: single-file custom fallback.
-	if len(customFallback) > 0 {
-		w.Write(customFallback) //nolint:errcheck
+	if len(custom) > 0 {
+		w.Write(custom) //nolint:errcheck
 		return
 	}
 
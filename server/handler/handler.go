@@ -1,12 +1,15 @@
 package handler
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	sharedconfig "github.com/nange/easyss/v3/config"
@@ -14,27 +17,39 @@ import (
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/outbound"
+	"github.com/nange/easyss/v3/server/quota"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/stats"
-	"github.com/nange/easyss/v3/util"
 )
 
 type ProxyHandler struct {
-	masterKey        []byte
+	usersMu          sync.RWMutex
+	users            []*proxyUser
+	userCache        *userCache
+	quota            *quota.Store
+	streams          *streamRegistry
 	allowedMethods   map[protocol.Method]bool
 	handshakeTimeout time.Duration
 	batchWindowMS    int
 	coverBudgetRatio float64
 	coverBudgetCap   int
-	nextProxy        *nextproxy.NextProxy
+	nextProxies      *nextproxy.Group
+	resolver         *resolver.Resolver
 	tcpHandler       *TCPHandler
 	udpHandler       *UDPHandler
 	icmpHandler      *ICMPHandler
+	reverseHandler   *ReverseHandler
 	saltCache        *saltCache
 	ipLimiter        *ipRateLimiter
+	draining         atomic.Bool
 }
 
 type ProxyHandlerConfig struct {
+	// Users are the accepted credentials; MasterKey alone is shorthand for
+	// a single user named "default" without reverse ports.
+	Users             []User
 	MasterKey         []byte
 	AllowedMethods    []string
 	HandshakeTimeout  time.Duration
@@ -44,7 +59,14 @@ type ProxyHandlerConfig struct {
 	BatchWindowMS     int
 	CoverBudgetRatio  float64
 	CoverBudgetCap    int
-	NextProxy         *nextproxy.NextProxy
+	// NextProxies are the upstream proxies streams may be dialed through.
+	NextProxies *nextproxy.Group
+	// Resolver resolves the domain targets; nil uses the system resolver.
+	Resolver *resolver.Resolver
+	// Outbound routes the TCP and UDP streams by their target and user.
+	Outbound *outbound.Router
+	// Quota persists the users' traffic; without it quotas are not enforced.
+	Quota *quota.Store
 }
 
 func NewProxyHandler(cfg ProxyHandlerConfig) *ProxyHandler {
@@ -78,17 +100,40 @@ func NewProxyHandler(cfg ProxyHandlerConfig) *ProxyHandler {
 		coverBudgetCap = sharedconfig.DefaultCoverBudgetCap
 	}
 
+	users := cfg.Users
+	if len(users) == 0 && cfg.MasterKey != nil {
+		users = []User{{Name: "default", MasterKey: cfg.MasterKey}}
+	}
+	proxyUsers := make([]*proxyUser, 0, len(users))
+	for _, u := range users {
+		proxyUsers = append(proxyUsers, newProxyUser(u, cfg.Quota))
+	}
+
+	tcpHandler := NewTCPHandler(cfg.StreamIdleTimeout, cfg.Timeout, cfg.NextProxies)
+	tcpHandler.outbound = cfg.Outbound
+	tcpHandler.resolver = cfg.Resolver
+	udpHandler := NewUDPHandler(cfg.UDPIdleTimeout, cfg.NextProxies)
+	udpHandler.outbound = cfg.Outbound
+	udpHandler.resolver = cfg.Resolver
+	icmpHandler := NewICMPHandler()
+	icmpHandler.outbound = cfg.Outbound
+	icmpHandler.resolver = cfg.Resolver
 	return &ProxyHandler{
-		masterKey:        cfg.MasterKey,
+		users:            proxyUsers,
+		userCache:        newUserCache(),
+		quota:            cfg.Quota,
+		streams:          newStreamRegistry(),
 		allowedMethods:   allowed,
 		handshakeTimeout: cfg.HandshakeTimeout,
 		batchWindowMS:    batchWindowMS,
 		coverBudgetRatio: coverBudgetRatio,
 		coverBudgetCap:   coverBudgetCap,
-		nextProxy:        cfg.NextProxy,
-		tcpHandler:       NewTCPHandler(cfg.StreamIdleTimeout, cfg.Timeout, cfg.NextProxy),
-		udpHandler:       NewUDPHandler(cfg.UDPIdleTimeout, cfg.NextProxy),
-		icmpHandler:      NewICMPHandler(),
+		nextProxies:      cfg.NextProxies,
+		resolver:         cfg.Resolver,
+		tcpHandler:       tcpHandler,
+		udpHandler:       udpHandler,
+		icmpHandler:      icmpHandler,
+		reverseHandler:   NewReverseHandler(tcpHandler),
 		saltCache:        newSaltCache(),
 		ipLimiter:        newIPRateLimiter(),
 	}
@@ -102,6 +147,19 @@ func clientIP(r *http.Request) string {
 	return host
 }
 
+// localIP returns the server IP the request arrived on, empty if unknown.
+func localIP(r *http.Request) string {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
 // serveReject writes a bare HTTP error response for handshake rejections.
 // Unlike ServeFallback it sends no camouflaged HTML body: it is only used for
 // requests that either timed out waiting for the handshake record, or already
@@ -120,7 +178,9 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	if !r.ProtoAtLeast(2, 0) {
+	// A draining server takes no new streams; they look like any other
+	// request for the fallback page.
+	if !r.ProtoAtLeast(2, 0) || h.draining.Load() {
 		ServeFallback(w, r)
 		return
 	}
@@ -160,13 +220,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	endpoint := r.URL.Path
-	sk, err := crypto.NewStreamKeys(h.masterKey, salt, endpoint)
-	if err != nil {
-		ServeFallback(w, r)
-		return
-	}
-
-	first, err := sk.ReadFirstRecordWithTimeout(r.Context(), r.Body, h.handshakeTimeout)
+	record, err := crypto.ReadBootstrapRecordWithTimeout(r.Context(), r.Body, h.handshakeTimeout)
 	if err != nil {
 		log.Error("[SERVER] read first record", "remote", r.RemoteAddr, "endpoint", endpoint, "err", err)
 		stats.RecordServerHandshakeError()
@@ -180,6 +234,16 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			serveReject(w, http.StatusRequestTimeout)
 			return
 		}
+		ServeFallback(w, r)
+		return
+	}
+
+	// The record names no user: it is tried against every user's key,
+	// starting with the one last seen from this address.
+	user, sk, first, err := h.authenticate(clientIP(r), salt, endpoint, record)
+	if err != nil {
+		log.Error("[SERVER] read first record", "remote", r.RemoteAddr, "endpoint", endpoint, "err", err)
+		stats.RecordServerHandshakeError()
 		// Decrypt failure: the request did not prove master-key possession
 		// (attacker probing, wrong key). Keep the camouflaged homepage so the
 		// server stays indistinguishable from a real site for keyless
@@ -203,7 +267,21 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info("[SERVER] proxy", "target", first.Handshake.Target, "remote", r.RemoteAddr)
+	if user.overQuota() {
+		log.Warn("[SERVER] user over quota", "remote", r.RemoteAddr, "user", user.name)
+		stats.RecordServerHandshakeError()
+		serveReject(w, http.StatusForbidden)
+		return
+	}
+	if !user.acquireStream() {
+		log.Warn("[SERVER] user stream limit reached", "remote", r.RemoteAddr, "user", user.name, "max_streams", user.maxStreams)
+		stats.RecordServerHandshakeError()
+		serveReject(w, http.StatusTooManyRequests)
+		return
+	}
+	defer user.releaseStream()
+
+	log.Info("[SERVER] proxy", "target", first.Handshake.Target, "remote", r.RemoteAddr, "user", user.name)
 
 	target := first.Handshake.Target
 	method := first.Handshake.Method
@@ -212,10 +290,14 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// before the response is committed (WriteHeader + Flush): once the
 	// octet-stream headers are flushed the response can no longer be turned
 	// into a fallback HTML page, and the client would receive a 200
-	// application/octet-stream instead of a clean rejection. IsLANHostResolved
-	// also resolves domain names so a target like evil.com (which resolves to
-	// 127.0.0.1) cannot bypass the literal-IP check.
-	if util.IsLANHostResolved(r.Context(), target) {
+	// application/octet-stream instead of a clean rejection. IsLANHost also
+	// resolves domain names so a target like evil.com (which resolves to
+	// 127.0.0.1) cannot bypass the literal-IP check; the dial checks the
+	// addresses it dials again.
+	// BIND and reverse targets are never dialed (a BIND target only
+	// restricts which peer may connect back), so they are exempt.
+	if endpoint != sharedconfig.EndpointBind && endpoint != sharedconfig.EndpointReverse &&
+		h.resolver.IsLANHost(r.Context(), target) {
 		log.Error("[SERVER] rejected LAN target", "target", target, "remote", r.RemoteAddr)
 		stats.RecordServerHandshakeError()
 		serveReject(w, http.StatusBadRequest)
@@ -244,8 +326,26 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stream := &activeStream{
+		user:     user,
+		remote:   r.RemoteAddr,
+		endpoint: endpoint,
+		target:   target,
+		started:  time.Now(),
+		kill:     func() { cancel(); _ = r.Body.Close() },
+	}
+	h.streams.add(stream)
+	defer func() {
+		h.streams.remove(stream)
+		stats.RecordStreamDuration(endpoint, time.Since(stream.started))
+	}()
+
 	rc := http.NewResponseController(w)
 	_ = rc.EnableFullDuplex()
+	user.counters.RecordConnection()
+	body := &userBody{body: r.Body, counters: user.counters, stream: stream}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Cache-Control", "no-store")
@@ -253,10 +353,10 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	_ = rc.Flush()
 
-	c2sReader := crypto.NewDecryptedReader(r.Body, aadC2S, c2sEnc, c2sCounter)
+	c2sReader := crypto.NewDecryptedReader(body, aadC2S, c2sEnc, c2sCounter)
 	c2sReader.SetLeftoverFrames(first.Leftover)
 
-	s2cWriter := crypto.NewRecordWriter(w, s2cEnc, s2cCounter, aadS2C)
+	s2cWriter := crypto.NewRecordWriter(&userWriter{w: w, counters: user.counters, stream: stream}, s2cEnc, s2cCounter, aadS2C)
 	s2cCfg := shaper.Config{BatchWindowMS: h.batchWindowMS, Cover: shaper.CoverConfig{BudgetRatio: h.coverBudgetRatio, BudgetCap: h.coverBudgetCap}}
 	if endpoint == sharedconfig.EndpointUDP {
 		// UDP uses a short 1ms batch window so datagram bursts are merged
@@ -274,17 +374,27 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// cancelRead unblocks the relay's client-read goroutine immediately
 		// when the relay terminates (idle timeout/error), instead of letting
 		// it linger on the request body until net/http closes it.
-		handleErr = h.tcpHandler.Handle(r.Context(), c2sReader, s2cShaper, target, func() { _ = r.Body.Close() })
+		handleErr = h.tcpHandler.Handle(ctx, c2sReader, s2cShaper, target, user, func() { _ = r.Body.Close() })
 	case sharedconfig.EndpointUDP:
 		stats.RecordServerUDPStream()
-		handleErr = h.udpHandler.Handle(r.Context(), c2sReader, s2cShaper, target)
+		handleErr = h.udpHandler.Handle(ctx, c2sReader, s2cShaper, target, user)
 	case sharedconfig.EndpointICMP:
 		stats.RecordServerICMPStream()
-		handleErr = h.icmpHandler.Handle(c2sReader, s2cShaper, target)
+		handleErr = h.icmpHandler.Handle(ctx, c2sReader, s2cShaper, target, user)
+	case sharedconfig.EndpointBind:
+		stats.RecordServerBindStream()
+		handleErr = h.tcpHandler.HandleBind(ctx, c2sReader, s2cShaper, target, localIP(r), user, func() { _ = r.Body.Close() })
+	case sharedconfig.EndpointReverse:
+		stats.RecordServerReverseStream()
+		if first.Handshake.Proto == protocol.ProtoReverse {
+			handleErr = h.reverseHandler.HandleRegister(ctx, c2sReader, s2cShaper, target, user, func() { _ = r.Body.Close() })
+		} else {
+			handleErr = h.reverseHandler.HandleConn(ctx, c2sReader, s2cShaper, target, user, func() { _ = r.Body.Close() })
+		}
 	}
 	if handleErr != nil {
-		log.Info("[SERVER] handler finished with error", "target", target, "endpoint", endpoint, "err", handleErr)
+		log.Info("[SERVER] handler finished with error", "target", target, "endpoint", endpoint, "user", user.name, "err", handleErr)
 	} else {
-		log.Debug("[SERVER] handler finished", "target", target, "endpoint", endpoint)
+		log.Debug("[SERVER] handler finished", "target", target, "endpoint", endpoint, "user", user.name)
 	}
 }
@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"time"
@@ -9,7 +11,10 @@ import (
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/server/outbound"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/util"
 	"github.com/nange/easyss/v3/util/bytespool"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
@@ -17,13 +22,15 @@ import (
 )
 
 type ICMPHandler struct {
+	resolver *resolver.Resolver
+	outbound *outbound.Router
 }
 
 func NewICMPHandler() *ICMPHandler {
 	return &ICMPHandler{}
 }
 
-func (h *ICMPHandler) Handle(dr *crypto.DecryptedReader, s2c shaper.Shaper, target string) error {
+func (h *ICMPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, user *proxyUser) error {
 	for {
 		frame, err := dr.ReadFrame()
 		if err != nil {
@@ -32,7 +39,7 @@ func (h *ICMPHandler) Handle(dr *crypto.DecryptedReader, s2c shaper.Shaper, targ
 
 		switch frame.Type {
 		case protocol.FrameDATA:
-			replyPayload, err := h.icmpExchange(target, frame.Payload)
+			replyPayload, err := h.icmpExchange(ctx, target, frame.Payload, user)
 			if err != nil {
 				_ = s2c.PushFrame(protocol.NewFrameRST())
 				_ = s2c.Flush()
@@ -54,27 +61,55 @@ func (h *ICMPHandler) Handle(dr *crypto.DecryptedReader, s2c shaper.Shaper, targ
 	}
 }
 
-func (h *ICMPHandler) icmpExchange(target string, payload []byte) ([]byte, error) {
-	log.Debug("[ICMP] exchange", "target", target)
-
-	if len(payload) < 4 {
-		return nil, io.ErrUnexpectedEOF
+// dialTarget dials the host of target for ICMP, unless an outbound rule
+// blocks it. The other actions only apply to TCP and UDP, echo requests
+// always go out directly.
+func (h *ICMPHandler) dialTarget(ctx context.Context, target string, user *proxyUser) (net.Conn, bool, error) {
+	if routeTarget(ctx, h.outbound, "icmp", target, user).Kind == outbound.ActionBlock {
+		return nil, false, fmt.Errorf("%w: %s", errBlocked, target)
 	}
-
-	isIPv6 := isIPv6Target(target)
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	ips, err := h.resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, false, err
+	}
+	// Post-resolution SSRF guard, as for TCP and UDP targets.
+	for _, ip := range ips {
+		if util.IsLANIP(ip.String()) {
+			return nil, false, fmt.Errorf("ssrf: rejected lan destination %s", ip)
+		}
+	}
+	ip := ips[0]
+	isIPv6 := isIPv6Target(ip.String())
 	dialNet := "ip4:icmp"
-	parseProto := 1
 	if isIPv6 {
 		dialNet = "ip6:ipv6-icmp"
-		parseProto = 58
 	}
+	d := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, dialNet, ip.String())
+	return conn, isIPv6, err
+}
 
-	conn, err := net.DialTimeout(dialNet, target, 5*time.Second)
+func (h *ICMPHandler) icmpExchange(ctx context.Context, target string, payload []byte, user *proxyUser) ([]byte, error) {
+	log.Debug("[ICMP] exchange", "target", target)
+
+	if len(payload) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	conn, isIPv6, err := h.dialTarget(ctx, target, user)
 	if err != nil {
 		log.Error("[ICMP] dial target failed", "target", target, "err", err)
 		return nil, err
 	}
 	defer conn.Close() //nolint:errcheck
+	parseProto := 1
+	if isIPv6 {
+		parseProto = 58
+	}
 
 	var echoType icmp.Type
 	if isIPv6 {
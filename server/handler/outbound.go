@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/outbound"
+)
+
+// errBlocked rejects a stream whose target an outbound rule blocks.
+var errBlocked = errors.New("blocked by outbound rule")
+
+// routeTarget matches a stream of user to target against the outbound
+// rules, logging the rule that decided it.
+func routeTarget(ctx context.Context, r *outbound.Router, network, target string, user *proxyUser) outbound.Action {
+	action := r.Match(ctx, outbound.Request{Network: network, Target: target, User: user.userName()})
+	if action.Kind != outbound.ActionDefault {
+		log.Info("[OUTBOUND] rule matched", "target", target, "network", network,
+			"user", user.userName(), "rule", action.Rule+1, "action", action.String())
+	}
+	return action
+}
+
+// viaProxy returns the next proxy an outbound rule names.
+func viaProxy(g *nextproxy.Group, name string) (*nextproxy.NextProxy, error) {
+	np := g.Get(name)
+	if np == nil {
+		return nil, fmt.Errorf("unknown next proxy %q", name)
+	}
+	return np, nil
+}
+
+// userName returns the name of u, empty for a nil user.
+func (u *proxyUser) userName() string {
+	if u == nil {
+		return ""
+	}
+	return u.name
+}
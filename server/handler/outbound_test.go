@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/outbound"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboundRulesDial(t *testing.T) {
+	router, err := outbound.New([]config.OutboundRule{
+		{Ports: []string{"25"}, Action: "block"},
+		{Users: []string{"alice"}, Action: "via:other"},
+		{Domains: []string{"direct.example"}, Action: "direct"},
+		{CIDRs: []string{"203.0.113.0/24"}, Action: "block"},
+	}, "")
+	require.NoError(t, err)
+	// 转发所有目标的下一跳代理，只有规则能绕过它
+	np, err := nextproxy.New("socks5://127.0.0.1:1", true, true)
+	require.NoError(t, err)
+	proxies := nextproxy.NewGroup(np)
+
+	tcp := NewTCPHandler(0, 0, proxies)
+	tcp.outbound = router
+	var dialed []string
+	tcp.dialContext = func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return newStubConn(&net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 443}), nil
+	}
+	udp := NewUDPHandler(0, proxies)
+	udp.outbound = router
+	icmp := NewICMPHandler()
+	icmp.outbound = router
+	alice := &proxyUser{name: "alice"}
+
+	t.Run("TCP 屏蔽端口", func(t *testing.T) {
+		_, _, err := tcp.dialTarget(context.Background(), "tcp", "mx.example.com:25", nil)
+		require.ErrorIs(t, err, errBlocked)
+	})
+
+	t.Run("UDP 屏蔽端口", func(t *testing.T) {
+		_, err := udp.dialTarget(context.Background(), "8.8.8.8:25", nil)
+		require.ErrorIs(t, err, errBlocked)
+	})
+
+	t.Run("ICMP 屏蔽网段", func(t *testing.T) {
+		_, _, err := icmp.dialTarget(context.Background(), "203.0.113.9", nil)
+		require.ErrorIs(t, err, errBlocked)
+	})
+
+	t.Run("ICMP 拒绝内网目标", func(t *testing.T) {
+		_, _, err := icmp.dialTarget(context.Background(), "127.0.0.1", nil)
+		require.ErrorContains(t, err, "ssrf")
+	})
+
+	t.Run("direct 绕过下一跳代理", func(t *testing.T) {
+		conn, remote, err := tcp.dialTarget(context.Background(), "tcp", "direct.example:443", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Empty(t, remote)
+		require.Equal(t, []string{"direct.example:443"}, dialed)
+	})
+
+	t.Run("未知的下一跳代理", func(t *testing.T) {
+		_, _, err := tcp.dialTarget(context.Background(), "tcp", "example.com:443", alice)
+		require.ErrorContains(t, err, `unknown next proxy "other"`)
+		_, err = udp.dialTarget(context.Background(), "8.8.8.8:53", alice)
+		require.ErrorContains(t, err, `unknown next proxy "other"`)
+	})
+}
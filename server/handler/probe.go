@@ -5,7 +5,9 @@ import (
 	"encoding/base64"
 	"net/http"
 	"strconv"
+	"sync"
 
+	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/stats"
@@ -18,33 +20,51 @@ const probeChunkSize = 32 * 1024
 
 // ProbeHandler serves the pre-generated random payload used by clients to
 // actively measure the download throughput of their own connection. A valid
-// request must carry the capability token derived from the master key in the
-// x-es header (same header name and wire shape as the proxy handshake salt);
+// request must carry the capability token derived from any user's master key
+// in the x-es header (same header name and wire shape as the proxy handshake salt);
 // anything else is answered with the camouflaged fallback page so the server
 // stays indistinguishable from a real site.
 type ProbeHandler struct {
 	payload []byte
-	token   []byte
 	limiter *ipRateLimiter
+
+	mu     sync.RWMutex
+	tokens [][]byte
 }
 
 // NewProbeHandler builds the /v3/probe handler. The payload must have been
 // generated at server startup; serving the same buffer keeps the endpoint
 // cheap and uncacheable (Cache-Control: no-store).
-func NewProbeHandler(masterKey, payload []byte) (*ProbeHandler, error) {
-	tokenB64, err := crypto.ProbeToken(masterKey)
-	if err != nil {
-		return nil, err
+func NewProbeHandler(masterKeys [][]byte, payload []byte) (*ProbeHandler, error) {
+	h := &ProbeHandler{
+		payload: payload,
+		limiter: newIPRateLimiter(),
 	}
-	token, err := base64.RawURLEncoding.DecodeString(tokenB64)
-	if err != nil {
+	if err := h.SetMasterKeys(masterKeys); err != nil {
 		return nil, err
 	}
-	return &ProbeHandler{
-		payload: payload,
-		token:   token,
-		limiter: newIPRateLimiter(),
-	}, nil
+	return h, nil
+}
+
+// SetMasterKeys replaces the accepted tokens with those of masterKeys, as
+// users are added or removed at runtime.
+func (h *ProbeHandler) SetMasterKeys(masterKeys [][]byte) error {
+	tokens := make([][]byte, 0, len(masterKeys))
+	for _, masterKey := range masterKeys {
+		tokenB64, err := crypto.ProbeToken(masterKey)
+		if err != nil {
+			return err
+		}
+		token, err := base64.RawURLEncoding.DecodeString(tokenB64)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	h.mu.Lock()
+	h.tokens = tokens
+	h.mu.Unlock()
+	return nil
 }
 
 func (h *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -59,12 +79,20 @@ func (h *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	token, err := base64.RawURLEncoding.DecodeString(tokenB64)
-	if err != nil || len(token) != len(h.token) ||
-		subtle.ConstantTimeCompare(token, h.token) != 1 {
+	if err != nil || !h.validToken(token) {
 		ServeFallback(w, r)
 		return
 	}
 
+	// HEAD only asks for the address the client is seen from (used for
+	// EDNS Client Subnet); it carries no payload and is not rate limited.
+	if r.Method == http.MethodHead {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set(sharedconfig.HeaderClientAddr, clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	// Bound probe downloads per source IP; wrong-token requests never reach
 	// this point (they get the cheap fallback page instead).
 	if !h.limiter.Allow(clientIP(r)) {
@@ -91,3 +119,17 @@ func (h *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		_ = rc.Flush()
 	}
 }
+
+// validToken reports whether token is one of the users' tokens. Every token
+// is compared so the time taken does not tell which user matched.
+func (h *ProbeHandler) validToken(token []byte) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	valid := 0
+	for _, t := range h.tokens {
+		if len(token) == len(t) {
+			valid |= subtle.ConstantTimeCompare(token, t)
+		}
+	}
+	return valid == 1
+}
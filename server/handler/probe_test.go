@@ -37,7 +37,7 @@ func newTestProbeHandler(t *testing.T) (*ProbeHandler, string, []byte) {
 	if _, err := io.ReadFull(rand.Reader, payload); err != nil {
 		t.Fatal(err)
 	}
-	h, err := NewProbeHandler(masterKey, payload)
+	h, err := NewProbeHandler([][]byte{masterKey}, payload)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -79,6 +79,36 @@ func TestProbeHandlerValidToken(t *testing.T) {
 	}
 }
 
+func TestProbeHandlerAcceptsAnyUserToken(t *testing.T) {
+	var masterKeys [][]byte
+	var tokens []string
+	for _, password := range []string{"alice-password", "bob-password"} {
+		masterKey, err := crypto.DeriveMasterKey(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := crypto.ProbeToken(masterKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		masterKeys = append(masterKeys, masterKey)
+		tokens = append(tokens, token)
+	}
+	h, err := NewProbeHandler(masterKeys, make([]byte, 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range tokens {
+		req := h2Request(http.MethodGet, "/v3/probe")
+		req.Header.Set("x-es", token)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if ct := rr.Header().Get("Content-Type"); ct != "application/octet-stream" {
+			t.Fatalf("Content-Type = %q, want the probe payload", ct)
+		}
+	}
+}
+
 func TestProbeHandlerRejectsInvalidToken(t *testing.T) {
 	h, _, _ := newTestProbeHandler(t)
 
@@ -147,3 +177,32 @@ func TestProbeHandlerRateLimit(t *testing.T) {
 		t.Fatalf("status = %d, want 429", rr.Code)
 	}
 }
+
+func TestProbeHandlerHeadReportsClientAddr(t *testing.T) {
+	h, token, _ := newTestProbeHandler(t)
+
+	req := h2Request(http.MethodHead, "/v3/probe")
+	req.Header.Set("x-es", token)
+	req.RemoteAddr = "198.51.100.23:40000"
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", rr.Code)
+	}
+	if addr := rr.Header().Get("x-es-addr"); addr != "198.51.100.23" {
+		t.Fatalf("x-es-addr = %q, want 198.51.100.23", addr)
+	}
+	if rr.Body.Len() != 0 {
+		t.Fatal("HEAD response must not carry the probe payload")
+	}
+
+	// Without a valid token the address is never disclosed.
+	req = h2Request(http.MethodHead, "/v3/probe")
+	req.RemoteAddr = "198.51.100.23:40000"
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if addr := rr.Header().Get("x-es-addr"); addr != "" {
+		t.Fatalf("x-es-addr = %q leaked without token", addr)
+	}
+}
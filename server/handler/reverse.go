@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+)
+
+// ReverseHandler serves reverse tunnels. A client registers one of its
+// user's allowed ports on a control stream and the server listens on it; every
+// accepted connection is parked under a random ID announced on the control
+// stream, until the client claims it with a connection stream or
+// acceptTimeout expires.
+type ReverseHandler struct {
+	tcp           *TCPHandler
+	acceptTimeout time.Duration
+
+	mu      sync.Mutex
+	active  map[int]*reverseRegistration
+	pending map[string]net.Conn
+}
+
+type reverseRegistration struct {
+	user   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// errReversePortInUse rejects the registration of a port registered by
+// another user.
+var errReversePortInUse = errors.New("reverse port registered by another user")
+
+func NewReverseHandler(tcp *TCPHandler) *ReverseHandler {
+	return &ReverseHandler{
+		tcp:           tcp,
+		acceptTimeout: tcp.acceptTimeout,
+		active:        make(map[int]*reverseRegistration),
+		pending:       make(map[string]net.Conn),
+	}
+}
+
+// HandleRegister serves a control stream registering the port of target
+// (":port"), which must be one of the reverse ports of user. A newer
+// registration of the same user takes the port over, so a reconnecting
+// client does not wait for its stale stream to time out; other users are
+// rejected while the port is registered.
+func (h *ReverseHandler) HandleRegister(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, user *proxyUser, cancelRead func()) error {
+	sendRST := func() {
+		_ = s2c.PushFrame(protocol.NewFrameRST())
+		_ = s2c.Flush()
+	}
+
+	port, err := reversePort(target)
+	if err != nil || !user.reversePorts[port] {
+		log.Warn("[REVERSE] port not allowed", "target", target)
+		sendRST()
+		return fmt.Errorf("reverse port %q not allowed", target)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reg := &reverseRegistration{user: user.name, cancel: cancel, done: make(chan struct{})}
+	defer close(reg.done)
+	if err := h.takeOver(port, reg); err != nil {
+		log.Warn("[REVERSE] port registered by another user", "port", port, "user", user.name)
+		sendRST()
+		return fmt.Errorf("reverse port %d: %w", port, err)
+	}
+	defer h.release(port, reg)
+
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		log.Error("[REVERSE] listen failed", "port", port, "err", err)
+		sendRST()
+		return fmt.Errorf("reverse listen: %w", err)
+	}
+	defer ln.Close() //nolint:errcheck
+	stop := context.AfterFunc(ctx, func() { _ = ln.Close() })
+	defer stop()
+
+	bound := ln.Addr().String()
+	log.Info("[REVERSE] listening", "bound", bound)
+	if err := s2c.PushData([]byte(bound)); err != nil {
+		return err
+	}
+	if err := s2c.Flush(); err != nil {
+		return err
+	}
+
+	// The client sends only keepalive padding on the control stream; any
+	// read error or FIN/RST ends the registration.
+	go func() {
+		defer cancel()
+		for {
+			f, err := dr.ReadFrame()
+			if err != nil || f.Type == protocol.FrameFIN || f.Type == protocol.FrameRST {
+				return
+			}
+		}
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Info("[REVERSE] registration closed", "bound", bound)
+				if cancelRead != nil {
+					cancelRead()
+				}
+				return nil
+			}
+			return err
+		}
+		id := h.park(c)
+		log.Info("[REVERSE] accepted", "bound", bound, "remote", c.RemoteAddr().String(), "id", id)
+		err = s2c.PushData([]byte(id))
+		if err == nil {
+			err = s2c.Flush()
+		}
+		if err != nil {
+			if pc := h.claim(id); pc != nil {
+				_ = pc.Close()
+			}
+			return err
+		}
+	}
+}
+
+// HandleConn relays the parked connection with the given ID.
+func (h *ReverseHandler) HandleConn(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, id string, user *proxyUser, cancelRead func()) error {
+	c := h.claim(id)
+	if c == nil {
+		log.Warn("[REVERSE] unknown connection", "id", id)
+		_ = s2c.PushFrame(protocol.NewFrameRST())
+		_ = s2c.Flush()
+		return fmt.Errorf("reverse connection %q not found", id)
+	}
+	defer c.Close() //nolint:errcheck
+	return h.tcp.relay(ctx, dr, s2c, c, c.LocalAddr().String(), c.RemoteAddr().String(), user, cancelRead)
+}
+
+// takeOver makes reg the registration of port, stopping the previous one
+// of the same user and waiting briefly for it to release its listener. It
+// fails with errReversePortInUse when another user registered port.
+func (h *ReverseHandler) takeOver(port int, reg *reverseRegistration) error {
+	h.mu.Lock()
+	prev := h.active[port]
+	if prev != nil && prev.user != reg.user {
+		h.mu.Unlock()
+		return errReversePortInUse
+	}
+	h.active[port] = reg
+	h.mu.Unlock()
+	if prev == nil {
+		return nil
+	}
+	log.Info("[REVERSE] registration taken over", "port", port, "user", reg.user)
+	prev.cancel()
+	select {
+	case <-prev.done:
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
+
+func (h *ReverseHandler) release(port int, reg *reverseRegistration) {
+	h.mu.Lock()
+	if h.active[port] == reg {
+		delete(h.active, port)
+	}
+	h.mu.Unlock()
+}
+
+// park holds c until claimed, closing it if it is not claimed in time.
+func (h *ReverseHandler) park(c net.Conn) string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	h.mu.Lock()
+	h.pending[id] = c
+	h.mu.Unlock()
+	time.AfterFunc(h.acceptTimeout, func() {
+		if pc := h.claim(id); pc != nil {
+			log.Info("[REVERSE] connection not claimed", "id", id)
+			_ = pc.Close()
+		}
+	})
+	return id
+}
+
+func (h *ReverseHandler) claim(id string) net.Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.pending[id]
+	delete(h.pending, id)
+	return c
+}
+
+// reversePort parses the port of a registration target, ":port".
+func reversePort(target string) (int, error) {
+	_, p, err := net.SplitHostPort(target)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", p)
+	}
+	return port, nil
+}
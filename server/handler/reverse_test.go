@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/protocol"
+)
+
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	return port
+}
+
+func reverseUser(name string, ports ...int) *proxyUser {
+	allowed := make(map[int]bool, len(ports))
+	for _, p := range ports {
+		allowed[p] = true
+	}
+	return &proxyUser{name: name, reversePorts: allowed}
+}
+
+func TestReverseHandler(t *testing.T) {
+	port := freeTCPPort(t)
+	h := NewReverseHandler(NewTCPHandler(5*time.Second, 5*time.Second, nil))
+	ctrlDR, ctrlW, ctrlS2C, ctrlClient := bindStream(t)
+
+	regDone := make(chan error, 1)
+	go func() {
+		regDone <- h.HandleRegister(context.Background(), ctrlDR, ctrlS2C, ":"+strconv.Itoa(port), reverseUser("alice", port), nil)
+	}()
+	readDataFrame(t, ctrlClient)
+
+	visitor, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close() //nolint:errcheck
+	id := readDataFrame(t, ctrlClient)
+
+	dr, c2sW, s2c, client := bindStream(t)
+	connDone := make(chan error, 1)
+	go func() {
+		connDone <- h.HandleConn(context.Background(), dr, s2c, id, nil, nil)
+	}()
+	if _, err := visitor.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDataFrame(t, client); got != "ping" {
+		t.Fatalf("relayed %q, want %q", got, "ping")
+	}
+
+	go drainFrames(client)
+	_ = visitor.Close()
+	_ = c2sW.Close()
+	select {
+	case <-connDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleConn did not return")
+	}
+
+	// 控制流断开后注册结束，端口被释放
+	go drainFrames(ctrlClient)
+	_ = ctrlW.Close()
+	select {
+	case err := <-regDone:
+		if err != nil {
+			t.Fatalf("HandleRegister: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleRegister did not return")
+	}
+	if _, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		t.Fatal("port still listening after the registration ended")
+	}
+}
+
+func TestReverseHandlerRejects(t *testing.T) {
+	h := NewReverseHandler(NewTCPHandler(5*time.Second, 5*time.Second, nil))
+	port := freeTCPPort(t)
+
+	t.Run("端口不在允许列表", func(t *testing.T) {
+		dr, _, s2c, client := bindStream(t)
+		go drainFrames(dr)
+		done := make(chan error, 1)
+		go func() {
+			done <- h.HandleRegister(context.Background(), dr, s2c, ":1", reverseUser("alice", port), nil)
+		}()
+		f, err := client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != protocol.FrameRST {
+			t.Fatalf("frame = %v, want RST", f.Type)
+		}
+		if err := <-done; err == nil {
+			t.Fatal("HandleRegister should fail")
+		}
+	})
+
+	t.Run("其他用户不能接管端口", func(t *testing.T) {
+		target := ":" + strconv.Itoa(port)
+		ctrlDR, ctrlW, ctrlS2C, ctrlClient := bindStream(t)
+		regDone := make(chan error, 1)
+		go func() {
+			regDone <- h.HandleRegister(context.Background(), ctrlDR, ctrlS2C, target, reverseUser("alice", port), nil)
+		}()
+		readDataFrame(t, ctrlClient)
+
+		dr, _, s2c, client := bindStream(t)
+		go drainFrames(dr)
+		done := make(chan error, 1)
+		go func() {
+			done <- h.HandleRegister(context.Background(), dr, s2c, target, reverseUser("bob", port), nil)
+		}()
+		f, err := client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != protocol.FrameRST {
+			t.Fatalf("frame = %v, want RST", f.Type)
+		}
+		if err := <-done; !errors.Is(err, errReversePortInUse) {
+			t.Fatalf("HandleRegister = %v, want errReversePortInUse", err)
+		}
+
+		// 同一用户重新注册时接管端口，原注册结束
+		dr2, _, s2c2, client2 := bindStream(t)
+		go drainFrames(dr2)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			_ = h.HandleRegister(ctx, dr2, s2c2, target, reverseUser("alice", port), nil)
+		}()
+		go drainFrames(ctrlClient)
+		select {
+		case err := <-regDone:
+			if err != nil {
+				t.Fatalf("taken over registration: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("registration not taken over")
+		}
+		readDataFrame(t, client2)
+		_ = ctrlW.Close()
+	})
+
+	t.Run("未知连接ID", func(t *testing.T) {
+		dr, _, s2c, client := bindStream(t)
+		go drainFrames(client)
+		if err := h.HandleConn(context.Background(), dr, s2c, "unknown", nil, nil); err == nil {
+			t.Fatal("HandleConn should fail")
+		}
+	})
+}
+
+func TestReversePort(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		want    int
+		wantErr bool
+	}{
+		{name: "仅端口", target: ":8022", want: 8022},
+		{name: "带主机", target: "0.0.0.0:8022", want: 8022},
+		{name: "缺少端口", target: "8022", wantErr: true},
+		{name: "端口为0", target: ":0", wantErr: true},
+		{name: "端口越界", target: ":70000", wantErr: true},
+		{name: "非数字端口", target: ":ssh", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := reversePort(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("port = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
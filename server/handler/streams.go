@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamInfo describes an active proxy stream. BytesUp and BytesDown are the
+// bytes received from and sent to the client on the stream.
+type StreamInfo struct {
+	ID         uint64    `json:"id"`
+	User       string    `json:"user"`
+	Remote     string    `json:"remote"`
+	Endpoint   string    `json:"endpoint"`
+	Target     string    `json:"target"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	Started    time.Time `json:"started"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+type activeStream struct {
+	id       uint64
+	user     *proxyUser
+	remote   string
+	endpoint string
+	target   string
+	started  time.Time
+	up, down atomic.Int64
+	// kill ends the stream: it cancels the request context and closes the
+	// request body, which unblocks every relay reading from the client.
+	kill func()
+}
+
+// streamRegistry keeps the active streams so they can be listed and
+// killed from the admin API.
+type streamRegistry struct {
+	next atomic.Uint64
+
+	mu sync.Mutex
+	m  map[uint64]*activeStream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{m: make(map[uint64]*activeStream)}
+}
+
+func (r *streamRegistry) add(s *activeStream) {
+	s.id = r.next.Add(1)
+	r.mu.Lock()
+	r.m[s.id] = s
+	r.mu.Unlock()
+}
+
+func (r *streamRegistry) remove(s *activeStream) {
+	r.mu.Lock()
+	delete(r.m, s.id)
+	r.mu.Unlock()
+}
+
+// list returns the active streams, oldest first.
+func (r *streamRegistry) list() []StreamInfo {
+	r.mu.Lock()
+	out := make([]StreamInfo, 0, len(r.m))
+	for _, s := range r.m {
+		out = append(out, StreamInfo{
+			ID:         s.id,
+			User:       s.user.name,
+			Remote:     s.remote,
+			Endpoint:   s.endpoint,
+			Target:     s.target,
+			BytesUp:    s.up.Load(),
+			BytesDown:  s.down.Load(),
+			Started:    s.started,
+			AgeSeconds: time.Since(s.started).Seconds(),
+		})
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// kill ends the streams matching match, returning how many there were.
+func (r *streamRegistry) kill(match func(*activeStream) bool) int {
+	var victims []*activeStream
+	r.mu.Lock()
+	for _, s := range r.m {
+		if match(s) {
+			victims = append(victims, s)
+		}
+	}
+	r.mu.Unlock()
+	for _, s := range victims {
+		s.kill()
+	}
+	return len(victims)
+}
+
+// Streams returns the active proxy streams.
+func (h *ProxyHandler) Streams() []StreamInfo {
+	return h.streams.list()
+}
+
+// KillStream ends the active stream with the given ID, reporting whether
+// it existed.
+func (h *ProxyHandler) KillStream(id uint64) bool {
+	return h.streams.kill(func(s *activeStream) bool { return s.id == id }) > 0
+}
+
+// KillStreams ends every active stream and returns how many there were.
+func (h *ProxyHandler) KillStreams() int {
+	return h.streams.kill(func(*activeStream) bool { return true })
+}
+
+// Drain makes the handler answer new handshakes with the fallback page,
+// while the active streams go on until they end or are killed.
+func (h *ProxyHandler) Drain() {
+	h.draining.Store(true)
+}
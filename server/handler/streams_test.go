@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	sharedconfig "github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamRegistry(t *testing.T) {
+	r := newStreamRegistry()
+	alice, bob := &proxyUser{name: "alice"}, &proxyUser{name: "bob"}
+	killed := make(map[string]int)
+	newStream := func(u *proxyUser) *activeStream {
+		s := &activeStream{user: u, started: time.Now()}
+		s.kill = func() { killed[u.name]++ }
+		r.add(s)
+		return s
+	}
+	s1 := newStream(alice)
+	newStream(bob)
+	s3 := newStream(alice)
+	s3.up.Add(10)
+
+	list := r.list()
+	require.Len(t, list, 3)
+	require.Equal(t, []uint64{1, 2, 3}, []uint64{list[0].ID, list[1].ID, list[2].ID})
+	require.Equal(t, int64(10), list[2].BytesUp)
+
+	t.Run("按用户结束流", func(t *testing.T) {
+		n := r.kill(func(s *activeStream) bool { return s.user == alice })
+		require.Equal(t, 2, n)
+		require.Equal(t, map[string]int{"alice": 2}, killed)
+	})
+
+	t.Run("移除后不再列出", func(t *testing.T) {
+		r.remove(s1)
+		require.Len(t, r.list(), 2)
+		require.Zero(t, r.kill(func(s *activeStream) bool { return s.id == s1.id }))
+	})
+}
+
+func TestProxyHandlerKillStream(t *testing.T) {
+	alice := bytes.Repeat([]byte{0x41}, 32)
+	bob := bytes.Repeat([]byte{0x42}, 32)
+	h := NewProxyHandler(ProxyHandlerConfig{
+		Users:             []User{{Name: "alice", MasterKey: alice}},
+		AllowedMethods:    []string{protocol.MethodAES256GCM.String()},
+		HandshakeTimeout:  time.Second,
+		Timeout:           5 * time.Second,
+		StreamIdleTimeout: 300 * time.Second,
+		UDPIdleTimeout:    30 * time.Second,
+	})
+	require.NoError(t, h.AddUser(User{Name: "bob", MasterKey: bob}))
+	require.Error(t, h.AddUser(User{Name: "bob", MasterKey: bytes.Repeat([]byte{0x43}, 32)}))
+	require.Error(t, h.AddUser(User{Name: "carol", MasterKey: alice}))
+
+	// 目标是一个不产生数据的公网连接，流会一直保持到被结束
+	h.tcpHandler.dialContext = func(context.Context, string, string) (net.Conn, error) {
+		return newStubConn(&net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 53}), nil
+	}
+	srv := newRejectTestServer(t, h)
+	tr := newRejectTestClient(t)
+
+	// open starts a stream of the user and returns a channel closed when
+	// the server ends it.
+	open := func(masterKey []byte) (StreamInfo, <-chan struct{}) {
+		saltB64, record := buildBootstrapRecord(t, masterKey, sharedconfig.EndpointTCP,
+			protocol.ProtoTCP, protocol.MethodAES256GCM, "8.8.8.8:53")
+		pr, pw := io.Pipe()
+		t.Cleanup(func() { _ = pw.Close() })
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// The transport closes the body when the server ends the stream.
+			body := struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(record), pr), pr}
+			req, err := http.NewRequest(http.MethodPost, srv.URL+sharedconfig.EndpointTCP, body)
+			if err != nil {
+				return
+			}
+			req.Header.Set("x-es", saltB64)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+
+		var info StreamInfo
+		require.Eventually(t, func() bool {
+			for _, s := range h.Streams() {
+				if s.ID > info.ID {
+					info = s
+				}
+			}
+			return info.ID != 0
+		}, 5*time.Second, 10*time.Millisecond)
+		return info, done
+	}
+
+	t.Run("结束指定的流", func(t *testing.T) {
+		info, done := open(alice)
+		require.Equal(t, "alice", info.User)
+		require.Equal(t, "8.8.8.8:53", info.Target)
+		require.Equal(t, sharedconfig.EndpointTCP, info.Endpoint)
+
+		require.True(t, h.KillStream(info.ID))
+		require.Eventually(t, func() bool { return len(h.Streams()) == 0 }, 5*time.Second, 10*time.Millisecond)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("killed stream still open")
+		}
+		require.False(t, h.KillStream(info.ID))
+	})
+
+	t.Run("移除用户结束其所有流", func(t *testing.T) {
+		info, done := open(bob)
+		require.Equal(t, "bob", info.User)
+		require.Len(t, h.Users(), 2)
+
+		require.True(t, h.RemoveUser("bob"))
+		require.False(t, h.RemoveUser("bob"))
+		require.Len(t, h.Users(), 1)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream of removed user still open")
+		}
+
+		saltB64, record := buildBootstrapRecord(t, bob, sharedconfig.EndpointTCP,
+			protocol.ProtoTCP, protocol.MethodAES256GCM, "8.8.8.8:53")
+		// 已移除用户的请求被当作探测，返回回落页面
+		resp, _ := postBootstrap(t, tr, srv.URL+sharedconfig.EndpointTCP, saltB64, bytes.NewReader(record))
+		require.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+		require.Empty(t, h.Streams())
+	})
+
+	t.Run("排空后新握手得到回落页面", func(t *testing.T) {
+		_, done := open(alice)
+		h.Drain()
+
+		saltB64, record := buildBootstrapRecord(t, alice, sharedconfig.EndpointTCP,
+			protocol.ProtoTCP, protocol.MethodAES256GCM, "8.8.8.8:53")
+		resp, _ := postBootstrap(t, tr, srv.URL+sharedconfig.EndpointTCP, saltB64, bytes.NewReader(record))
+		require.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+		require.Len(t, h.Streams(), 1, "已有的流不受影响")
+
+		require.Equal(t, 1, h.KillStreams())
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("killed stream still open")
+		}
+	})
+}
@@ -14,6 +14,8 @@ import (
 	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/relay"
 	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/outbound"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/stats"
 	"github.com/nange/easyss/v3/util"
@@ -23,9 +25,13 @@ import (
 type TCPHandler struct {
 	dialer      *net.Dialer
 	dialContext func(context.Context, string, string) (net.Conn, error)
-	nextProxy   *nextproxy.NextProxy
+	nextProxies *nextproxy.Group
+	outbound    *outbound.Router
+	resolver    *resolver.Resolver
 	idleTimeout time.Duration
 	dialTimeout time.Duration
+	// acceptTimeout bounds how long a BIND stream waits for its peer.
+	acceptTimeout time.Duration
 }
 
 // DialTimeout computes the dial timeout for outbound connections.
@@ -41,7 +47,7 @@ func DialTimeout(timeout time.Duration) time.Duration {
 	return d
 }
 
-func NewTCPHandler(idleTimeout, timeout time.Duration, np *nextproxy.NextProxy) *TCPHandler {
+func NewTCPHandler(idleTimeout, timeout time.Duration, nextProxies *nextproxy.Group) *TCPHandler {
 	if idleTimeout <= 0 {
 		idleTimeout = 300 * time.Second
 	}
@@ -50,37 +56,108 @@ func NewTCPHandler(idleTimeout, timeout time.Duration, np *nextproxy.NextProxy)
 	}
 	dialTimeout := DialTimeout(timeout)
 	return &TCPHandler{
-		dialer:      &net.Dialer{Timeout: dialTimeout, KeepAlive: timeout},
-		nextProxy:   np,
-		idleTimeout: idleTimeout,
-		dialTimeout: dialTimeout,
+		dialer:        &net.Dialer{Timeout: dialTimeout, KeepAlive: timeout},
+		nextProxies:   nextProxies,
+		idleTimeout:   idleTimeout,
+		dialTimeout:   dialTimeout,
+		acceptTimeout: timeout,
 	}
 }
 
-func (h *TCPHandler) dialTarget(ctx context.Context, network, addr string) (net.Conn, error) {
-	if h.nextProxy != nil && h.nextProxy.ShouldProxy(addr) {
-		log.Info("[TCP_HANDLE] dialing via next proxy", "target", addr, "proxy", h.nextProxy.URL().String())
-		return h.nextProxy.DialContext(ctx, network, addr)
+// dialTarget dials addr as the outbound rules of user's stream direct. It
+// also returns the next proxy address when dialing through one, since the
+// proxied connection cannot report its remote end.
+func (h *TCPHandler) dialTarget(ctx context.Context, network, addr string, user *proxyUser) (net.Conn, string, error) {
+	action := routeTarget(ctx, h.outbound, "tcp", addr, user)
+	var np *nextproxy.NextProxy
+	switch action.Kind {
+	case outbound.ActionBlock:
+		return nil, "", fmt.Errorf("%w: %s", errBlocked, addr)
+	case outbound.ActionVia:
+		var err error
+		if np, err = viaProxy(h.nextProxies, action.Via); err != nil {
+			return nil, "", err
+		}
+	case outbound.ActionDefault:
+		np = h.nextProxies.Match(addr)
+	}
+	if np != nil {
+		log.Info("[TCP_HANDLE] dialing via next proxy", "target", addr, "proxy", np.Name())
+		conn, used, err := h.nextProxies.DialContext(ctx, np, network, addr)
+		if err != nil {
+			return nil, "", err
+		}
+		return conn, used.URL().Host, nil
+	}
+
+	var local net.Addr
+	if action.Kind == outbound.ActionBind {
+		var err error
+		if local, err = outbound.LocalAddr(action.Bind, "tcp", addr); err != nil {
+			return nil, "", err
+		}
 	}
+	conn, err := h.dialDirect(ctx, network, addr, local)
+	return conn, "", err
+}
+
+// dialDirect dials addr from local, or any local address when nil.
+func (h *TCPHandler) dialDirect(ctx context.Context, network, addr string, local net.Addr) (net.Conn, error) {
 	// Test-only injection point; nil in production.
 	if h.dialContext != nil {
 		return h.dialContext(ctx, network, addr)
 	}
+	addrs, err := resolveTarget(ctx, h.resolver, addr, local)
+	if err != nil {
+		return nil, err
+	}
 	d := h.dialer
-	conn, err := d.DialContext(ctx, outboundTCPNetwork(addr), addr)
+	if local != nil {
+		bound := *h.dialer
+		bound.LocalAddr = local
+		d = &bound
+	}
+	var conn net.Conn
+	for _, a := range addrs {
+		if conn, err = d.DialContext(ctx, outboundTCPNetwork(a), a); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return conn, err
+}
+
+// resolveTarget resolves the host of addr and returns the addresses to
+// dial in order, restricted to the family of local when set. Dialing the
+// checked addresses rather than the name means a DNS answer cannot change
+// to a LAN address between the SSRF check and the dial.
+func resolveTarget(ctx context.Context, r *resolver.Resolver, addr string, local net.Addr) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	// Post-dial SSRF guard: verify the actual remote IP is not a LAN address.
-	// This defends against DNS rebinding attacks where a domain resolves to a
-	// safe public IP during the handshake validation but to a LAN IP on dial.
-	if ra := conn.RemoteAddr(); ra != nil {
-		if host, _, e := net.SplitHostPort(ra.String()); e == nil && util.IsLANIP(host) {
-			_ = conn.Close()
-			return nil, fmt.Errorf("ssrf: rejected lan destination %s", host)
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var family string
+	if local != nil {
+		family = outbound.BindNetwork("", local)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		// Post-resolution SSRF guard: the target check of the handshake may
+		// have seen another answer, as in a DNS rebinding attack.
+		if util.IsLANIP(ip.String()) {
+			return nil, fmt.Errorf("ssrf: rejected lan destination %s", ip)
 		}
+		if family == "" || (family == "4") == (ip.To4() != nil) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no address reachable from %s", host, local)
 	}
-	return conn, nil
+	return addrs, nil
 }
 
 func outboundTCPNetwork(addr string) string {
@@ -103,9 +180,9 @@ func outboundTCPNetwork(addr string) string {
 // it unblocks a copy goroutine that may be stuck reading from the client
 // (e.g. the HTTP/2 request body), so no goroutine lingers after the handler
 // returns.
-func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, cancelRead func()) error {
+func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, user *proxyUser, cancelRead func()) error {
 	log.Info("[TCP_HANDLE] dialing target", "target", target, "timeout", h.dialTimeout)
-	targetConn, err := h.dialTarget(ctx, "tcp", target)
+	targetConn, remote, err := h.dialTarget(ctx, "tcp", target, user)
 	if err != nil {
 		log.Error("[TCP_HANDLE] dial failed", "target", target, "err", err)
 		_ = s2c.PushFrame(protocol.NewFrameRST())
@@ -115,30 +192,39 @@ func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 	defer targetConn.Close() //nolint:errcheck
 	// When dialing via the next proxy, the socks5 client connection reports a
 	// nil RemoteAddr (the library's RemoteAddr() returns an unset field), so
-	// fall back to the configured proxy address for observability.
-	remote := ""
-	if h.nextProxy != nil && h.nextProxy.ShouldProxy(target) {
-		remote = h.nextProxy.URL().Host
-	} else if ra := targetConn.RemoteAddr(); ra != nil {
+	// dialTarget reports the proxy address for observability instead.
+	if ra := targetConn.RemoteAddr(); remote == "" && ra != nil {
 		remote = ra.String()
 	}
 	log.Info("[TCP_HANDLE] target connected", "target", target, "remote", remote)
+	return h.relay(ctx, dr, s2c, targetConn, target, remote, user, cancelRead)
+}
+
+// relay copies between the client stream and an established targetConn
+// until either side finishes, the idle timeout fires or an error occurs.
+// The payload is subject to the bandwidth limits and quota of user; a wait
+// on the limits ends with ctx or the relay.
+func (h *TCPHandler) relay(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, targetConn net.Conn, target, remote string, user *proxyUser, cancelRead func()) error {
 	m := stats.NewStreamMeter("tcp_handle", target)
 	defer m.Close()
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	sendRST := func() {
 		_ = s2c.PushFrame(protocol.NewFrameRST())
 		_ = s2c.Flush()
 	}
 
 	result := relay.Bidirectional(h.idleTimeout, func() {
+		cancel()
 		if cancelRead != nil {
 			cancelRead()
 		}
 		_ = targetConn.Close()
 	},
-		func(signal func()) error { return h.copyFromClient(dr, targetConn, signal) },
-		func(signal func()) error { return h.copyFromTarget(targetConn, s2c, signal, m) },
+		func(signal func()) error { return h.copyFromClient(ctx, dr, targetConn, user, signal) },
+		func(signal func()) error { return h.copyFromTarget(ctx, targetConn, s2c, user, signal, m) },
 	)
 	// Log the stream outcome (bytes relayed and exit reason) at INFO level so
 	// targets whose connection was established but later stalled, reset or
@@ -159,7 +245,7 @@ func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 	return result.Err
 }
 
-func (h *TCPHandler) copyFromClient(dr *crypto.DecryptedReader, dst net.Conn, signalActivity func()) error {
+func (h *TCPHandler) copyFromClient(ctx context.Context, dr *crypto.DecryptedReader, dst net.Conn, user *proxyUser, signalActivity func()) error {
 	for {
 		frame, err := dr.ReadFrame()
 		if err != nil {
@@ -170,6 +256,9 @@ func (h *TCPHandler) copyFromClient(dr *crypto.DecryptedReader, dst net.Conn, si
 		case protocol.FrameDATA:
 			signalActivity()
 			if len(frame.Payload) > 0 {
+				if lErr := user.limitUp(ctx, len(frame.Payload)); lErr != nil {
+					return lErr
+				}
 				if _, wErr := dst.Write(frame.Payload); wErr != nil {
 					return wErr
 				}
@@ -194,7 +283,7 @@ func (h *TCPHandler) copyFromClient(dr *crypto.DecryptedReader, dst net.Conn, si
 	}
 }
 
-func (h *TCPHandler) copyFromTarget(src net.Conn, s2c shaper.Shaper, signalActivity func(), m *stats.StreamMeter) error {
+func (h *TCPHandler) copyFromTarget(ctx context.Context, src net.Conn, s2c shaper.Shaper, user *proxyUser, signalActivity func(), m *stats.StreamMeter) error {
 	buf := bytespool.Get(config.ServerTCPStreamBufferSize)
 	defer bytespool.MustPut(buf)
 	for {
@@ -202,6 +291,9 @@ func (h *TCPHandler) copyFromTarget(src net.Conn, s2c shaper.Shaper, signalActiv
 		n, err := src.Read(buf)
 		if n > 0 {
 			signalActivity()
+			if lErr := user.limitDown(ctx, n); lErr != nil {
+				return lErr
+			}
 			m.SetState("write_http2")
 			if wErr := s2c.PushData(buf[:n]); wErr != nil {
 				return wErr
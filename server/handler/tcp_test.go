@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 	"net"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -12,6 +14,8 @@ import (
 	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/shaper"
 )
 
@@ -52,6 +56,50 @@ func TestOutboundTCPNetwork(t *testing.T) {
 	}
 }
 
+func TestResolveTarget(t *testing.T) {
+	res, err := resolver.New(&config.DNSConfig{
+		Strategy: resolver.StrategyIPv6First,
+		Hosts: map[string]string{
+			"dual.example":   "203.0.113.1,2001:db8::1",
+			"rebind.example": "203.0.113.2,127.0.0.1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		addr    string
+		local   net.Addr
+		want    []string
+		wantErr string
+	}{
+		{name: "ordered by strategy", addr: "dual.example:443", want: []string{"[2001:db8::1]:443", "203.0.113.1:443"}},
+		{name: "family of bind address", addr: "dual.example:443", local: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, want: []string{"203.0.113.1:443"}},
+		{name: "lan answer rejected", addr: "rebind.example:80", wantErr: "ssrf: rejected lan destination 127.0.0.1"},
+		{name: "lan literal rejected", addr: "10.0.0.1:80", wantErr: "ssrf: rejected lan destination"},
+		{name: "no address of the bind family", addr: "203.0.113.5:80", local: &net.UDPAddr{IP: net.ParseIP("2001:db8::5")}, wantErr: "no address reachable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveTarget(context.Background(), res, tt.addr, tt.local)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("addrs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 type stubConn struct {
 	closed chan struct{}
 	once   sync.Once
@@ -111,7 +159,7 @@ func TestTCPHandler_CancelReadOnIdleTimeout(t *testing.T) {
 
 	var cancelled atomic.Bool
 	start := time.Now()
-	err = h.Handle(context.Background(), dr, s2c, "8.8.8.8:53", func() { cancelled.Store(true) })
+	err = h.Handle(context.Background(), dr, s2c, "8.8.8.8:53", nil, func() { cancelled.Store(true) })
 	if err == nil {
 		t.Fatal("Handle should return an error on idle timeout")
 	}
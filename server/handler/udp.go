@@ -16,6 +16,8 @@ import (
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/outbound"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/util"
 	"github.com/nange/easyss/v3/util/bytespool"
@@ -25,30 +27,37 @@ const udpBufSize = protocol.MaxPlainRecordSize - protocol.FrameHeaderSize
 
 type UDPHandler struct {
 	idleTimeout time.Duration
-	nextProxy   *nextproxy.NextProxy
+	nextProxies *nextproxy.Group
+	outbound    *outbound.Router
+	resolver    *resolver.Resolver
 }
 
-func NewUDPHandler(idleTimeout time.Duration, np *nextproxy.NextProxy) *UDPHandler {
+func NewUDPHandler(idleTimeout time.Duration, nextProxies *nextproxy.Group) *UDPHandler {
 	if idleTimeout <= 0 {
 		idleTimeout = 30 * time.Second
 	}
 	h := &UDPHandler{
 		idleTimeout: idleTimeout,
-		nextProxy:   np,
+		nextProxies: nextProxies,
 	}
 	return h
 }
 
-func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string) error {
+// Handle relays the datagrams of a UDP stream between the client and
+// target, subject to the bandwidth limits and quota of user.
+func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, user *proxyUser) error {
 	log.Debug("[UDP] handler starting", "target", target)
 
-	conn, err := h.dialTarget(ctx, target)
+	conn, err := h.dialTarget(ctx, target, user)
 	if err != nil {
 		log.Error("[UDP] dial target failed", "target", target, "err", err)
 		_ = s2c.PushFrame(protocol.NewFrameRST())
 		_ = s2c.Flush()
 		return err
 	}
+	// ctx ends the waits on the user's limits when the stream ends.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	var dnsDetected atomic.Bool
 	var dnsChecked atomic.Bool
 
@@ -58,7 +67,7 @@ func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 	defer conn.Close() //nolint:errcheck
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- h.readFromTarget(conn, s2c, done, &dnsDetected)
+		errCh <- h.readFromTarget(ctx, conn, s2c, user, done, &dnsDetected)
 	}()
 	frameCh := make(chan udpFrameResult, 1)
 	go func() {
@@ -106,19 +115,19 @@ func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 			timer.Reset(h.idleTimeout)
 
 			// DNS query detection (only on first DATAGRAM frame)
-			if !dnsChecked.Load() && h.nextProxy != nil &&
+			if !dnsChecked.Load() && h.nextProxies != nil &&
 				res.frame.Type == protocol.FrameDATAGRAM && len(res.frame.Payload) > 0 {
 				msg := &dns.Msg{}
 				if err := msg.Unpack(res.frame.Payload); err == nil && util.IsDNSRequest(msg) {
 					dnsDetected.Store(true)
 					domain := strings.TrimSuffix(msg.Question[0].Name, ".")
-					viaNextProxy := h.nextProxy.IsCustomDomain(domain)
-					log.Info("[UDP_DNS]", "domain", domain, "target", target, "via_next_proxy", viaNextProxy)
+					np := h.nextProxies.CustomDomainProxy(domain)
+					log.Info("[UDP_DNS]", "domain", domain, "target", target, "via_next_proxy", np.Name())
 				}
 				dnsChecked.Store(true)
 			}
 
-			if err := h.handleClientFrame(conn, res.frame); err != nil {
+			if err := h.handleClientFrame(ctx, conn, res.frame, user); err != nil {
 				closeDone()
 				sendRST()
 				return err
@@ -140,10 +149,13 @@ type udpFrameResult struct {
 	err   error
 }
 
-func (h *UDPHandler) handleClientFrame(conn net.Conn, frame protocol.Frame) error {
+func (h *UDPHandler) handleClientFrame(ctx context.Context, conn net.Conn, frame protocol.Frame, user *proxyUser) error {
 	switch frame.Type {
 	case protocol.FrameDATAGRAM:
 		if len(frame.Payload) > 0 {
+			if err := user.limitUp(ctx, len(frame.Payload)); err != nil {
+				return err
+			}
 			_, err := conn.Write(frame.Payload)
 			return err
 		}
@@ -153,30 +165,54 @@ func (h *UDPHandler) handleClientFrame(conn net.Conn, frame protocol.Frame) erro
 	return nil
 }
 
-func (h *UDPHandler) dialTarget(ctx context.Context, target string) (net.Conn, error) {
+// dialTarget dials target as the outbound rules of user's stream direct.
+func (h *UDPHandler) dialTarget(ctx context.Context, target string, user *proxyUser) (net.Conn, error) {
 	host := target
 	if h, _, err := net.SplitHostPort(target); err == nil {
 		host = h
 	}
-	if h.nextProxy != nil && h.nextProxy.EnableUDP() && h.nextProxy.ShouldProxy(host) {
-		log.Info("[UDP] dialing via next proxy", "target", target, "proxy", h.nextProxy.URL().String())
-		return h.nextProxy.DialContext(ctx, "udp", target)
+	action := routeTarget(ctx, h.outbound, "udp", target, user)
+	var np *nextproxy.NextProxy
+	switch action.Kind {
+	case outbound.ActionBlock:
+		return nil, fmt.Errorf("%w: %s", errBlocked, target)
+	case outbound.ActionVia:
+		var err error
+		if np, err = viaProxy(h.nextProxies, action.Via); err != nil {
+			return nil, err
+		}
+		if !np.EnableUDP() {
+			return nil, fmt.Errorf("next proxy %q does not relay udp", action.Via)
+		}
+	case outbound.ActionDefault:
+		np = h.nextProxies.MatchUDP(host)
+	}
+	if np != nil {
+		log.Info("[UDP] dialing via next proxy", "target", target, "proxy", np.Name())
+		conn, _, err := h.nextProxies.DialContext(ctx, np, "udp", target)
+		return conn, err
+	}
+
+	d := &net.Dialer{Timeout: h.idleTimeout}
+	if action.Kind == outbound.ActionBind {
+		local, err := outbound.LocalAddr(action.Bind, "udp", target)
+		if err != nil {
+			return nil, err
+		}
+		d.LocalAddr = local
 	}
-	conn, err := net.DialTimeout("udp", target, h.idleTimeout)
+	addrs, err := resolveTarget(ctx, h.resolver, target, d.LocalAddr)
 	if err != nil {
 		return nil, err
 	}
-	// Post-dial SSRF guard: verify the actual remote IP is not a LAN address.
-	if ra := conn.RemoteAddr(); ra != nil {
-		if host, _, e := net.SplitHostPort(ra.String()); e == nil && util.IsLANIP(host) {
-			_ = conn.Close()
-			return nil, fmt.Errorf("ssrf: rejected lan destination %s", host)
-		}
+	network := "udp4"
+	if util.IsIPV6Addr(addrs[0]) {
+		network = "udp6"
 	}
-	return conn, nil
+	return d.DialContext(ctx, network, addrs[0])
 }
 
-func (h *UDPHandler) readFromTarget(conn net.Conn, s2c shaper.Shaper, done <-chan struct{}, dnsDetected *atomic.Bool) error {
+func (h *UDPHandler) readFromTarget(ctx context.Context, conn net.Conn, s2c shaper.Shaper, user *proxyUser, done <-chan struct{}, dnsDetected *atomic.Bool) error {
 	buf := bytespool.Get(udpBufSize)
 	defer bytespool.MustPut(buf)
 	for {
@@ -200,25 +236,28 @@ func (h *UDPHandler) readFromTarget(conn net.Conn, s2c shaper.Shaper, done <-cha
 		}
 		if n > 0 {
 			// DNS response interception for dynamic IP learning
-			if dnsDetected.Load() && h.nextProxy != nil {
+			if dnsDetected.Load() && h.nextProxies != nil {
 				msg := &dns.Msg{}
 				if err := msg.Unpack(buf[:n]); err == nil && msg.Response && len(msg.Question) > 0 {
 					domain := strings.TrimSuffix(msg.Question[0].Name, ".")
-					if h.nextProxy.IsCustomDomain(domain) {
+					if np := h.nextProxies.CustomDomainProxy(domain); np != nil {
 						for _, ans := range msg.Answer {
 							switch a := ans.(type) {
 							case *dns.A:
-								h.nextProxy.AddIP(a.A.String())
+								np.AddIP(a.A.String())
 							case *dns.AAAA:
-								h.nextProxy.AddIP(a.AAAA.String())
+								np.AddIP(a.AAAA.String())
 							case *dns.CNAME:
-								h.nextProxy.AddDomain(strings.TrimSuffix(a.Target, "."))
+								np.AddDomain(strings.TrimSuffix(a.Target, "."))
 							}
 						}
 					}
 				}
 			}
 
+			if err := user.limitDown(ctx, n); err != nil {
+				return err
+			}
 			frame := protocol.NewFrameDATAGRAM(buf[:n])
 			if wErr := s2c.PushFrame(frame); wErr != nil {
 				return wErr
@@ -0,0 +1,368 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/quota"
+	"github.com/nange/easyss/v3/stats"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxCachedUserIPs bounds the source IPs whose last user is remembered.
+	maxCachedUserIPs = 4096
+	// bandwidthBurst bounds the burst of a bandwidth limiter, so slow limits
+	// still let a full read through in a few waits.
+	bandwidthBurst = 64 * 1024
+)
+
+// errQuotaExceeded ends the streams of a user whose quota ran out.
+var errQuotaExceeded = errors.New("user quota exceeded")
+
+// User is a credential the proxy handler accepts: a client proves it by
+// sealing its bootstrap record with the key derived from the password.
+type User struct {
+	Name      string
+	MasterKey []byte
+	// ReversePorts are the ports the user may register reverse tunnels on.
+	ReversePorts []int
+	// BandwidthLimit caps each direction of all the user's streams
+	// together, in bytes per second; 0 means unlimited.
+	BandwidthLimit int64
+	// MaxStreams caps the user's concurrent streams; 0 means unlimited.
+	MaxStreams int
+	// DailyQuota and MonthlyQuota cap the payload bytes the user relays in
+	// both directions per calendar day and month; 0 means unlimited. They
+	// are only enforced with a quota store.
+	DailyQuota   int64
+	MonthlyQuota int64
+}
+
+type proxyUser struct {
+	name         string
+	masterKey    []byte
+	reversePorts map[int]bool
+	counters     *stats.UserCounters
+
+	up, down     *rate.Limiter
+	maxStreams   int
+	streams      atomic.Int64
+	quota        *quota.Store
+	dailyQuota   int64
+	monthlyQuota int64
+	// removed is set when the user is removed at runtime, so a cached
+	// lookup racing the removal cannot authenticate it.
+	removed atomic.Bool
+	// cfg is the User the proxyUser was built from.
+	cfg User
+}
+
+func newProxyUser(u User, store *quota.Store) *proxyUser {
+	ports := make(map[int]bool, len(u.ReversePorts))
+	for _, p := range u.ReversePorts {
+		ports[p] = true
+	}
+	pu := &proxyUser{
+		name:         u.Name,
+		masterKey:    u.MasterKey,
+		reversePorts: ports,
+		counters:     stats.User(u.Name),
+		maxStreams:   u.MaxStreams,
+		quota:        store,
+		dailyQuota:   u.DailyQuota,
+		monthlyQuota: u.MonthlyQuota,
+		cfg:          u,
+	}
+	if u.BandwidthLimit > 0 {
+		pu.up = newBandwidthLimiter(u.BandwidthLimit)
+		pu.down = newBandwidthLimiter(u.BandwidthLimit)
+	}
+	return pu
+}
+
+func newBandwidthLimiter(limit int64) *rate.Limiter {
+	burst := bandwidthBurst
+	if limit < int64(burst) {
+		burst = int(limit)
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// overQuota reports whether the user used up its daily or monthly quota.
+func (u *proxyUser) overQuota() bool {
+	if u == nil || u.quota == nil || (u.dailyQuota <= 0 && u.monthlyQuota <= 0) {
+		return false
+	}
+	usage := u.quota.Usage(u.name)
+	return (u.dailyQuota > 0 && usage.DayBytes >= u.dailyQuota) ||
+		(u.monthlyQuota > 0 && usage.MonthBytes >= u.monthlyQuota)
+}
+
+// acquireStream reserves one of the user's concurrent streams, reporting
+// false when all are in use. A reserved stream must be released.
+func (u *proxyUser) acquireStream() bool {
+	if n := u.streams.Add(1); u.maxStreams > 0 && n > int64(u.maxStreams) {
+		u.streams.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (u *proxyUser) releaseStream() {
+	u.streams.Add(-1)
+}
+
+// limitUp accounts n payload bytes from the user's client, blocking until
+// the bandwidth limit allows them or ctx, the context of the stream, is
+// done. It fails once the quota is used up. A nil user is not limited.
+func (u *proxyUser) limitUp(ctx context.Context, n int) error {
+	if u == nil {
+		return nil
+	}
+	return u.limit(ctx, u.up, n)
+}
+
+// limitDown is limitUp for the bytes towards the user's client.
+func (u *proxyUser) limitDown(ctx context.Context, n int) error {
+	if u == nil {
+		return nil
+	}
+	return u.limit(ctx, u.down, n)
+}
+
+func (u *proxyUser) limit(ctx context.Context, l *rate.Limiter, n int) error {
+	if u.quota != nil {
+		u.quota.Add(u.name, int64(n))
+		if u.overQuota() {
+			return errQuotaExceeded
+		}
+	}
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// userCache remembers the user last authenticated from each source IP, so
+// a client's streams usually need a single trial decryption.
+type userCache struct {
+	mu sync.Mutex
+	m  map[string]*proxyUser
+}
+
+func newUserCache() *userCache {
+	return &userCache{m: make(map[string]*proxyUser)}
+}
+
+func (c *userCache) get(ip string) *proxyUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[ip]
+}
+
+func (c *userCache) put(ip string, u *proxyUser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.m[ip]; !ok && len(c.m) >= maxCachedUserIPs {
+		// Evict an arbitrary entry; a miss only costs extra trials.
+		for k := range c.m {
+			delete(c.m, k)
+			break
+		}
+	}
+	c.m[ip] = u
+}
+
+// authenticate finds the user whose key opens record, trying the user last
+// seen from ip first. It returns the error of the last trial when no user
+// matches.
+func (h *ProxyHandler) authenticate(ip string, salt []byte, endpoint string, record crypto.BootstrapRecord) (*proxyUser, *crypto.StreamKeys, crypto.FirstRecord, error) {
+	users := h.currentUsers()
+	cached := h.userCache.get(ip)
+	if cached != nil && cached.removed.Load() {
+		cached = nil
+	}
+	try := func(u *proxyUser) (*crypto.StreamKeys, crypto.FirstRecord, error) {
+		sk, err := crypto.NewStreamKeys(u.masterKey, salt, endpoint)
+		if err != nil {
+			return nil, crypto.FirstRecord{}, err
+		}
+		first, err := sk.OpenFirstRecord(record)
+		return sk, first, err
+	}
+
+	err := errors.New("no users configured")
+	if cached != nil {
+		var sk *crypto.StreamKeys
+		var first crypto.FirstRecord
+		if sk, first, err = try(cached); err == nil {
+			return cached, sk, first, nil
+		}
+	}
+	for _, u := range users {
+		if u == cached {
+			continue
+		}
+		var sk *crypto.StreamKeys
+		var first crypto.FirstRecord
+		if sk, first, err = try(u); err == nil {
+			if len(users) > 1 {
+				h.userCache.put(ip, u)
+			}
+			return u, sk, first, nil
+		}
+	}
+	return nil, nil, crypto.FirstRecord{}, err
+}
+
+func (c *userCache) forget(u *proxyUser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ip, cu := range c.m {
+		if cu == u {
+			delete(c.m, ip)
+		}
+	}
+}
+
+func (h *ProxyHandler) currentUsers() []*proxyUser {
+	h.usersMu.RLock()
+	defer h.usersMu.RUnlock()
+	return h.users
+}
+
+// UserInfo describes a user of the proxy handler, without its key.
+type UserInfo struct {
+	Name           string       `json:"name"`
+	ReversePorts   []int        `json:"reverse_ports,omitempty"`
+	BandwidthLimit int64        `json:"bandwidth_limit,omitempty"`
+	MaxStreams     int          `json:"max_streams,omitempty"`
+	DailyQuota     int64        `json:"daily_quota,omitempty"`
+	MonthlyQuota   int64        `json:"monthly_quota,omitempty"`
+	Streams        int64        `json:"streams"`
+	Usage          *quota.Usage `json:"usage,omitempty"`
+}
+
+// Users returns the users in the order their keys are tried.
+func (h *ProxyHandler) Users() []UserInfo {
+	users := h.currentUsers()
+	out := make([]UserInfo, 0, len(users))
+	for _, u := range users {
+		info := UserInfo{
+			Name:           u.name,
+			ReversePorts:   u.cfg.ReversePorts,
+			BandwidthLimit: u.cfg.BandwidthLimit,
+			MaxStreams:     u.maxStreams,
+			DailyQuota:     u.dailyQuota,
+			MonthlyQuota:   u.monthlyQuota,
+			Streams:        u.streams.Load(),
+		}
+		if u.quota != nil {
+			usage := u.quota.Usage(u.name)
+			info.Usage = &usage
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+// AddUser starts accepting u. Its name and key must differ from those of
+// the current users.
+func (h *ProxyHandler) AddUser(u User) error {
+	h.usersMu.Lock()
+	defer h.usersMu.Unlock()
+	for _, cur := range h.users {
+		switch {
+		case cur.name == u.Name:
+			return fmt.Errorf("duplicate user %q", u.Name)
+		case bytes.Equal(cur.masterKey, u.MasterKey):
+			return fmt.Errorf("user %q reuses the password of %q", u.Name, cur.name)
+		}
+	}
+	// Copy on write: authenticate iterates the slice without the lock.
+	users := make([]*proxyUser, 0, len(h.users)+1)
+	users = append(users, h.users...)
+	h.users = append(users, newProxyUser(u, h.quota))
+	return nil
+}
+
+// RemoveUser stops accepting the named user and ends its active streams,
+// reporting whether the user existed.
+func (h *ProxyHandler) RemoveUser(name string) bool {
+	h.usersMu.Lock()
+	var removed *proxyUser
+	users := make([]*proxyUser, 0, len(h.users))
+	for _, u := range h.users {
+		if u.name == name {
+			removed = u
+			continue
+		}
+		users = append(users, u)
+	}
+	h.users = users
+	h.usersMu.Unlock()
+	if removed == nil {
+		return false
+	}
+
+	removed.removed.Store(true)
+	h.userCache.forget(removed)
+	n := h.streams.kill(func(s *activeStream) bool { return s.user == removed })
+	log.Info("[SERVER] user removed", "user", name, "killed_streams", n)
+	return true
+}
+
+// userBody counts the bytes read from a user's request body.
+type userBody struct {
+	body     io.ReadCloser
+	counters *stats.UserCounters
+	stream   *activeStream
+}
+
+func (b *userBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.counters.RecordBytesUp(n)
+	b.stream.up.Add(int64(n))
+	return n, err
+}
+
+func (b *userBody) Close() error {
+	return b.body.Close()
+}
+
+// userWriter counts the bytes written to a user's response, keeping the
+// Flush the record writer relies on.
+type userWriter struct {
+	w        http.ResponseWriter
+	counters *stats.UserCounters
+	stream   *activeStream
+}
+
+func (w *userWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.counters.RecordBytesDown(n)
+	w.stream.down.Add(int64(n))
+	return n, err
+}
+
+func (w *userWriter) Flush() {
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sharedconfig "github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/server/quota"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHandlerAuthenticate(t *testing.T) {
+	alice := bytes.Repeat([]byte{0x41}, 32)
+	bob := bytes.Repeat([]byte{0x42}, 32)
+	h := NewProxyHandler(ProxyHandlerConfig{
+		Users: []User{
+			{Name: "alice", MasterKey: alice},
+			{Name: "bob", MasterKey: bob, ReversePorts: []int{8022}},
+		},
+	})
+
+	auth := func(ip string, masterKey []byte) (*proxyUser, error) {
+		saltB64, body := buildBootstrapRecord(t, masterKey, sharedconfig.EndpointTCP,
+			protocol.ProtoTCP, protocol.MethodAES256GCM, "example.com:443")
+		salt, err := base64.RawURLEncoding.DecodeString(saltB64)
+		require.NoError(t, err)
+		record, err := crypto.ReadBootstrapRecord(bytes.NewReader(body))
+		require.NoError(t, err)
+		u, sk, first, err := h.authenticate(ip, salt, sharedconfig.EndpointTCP, record)
+		if err == nil {
+			require.NotNil(t, sk)
+			require.Equal(t, "example.com:443", first.Handshake.Target)
+		}
+		return u, err
+	}
+
+	t.Run("第二个用户的密钥被识别", func(t *testing.T) {
+		u, err := auth("192.0.2.1", bob)
+		require.NoError(t, err)
+		require.Equal(t, "bob", u.name)
+		require.True(t, u.reversePorts[8022])
+		require.Same(t, u, h.userCache.get("192.0.2.1"))
+	})
+
+	t.Run("缓存的用户不匹配时回退尝试其他用户", func(t *testing.T) {
+		u, err := auth("192.0.2.1", alice)
+		require.NoError(t, err)
+		require.Equal(t, "alice", u.name)
+		require.Same(t, u, h.userCache.get("192.0.2.1"))
+	})
+
+	t.Run("未知密钥被拒绝", func(t *testing.T) {
+		_, err := auth("192.0.2.2", bytes.Repeat([]byte{0x43}, 32))
+		require.Error(t, err)
+		require.Nil(t, h.userCache.get("192.0.2.2"))
+	})
+}
+
+func TestProxyHandlerMasterKeyIsDefaultUser(t *testing.T) {
+	h := NewProxyHandler(ProxyHandlerConfig{MasterKey: bytes.Repeat([]byte{0x42}, 32)})
+	require.Len(t, h.users, 1)
+	require.Equal(t, "default", h.users[0].name)
+}
+
+func TestUserCacheBounded(t *testing.T) {
+	c := newUserCache()
+	u := &proxyUser{name: "alice"}
+	for i := range maxCachedUserIPs + 10 {
+		c.put(string(rune(i)), u)
+	}
+	require.Len(t, c.m, maxCachedUserIPs)
+}
+
+func TestProxyHandlerUserLimits(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{0x42}, 32)
+	store, err := quota.Open(filepath.Join(t.TempDir(), "quota.json"))
+	require.NoError(t, err)
+	h := NewProxyHandler(ProxyHandlerConfig{
+		Users:            []User{{Name: "alice", MasterKey: masterKey, MaxStreams: 1, DailyQuota: 1000}},
+		AllowedMethods:   []string{protocol.MethodAES256GCM.String()},
+		HandshakeTimeout: time.Second,
+		Quota:            store,
+	})
+	srv := newRejectTestServer(t, h)
+	tr := newRejectTestClient(t)
+	post := func() int {
+		saltB64, body := buildBootstrapRecord(t, masterKey, sharedconfig.EndpointTCP,
+			protocol.ProtoTCP, protocol.MethodAES256GCM, "127.0.0.1:80")
+		resp, _ := postBootstrap(t, tr, srv.URL+sharedconfig.EndpointTCP, saltB64, bytes.NewReader(body))
+		return resp.StatusCode
+	}
+	alice := h.users[0]
+
+	// 未超限时进入后续校验（LAN 目标返回 400）
+	require.Equal(t, http.StatusBadRequest, post())
+
+	t.Run("并发流达到上限", func(t *testing.T) {
+		require.True(t, alice.acquireStream())
+		defer alice.releaseStream()
+		require.False(t, alice.acquireStream())
+		require.Equal(t, http.StatusTooManyRequests, post())
+	})
+
+	t.Run("流量超额", func(t *testing.T) {
+		require.NoError(t, alice.limitUp(context.Background(), 600))
+		require.ErrorIs(t, alice.limitDown(context.Background(), 600), errQuotaExceeded)
+		require.Equal(t, http.StatusForbidden, post())
+		require.Equal(t, int64(1200), store.Usage("alice").DayBytes)
+	})
+}
+
+func TestProxyUserBandwidthLimit(t *testing.T) {
+	u := newProxyUser(User{Name: "bob", BandwidthLimit: 64 * 1024}, nil)
+	// 令牌桶初始可突发一个 burst，其后按限速等待
+	start := time.Now()
+	require.NoError(t, u.limitDown(context.Background(), 64*1024))
+	require.NoError(t, u.limitDown(context.Background(), 32*1024))
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	var unlimited *proxyUser
+	require.NoError(t, unlimited.limitUp(context.Background(), 1<<30))
+
+	// 流被终止时等待限速立即返回
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- u.limitUp(ctx, 1<<20) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("limitUp did not return after cancel")
+	}
+}
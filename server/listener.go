@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/proxyproto"
+)
+
+// defaultSocketMode lets a reverse proxy sharing the group of the server
+// connect to a Unix socket listener.
+const defaultSocketMode = 0o660
+
+// listenFDStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDStart = 3
+
+// listener serves the proxy on one configured address.
+type listener struct {
+	cfg config.ListenerConfig
+	ln  net.Listener
+	srv *http.Server
+}
+
+func (l *listener) serve() error {
+	if l.cfg.IsTLS() {
+		return l.srv.ServeTLS(l.ln, "", "")
+	}
+	return l.srv.Serve(l.ln)
+}
+
+// openListeners opens the sockets of cfgs and builds their HTTP servers,
+// all serving the proxy handler and the fallback. The connections of TLS
+// listeners on TCP read PROXY protocol headers from ppTrusted, if any.
+func (s *Server) openListeners(cfgs []config.ListenerConfig, tlsConfig *tls.Config, ppTrusted []*net.IPNet, timeout time.Duration) error {
+	var inherited map[string][]int
+	for _, lc := range cfgs {
+		trusted, err := proxyproto.ParseTrusted(lc.TrustedProxies)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("listener %s: %w", lc.Address, err)
+		}
+		ln, err := s.upgradeSocket(lc.Address)
+		if err == nil && ln == nil {
+			if strings.HasPrefix(lc.Address, "systemd:") && inherited == nil {
+				inherited, err = systemdFDs(os.Getenv, os.Getpid())
+			}
+			if err == nil {
+				ln, err = listen(lc, inherited)
+			}
+		}
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("listener %s: %w", lc.Address, err)
+		}
+		_, isUnix := ln.Addr().(*net.UnixAddr)
+
+		trustAll := isUnix && lc.TrustUnixPeers
+		var h http.Handler = s.mux
+		if len(trusted) > 0 || trustAll {
+			h = forwardedClientAddr(h, trusted, trustAll)
+		}
+		srv := buildHTTPServer(s.cfg, tlsConfig, h, timeout)
+		srv.Addr = lc.Address
+		if !lc.IsTLS() {
+			srv.TLSConfig = nil
+			srv.Protocols.SetHTTP2(false)
+			srv.Protocols.SetUnencryptedHTTP2(true)
+		}
+		if lc.IsTLS() && ppTrusted != nil && !isUnix {
+			applyProxyProtocol(srv)
+			ln = proxyproto.NewListener(ln, ppTrusted, srv.ReadHeaderTimeout)
+		}
+		s.listeners = append(s.listeners, &listener{cfg: lc, ln: ln, srv: srv})
+		log.Info("[SERVER] listener opened", "addr", lc.Address, "local", ln.Addr().String(), "type", listenerType(lc),
+			"trusted_proxies", lc.TrustedProxies)
+	}
+	return nil
+}
+
+// serve serves every listener until one of them stops, returning its error.
+func (s *Server) serve() error {
+	errCh := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		go func() { errCh <- l.serve() }()
+	}
+	return <-errCh
+}
+
+// closeListeners closes the sockets of listeners not served yet.
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		_ = l.ln.Close()
+	}
+	s.listeners = nil
+}
+
+func listenerType(lc config.ListenerConfig) string {
+	if lc.IsTLS() {
+		return config.ListenerTLS
+	}
+	return lc.Type
+}
+
+// listen opens the socket of lc: a TCP address, a Unix socket replacing
+// one left behind by an unclean exit, or a socket inherited from systemd,
+// taken from inherited.
+func listen(lc config.ListenerConfig, inherited map[string][]int) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(lc.Address, "systemd:"); ok {
+		fds := inherited[name]
+		if len(fds) == 0 {
+			return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+		}
+		inherited[name] = fds[1:]
+		return fileListener(fds[0], name)
+	}
+
+	path, ok := strings.CutPrefix(lc.Address, "unix:")
+	if !ok {
+		return net.Listen("tcp", lc.Address)
+	}
+	mode := os.FileMode(defaultSocketMode)
+	if lc.SocketMode != "" {
+		m, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("socket mode: %w", err)
+		}
+		mode = os.FileMode(m)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// systemdFDs returns the file descriptors passed by systemd socket
+// activation (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES) by name; sockets
+// without a name are named "unknown", as systemd does.
+func systemdFDs(getenv func(string) string, pid int) (map[string][]int, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	var names []string
+	if v := getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	fds := make(map[string][]int, n)
+	for i := range n {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		fds[name] = append(fds[name], listenFDStart+i)
+	}
+	return fds, nil
+}
+
+// forwardedClientAddr sets the remote address of the requests of trusted
+// peers to the client address in their X-Forwarded-For or X-Real-IP
+// header, so the proxy handler limits and logs the client rather than the
+// reverse proxy in front.
+func forwardedClientAddr(next http.Handler, trusted []*net.IPNet, trustAll bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := forwardedClientIP(r, trusted, trustAll); ip != "" {
+			r.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientIP returns the client IP the trusted peer of r forwards,
+// empty when there is none. X-Forwarded-For is read right to left,
+// skipping trusted proxies, so a client cannot forge its address by
+// sending the header itself.
+func forwardedClientIP(r *http.Request, trusted []*net.IPNet, trustAll bool) string {
+	isTrusted := func(host string) bool {
+		ip := net.ParseIP(host)
+		return ip != nil && slices.ContainsFunc(trusted, func(n *net.IPNet) bool { return n.Contains(ip) })
+	}
+	if !trustAll {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !isTrusted(host) {
+			return ""
+		}
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for hop := range strings.SplitSeq(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			return ""
+		}
+		if i == 0 || !isTrusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return ""
+}
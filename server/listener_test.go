@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/proxyproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := proxyproto.ParseTrusted([]string{"127.0.0.1", "10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		remote   string
+		trustAll bool
+		xff      []string
+		realIP   string
+		want     string
+	}{
+		{"untrusted peer", "192.0.2.1:1234", false, []string{"203.0.113.7"}, "", ""},
+		{"trusted peer", "127.0.0.1:1234", false, []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"forged hop skipped", "127.0.0.1:1234", false, []string{"198.51.100.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"trusted hops skipped", "127.0.0.1:1234", false, []string{"203.0.113.7", "10.1.2.3"}, "", "203.0.113.7"},
+		{"all hops trusted", "127.0.0.1:1234", false, []string{"10.0.0.2, 10.1.2.3"}, "", "10.0.0.2"},
+		{"invalid hop", "127.0.0.1:1234", false, []string{"203.0.113.7, unknown"}, "", ""},
+		{"x-real-ip", "127.0.0.1:1234", false, nil, "203.0.113.8", "203.0.113.8"},
+		{"no header", "127.0.0.1:1234", false, nil, "", ""},
+		{"unix socket peer", "@", true, []string{"2001:db8::7"}, "", "2001:db8::7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.NoError(t, err)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			require.Equal(t, tt.want, forwardedClientIP(r, trusted, tt.trustAll))
+		})
+	}
+}
+
+func TestSystemdFDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    map[string][]int
+		wantErr bool
+	}{
+		{"named", map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "3", "LISTEN_FDNAMES": "https:h2c:h2c"},
+			map[string][]int{"https": {3}, "h2c": {4, 5}}, false},
+		{"unnamed", map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"}, map[string][]int{"unknown": {3}}, false},
+		{"other process", map[string]string{"LISTEN_PID": "7", "LISTEN_FDS": "1"}, nil, true},
+		{"none", map[string]string{}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := systemdFDs(func(k string) string { return tt.env[k] }, 42)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestOpenListenersH2C(t *testing.T) {
+	dir, err := os.MkdirTemp("", "easyss")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "h2c.sock")
+	untrustedSock := filepath.Join(dir, "untrusted.sock")
+
+	s := &Server{cfg: &config.ServerConfig{}, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%d %s", r.ProtoMajor, r.RemoteAddr)
+	})
+	err = s.openListeners([]config.ListenerConfig{
+		{Type: config.ListenerH2C, Address: "unix:" + sock, SocketMode: "0600", TrustUnixPeers: true},
+		{Type: config.ListenerH2C, Address: "127.0.0.1:0", TrustedProxies: []string{"127.0.0.1"}},
+		{Type: config.ListenerH2C, Address: "unix:" + untrustedSock},
+	}, nil, nil, 30*time.Second)
+	require.NoError(t, err)
+	go s.serve() //nolint:errcheck
+	t.Cleanup(func() {
+		for _, l := range s.listeners {
+			_ = l.srv.Close()
+		}
+	})
+
+	fi, err := os.Stat(sock)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	fi, err = os.Stat(untrustedSock)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o660), fi.Mode().Perm())
+
+	tests := []struct {
+		name string
+		dial func(ctx context.Context, network, addr string) (net.Conn, error)
+		want string
+	}{
+		{"unix socket", func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		}, "2 203.0.113.7:0"},
+		{"tcp", func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, s.listeners[1].ln.Addr().String())
+		}, "2 203.0.113.7:0"},
+		{"untrusted unix socket", func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", untrustedSock)
+		}, "2 @"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &http.Transport{DialContext: tt.dial, Protocols: &http.Protocols{}}
+			tr.Protocols.SetUnencryptedHTTP2(true)
+			defer tr.CloseIdleConnections()
+			req, err := http.NewRequest(http.MethodGet, "http://easyss.local/", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			resp, err := tr.RoundTrip(req)
+			require.NoError(t, err)
+			defer resp.Body.Close() //nolint:errcheck
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(body))
+		})
+	}
+}
+
+func TestOpenListenersMissingSystemdSocket(t *testing.T) {
+	s := &Server{cfg: &config.ServerConfig{}, mux: http.NewServeMux()}
+	err := s.openListeners([]config.ListenerConfig{
+		{Type: config.ListenerH2C, Address: "127.0.0.1:0"},
+		{Address: "systemd:https"},
+	}, nil, nil, 30*time.Second)
+	require.Error(t, err)
+	require.Empty(t, s.listeners)
+}
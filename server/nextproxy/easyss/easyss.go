@@ -0,0 +1,264 @@
+// Package easyss chains the streams of a next proxy to another Easyss
+// server, using the shared tunnel and transport packages.
+package easyss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	clientconfig "github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/transport/http2"
+	"github.com/nange/easyss/v3/tunnel"
+)
+
+// streamIdleTimeout ends a chained TCP stream neither side sent on for
+// that long, as the client does.
+const streamIdleTimeout = 300 * time.Second
+
+// Upstream dials through another Easyss server. Its URL is
+// easyss://:password@host:port, with the optional query parameters method,
+// sni and ca (a CA certificate file).
+type Upstream struct {
+	profile   clientconfig.ServerProfile
+	method    protocol.Method
+	masterKey []byte
+	timeout   time.Duration
+
+	mu        sync.Mutex
+	transport *http2.HTTP2Transport
+	closed    bool
+}
+
+// New parses the upstream of u. Its transport, with timeout, is created on
+// the first dial.
+func New(u *url.URL, timeout time.Duration) (*Upstream, error) {
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("easyss: invalid port %q", u.Port())
+	}
+	var password string
+	if u.User != nil {
+		// Accept the password alone as userinfo, as in easyss://password@host.
+		var ok bool
+		if password, ok = u.User.Password(); !ok {
+			password = u.User.Username()
+		}
+	}
+	if password == "" {
+		return nil, errors.New("easyss: password is required")
+	}
+	q := u.Query()
+	method := protocol.MethodAES256GCM
+	if m := q.Get("method"); m != "" {
+		if method = protocol.MethodFromString(m); method == 0 {
+			return nil, fmt.Errorf("easyss: unsupported method %q", m)
+		}
+	}
+	masterKey, err := crypto.DeriveMasterKey(password)
+	if err != nil {
+		return nil, fmt.Errorf("easyss: %w", err)
+	}
+	return &Upstream{
+		profile: clientconfig.ServerProfile{
+			Address:  u.Hostname(),
+			Port:     port,
+			Password: password,
+			Method:   method.String(),
+			SNI:      q.Get("sni"),
+			CAPath:   q.Get("ca"),
+		},
+		method:    method,
+		masterKey: masterKey,
+		timeout:   timeout,
+	}, nil
+}
+
+// dialTransport returns the transport to the upstream server, creating it
+// on first use.
+func (e *Upstream) dialTransport() (*http2.HTTP2Transport, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, net.ErrClosed
+	}
+	if e.transport != nil {
+		return e.transport, nil
+	}
+	probeToken, err := crypto.ProbeToken(e.masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("probe token: %w", err)
+	}
+	tr, err := http2.New(http2.Config{
+		ServerURL:  e.profile.URL(),
+		TLSConfig:  e.profile.UTLSConfig(),
+		Timeout:    e.timeout,
+		ProbeToken: probeToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("easyss transport: %w", err)
+	}
+	log.Info("[NEXTPROXY] easyss transport initialized", "server_url", e.profile.URL())
+	e.transport = tr
+	return tr, nil
+}
+
+// DialContext opens a stream to addr on the upstream server and returns
+// once the server accepted it, so that an unreachable or rejecting upstream
+// fails the dial. A TCP stream is relayed through one end of a pipe, a UDP
+// one carries a datagram per Read and Write.
+func (e *Upstream) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	tr, err := e.dialTransport()
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+		sess, err := tunnel.Dial(ctx, tr, e.masterKey, config.EndpointUDP, protocol.ProtoUDP, addr, e.method, nil)
+		if err != nil {
+			return nil, fmt.Errorf("easyss: %w", err)
+		}
+		ue, err := tunnel.NewUDPExchange(sess, addr, e.method, shaper.Config{})
+		if err != nil {
+			return nil, fmt.Errorf("easyss: %w", err)
+		}
+		return newExchangeConn(ue, e.profile.Addr(), addr), nil
+	}
+
+	sess, err := tunnel.Dial(ctx, tr, e.masterKey, config.EndpointTCP, protocol.ProtoTCP, addr, e.method, nil)
+	if err != nil {
+		return nil, fmt.Errorf("easyss: %w", err)
+	}
+	local, remote := net.Pipe()
+	go func() {
+		if err := sess.Relay(addr, e.method, shaper.Config{}, streamIdleTimeout, remote); err != nil {
+			log.Debug("[NEXTPROXY] easyss stream closed", "target", addr, "err", err)
+		}
+		_ = remote.Close()
+	}()
+	return local, nil
+}
+
+// Close closes the transport; later dials fail.
+func (e *Upstream) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	if e.transport == nil {
+		return nil
+	}
+	return e.transport.Close()
+}
+
+type easyssAddr string
+
+func (a easyssAddr) Network() string { return "easyss" }
+func (a easyssAddr) String() string  { return string(a) }
+
+// exchangeConn adapts a UDP exchange to a datagram net.Conn. Only read
+// deadlines are honored, as set before each Read.
+type exchangeConn struct {
+	ue     *tunnel.UDPExchange
+	local  net.Addr
+	remote net.Addr
+
+	recv      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func newExchangeConn(ue *tunnel.UDPExchange, server, target string) *exchangeConn {
+	c := &exchangeConn{
+		ue:     ue,
+		local:  easyssAddr(server),
+		remote: easyssAddr(target),
+		recv:   make(chan []byte, 16),
+		done:   make(chan struct{}),
+	}
+	go c.receiveLoop()
+	return c
+}
+
+func (c *exchangeConn) receiveLoop() {
+	defer close(c.recv)
+	for {
+		b, err := c.ue.Receive()
+		if err != nil {
+			return
+		}
+		select {
+		case c.recv <- b:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *exchangeConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case b, ok := <-c.recv:
+		if !ok {
+			return 0, io.EOF
+		}
+		return copy(p, b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *exchangeConn) Write(p []byte) (int, error) {
+	if err := c.ue.Send(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *exchangeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.ue.Close()
+	})
+	return nil
+}
+
+func (c *exchangeConn) LocalAddr() net.Addr  { return c.local }
+func (c *exchangeConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *exchangeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *exchangeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *exchangeConn) SetWriteDeadline(time.Time) error { return nil }
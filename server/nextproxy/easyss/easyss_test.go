@@ -0,0 +1,54 @@
+package easyss
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		method  protocol.Method
+		sni     string
+		wantErr string
+	}{
+		{"默认加密方法", "easyss://:secret@easyss.example.com:443", protocol.MethodAES256GCM, "", ""},
+		{"只有密码的 userinfo", "easyss://secret@easyss.example.com:8443?method=chacha20-poly1305&sni=cdn.example.com", protocol.MethodChaCha20Poly1305, "cdn.example.com", ""},
+		{"缺少密码", "easyss://easyss.example.com:443", 0, "", "password is required"},
+		{"缺少端口", "easyss://:secret@easyss.example.com", 0, "", "invalid port"},
+		{"不支持的加密方法", "easyss://:secret@easyss.example.com:443?method=rc4", 0, "", "unsupported method"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			up, err := New(u, time.Second)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.method, up.method)
+			require.Equal(t, "secret", up.profile.Password)
+			require.Equal(t, tt.sni, up.profile.SNI)
+		})
+	}
+}
+
+func TestDialAfterClose(t *testing.T) {
+	u, err := url.Parse("easyss://:secret@127.0.0.1:443")
+	require.NoError(t, err)
+	up, err := New(u, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, up.Close())
+
+	_, err = up.DialContext(context.Background(), "tcp", "example.com:443")
+	require.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,182 @@
+package nextproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+// Group holds the configured next proxies. Streams the outbound rules do
+// not route elsewhere go through the first proxy whose hosts cover their
+// target. A nil Group has no proxies.
+type Group struct {
+	proxies []*NextProxy
+	byName  map[string]*NextProxy
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// NewGroup groups proxies in order; their names must be unique. It
+// returns nil when there are no proxies.
+func NewGroup(proxies ...*NextProxy) *Group {
+	if len(proxies) == 0 {
+		return nil
+	}
+	g := &Group{proxies: proxies, byName: make(map[string]*NextProxy, len(proxies))}
+	for _, np := range proxies {
+		g.byName[np.name] = np
+	}
+	return g
+}
+
+// Get returns the proxy named name, nil if there is none.
+func (g *Group) Get(name string) *NextProxy {
+	if g == nil {
+		return nil
+	}
+	return g.byName[name]
+}
+
+// List returns the proxies in order.
+func (g *Group) List() []*NextProxy {
+	if g == nil {
+		return nil
+	}
+	return g.proxies
+}
+
+// Match returns the first proxy that should proxy host, nil if none does.
+func (g *Group) Match(host string) *NextProxy {
+	for _, np := range g.List() {
+		if np.ShouldProxy(host) {
+			return np
+		}
+	}
+	return nil
+}
+
+// MatchUDP is like Match among the proxies relaying UDP.
+func (g *Group) MatchUDP(host string) *NextProxy {
+	for _, np := range g.List() {
+		if np.EnableUDP() && np.ShouldProxy(host) {
+			return np
+		}
+	}
+	return nil
+}
+
+// CustomDomainProxy returns the first proxy listing domain, nil if none
+// does.
+func (g *Group) CustomDomainProxy(domain string) *NextProxy {
+	for _, np := range g.List() {
+		if np.IsCustomDomain(domain) {
+			return np
+		}
+	}
+	return nil
+}
+
+// DialContext dials addr through np, then through the proxies of its
+// failover list until one succeeds. Healthy proxies are tried before
+// unhealthy ones, and for UDP only proxies relaying UDP. It returns the
+// proxy the connection goes through.
+func (g *Group) DialContext(ctx context.Context, np *NextProxy, network, addr string) (net.Conn, *NextProxy, error) {
+	udp := network == "udp" || network == "udp4" || network == "udp6"
+	var healthy, unhealthy []*NextProxy
+	for _, p := range append([]*NextProxy{np}, g.failovers(np)...) {
+		switch {
+		case udp && !p.EnableUDP():
+		case p.Healthy():
+			healthy = append(healthy, p)
+		default:
+			unhealthy = append(unhealthy, p)
+		}
+	}
+
+	var errs []error
+	for _, p := range append(healthy, unhealthy...) {
+		if len(errs) > 0 {
+			log.Warn("[NEXTPROXY] failing over", "from", np.name, "to", p.name, "target", addr, "err", errs[len(errs)-1])
+		}
+		conn, err := p.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, p, nil
+		}
+		errs = append(errs, fmt.Errorf("next proxy %q: %w", p.name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("next proxy %q: no proxy relays %s", np.name, network)
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func (g *Group) failovers(np *NextProxy) []*NextProxy {
+	var out []*NextProxy
+	for _, name := range np.failover {
+		if p := g.Get(name); p != nil && p != np {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ReloadProxyFiles reloads the host file of every proxy that has one. A
+// proxy whose file fails to load keeps its hosts.
+func (g *Group) ReloadProxyFiles() error {
+	var errs []error
+	for _, np := range g.List() {
+		np.mu.RLock()
+		file := np.proxyFile
+		np.mu.RUnlock()
+		if err := np.ReloadProxyFile(file); err != nil {
+			errs = append(errs, fmt.Errorf("next proxy %q: %w", np.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartHealthChecks starts checking the proxies with a health check
+// interval, until Close.
+func (g *Group) StartHealthChecks() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cancel != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, g.cancel = context.WithCancel(context.Background())
+	for _, np := range g.proxies {
+		if np.healthInterval > 0 {
+			log.Info("[NEXTPROXY] health check started", "name", np.name, "interval", np.healthInterval, "target", np.healthTarget)
+			go np.healthLoop(ctx)
+		}
+	}
+}
+
+// Close stops the health checks and closes the proxies.
+func (g *Group) Close() error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	if g.cancel != nil {
+		g.cancel()
+	}
+	g.mu.Unlock()
+	var errs []error
+	for _, np := range g.proxies {
+		errs = append(errs, np.Close())
+	}
+	return errors.Join(errs...)
+}
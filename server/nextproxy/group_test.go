@@ -0,0 +1,247 @@
+package nextproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startConnectProxy starts an HTTP CONNECT proxy that answers the request
+// tunneled through it with 204, or echoes the tunneled bytes when echo is
+// set. It records the Proxy-Authorization header of the last request.
+func startConnectProxy(t *testing.T, echo bool) (addr string, auth <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	authCh := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				authCh <- req.Header.Get("Proxy-Authorization")
+				if echo {
+					// 响应与隧道数据一起写出，客户端需保留已读入缓冲的数据
+					_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+					_, _ = io.Copy(conn, br)
+					return
+				}
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+			}()
+		}
+	}()
+	return ln.Addr().String(), authCh
+}
+
+// closedAddr returns a local address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+func mustNew(t *testing.T, name, rawURL string) *NextProxy {
+	t.Helper()
+	np, err := New(rawURL, false, false)
+	if err != nil {
+		t.Fatalf("New(%q): %v", rawURL, err)
+	}
+	np.SetName(name)
+	np.SetDialTimeout(2 * time.Second)
+	return np
+}
+
+func TestDialHTTPConnect(t *testing.T) {
+	addr, auth := startConnectProxy(t, true)
+	np := mustNew(t, "http", "http://user:pass@"+addr)
+
+	conn, err := np.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if got := <-auth; got != want {
+		t.Errorf("Proxy-Authorization = %q, want %q", got, want)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read buffered bytes = %q, %v", buf, err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read echo = %q, %v", buf, err)
+	}
+
+	if _, err := np.DialContext(context.Background(), "udp", "example.com:53"); err == nil {
+		t.Error("expected error dialing udp through an http proxy")
+	}
+}
+
+func TestGroupDialFailover(t *testing.T) {
+	addr, _ := startConnectProxy(t, false)
+	primary := mustNew(t, "primary", "http://"+closedAddr(t))
+	primary.SetFailover([]string{"backup"})
+	backup := mustNew(t, "backup", "http://"+addr)
+	g := NewGroup(primary, backup)
+
+	t.Run("主代理失败时切换到备用代理", func(t *testing.T) {
+		conn, used, err := g.DialContext(context.Background(), primary, "tcp", "example.com:80")
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		_ = conn.Close()
+		if used != backup {
+			t.Errorf("used %q, want backup", used.Name())
+		}
+	})
+
+	t.Run("健康检查", func(t *testing.T) {
+		if err := backup.CheckHealth(context.Background()); err != nil {
+			t.Fatalf("backup health check: %v", err)
+		}
+		if !backup.Healthy() {
+			t.Error("backup should be healthy")
+		}
+		if err := primary.CheckHealth(context.Background()); err == nil {
+			t.Fatal("primary health check should fail")
+		}
+		if primary.Healthy() {
+			t.Error("primary should be unhealthy")
+		}
+	})
+
+	t.Run("全部失败时返回所有错误", func(t *testing.T) {
+		_, _, err := g.DialContext(context.Background(), backup, "udp", "example.com:53")
+		if err == nil || !strings.Contains(err.Error(), "no proxy relays udp") {
+			t.Fatalf("expected no udp proxy error, got %v", err)
+		}
+		lone := mustNew(t, "lone", "http://"+closedAddr(t))
+		_, _, err = NewGroup(lone).DialContext(context.Background(), lone, "tcp", "example.com:80")
+		if err == nil || !strings.Contains(err.Error(), `next proxy "lone"`) {
+			t.Fatalf("expected dial error of lone, got %v", err)
+		}
+	})
+}
+
+func TestGroupMatch(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	aFile := write("a.txt", "a.example\n")
+	a := mustNew(t, "a", "socks5://127.0.0.1:1")
+	if err := a.LoadProxyFile(aFile); err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("socks5://127.0.0.1:2", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetName("b")
+	if err := b.LoadProxyFile(write("b.txt", "a.example\nb.example\n")); err != nil {
+		t.Fatal(err)
+	}
+	g := NewGroup(a, b)
+
+	tests := []struct {
+		name string
+		got  *NextProxy
+		want *NextProxy
+	}{
+		{"按顺序匹配", g.Match("www.a.example:443"), a},
+		{"后面的代理", g.Match("b.example"), b},
+		{"不匹配", g.Match("c.example"), nil},
+		{"UDP 只匹配支持 UDP 的代理", g.MatchUDP("a.example"), b},
+		{"自定义域名", g.CustomDomainProxy("b.example"), b},
+		{"按名称查找", g.Get("b"), b},
+		{"未知名称", g.Get("c"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %q, want %q", tt.got.Name(), tt.want.Name())
+			}
+		})
+	}
+
+	// 重新加载各自的文件
+	write("a.txt", "c.example\n")
+	if err := g.ReloadProxyFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if g.Match("c.example") != a || g.Match("a.example") != b {
+		t.Error("reload should replace the hosts of a")
+	}
+
+	var nilGroup *Group
+	if nilGroup.Match("a.example") != nil || nilGroup.Get("a") != nil || nilGroup.Close() != nil {
+		t.Error("nil group should have no proxies")
+	}
+}
+
+type stubUpstream struct{ closed bool }
+
+func (u *stubUpstream) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, errors.New("stub")
+}
+
+func (u *stubUpstream) Close() error {
+	u.closed = true
+	return nil
+}
+
+func TestGroupClose(t *testing.T) {
+	np := mustNew(t, "easyss", "easyss://:pass@127.0.0.1:443")
+	upstream := &stubUpstream{}
+	np.SetUpstream(upstream)
+	if err := np.CheckHealth(context.Background()); err == nil || np.Healthy() {
+		t.Error("a failing health check should mark the proxy unhealthy")
+	}
+
+	g := NewGroup(np)
+	g.StartHealthChecks()
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !upstream.closed {
+		t.Error("Close should close the upstream")
+	}
+}
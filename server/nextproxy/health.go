@@ -0,0 +1,98 @@
+package nextproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+// DefaultHealthCheckTarget is fetched through a proxy to check its health
+// when no target is configured.
+const DefaultHealthCheckTarget = "www.gstatic.com:80"
+
+// SetHealthCheck checks the proxy every interval by sending an HTTP HEAD
+// request to target (host:port, DefaultHealthCheckTarget when empty)
+// through it. A zero interval disables the checks.
+func (np *NextProxy) SetHealthCheck(interval time.Duration, target string) {
+	if target == "" {
+		target = DefaultHealthCheckTarget
+	}
+	np.healthInterval = interval
+	np.healthTarget = target
+}
+
+// Healthy reports whether the last health check passed; a proxy is
+// healthy until a check fails.
+func (np *NextProxy) Healthy() bool {
+	return np != nil && !np.unhealthy.Load()
+}
+
+// CheckHealth fetches the health check target through the proxy and
+// records the outcome. Any HTTP response counts as healthy.
+func (np *NextProxy) CheckHealth(ctx context.Context) error {
+	err := np.checkHealth(ctx)
+	if wasUnhealthy := np.unhealthy.Swap(err != nil); wasUnhealthy != (err != nil) {
+		if err != nil {
+			log.Warn("[NEXTPROXY] health check failed", "name", np.name, "proxy", np.url.Redacted(), "err", err)
+		} else {
+			log.Info("[NEXTPROXY] health check recovered", "name", np.name, "proxy", np.url.Redacted())
+		}
+	}
+	return err
+}
+
+func (np *NextProxy) checkHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, np.timeout())
+	defer cancel()
+
+	target := np.healthTarget
+	if target == "" {
+		target = DefaultHealthCheckTarget
+	}
+	conn, err := np.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	req, err := http.NewRequest(http.MethodHead, "http://"+host+"/generate_204", nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("write health check request: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("read health check response: %w", err)
+	}
+	return resp.Body.Close()
+}
+
+// healthLoop checks the proxy every health check interval until ctx is
+// done.
+func (np *NextProxy) healthLoop(ctx context.Context) {
+	ticker := time.NewTicker(np.healthInterval)
+	defer ticker.Stop()
+	for {
+		_ = np.CheckHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
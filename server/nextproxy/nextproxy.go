@@ -5,23 +5,41 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/config"
 	"github.com/nange/easyss/v3/util"
 	"github.com/txthinking/socks5"
 )
 
+// DefaultName names the next proxy of the next_proxy section, e.g. in the
+// "via:default" action of outbound rules.
+const DefaultName = config.DefaultNextProxyName
+
 type NextProxy struct {
+	name        string
 	url         *url.URL
 	enableUDP   bool
 	allHost     bool
 	dialTimeout time.Duration
+	failover    []string
+
+	healthInterval time.Duration
+	healthTarget   string
+	unhealthy      atomic.Bool
+
+	// upstream dials for the schemes implemented outside the package.
+	upstream Upstream
 
-	mu             sync.RWMutex
+	mu sync.RWMutex
+	// proxyFile is the file the hosts were last loaded from.
+	proxyFile      string
 	ips            map[string]struct{}
 	cidrIPs        []*net.IPNet
 	domains        map[string]struct{}
@@ -37,21 +55,88 @@ func New(proxyURL string, enableUDP, allHost bool) (*NextProxy, error) {
 	if err != nil {
 		return nil, err
 	}
-	if u.Scheme != "socks5" {
-		return nil, fmt.Errorf("unsupported next proxy scheme %q", u.Scheme)
-	}
 
 	np := &NextProxy{
+		name:      DefaultName,
 		url:       u,
 		enableUDP: enableUDP,
 		allHost:   allHost,
 		ips:       make(map[string]struct{}),
 		domains:   make(map[string]struct{}),
 	}
+	switch u.Scheme {
+	case "socks5":
+	case "http", "https":
+		if enableUDP {
+			return nil, fmt.Errorf("%s next proxy cannot relay udp", u.Scheme)
+		}
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			u.Host = net.JoinHostPort(u.Hostname(), port)
+		}
+	case "easyss":
+		// Dialed by the upstream set with SetUpstream.
+	default:
+		return nil, fmt.Errorf("unsupported next proxy scheme %q", u.Scheme)
+	}
 	return np, nil
 }
 
+// SetName sets the name outbound rules and failover lists refer to the
+// proxy by.
+func (np *NextProxy) SetName(name string) {
+	np.name = name
+}
+
+// Name returns the name of the proxy, DefaultName unless set.
+func (np *NextProxy) Name() string {
+	if np == nil {
+		return ""
+	}
+	return np.name
+}
+
+// SetFailover sets the names of the proxies to try, in order, when dialing
+// through this one fails.
+func (np *NextProxy) SetFailover(names []string) {
+	np.failover = names
+}
+
+// Upstream dials through a proxy of a scheme the package does not
+// implement itself, such as easyss://.
+type Upstream interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	Close() error
+}
+
+// SetUpstream sets the dialer of an easyss:// proxy.
+func (np *NextProxy) SetUpstream(u Upstream) {
+	np.upstream = u
+}
+
+// Close releases the connections of the upstream, if any.
+func (np *NextProxy) Close() error {
+	if np == nil || np.upstream == nil {
+		return nil
+	}
+	return np.upstream.Close()
+}
+
 func (np *NextProxy) LoadProxyFile(proxyFile string) error {
+	return np.loadProxyFile(proxyFile, false)
+}
+
+// ReloadProxyFile replaces the hosts loaded from proxy files, and those
+// learned from DNS answers, with the entries of proxyFile. On error the
+// previous hosts are kept.
+func (np *NextProxy) ReloadProxyFile(proxyFile string) error {
+	return np.loadProxyFile(proxyFile, true)
+}
+
+func (np *NextProxy) loadProxyFile(proxyFile string, replace bool) error {
 	if np == nil {
 		return nil
 	}
@@ -59,6 +144,12 @@ func (np *NextProxy) LoadProxyFile(proxyFile string) error {
 	if proxyFile == "" {
 		return nil
 	}
+	if replace {
+		// A missing file reads as empty; do not let it clear the hosts.
+		if _, err := os.Stat(proxyFile); err != nil {
+			return err
+		}
+	}
 
 	entries, err := util.ReadFileLinesMap(proxyFile)
 	if err != nil {
@@ -68,6 +159,13 @@ func (np *NextProxy) LoadProxyFile(proxyFile string) error {
 	np.mu.Lock()
 	defer np.mu.Unlock()
 
+	np.proxyFile = proxyFile
+	if replace {
+		np.ips = make(map[string]struct{})
+		np.cidrIPs = nil
+		np.domains = make(map[string]struct{})
+		np.domainPatterns = nil
+	}
 	for k := range entries {
 		if strings.HasPrefix(k, "regexp:") {
 			re, err := regexp.Compile(k[7:])
@@ -94,7 +192,7 @@ func (np *NextProxy) LoadProxyFile(proxyFile string) error {
 		}
 		np.domains[k] = struct{}{}
 	}
-	log.Info("[NEXTPROXY] loaded proxy file", "file", proxyFile, "total", len(entries), "ips", len(np.ips), "cidrs", len(np.cidrIPs), "domains", len(np.domains), "patterns", len(np.domainPatterns))
+	log.Info("[NEXTPROXY] loaded proxy file", "name", np.name, "file", proxyFile, "total", len(entries), "ips", len(np.ips), "cidrs", len(np.cidrIPs), "domains", len(np.domains), "patterns", len(np.domainPatterns))
 
 	return nil
 }
@@ -186,7 +284,7 @@ func (np *NextProxy) AddDomain(domain string) {
 	np.mu.Unlock()
 }
 
-// SetDialTimeout sets the timeout for dialing the SOCKS5 proxy.
+// SetDialTimeout sets the timeout for dialing the proxy.
 func (np *NextProxy) SetDialTimeout(d time.Duration) {
 	if np == nil {
 		return
@@ -199,9 +297,26 @@ func (np *NextProxy) Dial(network, addr string) (net.Conn, error) {
 }
 
 func (np *NextProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch np.url.Scheme {
+	case "http", "https":
+		return np.dialHTTPConnect(ctx, network, addr)
+	case "easyss":
+		if np.upstream == nil {
+			return nil, fmt.Errorf("easyss next proxy %q has no upstream", np.name)
+		}
+		return np.upstream.DialContext(ctx, network, addr)
+	}
 	return np.dialSOCKS5Context(ctx, network, addr)
 }
 
+// timeout returns the dial timeout, 10 seconds unless set.
+func (np *NextProxy) timeout() time.Duration {
+	if np.dialTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return np.dialTimeout
+}
+
 func (np *NextProxy) dialSOCKS5Context(ctx context.Context, network, addr string) (net.Conn, error) {
 	username := ""
 	password := ""
@@ -213,10 +328,7 @@ func (np *NextProxy) dialSOCKS5Context(ctx context.Context, network, addr string
 		log.Debug("[NEXTPROXY] connecting via SOCKS5 proxy", "addr", np.url.Host, "network", network, "target", addr)
 	}
 
-	dialTimeout := np.dialTimeout
-	if dialTimeout <= 0 {
-		dialTimeout = 10 * time.Second
-	}
+	dialTimeout := np.timeout()
 	dialer := &net.Dialer{Timeout: dialTimeout}
 	socksTimeout := int(dialTimeout.Seconds())
 	if socksTimeout < 1 {
@@ -0,0 +1,424 @@
+// Package outbound decides how the server reaches a stream's target: a
+// list of rules matched in order on the target, the network and the user,
+// each with an action such as blocking the target or dialing it from a
+// specific local address.
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nange/easyss/v3/assets"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/util"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// ActionKind is what to do with a matched stream.
+type ActionKind int
+
+const (
+	// ActionDefault means no rule matched: the target is reached as
+	// without rules, via the next proxy when it covers the target.
+	ActionDefault ActionKind = iota
+	// ActionBlock rejects the stream.
+	ActionBlock
+	// ActionDirect dials the target directly, bypassing the next proxy.
+	ActionDirect
+	// ActionVia dials the target through the named next proxy.
+	ActionVia
+	// ActionBind dials the target directly from a local IP or interface.
+	ActionBind
+)
+
+// Action is the outcome of matching a stream against the rules.
+type Action struct {
+	Kind ActionKind
+	// Via is the next proxy name of ActionVia.
+	Via string
+	// Bind is the local IP or interface name of ActionBind.
+	Bind string
+	// Rule is the index of the matched rule, -1 for ActionDefault.
+	Rule int
+}
+
+func (a Action) String() string {
+	switch a.Kind {
+	case ActionBlock:
+		return "block"
+	case ActionDirect:
+		return "direct"
+	case ActionVia:
+		return "via:" + a.Via
+	case ActionBind:
+		return "bind:" + a.Bind
+	default:
+		return "default"
+	}
+}
+
+// ParseAction parses "block", "direct", "via:<next proxy name>" or
+// "bind:<local IP or interface>".
+func ParseAction(s string) (Action, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch {
+	case s == "block":
+		return Action{Kind: ActionBlock}, nil
+	case s == "direct":
+		return Action{Kind: ActionDirect}, nil
+	case kind == "via" && arg != "":
+		return Action{Kind: ActionVia, Via: arg}, nil
+	case kind == "bind" && arg != "":
+		return Action{Kind: ActionBind, Bind: arg}, nil
+	}
+	return Action{}, fmt.Errorf("invalid outbound action %q", s)
+}
+
+// Request describes a stream to route.
+type Request struct {
+	// Network is "tcp", "udp" or "icmp"; only rules without a network
+	// condition match ICMP.
+	Network string
+	// Target is the host:port the client asked for.
+	Target string
+	// User is the name of the server user owning the stream.
+	User string
+}
+
+type portRange struct{ lo, hi int }
+
+type rule struct {
+	action   Action
+	network  string
+	users    map[string]bool
+	ports    []portRange
+	domains  []string
+	patterns []*regexp.Regexp
+	cidrs    []*net.IPNet
+	geoIP    map[string]bool
+}
+
+// Router matches streams against the outbound rules. A nil Router matches
+// nothing.
+type Router struct {
+	rules []*rule
+	geoIP *geoip2.Reader
+	// lookupIP resolves domain targets for CIDR and GeoIP conditions.
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// embeddedGeoIPCodes are the codes the embedded GeoIP database knows.
+var embeddedGeoIPCodes = map[string]bool{"CN": true, "PRIVATE": true}
+
+// New compiles rules. GeoIP conditions use the database at geoIPFile, or
+// the embedded one, which only knows China and private ranges, when it is
+// empty; other codes then fail New. New returns nil when there are no
+// rules.
+func New(rules []config.OutboundRule, geoIPFile string) (*Router, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &Router{lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}}
+	needGeoIP := false
+	for i, rc := range rules {
+		ru, err := compileRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("outbound rule %d: %w", i+1, err)
+		}
+		ru.action.Rule = i
+		if geoIPFile == "" {
+			for code := range ru.geoIP {
+				if !embeddedGeoIPCodes[code] {
+					return nil, fmt.Errorf("outbound rule %d: geoip %q requires geoip_file, the embedded database only knows cn and private", i+1, strings.ToLower(code))
+				}
+			}
+		}
+		needGeoIP = needGeoIP || len(ru.geoIP) > 0
+		r.rules = append(r.rules, ru)
+	}
+	if needGeoIP {
+		data := assets.GeoIPCNPrivate
+		if geoIPFile != "" {
+			var err error
+			if data, err = os.ReadFile(geoIPFile); err != nil {
+				return nil, fmt.Errorf("read geoip file: %w", err)
+			}
+		}
+		db, err := geoip2.FromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("open geoip database: %w", err)
+		}
+		r.geoIP = db
+	}
+	return r, nil
+}
+
+func compileRule(rc config.OutboundRule) (*rule, error) {
+	action, err := ParseAction(rc.Action)
+	if err != nil {
+		return nil, err
+	}
+	ru := &rule{action: action, network: rc.Network}
+	switch rc.Network {
+	case "", "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("invalid network %q", rc.Network)
+	}
+	if len(rc.Users) > 0 {
+		ru.users = make(map[string]bool, len(rc.Users))
+		for _, u := range rc.Users {
+			ru.users[u] = true
+		}
+	}
+	for _, p := range rc.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		ru.ports = append(ru.ports, pr)
+	}
+	for _, d := range rc.Domains {
+		switch {
+		case strings.HasPrefix(d, "regexp:"):
+			re, err := regexp.Compile(d[len("regexp:"):])
+			if err != nil {
+				return nil, fmt.Errorf("invalid domain %q: %w", d, err)
+			}
+			ru.patterns = append(ru.patterns, re)
+		case strings.Contains(d, "*"):
+			re, err := util.GlobToRegexp(strings.ToLower(d))
+			if err != nil {
+				return nil, fmt.Errorf("invalid domain %q: %w", d, err)
+			}
+			ru.patterns = append(ru.patterns, re)
+		default:
+			ru.domains = append(ru.domains, strings.ToLower(strings.TrimSuffix(d, ".")))
+		}
+	}
+	for _, c := range rc.CIDRs {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", c)
+		}
+		ru.cidrs = append(ru.cidrs, ipnet)
+	}
+	if len(rc.GeoIP) > 0 {
+		ru.geoIP = make(map[string]bool, len(rc.GeoIP))
+		for _, g := range rc.GeoIP {
+			ru.geoIP[strings.ToUpper(g)] = true
+		}
+	}
+	return ru, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	l, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	h, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || l < 1 || h > 65535 || l > h {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	return portRange{lo: l, hi: h}, nil
+}
+
+// SetLookupIP sets how domain targets are resolved for CIDR and GeoIP
+// conditions, by default with the system resolver.
+func (r *Router) SetLookupIP(lookup func(ctx context.Context, host string) ([]net.IP, error)) {
+	if r == nil {
+		return
+	}
+	r.lookupIP = lookup
+}
+
+// Proxies returns the next proxy names the rules route through.
+func (r *Router) Proxies() []string {
+	if r == nil {
+		return nil
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, ru := range r.rules {
+		if ru.action.Kind == ActionVia && !seen[ru.action.Via] {
+			seen[ru.action.Via] = true
+			names = append(names, ru.action.Via)
+		}
+	}
+	return names
+}
+
+// Match returns the action of the first rule matching req. A domain
+// target is resolved only when a rule has CIDR or GeoIP conditions; if
+// that fails those conditions do not match.
+func (r *Router) Match(ctx context.Context, req Request) Action {
+	if r == nil {
+		return Action{Rule: -1}
+	}
+	host, portStr, err := net.SplitHostPort(req.Target)
+	if err != nil {
+		host = req.Target
+	}
+	port, _ := strconv.Atoi(portStr)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	}
+	resolved := ips != nil
+	targetIPs := func() []net.IP {
+		if !resolved {
+			resolved = true
+			ips, _ = r.lookupIP(ctx, host)
+		}
+		return ips
+	}
+
+	for _, ru := range r.rules {
+		if ru.matches(r, req, host, port, targetIPs) {
+			return ru.action
+		}
+	}
+	return Action{Rule: -1}
+}
+
+// matches reports whether every condition of the rule holds; a condition
+// with several values holds when any of them does.
+func (ru *rule) matches(r *Router, req Request, host string, port int, targetIPs func() []net.IP) bool {
+	if ru.network != "" && ru.network != req.Network {
+		return false
+	}
+	if ru.users != nil && !ru.users[req.User] {
+		return false
+	}
+	if len(ru.ports) > 0 && !ru.matchPort(port) {
+		return false
+	}
+	if (len(ru.domains) > 0 || len(ru.patterns) > 0) && !ru.matchDomain(host) {
+		return false
+	}
+	if len(ru.cidrs) > 0 && !ru.matchCIDR(targetIPs()) {
+		return false
+	}
+	if len(ru.geoIP) > 0 && !ru.matchGeoIP(r.geoIP, targetIPs()) {
+		return false
+	}
+	return true
+}
+
+func (ru *rule) matchPort(port int) bool {
+	for _, pr := range ru.ports {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain matches host against the domains, which also cover their
+// subdomains, and the patterns.
+func (ru *rule) matchDomain(host string) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	for _, d := range ru.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	for _, re := range ru.patterns {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ru *rule) matchCIDR(ips []net.IP) bool {
+	for _, ip := range ips {
+		for _, c := range ru.cidrs {
+			if c.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ru *rule) matchGeoIP(db *geoip2.Reader, ips []net.IP) bool {
+	for _, ip := range ips {
+		country, err := db.Country(ip)
+		if err == nil && ru.geoIP[country.Country.IsoCode] {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalAddr returns the local address to dial network ("tcp" or "udp")
+// from for bind, an IP or the name of an interface. For an interface the
+// first address of the family of target is used.
+func LocalAddr(bind, network, target string) (net.Addr, error) {
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		iface, err := net.InterfaceByName(bind)
+		if err != nil {
+			return nil, fmt.Errorf("bind interface %q: %w", bind, err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("bind interface %q: %w", bind, err)
+		}
+		wantV6 := false
+		if host, _, err := net.SplitHostPort(target); err == nil {
+			if tip := net.ParseIP(host); tip != nil {
+				wantV6 = tip.To4() == nil
+			}
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && (ipnet.IP.To4() == nil) == wantV6 && !ipnet.IP.IsLinkLocalUnicast() {
+				ip = ipnet.IP
+				break
+			}
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("bind interface %q has no usable address", bind)
+		}
+	}
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip}, nil
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
+
+// BindNetwork narrows network to the family of the local address, so a
+// domain target resolves to an address reachable from it.
+func BindNetwork(network string, local net.Addr) string {
+	var ip net.IP
+	switch a := local.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if ip.To4() != nil {
+		return network + "4"
+	}
+	return network + "6"
+}
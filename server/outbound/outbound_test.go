@@ -0,0 +1,141 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Action
+		wantErr bool
+	}{
+		{"block", Action{Kind: ActionBlock}, false},
+		{"direct", Action{Kind: ActionDirect}, false},
+		{"via:default", Action{Kind: ActionVia, Via: "default"}, false},
+		{"bind:203.0.113.5", Action{Kind: ActionBind, Bind: "203.0.113.5"}, false},
+		{"bind:eth1", Action{Kind: ActionBind, Bind: "eth1"}, false},
+		{"via:", Action{}, true},
+		{"proxy", Action{}, true},
+		{"", Action{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseAction(tt.in)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.in, got.String())
+		})
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	r, err := New([]config.OutboundRule{
+		{Ports: []string{"25", "465-587"}, Network: "tcp", Action: "block"},
+		{Domains: []string{"netflix.com", "*.nflxvideo.net"}, Action: "bind:203.0.113.5"},
+		{Domains: []string{"regexp:^ads?\\."}, Action: "block"},
+		{Users: []string{"alice"}, CIDRs: []string{"198.51.100.0/24"}, Action: "via:default"},
+		{CIDRs: []string{"192.0.2.1"}, Action: "direct"},
+		{GeoIP: []string{"cn"}, Action: "direct"},
+	}, "")
+	require.NoError(t, err)
+	r.lookupIP = func(_ context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "cn.example":
+			return []net.IP{net.ParseIP("114.114.114.114")}, nil
+		case "alice.example":
+			return []net.IP{net.ParseIP("198.51.100.7")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		name string
+		req  Request
+		want string
+		rule int
+	}{
+		{"端口 25 被屏蔽", Request{Network: "tcp", Target: "mx.example.com:25"}, "block", 1},
+		{"端口范围", Request{Network: "tcp", Target: "1.1.1.1:587"}, "block", 1},
+		{"UDP 不匹配 TCP 规则", Request{Network: "udp", Target: "1.1.1.1:25"}, "default", 0},
+		{"域名及子域名", Request{Network: "tcp", Target: "www.netflix.com:443"}, "bind:203.0.113.5", 2},
+		{"域名本身", Request{Network: "tcp", Target: "NETFLIX.com.:443"}, "bind:203.0.113.5", 2},
+		{"后缀不同的域名不匹配", Request{Network: "tcp", Target: "notnetflix.com:443"}, "default", 0},
+		{"通配符", Request{Network: "udp", Target: "a.b.nflxvideo.net:443"}, "bind:203.0.113.5", 2},
+		{"正则", Request{Network: "tcp", Target: "ad.example.com:80"}, "block", 3},
+		{"用户与 CIDR 同时满足", Request{Network: "tcp", Target: "198.51.100.9:443", User: "alice"}, "via:default", 4},
+		{"其他用户不匹配", Request{Network: "tcp", Target: "198.51.100.9:443", User: "bob"}, "default", 0},
+		{"域名解析后匹配 CIDR", Request{Network: "tcp", Target: "alice.example:443", User: "alice"}, "via:default", 4},
+		{"单个 IP", Request{Network: "tcp", Target: "192.0.2.1:443"}, "direct", 5},
+		{"GeoIP", Request{Network: "tcp", Target: "cn.example:443"}, "direct", 6},
+		{"解析失败时 IP 条件不匹配", Request{Network: "tcp", Target: "unknown.example:443"}, "default", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.Match(context.Background(), tt.req)
+			require.Equal(t, tt.want, got.String())
+			require.Equal(t, tt.rule, got.Rule+1)
+		})
+	}
+
+	require.Equal(t, []string{"default"}, r.Proxies())
+}
+
+func TestNilRouter(t *testing.T) {
+	r, err := New(nil, "")
+	require.NoError(t, err)
+	require.Nil(t, r)
+	require.Equal(t, ActionDefault, r.Match(context.Background(), Request{Network: "tcp", Target: "example.com:443"}).Kind)
+	require.Empty(t, r.Proxies())
+}
+
+func TestNewInvalidRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    config.OutboundRule
+		wantErr string
+	}{
+		{"无效动作", config.OutboundRule{Action: "reject"}, "invalid outbound action"},
+		{"无效端口", config.OutboundRule{Ports: []string{"70000"}, Action: "block"}, "invalid port"},
+		{"反向端口范围", config.OutboundRule{Ports: []string{"90-80"}, Action: "block"}, "invalid port"},
+		{"无效 CIDR", config.OutboundRule{CIDRs: []string{"10.0.0.0/33"}, Action: "block"}, "invalid cidr"},
+		{"无效正则", config.OutboundRule{Domains: []string{"regexp:("}, Action: "block"}, "invalid domain"},
+		{"无效网络类型", config.OutboundRule{Network: "icmp", Action: "block"}, "invalid network"},
+		{"内置 GeoIP 数据库不认识的国家", config.OutboundRule{GeoIP: []string{"cn", "us"}, Action: "block"}, `geoip "us" requires geoip_file`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New([]config.OutboundRule{tt.rule}, "")
+			require.ErrorContains(t, err, tt.wantErr)
+			require.ErrorContains(t, err, "outbound rule 1")
+		})
+	}
+
+	_, err := New([]config.OutboundRule{{GeoIP: []string{"us"}, Action: "block"}}, filepath.Join(t.TempDir(), "missing.mmdb"))
+	require.ErrorContains(t, err, "read geoip file")
+}
+
+func TestLocalAddr(t *testing.T) {
+	addr, err := LocalAddr("203.0.113.5", "tcp", "example.com:443")
+	require.NoError(t, err)
+	require.Equal(t, &net.TCPAddr{IP: net.ParseIP("203.0.113.5")}, addr)
+	require.Equal(t, "tcp4", BindNetwork("tcp", addr))
+
+	addr, err = LocalAddr("2001:db8::1", "udp", "[2001:db8::2]:53")
+	require.NoError(t, err)
+	require.Equal(t, "udp6", BindNetwork("udp", addr))
+
+	_, err = LocalAddr("no-such-interface0", "tcp", "1.1.1.1:443")
+	require.ErrorContains(t, err, "bind interface")
+}
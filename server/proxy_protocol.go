@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/handler"
+	"github.com/nange/easyss/v3/server/proxyproto"
+)
+
+// untrustedPeerKey marks the context of a connection from a sender outside
+// the trusted PROXY protocol CIDRs.
+type untrustedPeerKey struct{}
+
+// proxyProtocolTrusted returns the trusted senders of PROXY protocol
+// headers, nil when the PROXY protocol is not enabled.
+func (s *Server) proxyProtocolTrusted() ([]*net.IPNet, error) {
+	pp := s.cfg.ProxyProtocol
+	if pp == nil {
+		return nil, nil
+	}
+	if err := pp.Validate(); err != nil {
+		return nil, err
+	}
+	trusted, err := proxyproto.ParseTrusted(pp.TrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("[SERVER] proxy protocol enabled", "trusted_cidrs", pp.TrustedCIDRs)
+	return trusted, nil
+}
+
+// applyProxyProtocol makes srv, serving a proxyproto.Listener, serve only
+// the fallback page to connections from untrusted senders.
+func applyProxyProtocol(srv *http.Server) {
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if !proxyproto.Trusted(c) {
+			return context.WithValue(ctx, untrustedPeerKey{}, true)
+		}
+		return ctx
+	}
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(untrustedPeerKey{}) != nil {
+			log.Debug("[SERVER] untrusted proxy protocol sender", "remote", r.RemoteAddr, "path", r.URL.Path)
+			handler.ServeFallback(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
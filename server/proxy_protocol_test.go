@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/proxyproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyProtocolTrustedDisabled(t *testing.T) {
+	s := &Server{cfg: &config.ServerConfig{}}
+	trusted, err := s.proxyProtocolTrusted()
+	require.NoError(t, err)
+	require.Nil(t, trusted)
+}
+
+func TestProxyProtocolTrustedInvalid(t *testing.T) {
+	for _, cidrs := range [][]string{nil, {"not-an-ip"}} {
+		s := &Server{cfg: &config.ServerConfig{ProxyProtocol: &config.ProxyProtocolConfig{TrustedCIDRs: cidrs}}}
+		_, err := s.proxyProtocolTrusted()
+		require.Error(t, err)
+	}
+}
+
+// selfSignedTLSConfig returns a server TLS config with a self-signed
+// certificate for example.com.
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestProxyProtocolClientAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		trusted  string
+		header   string
+		wantBody string
+	}{
+		{"trusted sender", "127.0.0.1", "PROXY TCP4 203.0.113.7 127.0.0.1 51234 443\r\n", "203.0.113.7:51234"},
+		// The fallback page is served instead of the proxy handler.
+		{"untrusted sender", "192.0.2.0/24", "", ""},
+	}
+	for _, tt := range tests {
+		// Listeners with the PROXY protocol serve TLS, where the server
+		// sees the connection through a *tls.Conn.
+		for _, useTLS := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s tls=%v", tt.name, useTLS), func(t *testing.T) {
+				s := &Server{cfg: &config.ServerConfig{ProxyProtocol: &config.ProxyProtocolConfig{TrustedCIDRs: []string{tt.trusted}}}}
+				trusted, err := s.proxyProtocolTrusted()
+				require.NoError(t, err)
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = io.WriteString(w, r.RemoteAddr)
+				})}
+				applyProxyProtocol(srv)
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				require.NoError(t, err)
+				pl := proxyproto.NewListener(ln, trusted, time.Second)
+				if useTLS {
+					srv.TLSConfig = selfSignedTLSConfig(t)
+					go srv.ServeTLS(pl, "", "") //nolint:errcheck
+				} else {
+					go srv.Serve(pl) //nolint:errcheck
+				}
+				t.Cleanup(func() { _ = srv.Close() })
+
+				c, err := net.Dial("tcp", ln.Addr().String())
+				require.NoError(t, err)
+				defer c.Close() //nolint:errcheck
+				_, err = io.WriteString(c, tt.header)
+				require.NoError(t, err)
+				if useTLS {
+					c = tls.Client(c, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+				}
+				_, err = io.WriteString(c, "GET /tcp HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+				require.NoError(t, err)
+				resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+				require.NoError(t, err)
+				defer resp.Body.Close() //nolint:errcheck
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				if tt.wantBody == "" {
+					require.NotContains(t, string(body), "127.0.0.1:")
+					return
+				}
+				require.Equal(t, tt.wantBody, string(body))
+			})
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Package proxyproto accepts the PROXY protocol (v1 and v2) headers a
+// load balancer prepends to a connection to pass on the address of the
+// original client.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2Signature starts a PROXY protocol v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1HeaderLen is the longest v1 header, CRLF included.
+const maxV1HeaderLen = 107
+
+// ParseTrusted parses CIDRs, or single IPs, of trusted header senders.
+func ParseTrusted(cidrs []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted cidr %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted cidr %q", c)
+		}
+		out = append(out, ipnet)
+	}
+	return out, nil
+}
+
+// Listener reads a PROXY protocol header from the connections of trusted
+// senders, whose remote address becomes the one in the header. The
+// connections of other senders are passed through untouched and marked
+// untrusted.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// NewListener wraps ln; timeout bounds reading a header.
+func NewListener(ln net.Listener, trusted []*net.IPNet, timeout time.Duration) *Listener {
+	return &Listener{Listener: ln, trusted: trusted, timeout: timeout}
+}
+
+// Accept returns the next connection. The header is read on the first
+// Read or RemoteAddr, in the goroutine serving the connection, so a slow
+// sender cannot hold up the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, trusted: l.isTrusted(c.RemoteAddr()), timeout: l.timeout}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection accepted by a Listener.
+type Conn struct {
+	net.Conn
+	trusted bool
+	timeout time.Duration
+
+	once   sync.Once
+	r      io.Reader
+	remote net.Addr
+	err    error
+}
+
+// Trusted reports whether c came from a trusted sender; connections not
+// accepted by a Listener are trusted. Wrappers exposing the connection
+// they wrap with NetConn, such as *tls.Conn, are unwrapped.
+func Trusted(c net.Conn) bool {
+	for {
+		switch cc := c.(type) {
+		case *Conn:
+			return cc.trusted
+		case interface{ NetConn() net.Conn }:
+			c = cc.NetConn()
+		default:
+			return true
+		}
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address of the header, or the address of
+// the sender when there is none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	c.r = c.Conn
+	if !c.trusted {
+		return
+	}
+	if c.timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+	}
+	br := bufio.NewReader(c.Conn)
+	c.r = br
+	c.remote, c.err = ReadHeader(br)
+	if c.err != nil {
+		c.err = fmt.Errorf("proxy protocol from %s: %w", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+// ReadHeader reads a v1 or v2 header from br and returns the client
+// address in it, nil for a header without one (v1 UNKNOWN, v2 LOCAL or a
+// non-TCP family).
+func ReadHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(v2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	switch {
+	case bytes.Equal(sig, v2Signature):
+		return readV2(br)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readV1(br)
+	}
+	return nil, errors.New("missing header")
+}
+
+func readV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1HeaderLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("read v2 header: %w", err)
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, fmt.Errorf("read v2 header: %w", err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL: a health check of the balancer itself.
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", verCmd&0x0f)
+	}
+	// Addresses are followed by TLVs, which are ignored.
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 ipv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 ipv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,134 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(cmd, family byte, addrs []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|cmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := append(net.IPv4(203, 0, 113, 7).To4(), 10, 0, 0, 1)
+	ipv4 = binary.BigEndian.AppendUint16(ipv4, 51234)
+	ipv4 = binary.BigEndian.AppendUint16(ipv4, 443)
+	ipv6 := append(append([]byte{}, net.ParseIP("2001:db8::7")...), net.ParseIP("2001:db8::1")...)
+	ipv6 = binary.BigEndian.AppendUint16(ipv6, 40000)
+	ipv6 = binary.BigEndian.AppendUint16(ipv6, 443)
+
+	tests := []struct {
+		name    string
+		in      []byte
+		want    string
+		wantErr bool
+	}{
+		{"v1 ipv4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"), "203.0.113.7:51234", false},
+		{"v1 ipv6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 40000 443\r\n"), "[2001:db8::7]:40000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 协议族与地址不符", []byte("PROXY TCP4 2001:db8::7 10.0.0.1 1 443\r\n"), "", true},
+		{"v1 端口非法", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 70000 443\r\n"), "", true},
+		{"v1 过长", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", true},
+		{"v2 ipv4", v2Header(0x1, 0x11, ipv4), "203.0.113.7:51234", false},
+		{"v2 ipv6", v2Header(0x1, 0x21, ipv6), "[2001:db8::7]:40000", false},
+		{"v2 带 TLV", v2Header(0x1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0xff)), "203.0.113.7:51234", false},
+		{"v2 LOCAL", v2Header(0x0, 0x00, nil), "", false},
+		{"v2 地址过短", v2Header(0x1, 0x11, ipv4[:6]), "", true},
+		{"v2 命令非法", v2Header(0x5, 0x11, ipv4), "", true},
+		{"缺少头部", []byte("\x16\x03\x01\x00\xa5\x01\x00\x00\xa1\x03\x03\x00\x00"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.in), strings.NewReader("rest")))
+			addr, err := ReadHeader(br)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == "" {
+				require.Nil(t, addr)
+			} else {
+				require.Equal(t, tt.want, addr.String())
+			}
+			rest, err := io.ReadAll(br)
+			require.NoError(t, err)
+			require.Equal(t, "rest", string(rest))
+		})
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	nets, err := ParseTrusted([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	require.NoError(t, err)
+	require.Len(t, nets, 3)
+	require.Equal(t, "192.0.2.1/32", nets[1].String())
+
+	_, err = ParseTrusted([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+	_, err = ParseTrusted([]string{"lb.example"})
+	require.Error(t, err)
+}
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		name        string
+		trusted     string
+		send        string
+		wantTrusted bool
+		wantRemote  string
+		wantData    string
+		wantErr     bool
+	}{
+		{"可信来源", "127.0.0.0/8", "PROXY TCP4 203.0.113.7 127.0.0.1 51234 443\r\nhello", true, "203.0.113.7:51234", "hello", false},
+		{"可信来源缺少头部", "127.0.0.1", "hello", true, "", "", true},
+		{"不可信来源原样透传", "10.0.0.0/8", "PROXY TCP4 203.0.113.7 127.0.0.1 51234 443\r\nhello", false, "127.0.0.1", "PROXY TCP4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := ParseTrusted([]string{tt.trusted})
+			require.NoError(t, err)
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			ln := NewListener(inner, trusted, time.Second)
+			defer ln.Close()
+
+			go func() {
+				c, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				_, _ = c.Write([]byte(tt.send))
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			c, err := ln.Accept()
+			require.NoError(t, err)
+			defer c.Close()
+			require.Equal(t, tt.wantTrusted, Trusted(c))
+
+			if tt.wantErr {
+				_, err = c.Read(make([]byte, 16))
+				require.Error(t, err)
+				return
+			}
+			buf := make([]byte, len(tt.wantData))
+			_, err = io.ReadFull(c, buf)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantData, string(buf))
+			require.True(t, strings.HasPrefix(c.RemoteAddr().String(), tt.wantRemote))
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// Package quota keeps the per-user traffic of the current day and month,
+// persisted to a JSON file so quotas survive server restarts.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Usage is the traffic of one user in the current periods, in bytes of
+// payload relayed in both directions.
+type Usage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// Store accumulates usage per user name. Periods roll over lazily on the
+// server's local clock: a counter of a past day or month reads as zero.
+//
+// The old and the new process of an upgrade share the file for a while, so
+// a save adds the traffic not saved yet to the totals in the file rather
+// than overwriting them.
+type Store struct {
+	path string
+	now  func() time.Time
+
+	mu    sync.Mutex
+	users map[string]*Usage
+	// pending is the traffic added since the last save.
+	pending map[string]*Usage
+}
+
+// Open loads the store saved at path, starting empty when the file does
+// not exist yet.
+func Open(path string) (*Store, error) {
+	users, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{path: path, now: time.Now, users: users, pending: make(map[string]*Usage)}, nil
+}
+
+// load reads the usage saved at path, empty when the file does not exist.
+func load(path string) (map[string]*Usage, error) {
+	users := make(map[string]*Usage)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if users == nil {
+		users = make(map[string]*Usage)
+	}
+	return users, nil
+}
+
+// usage returns the usage of name rolled over to the current periods. The
+// caller must hold s.mu.
+func (s *Store) usage(name string) *Usage {
+	now := s.now()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	u, ok := s.users[name]
+	if !ok {
+		u = &Usage{}
+		s.users[name] = u
+	}
+	if u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+	return u
+}
+
+// Add records n bytes of traffic of name.
+func (s *Store) Add(name string, n int64) {
+	if n <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.usage(name)
+	u.DayBytes += n
+	u.MonthBytes += n
+	p, ok := s.pending[name]
+	if !ok {
+		p = &Usage{}
+		s.pending[name] = p
+	}
+	p.add(Usage{Day: u.Day, DayBytes: n, Month: u.Month, MonthBytes: n})
+}
+
+// Usage returns the traffic of name in the current periods.
+func (s *Store) Usage(name string) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.usage(name)
+}
+
+// Save adds the traffic since the last save to the totals in the file,
+// which may have been saved by another process, and takes those totals.
+// The file is replaced atomically so a crash never leaves it truncated.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]*Usage)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	users, err := load(s.path)
+	if err == nil {
+		merge(users, pending)
+		var data []byte
+		if data, err = json.MarshalIndent(users, "", "  "); err == nil {
+			err = writeFile(s.path, data)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// Keep the traffic pending so the next save retries it.
+		merge(s.pending, pending)
+		return err
+	}
+	s.users = users
+	// The traffic added during the save is not in the file yet.
+	merge(s.users, s.pending)
+	return nil
+}
+
+// merge adds the usage of src to dst.
+func merge(dst, src map[string]*Usage) {
+	for name, su := range src {
+		du, ok := dst[name]
+		if !ok {
+			du = &Usage{}
+			dst[name] = du
+		}
+		du.add(*su)
+	}
+}
+
+// add adds the counters of o to u. A counter of an older period than the
+// other one is dropped.
+func (u *Usage) add(o Usage) {
+	if u.Day < o.Day {
+		u.Day, u.DayBytes = o.Day, 0
+	}
+	if u.Day == o.Day {
+		u.DayBytes += o.DayBytes
+	}
+	if u.Month < o.Month {
+		u.Month, u.MonthBytes = o.Month, 0
+	}
+	if u.Month == o.Month {
+		u.MonthBytes += o.MonthBytes
+	}
+}
+
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()           //nolint:errcheck
+		os.Remove(tmp.Name()) //nolint:errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name()) //nolint:errcheck
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,139 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 19, 23, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return now }
+
+	s.Add("alice", 100)
+	s.Add("alice", 50)
+	s.Add("bob", 10)
+	if u := s.Usage("alice"); u.DayBytes != 150 || u.MonthBytes != 150 {
+		t.Fatalf("alice usage = %+v", u)
+	}
+
+	t.Run("跨天只清零日用量", func(t *testing.T) {
+		now = now.Add(2 * time.Hour)
+		if u := s.Usage("alice"); u.DayBytes != 0 || u.MonthBytes != 150 {
+			t.Fatalf("alice usage = %+v", u)
+		}
+	})
+
+	t.Run("重启后用量保留", func(t *testing.T) {
+		s.Add("alice", 5)
+		if err := s.Save(); err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reopened.now = s.now
+		if u := reopened.Usage("alice"); u.DayBytes != 5 || u.MonthBytes != 155 {
+			t.Fatalf("alice usage = %+v", u)
+		}
+		if u := reopened.Usage("bob"); u.MonthBytes != 10 {
+			t.Fatalf("bob usage = %+v", u)
+		}
+	})
+
+	t.Run("跨月清零", func(t *testing.T) {
+		now = time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)
+		if u := s.Usage("alice"); u.DayBytes != 0 || u.MonthBytes != 0 {
+			t.Fatalf("alice usage = %+v", u)
+		}
+	})
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("Open should fail on a corrupt file")
+	}
+}
+
+func TestStoreSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	now := func() time.Time { return time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local) }
+	open := func() *Store {
+		s, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.now = now
+		return s
+	}
+
+	// The old process of an upgrade saves before the new one opens the file.
+	old := open()
+	old.Add("alice", 100)
+	if err := old.Save(); err != nil {
+		t.Fatal(err)
+	}
+	cur := open()
+	if u := cur.Usage("alice"); u.DayBytes != 100 {
+		t.Fatalf("alice usage = %+v", u)
+	}
+
+	t.Run("交替保存时合并用量", func(t *testing.T) {
+		old.Add("alice", 5)
+		cur.Add("alice", 20)
+		cur.Add("bob", 7)
+		if err := cur.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if err := old.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if u := old.Usage("alice"); u.DayBytes != 125 || u.MonthBytes != 125 {
+			t.Fatalf("old alice usage = %+v", u)
+		}
+		if u := old.Usage("bob"); u.DayBytes != 7 {
+			t.Fatalf("old bob usage = %+v", u)
+		}
+		// The new process takes the traffic of the old one on its next save.
+		cur.Add("alice", 1)
+		if err := cur.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if u := cur.Usage("alice"); u.DayBytes != 126 {
+			t.Fatalf("cur alice usage = %+v", u)
+		}
+		if u := open().Usage("alice"); u.DayBytes != 126 {
+			t.Fatalf("saved alice usage = %+v", u)
+		}
+	})
+
+	t.Run("保存失败时保留未保存的用量", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cur.Add("alice", 4)
+		if err := cur.Save(); err == nil {
+			t.Fatal("Save should fail on a corrupt file")
+		}
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := cur.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if u := open().Usage("alice"); u.DayBytes != 4 {
+			t.Fatalf("saved alice usage = %+v", u)
+		}
+	})
+}
@@ -0,0 +1,261 @@
+// Package resolver resolves the domain targets of streams on the server:
+// static hosts first, then a cache, then the configured DNS upstreams or
+// the system resolver, ordering the answers by the preferred address
+// family.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/util"
+)
+
+// Strategies order the addresses of a name by family.
+const (
+	StrategyIPv4First = "ipv4_first"
+	StrategyIPv6First = "ipv6_first"
+	StrategyIPv4Only  = "ipv4_only"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	// systemTTL caches the answers of the system resolver, which does not
+	// report TTLs.
+	systemTTL = 60 * time.Second
+	minTTL    = 10 * time.Second
+	maxTTL    = time.Hour
+	// maxCacheEntries bounds the cache; expired entries are dropped first.
+	maxCacheEntries = 4096
+)
+
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Resolver resolves names as configured by the dns section. A nil Resolver
+// uses the system resolver without caching.
+type Resolver struct {
+	upstreams []*upstream
+	strategy  string
+	hosts     map[string][]net.IP
+	timeout   time.Duration
+	cache     bool
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// now is the clock of the cache, replaced in tests.
+	now func() time.Time
+	// lookupSystem resolves names when no upstream is configured.
+	lookupSystem func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// New creates the resolver of cfg, nil when cfg is nil.
+func New(cfg *config.DNSConfig) (*Resolver, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Strategy {
+	case "", StrategyIPv4First, StrategyIPv6First, StrategyIPv4Only:
+	default:
+		return nil, fmt.Errorf("invalid dns strategy %q", cfg.Strategy)
+	}
+	if cfg.Timeout < 0 {
+		return nil, errors.New("negative dns timeout")
+	}
+	r := &Resolver{
+		strategy:     cfg.Strategy,
+		hosts:        make(map[string][]net.IP, len(cfg.Hosts)),
+		timeout:      defaultTimeout,
+		cache:        !cfg.DisableCache,
+		entries:      make(map[string]cacheEntry),
+		now:          time.Now,
+		lookupSystem: net.DefaultResolver.LookupIP,
+	}
+	if cfg.Timeout > 0 {
+		r.timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	for _, s := range cfg.Servers {
+		u, err := parseUpstream(s, r.timeout)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	for name, value := range cfg.Hosts {
+		var ips []net.IP
+		for _, v := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(v))
+			if ip == nil {
+				return nil, fmt.Errorf("dns hosts %q: invalid ip %q", name, v)
+			}
+			ips = append(ips, ip)
+		}
+		r.hosts[canonicalName(name)] = ips
+	}
+	return r, nil
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// LookupIP resolves host, returning literal IPs as they are. The addresses
+// are ordered, or filtered, by the strategy.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r == nil {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	name := canonicalName(host)
+	if ips, ok := r.hosts[name]; ok {
+		return r.order(ips), nil
+	}
+	if ips, ok := r.cached(name); ok {
+		return ips, nil
+	}
+
+	ips, ttl, err := r.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips = r.order(ips)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+	r.store(name, ips, ttl)
+	return ips, nil
+}
+
+// IsLANHost reports whether addr (host or host:port) is, or resolves to, a
+// LAN address. Resolution failures report false, leaving the error to the
+// dial.
+func (r *Resolver) IsLANHost(ctx context.Context, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "" {
+		return false
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return false
+	}
+	return HasLANIP(ips)
+}
+
+// HasLANIP reports whether any of ips is a LAN address.
+func HasLANIP(ips []net.IP) bool {
+	for _, ip := range ips {
+		if util.IsLANIP(ip.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve queries the upstreams in order, or the system resolver, for the
+// addresses of name and their TTL.
+func (r *Resolver) resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if len(r.upstreams) == 0 {
+		network := "ip"
+		if r.strategy == StrategyIPv4Only {
+			network = "ip4"
+		}
+		ips, err := r.lookupSystem(ctx, network, name)
+		return ips, systemTTL, err
+	}
+	var errs []error
+	for _, u := range r.upstreams {
+		ips, ttl, err := u.lookup(ctx, name, r.strategy != StrategyIPv4Only)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, 0, err
+		}
+		log.Debug("[DNS] upstream failed", "server", u.addr, "name", name, "err", err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, fmt.Errorf("resolve %s: %w", name, errors.Join(errs...))
+}
+
+// order sorts ips by the strategy, dropping IPv6 for StrategyIPv4Only.
+func (r *Resolver) order(ips []net.IP) []net.IP {
+	if r.strategy == "" {
+		return ips
+	}
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch r.strategy {
+	case StrategyIPv4Only:
+		return v4
+	case StrategyIPv6First:
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
+
+func (r *Resolver) cached(name string) ([]net.IP, bool) {
+	if !r.cache {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[name]
+	if !ok || !r.now().Before(e.expires) {
+		return nil, false
+	}
+	return e.ips, true
+}
+
+func (r *Resolver) store(name string, ips []net.IP, ttl time.Duration) {
+	if !r.cache {
+		return
+	}
+	ttl = min(max(ttl, minTTL), maxTTL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if len(r.entries) >= maxCacheEntries {
+		for k, e := range r.entries {
+			if !now.Before(e.expires) {
+				delete(r.entries, k)
+			}
+		}
+		// Still full: drop arbitrary entries rather than grow.
+		for k := range r.entries {
+			if len(r.entries) < maxCacheEntries {
+				break
+			}
+			delete(r.entries, k)
+		}
+	}
+	r.entries[name] = cacheEntry{ips: ips, expires: now.Add(ttl)}
+}
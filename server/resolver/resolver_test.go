@@ -0,0 +1,270 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/stretchr/testify/require"
+)
+
+// dnsHandler answers a.example with 203.0.113.1 and 2001:db8::1 (TTL 300)
+// and NXDOMAIN for everything else, counting the queries.
+func dnsHandler(queries *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		if q.Name != "a.example." {
+			m.Rcode = dns.RcodeNameError
+			_ = w.WriteMsg(m)
+			return
+		}
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("203.0.113.1")})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		_ = w.WriteMsg(m)
+	}
+}
+
+func startDNSServer(t *testing.T, queries *atomic.Int32) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: dnsHandler(queries), NotifyStartedFunc: func() { close(started) }}
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func closedTCPAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	return addr
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		in      string
+		addr    string
+		network string
+		wantErr bool
+	}{
+		{"1.1.1.1", "1.1.1.1:53", "udp", false},
+		{"udp://8.8.8.8:5353", "8.8.8.8:5353", "udp", false},
+		{"tcp://[2606:4700::1111]", "[2606:4700::1111]:53", "tcp", false},
+		{"tls://dns.google", "dns.google:853", "tcp-tls", false},
+		{"https://dns.google/dns-query", "https://dns.google/dns-query", "", false},
+		{"quic://dns.adguard.com", "", "", true},
+		{"udp://", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			u, err := parseUpstream(tt.in, time.Second)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.addr, u.addr)
+			if tt.network == "" {
+				require.NotNil(t, u.http)
+				return
+			}
+			require.Equal(t, tt.network, u.client.Net)
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.DNSConfig
+		wantErr string
+	}{
+		{"无效策略", config.DNSConfig{Strategy: "ipv6_only"}, "invalid dns strategy"},
+		{"无效服务器", config.DNSConfig{Servers: []string{"ftp://1.1.1.1"}}, "invalid dns server"},
+		{"无效 hosts", config.DNSConfig{Hosts: map[string]string{"a.example": "1.2.3"}}, "invalid ip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(&tt.cfg)
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+
+	r, err := New(nil)
+	require.NoError(t, err)
+	require.Nil(t, r)
+}
+
+func TestLookupIP(t *testing.T) {
+	var queries atomic.Int32
+	server := startDNSServer(t, &queries)
+
+	tests := []struct {
+		name     string
+		strategy string
+		want     []string
+	}{
+		{"IPv4 优先", StrategyIPv4First, []string{"203.0.113.1", "2001:db8::1"}},
+		{"IPv6 优先", StrategyIPv6First, []string{"2001:db8::1", "203.0.113.1"}},
+		{"仅 IPv4", StrategyIPv4Only, []string{"203.0.113.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(&config.DNSConfig{
+				// 第一个服务器不可用时使用下一个
+				Servers:  []string{"tcp://" + closedTCPAddr(t), server},
+				Strategy: tt.strategy,
+			})
+			require.NoError(t, err)
+			ips, err := r.LookupIP(context.Background(), "A.example.")
+			require.NoError(t, err)
+			require.Equal(t, tt.want, ipStrings(ips))
+		})
+	}
+
+	t.Run("域名不存在", func(t *testing.T) {
+		r, err := New(&config.DNSConfig{Servers: []string{server}})
+		require.NoError(t, err)
+		_, err = r.LookupIP(context.Background(), "missing.example")
+		var dnsErr *net.DNSError
+		require.True(t, errors.As(err, &dnsErr) && dnsErr.IsNotFound, "err = %v", err)
+	})
+
+	t.Run("静态 hosts 与 IP 不查询", func(t *testing.T) {
+		r, err := New(&config.DNSConfig{
+			Servers:  []string{server},
+			Strategy: StrategyIPv4First,
+			Hosts:    map[string]string{"Static.Example": "2001:db8::2, 192.0.2.2"},
+		})
+		require.NoError(t, err)
+		before := queries.Load()
+		ips, err := r.LookupIP(context.Background(), "static.example")
+		require.NoError(t, err)
+		require.Equal(t, []string{"192.0.2.2", "2001:db8::2"}, ipStrings(ips))
+		ips, err = r.LookupIP(context.Background(), "198.51.100.1")
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.1"}, ipStrings(ips))
+		require.Equal(t, before, queries.Load())
+	})
+}
+
+func TestCache(t *testing.T) {
+	var queries atomic.Int32
+	server := startDNSServer(t, &queries)
+	r, err := New(&config.DNSConfig{Servers: []string{server}, Strategy: StrategyIPv4Only})
+	require.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for range 3 {
+		_, err := r.LookupIP(context.Background(), "a.example")
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 1, queries.Load(), "answers are cached for their TTL")
+
+	now = now.Add(301 * time.Second)
+	_, err = r.LookupIP(context.Background(), "a.example")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, queries.Load(), "expired answers are queried again")
+
+	r, err = New(&config.DNSConfig{Servers: []string{server}, Strategy: StrategyIPv4Only, DisableCache: true})
+	require.NoError(t, err)
+	for range 2 {
+		_, err := r.LookupIP(context.Background(), "a.example")
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 4, queries.Load())
+}
+
+func TestSystemResolver(t *testing.T) {
+	r, err := New(&config.DNSConfig{Strategy: StrategyIPv4Only})
+	require.NoError(t, err)
+	var networks []string
+	r.lookupSystem = func(_ context.Context, network, host string) ([]net.IP, error) {
+		networks = append(networks, network)
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+
+	require.True(t, r.IsLANHost(context.Background(), "intranet.example:443"))
+	require.True(t, r.IsLANHost(context.Background(), "intranet.example:80"))
+	require.False(t, r.IsLANHost(context.Background(), "203.0.113.1:443"))
+	require.Equal(t, []string{"ip4"}, networks, "system answers are cached too")
+
+	var nilResolver *Resolver
+	require.True(t, nilResolver.IsLANHost(context.Background(), "127.0.0.1:80"))
+}
+
+func TestDoH(t *testing.T) {
+	var queries atomic.Int32
+	answer := dnsHandler(&queries)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec := &msgRecorder{}
+		answer(rec, q)
+		out, _ := rec.msg.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(out)
+	}))
+	defer srv.Close()
+
+	r, err := New(&config.DNSConfig{Servers: []string{srv.URL + "/dns-query"}, Strategy: StrategyIPv4First})
+	require.NoError(t, err)
+	r.upstreams[0].http = srv.Client()
+	ips, err := r.LookupIP(context.Background(), "a.example")
+	require.NoError(t, err)
+	require.Equal(t, []string{"203.0.113.1", "2001:db8::1"}, ipStrings(ips))
+	require.EqualValues(t, 2, queries.Load())
+}
+
+// msgRecorder captures the message a dns.Handler writes.
+type msgRecorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (m *msgRecorder) WriteMsg(msg *dns.Msg) error {
+	m.msg = msg
+	return nil
+}
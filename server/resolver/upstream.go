@@ -0,0 +1,183 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the media type of DNS over HTTPS messages (RFC 8484).
+const dohContentType = "application/dns-message"
+
+// upstream is a DNS server queried over UDP, TCP, TLS or HTTPS.
+type upstream struct {
+	// addr is the server address, or the URL of a DoH server.
+	addr   string
+	client *dns.Client
+	http   *http.Client
+}
+
+// parseUpstream parses a server of the dns section: an IP or host with an
+// optional port, or a udp://, tcp://, tls:// or https:// URL.
+func parseUpstream(s string, timeout time.Duration) (*upstream, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid dns server %q", s)
+	}
+	if u.Scheme == "https" {
+		return &upstream{
+			addr: u.String(),
+			http: &http.Client{Timeout: timeout, Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{ServerName: u.Hostname()},
+			}},
+		}, nil
+	}
+
+	var network, port string
+	switch u.Scheme {
+	case "udp":
+		network, port = "udp", "53"
+	case "tcp":
+		network, port = "tcp", "53"
+	case "tls":
+		network, port = "tcp-tls", "853"
+	default:
+		return nil, fmt.Errorf("invalid dns server %q: unsupported scheme %q", s, u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	c := &dns.Client{Net: network, Timeout: timeout, UDPSize: dns.DefaultMsgSize}
+	if network == "tcp-tls" {
+		c.TLSConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+	return &upstream{addr: net.JoinHostPort(u.Hostname(), port), client: c}, nil
+}
+
+// lookup queries the A, and with ipv6 the AAAA, records of name. The TTL
+// is the smallest of the answers.
+func (u *upstream) lookup(ctx context.Context, name string, ipv6 bool) ([]net.IP, time.Duration, error) {
+	qtypes := []uint16{dns.TypeA}
+	if ipv6 {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+	results := make([]chan result, len(qtypes))
+	for i, qtype := range qtypes {
+		results[i] = make(chan result, 1)
+		go func() {
+			msg, err := u.exchange(ctx, name, qtype)
+			results[i] <- result{msg, err}
+		}()
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	var errs []error
+	notFound := 0
+	for _, ch := range results {
+		res := <-ch
+		switch {
+		case res.err != nil:
+			errs = append(errs, res.err)
+			continue
+		case res.msg.Rcode == dns.RcodeNameError:
+			notFound++
+			continue
+		case res.msg.Rcode != dns.RcodeSuccess:
+			errs = append(errs, fmt.Errorf("rcode %s", dns.RcodeToString[res.msg.Rcode]))
+			continue
+		}
+		for _, rr := range res.msg.Answer {
+			var ip net.IP
+			switch a := rr.(type) {
+			case *dns.A:
+				ip = a.A
+			case *dns.AAAA:
+				ip = a.AAAA
+			default:
+				continue
+			}
+			ips = append(ips, ip)
+			if ttl == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+	if len(errs) > 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	if notFound > 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: u.addr, IsNotFound: true}
+	}
+	return nil, 0, &net.DNSError{Err: "no address", Name: name, Server: u.addr, IsNotFound: true}
+}
+
+func (u *upstream) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+	if u.http != nil {
+		return u.exchangeHTTPS(ctx, m)
+	}
+	r, _, err := u.client.ExchangeContext(ctx, m, u.addr)
+	if err == nil && r.Truncated && u.client.Net == "udp" {
+		tcp := *u.client
+		tcp.Net = "tcp"
+		r, _, err = tcp.ExchangeContext(ctx, m, u.addr)
+	}
+	return r, err
+}
+
+// exchangeHTTPS sends m to a DNS over HTTPS server with POST.
+func (u *upstream) exchangeHTTPS(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends ID 0 for cache friendliness.
+	m.Id = 0
+	body, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.addr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := u.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(data); err != nil {
+		return nil, fmt.Errorf("doh server: %w", err)
+	}
+	return r, nil
+}
@@ -5,9 +5,11 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	stdlog "log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -20,19 +22,44 @@ import (
 	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/certstore"
 	"github.com/nange/easyss/v3/server/config"
 	"github.com/nange/easyss/v3/server/handler"
 	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/nextproxy/easyss"
+	"github.com/nange/easyss/v3/server/outbound"
+	"github.com/nange/easyss/v3/server/quota"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/stats"
 )
 
 type Server struct {
-	cfg        *config.ServerConfig
-	httpServer *http.Server
-	mux        *http.ServeMux
-	certCache  *certmagic.Cache
-	statsDone  chan struct{}
-	statsOnce  sync.Once
+	cfg          *config.ServerConfig
+	quota        *quota.Store
+	listeners    []*listener
+	mux          *http.ServeMux
+	certCache    *certmagic.Cache
+	certStore    *certstore.Store
+	statsDone    chan struct{}
+	statsOnce    sync.Once
+	proxyHandler *handler.ProxyHandler
+	probeHandler *handler.ProbeHandler
+	nextProxies  *nextproxy.Group
+	adminServer  *http.Server
+	// adminListener is the socket of the admin API, handed over on
+	// upgrade.
+	adminListener net.Listener
+
+	// upgradeFDs are the sockets handed over by the process this one
+	// upgrades, by address, until they are taken; upgradeReadyFD tells
+	// that process this one serves.
+	upgradeFDs     map[string]int
+	upgradeReadyFD int
+
+	// adminMu serializes the changes made through the admin API; it
+	// guards masterKeys, the users' keys by name.
+	adminMu    sync.Mutex
+	masterKeys map[string][]byte
 }
 
 func New(cfg *config.ServerConfig) (*Server, error) {
@@ -46,15 +73,25 @@ func New(cfg *config.ServerConfig) (*Server, error) {
 func (s *Server) initTLS() (*tls.Config, error) {
 	cfg := s.cfg
 
-	if cfg.CertPath != "" && cfg.KeyPath != "" {
-		cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
-		if err != nil {
-			return nil, fmt.Errorf("load cert: %w", err)
+	files, err := cfg.CertificateFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		pairs := make([]certstore.Pair, 0, len(files))
+		for _, f := range files {
+			pairs = append(pairs, certstore.Pair{CertPath: f.CertPath, KeyPath: f.KeyPath})
+		}
+		if s.certStore, err = certstore.New(pairs); err != nil {
+			return nil, err
 		}
+	}
+	if !cfg.UseCertmagic() {
+		s.certStore.Watch(certstore.DefaultWatchInterval)
 		return &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			NextProtos:   sharedconfig.NextProtos,
-			MinVersion:   tls.VersionTLS12,
+			GetCertificate: s.certStore.GetCertificate,
+			NextProtos:     sharedconfig.NextProtos,
+			MinVersion:     tls.VersionTLS12,
 		}, nil
 	}
 
@@ -75,7 +112,7 @@ func (s *Server) initTLS() (*tls.Config, error) {
 		if cache != nil {
 			cache.Stop()
 		}
-		_ = cleanCertmagicDomainAssets(context.Background(), storage, cfg.Domain)
+		_ = cleanCertmagicDomainAssets(context.Background(), storage, acmeDirectory(cfg.ACME), cfg.ManagedDomains())
 		tlsConfig, cache, err = s.manageCert(storage, true)
 	}
 	if err != nil {
@@ -87,9 +124,30 @@ func (s *Server) initTLS() (*tls.Config, error) {
 
 	s.certCache = cache
 	tlsConfig.NextProtos = append(slices.Clone(sharedconfig.NextProtos), tlsConfig.NextProtos...)
+	if s.certStore != nil {
+		tlsConfig.GetCertificate = withFileCertificates(s.certStore, tlsConfig.GetCertificate)
+		s.certStore.Watch(certstore.DefaultWatchInterval)
+	}
 	return tlsConfig, nil
 }
 
+// acmeTLSALPN is the ALPN protocol of the ACME TLS-ALPN-01 challenge.
+const acmeTLSALPN = "acme-tls/1"
+
+// withFileCertificates answers with the file certificate matching the
+// server name, before the certmagic managed one. ACME challenges are left
+// to certmagic.
+func withFileCertificates(store *certstore.Store, managed func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !slices.Contains(hello.SupportedProtos, acmeTLSALPN) {
+			if c := store.Match(hello); c != nil {
+				return c, nil
+			}
+		}
+		return managed(hello)
+	}
+}
+
 func (s *Server) manageCert(storage certmagic.Storage, disableARI bool) (*tls.Config, *certmagic.Cache, error) {
 	var cmCfg *certmagic.Config
 	cache := certmagic.NewCache(certmagic.CacheOptions{
@@ -107,10 +165,13 @@ func (s *Server) manageCert(storage certmagic.Storage, disableARI bool) (*tls.Co
 	acmeCfg.Agreed = true
 	acmeCfg.Email = s.cfg.Email
 	acmeCfg.DisableHTTPChallenge = true
+	if err := applyACMEConfig(&acmeCfg, s.cfg.ACME); err != nil {
+		return nil, cache, err
+	}
 	cmCfg.Issuers = []certmagic.Issuer{certmagic.NewACMEIssuer(cmCfg, acmeCfg)}
 
 	tlsConfig := cmCfg.TLSConfig()
-	err := cmCfg.ManageSync(context.Background(), []string{s.cfg.Domain})
+	err := cmCfg.ManageSync(context.Background(), s.cfg.ManagedDomains())
 	if err != nil {
 		return nil, cache, err
 	}
@@ -144,12 +205,19 @@ func (s *Server) statsLoop() {
 				"tcp", snap.ServerTCPStreams,
 				"udp", snap.ServerUDPStreams,
 				"icmp", snap.ServerICMPStreams,
+				"bind", snap.ServerBindStreams,
+				"reverse", snap.ServerReverseStreams,
 				"hserr", snap.ServerHandshakeErrors,
 				"fallback", snap.ServerFallbackPages,
 				"probe", snap.ServerProbes,
 				"padding", stats.HumanBytes(snap.PaddingBytes),
 				"records", snap.RecordsWritten,
 			)
+			for _, u := range snap.Users {
+				log.Info("[SERVER_STATS] user", "name", u.Name, "conns", u.Connections,
+					"up", stats.HumanBytes(u.BytesUp), "down", stats.HumanBytes(u.BytesDown))
+			}
+			s.saveQuota()
 		case <-s.statsDone:
 			return
 		}
@@ -222,13 +290,18 @@ func shouldRetryFreshCertificate(err error) bool {
 		strings.Contains(msg, "requested certificate was not found")
 }
 
-func cleanCertmagicDomainAssets(ctx context.Context, storage certmagic.Storage, domain string) error {
-	issuerKey := (&certmagic.ACMEIssuer{CA: certmagic.DefaultACME.CA}).IssuerKey()
-	keys := []string{
-		certmagic.StorageKeys.SiteCert(issuerKey, domain),
-		certmagic.StorageKeys.SitePrivateKey(issuerKey, domain),
-		certmagic.StorageKeys.SiteMeta(issuerKey, domain),
-		certmagic.StorageKeys.CertsSitePrefix(issuerKey, domain),
+// cleanCertmagicDomainAssets deletes the stored certificates of domains
+// issued by the ACME directory.
+func cleanCertmagicDomainAssets(ctx context.Context, storage certmagic.Storage, directory string, domains []string) error {
+	issuerKey := (&certmagic.ACMEIssuer{CA: directory}).IssuerKey()
+	var keys []string
+	for _, domain := range domains {
+		keys = append(keys,
+			certmagic.StorageKeys.SiteCert(issuerKey, domain),
+			certmagic.StorageKeys.SitePrivateKey(issuerKey, domain),
+			certmagic.StorageKeys.SiteMeta(issuerKey, domain),
+			certmagic.StorageKeys.CertsSitePrefix(issuerKey, domain),
+		)
 	}
 	var lastErr error
 	for _, key := range keys {
@@ -243,15 +316,37 @@ func (s *Server) Start() error {
 	cfg := s.cfg
 	log.Info("[SERVER] starting", "listen", cfg.Listen, "domain", cfg.Domain, "timeout", cfg.Timeout)
 
-	tlsConfig, err := s.initTLS()
-	if err != nil {
-		log.Error("[SERVER] init TLS failed", "err", err)
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if err := s.takeUpgradeSockets(); err != nil {
 		return err
 	}
-	if cfg.CertPath != "" && cfg.KeyPath != "" {
-		log.Info("[SERVER] TLS mode: cert files", "cert", cfg.CertPath, "key", cfg.KeyPath)
-	} else {
-		log.Info("[SERVER] TLS mode: certmagic (Let's Encrypt)", "domain", cfg.Domain, "email", cfg.Email)
+
+	listenerCfgs, err := cfg.AllListeners()
+	if err != nil {
+		return fmt.Errorf("listeners: %w", err)
+	}
+	// TLS is left to the reverse proxy in front of h2c listeners.
+	var tlsConfig *tls.Config
+	started := false
+	if slices.ContainsFunc(listenerCfgs, func(lc config.ListenerConfig) bool { return lc.IsTLS() }) {
+		tlsConfig, err = s.initTLS()
+		if err != nil {
+			log.Error("[SERVER] init TLS failed", "err", err)
+			return err
+		}
+		defer func() {
+			if !started {
+				s.stopTLS()
+			}
+		}()
+		if !cfg.UseCertmagic() {
+			log.Info("[SERVER] TLS mode: cert files", "cert", cfg.CertPath, "key", cfg.KeyPath, "certificates", len(cfg.Certificates))
+		} else {
+			log.Info("[SERVER] TLS mode: certmagic (ACME)", "domains", cfg.ManagedDomains(), "email", cfg.Email,
+				"directory", acmeDirectory(cfg.ACME), "certificates", len(cfg.Certificates))
+		}
 	}
 
 	timeout := time.Duration(s.cfg.Timeout) * time.Second
@@ -266,29 +361,78 @@ func (s *Server) Start() error {
 		log.Info("[SERVER] fallback target configured", "target", s.cfg.FallbackTarget, "preserve_host", s.cfg.FallbackPreserveHost, "cdn_domains", s.cfg.FallbackCDNDomains)
 	}
 
-	masterKey, err := crypto.DeriveMasterKey(s.cfg.Password)
+	serverUsers, err := s.cfg.EnabledUsers()
 	if err != nil {
-		return fmt.Errorf("derive master key: %w", err)
+		return fmt.Errorf("users: %w", err)
+	}
+	users := make([]handler.User, 0, len(serverUsers))
+	names := make([]string, 0, len(serverUsers))
+	// Users added through the admin API may have quotas too.
+	needQuota := s.cfg.Admin != nil
+	s.masterKeys = make(map[string][]byte, len(serverUsers))
+	for _, u := range serverUsers {
+		masterKey, err := crypto.DeriveMasterKey(u.Password)
+		if err != nil {
+			return fmt.Errorf("derive master key of user %q: %w", u.Name, err)
+		}
+		users = append(users, handlerUser(u, masterKey))
+		s.masterKeys[u.Name] = masterKey
+		names = append(names, u.Name)
+		needQuota = needQuota || u.HasQuota()
+	}
+	log.Info("[SERVER] users configured", "users", names)
+	if needQuota {
+		if s.quota, err = quota.Open(s.cfg.GetQuotaFile()); err != nil {
+			return fmt.Errorf("quota file: %w", err)
+		}
+		log.Info("[SERVER] quota file loaded", "path", s.cfg.GetQuotaFile())
 	}
 
-	np, err := nextproxy.New(s.cfg.NextProxy.URL, s.cfg.NextProxy.EnableUDP, s.cfg.NextProxy.AllHost)
+	proxyCfgs, err := s.cfg.AllNextProxies()
 	if err != nil {
-		log.Error("[SERVER] next proxy init failed", "err", err)
 		return fmt.Errorf("next proxy: %w", err)
 	}
-	if np != nil {
-		if err := np.LoadProxyFile(s.cfg.NextProxy.NextProxyFile); err != nil {
-			log.Error("[SERVER] next proxy load file failed", "err", err)
-			return fmt.Errorf("next proxy load file: %w", err)
+	proxies := make([]*nextproxy.NextProxy, 0, len(proxyCfgs))
+	for _, pc := range proxyCfgs {
+		np, err := newNextProxy(pc, timeout)
+		if err != nil {
+			log.Error("[SERVER] next proxy init failed", "name", pc.Name, "err", err)
+			return fmt.Errorf("next proxy %q: %w", pc.Name, err)
 		}
-		np.SetDialTimeout(handler.DialTimeout(timeout))
-		log.Info("[SERVER] next proxy configured", "url", s.cfg.NextProxy.URL, "udp", s.cfg.NextProxy.EnableUDP, "all_host", s.cfg.NextProxy.AllHost)
+		proxies = append(proxies, np)
+	}
+	nextProxies := nextproxy.NewGroup(proxies...)
+
+	res, err := resolver.New(s.cfg.DNS)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	if res != nil {
+		log.Info("[SERVER] dns configured", "servers", s.cfg.DNS.Servers, "strategy", s.cfg.DNS.Strategy,
+			"hosts", len(s.cfg.DNS.Hosts), "cache", !s.cfg.DNS.DisableCache)
+	}
+
+	router, err := outbound.New(s.cfg.OutboundRules, s.cfg.GeoIPFile)
+	if err != nil {
+		return fmt.Errorf("outbound rules: %w", err)
+	}
+	if res != nil {
+		router.SetLookupIP(res.LookupIP)
+	}
+	for _, name := range router.Proxies() {
+		if nextProxies.Get(name) == nil {
+			return fmt.Errorf("outbound rules: unknown next proxy %q", name)
+		}
+	}
+	if router != nil {
+		log.Info("[SERVER] outbound rules configured", "rules", len(s.cfg.OutboundRules))
 	}
 
 	streamIdleTimeout := 10 * timeout
 
-	proxyHandler := handler.NewProxyHandler(handler.ProxyHandlerConfig{
-		MasterKey:         masterKey,
+	s.nextProxies = nextProxies
+	s.proxyHandler = handler.NewProxyHandler(handler.ProxyHandlerConfig{
+		Users:             users,
 		AllowedMethods:    s.cfg.GetAllowedMethods(),
 		HandshakeTimeout:  timeout,
 		Timeout:           timeout,
@@ -297,14 +441,17 @@ func (s *Server) Start() error {
 		BatchWindowMS:     s.cfg.BatchWindowMS,
 		CoverBudgetRatio:  s.cfg.CoverBudgetRatio,
 		CoverBudgetCap:    s.cfg.CoverBudgetCap,
-		NextProxy:         np,
+		NextProxies:       nextProxies,
+		Resolver:          res,
+		Outbound:          router,
+		Quota:             s.quota,
 	})
 
 	probePayload := make([]byte, sharedconfig.ProbePayloadSize)
 	if _, err := io.ReadFull(rand.Reader, probePayload); err != nil {
 		return fmt.Errorf("generate probe payload: %w", err)
 	}
-	probeHandler, err := handler.NewProbeHandler(masterKey, probePayload)
+	s.probeHandler, err = handler.NewProbeHandler(s.probeKeys(), probePayload)
 	if err != nil {
 		return fmt.Errorf("probe handler: %w", err)
 	}
@@ -313,28 +460,85 @@ func (s *Server) Start() error {
 	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		handler.ServeFallback(w, r)
 	})
-	s.mux.Handle(sharedconfig.EndpointTCP, proxyHandler)
-	s.mux.Handle(sharedconfig.EndpointUDP, proxyHandler)
-	s.mux.Handle(sharedconfig.EndpointICMP, proxyHandler)
-	s.mux.Handle(sharedconfig.EndpointProbe, probeHandler)
-
-	s.httpServer = buildHTTPServer(cfg, tlsConfig, s.mux, timeout)
+	s.mux.Handle(sharedconfig.EndpointTCP, s.proxyHandler)
+	s.mux.Handle(sharedconfig.EndpointUDP, s.proxyHandler)
+	s.mux.Handle(sharedconfig.EndpointICMP, s.proxyHandler)
+	s.mux.Handle(sharedconfig.EndpointBind, s.proxyHandler)
+	s.mux.Handle(sharedconfig.EndpointReverse, s.proxyHandler)
+	s.mux.Handle(sharedconfig.EndpointProbe, s.probeHandler)
+
+	ppTrusted, err := s.proxyProtocolTrusted()
+	if err != nil {
+		return fmt.Errorf("proxy protocol: %w", err)
+	}
+	if err := s.openListeners(listenerCfgs, tlsConfig, ppTrusted, timeout); err != nil {
+		return err
+	}
 
-	log.Info("[SERVER] listening", "addr", s.cfg.Listen, "routes", []string{"/", sharedconfig.EndpointTCP, sharedconfig.EndpointUDP, sharedconfig.EndpointICMP, sharedconfig.EndpointProbe})
+	log.Info("[SERVER] listening", "listeners", len(s.listeners), "routes", []string{"/", sharedconfig.EndpointTCP, sharedconfig.EndpointUDP, sharedconfig.EndpointICMP, sharedconfig.EndpointBind, sharedconfig.EndpointReverse, sharedconfig.EndpointProbe})
+	if s.cfg.Admin != nil {
+		if err := s.startAdmin(); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+	s.nextProxies.StartHealthChecks()
 	s.statsDone = make(chan struct{})
 	go s.statsLoop()
-	return s.httpServer.ListenAndServeTLS("", "")
+	started = true
+	s.notifyUpgradeReady()
+	return s.serve()
+}
+
+// stopTLS stops renewing the certmagic certificates and watching the
+// certificate files.
+func (s *Server) stopTLS() {
+	if s.certCache != nil {
+		s.certCache.Stop()
+		s.certCache = nil
+	}
+	if s.certStore != nil {
+		s.certStore.Close()
+	}
+}
+
+// newNextProxy creates the next proxy of pc and loads its host file.
+func newNextProxy(pc config.NextProxyConfig, timeout time.Duration) (*nextproxy.NextProxy, error) {
+	np, err := nextproxy.New(pc.URL, pc.EnableUDP, pc.AllHost)
+	if err != nil {
+		return nil, err
+	}
+	np.SetName(pc.Name)
+	np.SetFailover(pc.Failover)
+	np.SetDialTimeout(handler.DialTimeout(timeout))
+	if np.URL().Scheme == "easyss" {
+		upstream, err := easyss.New(np.URL(), timeout)
+		if err != nil {
+			return nil, err
+		}
+		np.SetUpstream(upstream)
+	}
+	if pc.HealthCheckInterval > 0 {
+		np.SetHealthCheck(time.Duration(pc.HealthCheckInterval)*time.Second, pc.HealthCheckTarget)
+	}
+	if err := np.LoadProxyFile(pc.NextProxyFile); err != nil {
+		log.Error("[SERVER] next proxy load file failed", "name", pc.Name, "err", err)
+		return nil, fmt.Errorf("load file: %w", err)
+	}
+	log.Info("[SERVER] next proxy configured", "name", pc.Name, "url", np.URL().Redacted(), "udp", pc.EnableUDP,
+		"all_host", pc.AllHost, "failover", pc.Failover)
+	return np, nil
 }
 
 // buildHTTPServer assembles the HTTP server with HTTP/2 flow-control windows
 // sized for upload throughput: the per-stream receive window bounds a single
 // upload stream's in-flight data (throughput ≈ window/RTT), so both windows
 // must be generous enough for high-RTT links.
-func buildHTTPServer(cfg *config.ServerConfig, tlsConfig *tls.Config, mux *http.ServeMux, timeout time.Duration) *http.Server {
+func buildHTTPServer(cfg *config.ServerConfig, tlsConfig *tls.Config, h http.Handler, timeout time.Duration) *http.Server {
 	srv := &http.Server{
 		Addr:      cfg.Listen,
 		TLSConfig: tlsConfig,
-		Handler:   mux,
+		Handler:   h,
 		ErrorLog:  stdErrorLog(),
 		Protocols: &http.Protocols{},
 		HTTP2: &http.HTTP2Config{
@@ -350,8 +554,17 @@ func buildHTTPServer(cfg *config.ServerConfig, tlsConfig *tls.Config, mux *http.
 	return srv
 }
 
+// Shutdown drains the server: new handshakes get the fallback page, the
+// listeners stop accepting, HTTP/2 connections get a GOAWAY, and the
+// active streams have until ctx is done to finish, after which they are
+// ended and the remaining connections closed.
 func (s *Server) Shutdown(ctx context.Context) error {
-	log.Info("[SERVER] shutting down")
+	streams := 0
+	if s.proxyHandler != nil {
+		s.proxyHandler.Drain()
+		streams = len(s.proxyHandler.Streams())
+	}
+	log.Info("[SERVER] shutting down", "streams", streams)
 
 	// Stop the stats loop goroutine so it doesn't leak past shutdown.
 	s.statsOnce.Do(func() {
@@ -360,14 +573,46 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		}
 	})
 
-	if s.certCache != nil {
-		s.certCache.Stop()
-		s.certCache = nil
+	s.stopTLS()
+	s.stopAdmin(ctx)
+	err := s.drain(ctx)
+	_ = s.nextProxies.Close()
+	s.saveQuota()
+	return err
+}
+
+// drain shuts the HTTP servers down, waiting for their connections until
+// ctx is done, then ends the streams left and closes their connections.
+func (s *Server) drain(ctx context.Context) error {
+	errs := make([]error, len(s.listeners))
+	var wg sync.WaitGroup
+	for i, l := range s.listeners {
+		wg.Go(func() { errs[i] = l.srv.Shutdown(ctx) })
+	}
+	wg.Wait()
+	if ctx.Err() == nil {
+		return errors.Join(errs...)
+	}
+
+	killed := 0
+	if s.proxyHandler != nil {
+		killed = s.proxyHandler.KillStreams()
+	}
+	log.Warn("[SERVER] drain deadline reached, ending streams", "streams", killed)
+	for _, l := range s.listeners {
+		_ = l.srv.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// saveQuota persists the users' traffic, if any user has a quota.
+func (s *Server) saveQuota() {
+	if s.quota == nil {
+		return
 	}
-	if s.httpServer != nil {
-		return s.httpServer.Shutdown(ctx)
+	if err := s.quota.Save(); err != nil {
+		log.Error("[SERVER] save quota file", "err", err)
 	}
-	return nil
 }
 
 // stdErrorLog routes Go's internal http.Server/HTTP2 logs (connection-level
@@ -1,15 +1,21 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/pem"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime/pprof"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,23 +37,38 @@ func TestShouldRetryFreshCertificate(t *testing.T) {
 }
 
 func TestCleanCertmagicDomainAssets(t *testing.T) {
-	storage := &certmagic.FileStorage{Path: t.TempDir()}
-	domain := "example.com"
-	issuerKey := (&certmagic.ACMEIssuer{CA: certmagic.DefaultACME.CA}).IssuerKey()
-
-	keys := []string{
-		certmagic.StorageKeys.SiteCert(issuerKey, domain),
-		certmagic.StorageKeys.SitePrivateKey(issuerKey, domain),
-		certmagic.StorageKeys.SiteMeta(issuerKey, domain),
-	}
-	for _, key := range keys {
-		require.NoError(t, storage.Store(context.Background(), key, []byte("test")))
-		require.True(t, storage.Exists(context.Background(), key))
+	domains := []string{"example.com", "*.example.com"}
+	siteKeys := func(directory string) []string {
+		issuerKey := (&certmagic.ACMEIssuer{CA: directory}).IssuerKey()
+		var keys []string
+		for _, domain := range domains {
+			keys = append(keys,
+				certmagic.StorageKeys.SiteCert(issuerKey, domain),
+				certmagic.StorageKeys.SitePrivateKey(issuerKey, domain),
+				certmagic.StorageKeys.SiteMeta(issuerKey, domain),
+			)
+		}
+		return keys
 	}
 
-	require.NoError(t, cleanCertmagicDomainAssets(context.Background(), storage, domain))
-	for _, key := range keys {
-		require.False(t, storage.Exists(context.Background(), key))
+	for _, directory := range []string{certmagic.DefaultACME.CA, "https://ca.internal:9000/acme/acme/directory"} {
+		t.Run(directory, func(t *testing.T) {
+			storage := &certmagic.FileStorage{Path: t.TempDir()}
+			// The certificates of another issuer are kept.
+			other := siteKeys(certmagic.ZeroSSLProductionCA)
+			keys := siteKeys(directory)
+			for _, key := range append(slices.Clone(keys), other...) {
+				require.NoError(t, storage.Store(context.Background(), key, []byte("test")))
+			}
+
+			require.NoError(t, cleanCertmagicDomainAssets(context.Background(), storage, directory, domains))
+			for _, key := range keys {
+				require.False(t, storage.Exists(context.Background(), key), key)
+			}
+			for _, key := range other {
+				require.True(t, storage.Exists(context.Background(), key), key)
+			}
+		})
 	}
 }
 
@@ -235,3 +256,71 @@ func TestServerUploadFlowControlWindowsOnWire(t *testing.T) {
 	require.GreaterOrEqual(t, connWindow, 2<<20,
 		"connection upload window must be >= 2MB")
 }
+
+// TestShutdownDrainDeadline verifies that Shutdown waits for the active
+// requests until its context is done, then closes their connections.
+func TestShutdownDrainDeadline(t *testing.T) {
+	started := make(chan struct{})
+	ended := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_ = http.NewResponseController(w).Flush()
+		close(started)
+		<-r.Context().Done()
+		close(ended)
+	})
+	s := &Server{cfg: &config.ServerConfig{}, mux: mux}
+	require.NoError(t, s.openListeners([]config.ListenerConfig{{Type: config.ListenerH2C, Address: "127.0.0.1:0"}}, nil, nil, 30*time.Second))
+	go s.serve() //nolint:errcheck
+
+	go func() {
+		resp, err := http.Get("http://" + s.listeners[0].ln.Addr().String() + "/")
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	err := s.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.GreaterOrEqual(t, time.Since(begin), 200*time.Millisecond, "active requests get the drain timeout")
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still running after the drain deadline")
+	}
+}
+
+func TestStartFailureStopsCertificateWatch(t *testing.T) {
+	dir := t.TempDir()
+	cert := selfSignedTLSConfig(t).Certificates[0]
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	certPath := filepath.Join(dir, "server.crt")
+	keyPath := filepath.Join(dir, "server.key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	// The users are checked after TLS is set up.
+	s, err := New(&config.ServerConfig{
+		Listen:   "127.0.0.1:0",
+		CertPath: certPath,
+		KeyPath:  keyPath,
+		Users:    []config.ServerUser{{Name: "alice", Password: "a", DailyQuota: -1}},
+	})
+	require.NoError(t, err)
+	require.ErrorContains(t, s.Start(), "negative limit")
+	require.NotNil(t, s.certStore)
+
+	watching := func() bool {
+		var buf bytes.Buffer
+		require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 2))
+		return strings.Contains(buf.String(), "certstore.(*Store).Watch")
+	}
+	require.Eventually(t, func() bool { return !watching() }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/proxyproto"
+)
+
+const (
+	// envUpgradeListeners carries the addresses of the sockets a process
+	// upgrading to a new one hands over, JSON encoded. The sockets are the
+	// file descriptors from listenFDStart, in the same order.
+	envUpgradeListeners = "EASYSS_UPGRADE_LISTENERS"
+	// envUpgradeReady is the file descriptor the new process writes to
+	// once it serves on the sockets.
+	envUpgradeReady = "EASYSS_UPGRADE_READY_FD"
+	// adminSocketKey is the address under which the admin API socket is
+	// handed over.
+	adminSocketKey = "admin"
+)
+
+// Upgrade starts the executable of this process again, with the same
+// arguments, and hands it the listening sockets, so a new binary takes
+// over without refusing any connection. It returns once the new process
+// serves, within timeout; the caller then drains this server with
+// Shutdown. On error this server keeps serving.
+func (s *Server) Upgrade(timeout time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("upgrade: %w", err)
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	var addrs []string
+	add := func(addr string, ln net.Listener) error {
+		f, err := listenerFile(ln)
+		if err != nil {
+			return fmt.Errorf("upgrade: listener %s: %w", addr, err)
+		}
+		files = append(files, f)
+		addrs = append(addrs, addr)
+		return nil
+	}
+	for _, l := range s.listeners {
+		if err := add(l.cfg.Address, l.ln); err != nil {
+			return err
+		}
+	}
+	if s.adminListener != nil {
+		if err := add(adminSocketKey, s.adminListener); err != nil {
+			return err
+		}
+	}
+	encoded, err := json.Marshal(addrs)
+	if err != nil {
+		return fmt.Errorf("upgrade: %w", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("upgrade: %w", err)
+	}
+	defer readyR.Close() //nolint:errcheck
+
+	// The new process loads the traffic of the users with their quotas.
+	s.saveQuota()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(slices.Clone(files), readyW)
+	cmd.Env = append(upgradeEnv(os.Environ()),
+		envUpgradeListeners+"="+string(encoded),
+		envUpgradeReady+"="+strconv.Itoa(listenFDStart+len(files)))
+	err = cmd.Start()
+	_ = readyW.Close()
+	if err != nil {
+		return fmt.Errorf("upgrade: start %s: %w", exe, err)
+	}
+	log.Info("[SERVER] upgrade started", "exe", exe, "pid", cmd.Process.Pid, "sockets", addrs)
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			_ = cmd.Wait()
+			return fmt.Errorf("upgrade: new process exited before serving: %s", cmd.ProcessState)
+		}
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("upgrade: new process not serving after %s", timeout)
+	}
+	log.Info("[SERVER] upgrade done, new process serving", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// upgradeEnv returns env without the variables handing sockets over,
+// which are set again for the new process; systemd sockets are handed
+// over by address like the others.
+func upgradeEnv(env []string) []string {
+	return slices.DeleteFunc(slices.Clone(env), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		switch name {
+		case envUpgradeListeners, envUpgradeReady, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES":
+			return true
+		}
+		return false
+	})
+}
+
+// listenerFile returns a duplicate of the socket of ln. The socket file
+// of a Unix listener is kept when ln closes, for the new process.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	if pl, ok := ln.(*proxyproto.Listener); ok {
+		ln = pl.Listener
+	}
+	switch l := ln.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, errors.New("socket cannot be handed over")
+}
+
+// takeUpgradeSockets takes the sockets handed over by the process this
+// one upgrades, if any, by address.
+func (s *Server) takeUpgradeSockets() error {
+	encoded := os.Getenv(envUpgradeListeners)
+	ready := os.Getenv(envUpgradeReady)
+	_ = os.Unsetenv(envUpgradeListeners)
+	_ = os.Unsetenv(envUpgradeReady)
+	if encoded == "" {
+		return nil
+	}
+	fds, readyFD, err := parseUpgradeSockets(encoded, ready)
+	if err != nil {
+		return err
+	}
+	s.upgradeFDs, s.upgradeReadyFD = fds, readyFD
+	log.Info("[SERVER] taking over sockets", "sockets", len(fds))
+	return nil
+}
+
+func parseUpgradeSockets(encoded, ready string) (map[string]int, int, error) {
+	var addrs []string
+	if err := json.Unmarshal([]byte(encoded), &addrs); err != nil {
+		return nil, 0, fmt.Errorf("upgrade sockets: %w", err)
+	}
+	readyFD, err := strconv.Atoi(ready)
+	if err != nil || readyFD != listenFDStart+len(addrs) {
+		return nil, 0, fmt.Errorf("upgrade sockets: invalid ready fd %q", ready)
+	}
+	fds := make(map[string]int, len(addrs))
+	for i, addr := range addrs {
+		fds[addr] = listenFDStart + i
+	}
+	return fds, readyFD, nil
+}
+
+// upgradeSocket returns the listener of the socket handed over for addr,
+// nil if there is none.
+func (s *Server) upgradeSocket(addr string) (net.Listener, error) {
+	fd, ok := s.upgradeFDs[addr]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.upgradeFDs, addr)
+	return fileListener(fd, addr)
+}
+
+// notifyUpgradeReady tells the process this one upgrades that it serves,
+// and closes the handed over sockets no longer configured.
+func (s *Server) notifyUpgradeReady() {
+	if s.upgradeReadyFD == 0 {
+		return
+	}
+	for addr, fd := range s.upgradeFDs {
+		log.Warn("[SERVER] handed over socket not configured, closing", "addr", addr)
+		_ = os.NewFile(uintptr(fd), addr).Close()
+	}
+	s.upgradeFDs = nil
+	f := os.NewFile(uintptr(s.upgradeReadyFD), "upgrade-ready")
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Error("[SERVER] notify upgrade ready", "err", err)
+	}
+	_ = f.Close()
+	s.upgradeReadyFD = 0
+}
+
+// fileListener returns a listener on the socket of the inherited fd.
+func fileListener(fd int, name string) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close() //nolint:errcheck
+	return net.FileListener(f)
+}
@@ -0,0 +1,157 @@
+//go:build !windows
+
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/quota"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUpgradeSockets(t *testing.T) {
+	fds, ready, err := parseUpgradeSockets(`[":443","unix:/run/easyss.sock","admin"]`, "6")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{":443": 3, "unix:/run/easyss.sock": 4, "admin": 5}, fds)
+	require.Equal(t, 6, ready)
+
+	_, _, err = parseUpgradeSockets(`[":443"]`, "5")
+	require.Error(t, err)
+	_, _, err = parseUpgradeSockets(`:443`, "4")
+	require.Error(t, err)
+}
+
+func TestUpgradeEnv(t *testing.T) {
+	env := upgradeEnv([]string{"HOME=/root", envUpgradeListeners + "=[]", envUpgradeReady + "=3", "LISTEN_FDS=1", "LISTEN_PID=1"})
+	require.Equal(t, []string{"HOME=/root"}, env)
+}
+
+func TestListenerFileKeepsUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "easyss")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "h2c.sock")
+
+	ln, err := listen(config.ListenerConfig{Type: config.ListenerH2C, Address: "unix:" + sock}, nil)
+	require.NoError(t, err)
+	f, err := listenerFile(ln)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, ln.Close())
+	_, err = os.Stat(sock)
+	require.NoError(t, err, "the new process still serves on the socket")
+}
+
+// dupFD returns a duplicate of the descriptor of f and closes f, as if the
+// descriptor were inherited.
+func dupFD(t *testing.T, f *os.File) int {
+	t.Helper()
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return fd
+}
+
+func TestUpgradeHandover(t *testing.T) {
+	old, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := old.Addr().String()
+	f, err := listenerFile(old)
+	require.NoError(t, err)
+	stale, err := listenerFile(old)
+	require.NoError(t, err)
+	readyR, readyW, err := os.Pipe()
+	require.NoError(t, err)
+	defer readyR.Close() //nolint:errcheck
+
+	s := &Server{
+		cfg:            &config.ServerConfig{},
+		mux:            http.NewServeMux(),
+		upgradeFDs:     map[string]int{addr: dupFD(t, f), "127.0.0.1:1": dupFD(t, stale)},
+		upgradeReadyFD: dupFD(t, readyW),
+	}
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "new process")
+	})
+	require.NoError(t, s.openListeners([]config.ListenerConfig{{Type: config.ListenerH2C, Address: addr}}, nil, nil, 30*time.Second))
+	go s.serve() //nolint:errcheck
+	t.Cleanup(func() { _ = s.listeners[0].srv.Close() })
+
+	s.notifyUpgradeReady()
+	require.Empty(t, s.upgradeFDs)
+	b := make([]byte, 1)
+	n, err := readyR.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// The old process stops; connections keep being accepted.
+	require.NoError(t, old.Close())
+	resp, err := http.Get("http://" + addr + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close() //nolint:errcheck
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "new process", string(body))
+}
+
+// envTestQuotaFile passes the quota file of TestUpgradeQuota to the new
+// process, which runs the test again.
+const envTestQuotaFile = "EASYSS_TEST_QUOTA_FILE"
+
+func TestUpgradeQuota(t *testing.T) {
+	if os.Getenv(envUpgradeListeners) != "" {
+		upgradedQuotaProcess(t)
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "quota.json")
+	t.Setenv(envTestQuotaFile, path)
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestUpgradeQuota$"}
+	t.Cleanup(func() { os.Args = args })
+
+	store, err := quota.Open(path)
+	require.NoError(t, err)
+	s := &Server{cfg: &config.ServerConfig{QuotaFile: path}, mux: http.NewServeMux(), quota: store}
+	require.NoError(t, s.openListeners([]config.ListenerConfig{{Type: config.ListenerH2C, Address: "127.0.0.1:0"}}, nil, nil, 30*time.Second))
+	go s.serve() //nolint:errcheck
+
+	s.quota.Add("alice", 100)
+	require.NoError(t, s.Upgrade(30*time.Second))
+	// Traffic of the streams drained after the new process took over.
+	s.quota.Add("alice", 5)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	saved, err := quota.Open(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(125), saved.Usage("alice").DayBytes)
+}
+
+// upgradedQuotaProcess is the new process of TestUpgradeQuota. It does not
+// tell the old process it serves when the traffic saved by it is missing.
+func upgradedQuotaProcess(t *testing.T) {
+	s := &Server{cfg: &config.ServerConfig{QuotaFile: os.Getenv(envTestQuotaFile)}, mux: http.NewServeMux()}
+	require.NoError(t, s.takeUpgradeSockets())
+	var err error
+	s.quota, err = quota.Open(s.cfg.GetQuotaFile())
+	require.NoError(t, err)
+	require.Equal(t, int64(100), s.quota.Usage("alice").DayBytes)
+
+	s.quota.Add("alice", 20)
+	s.saveQuota()
+	for addr := range s.upgradeFDs {
+		require.NoError(t, s.openListeners([]config.ListenerConfig{{Type: config.ListenerH2C, Address: addr}}, nil, nil, 30*time.Second))
+	}
+	s.notifyUpgradeReady()
+}
@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// rttBuckets are the upper bounds of the RTT histogram, in seconds.
+	rttBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 1, 2, 5}
+	// streamDurationBuckets are the upper bounds of the stream duration
+	// histogram, in seconds: short web requests up to long-lived tunnels.
+	streamDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+)
+
+// histogram counts durations into fixed buckets.
+type histogram struct {
+	bounds []float64
+	// counts has one counter per bound plus one for +Inf; they are not
+	// cumulative.
+	counts []atomic.Int64
+	count  atomic.Int64
+	sumNS  atomic.Int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sumNS.Add(int64(d))
+}
+
+func (h *histogram) reset() {
+	for i := range h.counts {
+		h.counts[i].Store(0)
+	}
+	h.count.Store(0)
+	h.sumNS.Store(0)
+}
+
+// Histogram is a point-in-time copy of a duration histogram. Counts are
+// cumulative: Counts[i] is the number of observations <= Bounds[i].
+type Histogram struct {
+	Bounds []float64
+	Counts []int64
+	Count  int64
+	// Sum is the total of the observations, in seconds.
+	Sum float64
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Bounds: h.bounds, Counts: make([]int64, len(h.bounds))}
+	var cum int64
+	for i := range h.bounds {
+		cum += h.counts[i].Load()
+		s.Counts[i] = cum
+	}
+	s.Count = cum + h.counts[len(h.bounds)].Load()
+	s.Sum = time.Duration(h.sumNS.Load()).Seconds()
+	return s
+}
+
+var (
+	rttHist = newHistogram(rttBuckets)
+
+	streamDurationsMu sync.Mutex
+	streamDurations   = make(map[string]*histogram)
+)
+
+// RecordStreamDuration records the lifetime of a finished stream of the
+// given endpoint, e.g. "/v3/tcp".
+func RecordStreamDuration(endpoint string, d time.Duration) {
+	streamDurationsMu.Lock()
+	h, ok := streamDurations[endpoint]
+	if !ok {
+		h = newHistogram(streamDurationBuckets)
+		streamDurations[endpoint] = h
+	}
+	streamDurationsMu.Unlock()
+	h.observe(d)
+}
+
+// collectStreamDurations returns the stream duration histograms by
+// endpoint, nil if none.
+func collectStreamDurations() map[string]Histogram {
+	streamDurationsMu.Lock()
+	defer streamDurationsMu.Unlock()
+	if len(streamDurations) == 0 {
+		return nil
+	}
+	out := make(map[string]Histogram, len(streamDurations))
+	for endpoint, h := range streamDurations {
+		out[endpoint] = h.snapshot()
+	}
+	return out
+}
+
+func resetHistograms() {
+	rttHist.reset()
+	streamDurationsMu.Lock()
+	defer streamDurationsMu.Unlock()
+	for _, h := range streamDurations {
+		h.reset()
+	}
+}
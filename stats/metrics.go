@@ -0,0 +1,186 @@
+package stats
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsContentType is the content type of the Prometheus text exposition
+// format written by WriteMetrics.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteMetrics writes snap in the Prometheus text exposition format. Every
+// metric is written on both sides; those of the other side stay zero.
+func WriteMetrics(w io.Writer, snap Snapshot) error {
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+
+	m.counter("easyss_streams_opened_total", "Streams opened to the server.", snap.TotalStreamsOpened)
+	m.counter("easyss_streams_closed_total", "Streams closed.", snap.TotalStreamsClosed)
+	m.gauge("easyss_streams_active", "Streams opened but not yet closed.", float64(snap.ActiveStreamsCount()))
+	m.family("easyss_pool_streams_opened_total", "counter", "Streams opened per connection pool.")
+	m.sample("easyss_pool_streams_opened_total", labels("pool", "priority"), float64(snap.PriorityStreamsOpened))
+	m.sample("easyss_pool_streams_opened_total", labels("pool", "bulk"), float64(snap.BulkStreamsOpened))
+	m.family("easyss_pool_fallback_total", "counter", "Streams placed on the other pool because their own was unavailable.")
+	m.sample("easyss_pool_fallback_total", labels("pool", "priority"), float64(snap.PriorityFallback))
+	m.sample("easyss_pool_fallback_total", labels("pool", "bulk"), float64(snap.BulkFallback))
+	m.family("easyss_pool_conns", "gauge", "Transport connections per pool.")
+	m.sample("easyss_pool_conns", labels("pool", "priority"), float64(snap.PriorityConns))
+	m.sample("easyss_pool_conns", labels("pool", "bulk"), float64(snap.BulkConns))
+	m.family("easyss_pool_active_streams", "gauge", "Active streams per pool.")
+	m.sample("easyss_pool_active_streams", labels("pool", "priority"), float64(snap.PriorityActiveStreams))
+	m.sample("easyss_pool_active_streams", labels("pool", "bulk"), float64(snap.BulkActiveStreams))
+
+	m.counter("easyss_bytes_sent_total", "Payload bytes sent through streams.", snap.BytesSent)
+	m.counter("easyss_bytes_recv_total", "Payload bytes received through streams.", snap.BytesRecv)
+	m.counter("easyss_raw_bytes_sent_total", "Bytes sent on the wire, including encryption and padding.", snap.RawBytesSent)
+	m.counter("easyss_raw_bytes_recv_total", "Bytes received on the wire, including encryption and padding.", snap.RawBytesRecv)
+	m.counter("easyss_padding_bytes_total", "Padding bytes written.", snap.PaddingBytes)
+	m.counter("easyss_records_written_total", "Encrypted records written.", snap.RecordsWritten)
+	m.counter("easyss_tcp_connections_total", "Local TCP connections accepted.", snap.TCPConnections)
+	m.counter("easyss_udp_associations_total", "Local UDP associations created.", snap.UDPAssociations)
+	m.gauge("easyss_upload_speed_bytes", "Smoothed upload speed in bytes per second.", float64(snap.UploadSpeed))
+	m.gauge("easyss_download_speed_bytes", "Smoothed download speed in bytes per second.", float64(snap.DownloadSpeed))
+
+	m.counter("easyss_dns_cache_hits_total", "DNS answers served from the cache.", snap.DNSCacheHits)
+	m.counter("easyss_dns_cache_misses_total", "DNS lookups missing the cache.", snap.DNSCacheMisses)
+	m.counter("easyss_dns_prefetches_total", "DNS cache entries refreshed before expiry.", snap.DNSPrefetches)
+	m.counter("easyss_dns_stale_served_total", "Expired DNS answers served while refreshing.", snap.DNSStaleServed)
+	m.family("easyss_dns_queries_total", "counter", "DNS queries sent upstream per route.")
+	m.sample("easyss_dns_queries_total", labels("route", "proxy"), float64(snap.DNSProxyQueries))
+	m.sample("easyss_dns_queries_total", labels("route", "direct"), float64(snap.DNSDirectQueries))
+
+	m.family("easyss_tier_scheduled_total", "counter", "Streams scheduled onto a non-active health tier.")
+	m.sample("easyss_tier_scheduled_total", labels("tier", "expiring"), float64(snap.TierExpiringScheduled))
+	m.sample("easyss_tier_scheduled_total", labels("tier", "heavy"), float64(snap.TierHeavyScheduled))
+	m.sample("easyss_tier_scheduled_total", labels("tier", "degraded"), float64(snap.TierDegradedScheduled))
+	m.counter("easyss_slot_degraded_total", "Transport slots marked degraded.", snap.SlotDegraded)
+	m.counter("easyss_slot_retired_degraded_total", "Degraded transport slots retired.", snap.SlotRetiredDegraded)
+	m.counter("easyss_conn_rotated_total", "Transport connections rotated.", snap.ConnRotated)
+	m.counter("easyss_slot_probes_total", "Health probes sent on transport slots.", snap.SlotProbes)
+	m.counter("easyss_slot_probe_slow_total", "Health probes slower than the degraded threshold.", snap.SlotProbeSlow)
+	m.counter("easyss_slot_probe_unsupported_total", "Health probes the server did not support.", snap.SlotProbeUnsupported)
+
+	m.gauge("easyss_rtt_ewma_seconds", "Smoothed client to server path RTT.", snap.AvgRTT().Seconds())
+	m.histogram("easyss_rtt_seconds", "Client to server path RTT samples.", snap.RTTHistogram)
+	m.family("easyss_stream_duration_seconds", "histogram", "Lifetime of finished streams per endpoint.")
+	endpoints := make([]string, 0, len(snap.StreamDurations))
+	for endpoint := range snap.StreamDurations {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		m.histogramSamples("easyss_stream_duration_seconds", labels("endpoint", path.Base(endpoint)), snap.StreamDurations[endpoint])
+	}
+
+	m.family("easyss_server_streams_total", "counter", "Streams accepted by the server per endpoint.")
+	for _, s := range []struct {
+		endpoint string
+		n        int64
+	}{
+		{"tcp", snap.ServerTCPStreams},
+		{"udp", snap.ServerUDPStreams},
+		{"icmp", snap.ServerICMPStreams},
+		{"bind", snap.ServerBindStreams},
+		{"reverse", snap.ServerReverseStreams},
+	} {
+		m.sample("easyss_server_streams_total", labels("endpoint", s.endpoint), float64(s.n))
+	}
+	m.counter("easyss_server_handshake_errors_total", "Requests rejected during the handshake.", snap.ServerHandshakeErrors)
+	m.counter("easyss_server_fallback_pages_total", "Fallback pages served.", snap.ServerFallbackPages)
+	m.counter("easyss_server_probes_total", "Health probes answered by the server.", snap.ServerProbes)
+
+	m.family("easyss_user_connections_total", "counter", "Connections per user.")
+	for _, u := range snap.Users {
+		m.sample("easyss_user_connections_total", labels("user", u.Name), float64(u.Connections))
+	}
+	m.family("easyss_user_bytes_total", "counter", "Bytes per user and direction: up is from the user, down towards it.")
+	for _, u := range snap.Users {
+		m.sample("easyss_user_bytes_total", labels("user", u.Name, "direction", "up"), float64(u.BytesUp))
+		m.sample("easyss_user_bytes_total", labels("user", u.Name, "direction", "down"), float64(u.BytesDown))
+	}
+
+	m.gauge("easyss_uptime_seconds", "Seconds since the session or process started.", snap.UptimeSeconds)
+
+	if m.err != nil {
+		return m.err
+	}
+	return m.w.Flush()
+}
+
+// metricsWriter writes metric families, keeping the first write error.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (m *metricsWriter) write(parts ...string) {
+	if m.err != nil {
+		return
+	}
+	for _, p := range parts {
+		if _, m.err = m.w.WriteString(p); m.err != nil {
+			return
+		}
+	}
+}
+
+func (m *metricsWriter) family(name, typ, help string) {
+	m.write("# HELP ", name, " ", help, "\n# TYPE ", name, " ", typ, "\n")
+}
+
+func (m *metricsWriter) sample(name, labels string, v float64) {
+	m.write(name, labels, " ", strconv.FormatFloat(v, 'g', -1, 64), "\n")
+}
+
+func (m *metricsWriter) counter(name, help string, v int64) {
+	m.family(name, "counter", help)
+	m.sample(name, "", float64(v))
+}
+
+func (m *metricsWriter) gauge(name, help string, v float64) {
+	m.family(name, "gauge", help)
+	m.sample(name, "", v)
+}
+
+func (m *metricsWriter) histogram(name, help string, h Histogram) {
+	m.family(name, "histogram", help)
+	m.histogramSamples(name, "", h)
+}
+
+// histogramSamples writes the buckets, sum and count of h. labelSet is
+// either empty or a label set rendered by labels.
+func (m *metricsWriter) histogramSamples(name, labelSet string, h Histogram) {
+	prefix := "{"
+	if labelSet != "" {
+		prefix = strings.TrimSuffix(labelSet, "}") + ","
+	}
+	for i, bound := range h.Bounds {
+		m.sample(name+"_bucket", prefix+`le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"}`, float64(h.Counts[i]))
+	}
+	m.sample(name+"_bucket", prefix+`le="+Inf"}`, float64(h.Count))
+	m.sample(name+"_sum", labelSet, h.Sum)
+	m.sample(name+"_count", labelSet, float64(h.Count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders name/value pairs as a label set.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,109 @@
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramSnapshot(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(50 * time.Millisecond)
+	h.observe(100 * time.Millisecond)
+	h.observe(500 * time.Millisecond)
+	h.observe(2 * time.Second)
+
+	s := h.snapshot()
+	if s.Counts[0] != 2 || s.Counts[1] != 3 {
+		t.Fatalf("cumulative counts = %v, want [2 3]", s.Counts)
+	}
+	if s.Count != 4 {
+		t.Fatalf("count = %d, want 4", s.Count)
+	}
+	if s.Sum < 2.649 || s.Sum > 2.651 {
+		t.Fatalf("sum = %v, want 2.65", s.Sum)
+	}
+
+	h.reset()
+	if s := h.snapshot(); s.Count != 0 || s.Counts[1] != 0 || s.Sum != 0 {
+		t.Fatalf("snapshot after reset = %+v", s)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	snap := Snapshot{
+		TotalStreamsOpened:    5,
+		TotalStreamsClosed:    2,
+		PriorityStreamsOpened: 3,
+		ServerUDPStreams:      7,
+		ServerHandshakeErrors: 4,
+		RTTHistogram:          Histogram{Bounds: []float64{0.05, 0.1}, Counts: []int64{1, 2}, Count: 3, Sum: 0.4},
+		StreamDurations: map[string]Histogram{
+			"/v3/tcp": {Bounds: []float64{1}, Counts: []int64{1}, Count: 1, Sum: 0.5},
+		},
+		Users: []UserStats{{Name: `al"ice`, Connections: 2, BytesUp: 10, BytesDown: 20}},
+	}
+	snap.BulkConns = 2
+
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"# TYPE easyss_streams_opened_total counter\neasyss_streams_opened_total 5\n",
+		"# TYPE easyss_streams_active gauge\neasyss_streams_active 3\n",
+		`easyss_pool_streams_opened_total{pool="priority"} 3`,
+		`easyss_pool_conns{pool="bulk"} 2`,
+		`easyss_server_streams_total{endpoint="udp"} 7`,
+		"easyss_server_handshake_errors_total 4",
+		"# TYPE easyss_rtt_seconds histogram\n",
+		`easyss_rtt_seconds_bucket{le="0.05"} 1`,
+		`easyss_rtt_seconds_bucket{le="+Inf"} 3`,
+		"easyss_rtt_seconds_sum 0.4",
+		"easyss_rtt_seconds_count 3",
+		`easyss_stream_duration_seconds_bucket{endpoint="tcp",le="1"} 1`,
+		`easyss_stream_duration_seconds_count{endpoint="tcp"} 1`,
+		`easyss_user_connections_total{user="al\"ice"} 2`,
+		`easyss_user_bytes_total{user="al\"ice",direction="down"} 20`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+
+	// Every sample belongs to a family declared exactly once.
+	types := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			types[strings.Fields(name)[0]]++
+		}
+	}
+	for name, n := range types {
+		if n != 1 {
+			t.Errorf("family %s declared %d times", name, n)
+		}
+	}
+}
+
+func TestRecordRTTObservesHistogram(t *testing.T) {
+	ResetCounters()
+	RecordRTT(30 * time.Millisecond)
+	RecordStreamDuration("/v3/udp", 2*time.Second)
+
+	snap := Collect()
+	if snap.RTTHistogram.Count != 1 {
+		t.Fatalf("rtt histogram count = %d, want 1", snap.RTTHistogram.Count)
+	}
+	if snap.StreamDurations["/v3/udp"].Count != 1 {
+		t.Fatalf("stream duration count = %d, want 1", snap.StreamDurations["/v3/udp"].Count)
+	}
+
+	ResetCounters()
+	snap = Collect()
+	if snap.RTTHistogram.Count != 0 || snap.StreamDurations["/v3/udp"].Count != 0 {
+		t.Fatal("histograms should be zero after ResetCounters")
+	}
+}
@@ -32,6 +32,8 @@ type stats struct {
 
 	dnsCacheHits     atomic.Int64
 	dnsCacheMisses   atomic.Int64
+	dnsPrefetches    atomic.Int64
+	dnsStaleServed   atomic.Int64
 	dnsProxyQueries  atomic.Int64
 	dnsDirectQueries atomic.Int64
 
@@ -71,6 +73,8 @@ type stats struct {
 	serverTCPStreams      atomic.Int64
 	serverUDPStreams      atomic.Int64
 	serverICMPStreams     atomic.Int64
+	serverBindStreams     atomic.Int64
+	serverReverseStreams  atomic.Int64
 	serverHandshakeErrors atomic.Int64
 	serverFallbackPages   atomic.Int64
 	serverProbes          atomic.Int64
@@ -94,6 +98,8 @@ func RecordUDPAssociation()    { g.udpAssociations.Add(1) }
 
 func RecordDNSCacheHit()    { g.dnsCacheHits.Add(1) }
 func RecordDNSCacheMiss()   { g.dnsCacheMisses.Add(1) }
+func RecordDNSPrefetch()    { g.dnsPrefetches.Add(1) }
+func RecordDNSStaleServed() { g.dnsStaleServed.Add(1) }
 func RecordDNSProxyQuery()  { g.dnsProxyQueries.Add(1) }
 func RecordDNSDirectQuery() { g.dnsDirectQueries.Add(1) }
 
@@ -132,11 +138,14 @@ func RecordRTT(d time.Duration) {
 	}
 	g.rttMu.Unlock()
 	g.rttCount.Add(1)
+	rttHist.observe(d)
 }
 
 func RecordServerTCPStream()      { g.serverTCPStreams.Add(1) }
 func RecordServerUDPStream()      { g.serverUDPStreams.Add(1) }
 func RecordServerICMPStream()     { g.serverICMPStreams.Add(1) }
+func RecordServerBindStream()     { g.serverBindStreams.Add(1) }
+func RecordServerReverseStream()  { g.serverReverseStreams.Add(1) }
 func RecordServerHandshakeError() { g.serverHandshakeErrors.Add(1) }
 func RecordServerFallbackPage()   { g.serverFallbackPages.Add(1) }
 func RecordServerProbe()          { g.serverProbes.Add(1) }
@@ -166,6 +175,8 @@ func ResetCounters() {
 	g.udpAssociations.Store(0)
 	g.dnsCacheHits.Store(0)
 	g.dnsCacheMisses.Store(0)
+	g.dnsPrefetches.Store(0)
+	g.dnsStaleServed.Store(0)
 	g.dnsProxyQueries.Store(0)
 	g.dnsDirectQueries.Store(0)
 	g.paddingBytes.Store(0)
@@ -197,9 +208,14 @@ func ResetCounters() {
 	g.serverTCPStreams.Store(0)
 	g.serverUDPStreams.Store(0)
 	g.serverICMPStreams.Store(0)
+	g.serverBindStreams.Store(0)
+	g.serverReverseStreams.Store(0)
 	g.serverHandshakeErrors.Store(0)
 	g.serverFallbackPages.Store(0)
 	g.serverProbes.Store(0)
+
+	resetUsers()
+	resetHistograms()
 }
 
 // --- snapshot ---
@@ -217,6 +233,8 @@ type Snapshot struct {
 	UDPAssociations       int64 `json:"udp_associations"`
 	DNSCacheHits          int64 `json:"dns_cache_hits"`
 	DNSCacheMisses        int64 `json:"dns_cache_misses"`
+	DNSPrefetches         int64 `json:"dns_prefetches"`
+	DNSStaleServed        int64 `json:"dns_stale_served"`
 	DNSProxyQueries       int64 `json:"dns_proxy_queries"`
 	DNSDirectQueries      int64 `json:"dns_direct_queries"`
 	PaddingBytes          int64 `json:"padding_bytes"`
@@ -226,6 +244,8 @@ type Snapshot struct {
 	ServerTCPStreams      int64 `json:"server_tcp_streams,omitempty"`
 	ServerUDPStreams      int64 `json:"server_udp_streams,omitempty"`
 	ServerICMPStreams     int64 `json:"server_icmp_streams,omitempty"`
+	ServerBindStreams     int64 `json:"server_bind_streams,omitempty"`
+	ServerReverseStreams  int64 `json:"server_reverse_streams,omitempty"`
 	ServerHandshakeErrors int64 `json:"server_handshake_errors,omitempty"`
 	ServerFallbackPages   int64 `json:"server_fallback_pages,omitempty"`
 	ServerProbes          int64 `json:"server_probes,omitempty"`
@@ -258,6 +278,13 @@ type Snapshot struct {
 	// Transport stats (embedded, client-side only; zero on server)
 	transport.TransportStats
 
+	// Local inbound users (client-side only)
+	Users []UserStats `json:"users,omitempty"`
+
+	// Histograms, exported as metrics only
+	RTTHistogram    Histogram            `json:"-"`
+	StreamDurations map[string]Histogram `json:"-"`
+
 	// Derived
 	UptimeSeconds float64 `json:"uptime_seconds"`
 	AvgRTTMs      float64 `json:"avg_rtt_ms"`
@@ -313,6 +340,8 @@ func Collect() Snapshot {
 		UDPAssociations:        g.udpAssociations.Load(),
 		DNSCacheHits:           g.dnsCacheHits.Load(),
 		DNSCacheMisses:         g.dnsCacheMisses.Load(),
+		DNSPrefetches:          g.dnsPrefetches.Load(),
+		DNSStaleServed:         g.dnsStaleServed.Load(),
 		DNSProxyQueries:        g.dnsProxyQueries.Load(),
 		DNSDirectQueries:       g.dnsDirectQueries.Load(),
 		PaddingBytes:           g.paddingBytes.Load(),
@@ -322,6 +351,8 @@ func Collect() Snapshot {
 		ServerTCPStreams:       g.serverTCPStreams.Load(),
 		ServerUDPStreams:       g.serverUDPStreams.Load(),
 		ServerICMPStreams:      g.serverICMPStreams.Load(),
+		ServerBindStreams:      g.serverBindStreams.Load(),
+		ServerReverseStreams:   g.serverReverseStreams.Load(),
 		ServerHandshakeErrors:  g.serverHandshakeErrors.Load(),
 		ServerFallbackPages:    g.serverFallbackPages.Load(),
 		ServerProbes:           g.serverProbes.Load(),
@@ -346,6 +377,9 @@ func Collect() Snapshot {
 		PeakDownloadSpeedHuman: HumanBytes(g.peakDownloadSpeed.Load()) + "/s",
 		UptimeSeconds:          uptimeSeconds,
 		AvgRTTMs:               float64(time.Duration(ewma).Microseconds()) / 1000.0,
+		Users:                  collectUsers(),
+		RTTHistogram:           rttHist.snapshot(),
+		StreamDurations:        collectStreamDurations(),
 		StartTime:              startTime,
 	}
 }
@@ -58,6 +58,8 @@ func TestResetCounters(t *testing.T) {
 	RecordUDPAssociation()
 	RecordDNSCacheHit()
 	RecordDNSCacheMiss()
+	RecordDNSPrefetch()
+	RecordDNSStaleServed()
 	RecordDNSProxyQuery()
 	RecordDNSDirectQuery()
 	RecordPaddingBytes(500)
@@ -73,6 +75,8 @@ func TestResetCounters(t *testing.T) {
 	RecordServerTCPStream()
 	RecordServerUDPStream()
 	RecordServerICMPStream()
+	RecordServerBindStream()
+	RecordServerReverseStream()
 	RecordServerHandshakeError()
 	RecordServerFallbackPage()
 	g.uploadSpeed.Store(1000)
@@ -88,6 +92,7 @@ func TestResetCounters(t *testing.T) {
 		snap.RawBytesSent != 0 || snap.RawBytesRecv != 0 ||
 		snap.TCPConnections != 0 || snap.UDPAssociations != 0 ||
 		snap.DNSCacheHits != 0 || snap.DNSCacheMisses != 0 ||
+		snap.DNSPrefetches != 0 || snap.DNSStaleServed != 0 ||
 		snap.DNSProxyQueries != 0 || snap.DNSDirectQueries != 0 ||
 		snap.PaddingBytes != 0 || snap.RecordsWritten != 0 ||
 		snap.PriorityStreamsOpened != 0 || snap.BulkStreamsOpened != 0 ||
@@ -98,7 +103,8 @@ func TestResetCounters(t *testing.T) {
 		snap.UploadSpeed != 0 || snap.DownloadSpeed != 0 ||
 		snap.PeakUploadSpeedHuman != "0 B/s" || snap.PeakDownloadSpeedHuman != "0 B/s" ||
 		snap.ServerTCPStreams != 0 || snap.ServerUDPStreams != 0 ||
-		snap.ServerICMPStreams != 0 || snap.ServerHandshakeErrors != 0 ||
+		snap.ServerICMPStreams != 0 || snap.ServerBindStreams != 0 || snap.ServerReverseStreams != 0 ||
+		snap.ServerHandshakeErrors != 0 ||
 		snap.ServerFallbackPages != 0 {
 		t.Fatalf("counters not fully reset: %+v", snap)
 	}
@@ -121,3 +127,33 @@ func TestCollectConcurrentWithReset(t *testing.T) {
 	}
 	<-done
 }
+
+func TestUserCounters(t *testing.T) {
+	bob := User("bob")
+	alice := User("alice")
+	if User("bob") != bob {
+		t.Fatal("User should return the registered counters")
+	}
+	bob.RecordConnection()
+	bob.RecordBytesUp(10)
+	bob.RecordBytesDown(20)
+	alice.RecordBytesDown(5)
+
+	users := Collect().Users
+	if len(users) < 2 || users[0].Name != "alice" || users[1].Name != "bob" {
+		t.Fatalf("users not sorted by name: %+v", users)
+	}
+	if got := users[1]; got.Connections != 1 || got.BytesUp != 10 || got.BytesDown != 20 {
+		t.Fatalf("bob = %+v", got)
+	}
+
+	ResetCounters()
+	users = Collect().Users
+	if len(users) != 2 || users[1].BytesDown != 0 || users[1].Connections != 0 {
+		t.Fatalf("users not reset in place: %+v", users)
+	}
+	bob.RecordBytesUp(1)
+	if Collect().Users[1].BytesUp != 1 {
+		t.Fatal("counters looked up before the reset should still be reported")
+	}
+}
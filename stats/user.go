@@ -0,0 +1,78 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// UserStats is the traffic of one user: a local inbound user on the
+// client, a server user on the server. Up is from the user's applications,
+// down is towards them.
+type UserStats struct {
+	Name        string `json:"name"`
+	Connections int64  `json:"connections"`
+	BytesUp     int64  `json:"bytes_up"`
+	BytesDown   int64  `json:"bytes_down"`
+}
+
+// UserCounters accumulates the traffic of one user.
+type UserCounters struct {
+	connections atomic.Int64
+	bytesUp     atomic.Int64
+	bytesDown   atomic.Int64
+}
+
+func (c *UserCounters) RecordConnection()     { c.connections.Add(1) }
+func (c *UserCounters) RecordBytesUp(n int)   { c.bytesUp.Add(int64(n)) }
+func (c *UserCounters) RecordBytesDown(n int) { c.bytesDown.Add(int64(n)) }
+
+var (
+	usersMu sync.Mutex
+	users   = make(map[string]*UserCounters)
+)
+
+// User returns the counters of the named user, registering the user on
+// first use so it is reported even before any traffic.
+func User(name string) *UserCounters {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	c, ok := users[name]
+	if !ok {
+		c = &UserCounters{}
+		users[name] = c
+	}
+	return c
+}
+
+// collectUsers returns the registered users sorted by name, nil if none.
+func collectUsers() []UserStats {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	if len(users) == 0 {
+		return nil
+	}
+	out := make([]UserStats, 0, len(users))
+	for name, c := range users {
+		out = append(out, UserStats{
+			Name:        name,
+			Connections: c.connections.Load(),
+			BytesUp:     c.bytesUp.Load(),
+			BytesDown:   c.bytesDown.Load(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// resetUsers zeroes the user counters in place: inbounds keep the counters
+// they looked up before the session started.
+func resetUsers() {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	for _, c := range users {
+		c.connections.Store(0)
+		c.bytesUp.Store(0)
+		c.bytesDown.Store(0)
+	}
+}
@@ -29,7 +29,8 @@ type HTTP2Transport struct {
 	sched     *slotScheduler
 	lifecycle *slotLifecycle
 
-	serverURL string
+	serverURL  string
+	probeToken string
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -119,11 +120,12 @@ func New(cfg Config) (*HTTP2Transport, error) {
 	}
 
 	tr := &HTTP2Transport{
-		sched:     sched,
-		lifecycle: lc,
-		serverURL: cfg.ServerURL,
-		ctx:       ctx,
-		cancel:    cancel,
+		sched:      sched,
+		lifecycle:  lc,
+		serverURL:  cfg.ServerURL,
+		probeToken: cfg.ProbeToken,
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 	go tr.lifecycle.run(ctx)
 	return tr, nil
@@ -258,6 +260,7 @@ func (t *HTTP2Transport) Open(ctx context.Context, req transport.OpenRequest) (t
 		stream.releaseHeavy()
 		slot.active.Add(-1)
 		stats.RecordStreamClosed()
+		stats.RecordStreamDuration(req.Endpoint, time.Since(stream.startTime))
 		cancel()
 	})
 
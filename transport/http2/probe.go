@@ -2,6 +2,9 @@ package http2
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"time"
 
@@ -128,3 +131,37 @@ func (p *slotProber) probe(ctx context.Context, slot *transportSlot) (float64, p
 	}
 	return speed, probeFast
 }
+
+// PublicIP asks the server for the address it sees this client connecting
+// from (an authenticated HEAD on the probe endpoint). It requires the probe
+// token and a server that reports the address.
+func (t *HTTP2Transport) PublicIP(ctx context.Context) (net.IP, error) {
+	if t.probeToken == "" {
+		return nil, errors.New("public ip: probe token not configured")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, t.serverURL+sharedconfig.EndpointProbe, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-es", t.probeToken)
+	req.Header.Set("Cache-Control", "no-store")
+	req.Header.Set("User-Agent", chromeUserAgent())
+
+	t.sched.mu.RLock()
+	slot := t.sched.pick(true)
+	t.sched.mu.RUnlock()
+
+	resp, err := slot.t.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("public ip: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("public ip: unexpected status %s", resp.Status)
+	}
+	ip := net.ParseIP(resp.Header.Get(sharedconfig.HeaderClientAddr))
+	if ip == nil {
+		return nil, errors.New("public ip: server did not report an address")
+	}
+	return ip, nil
+}
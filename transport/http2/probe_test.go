@@ -30,7 +30,7 @@ func newProbeServer(t *testing.T) (*httptest.Server, string) {
 	for i := range payload {
 		payload[i] = byte(i)
 	}
-	h, err := handler.NewProbeHandler(masterKey, payload)
+	h, err := handler.NewProbeHandler([][]byte{masterKey}, payload)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,3 +138,27 @@ func TestSlotProberInconclusiveOnDialError(t *testing.T) {
 		t.Fatalf("verdict = %v, want probeInconclusive", verdict)
 	}
 }
+
+func TestTransportPublicIP(t *testing.T) {
+	ts, token := newProbeServer(t)
+	slots := []*transportSlot{newProbeSlot(), newProbeSlot()}
+	tr := &HTTP2Transport{
+		sched:      newScheduler(len(slots), slots, 8, 1),
+		serverURL:  ts.URL,
+		probeToken: token,
+	}
+
+	ip, err := tr.PublicIP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.IsLoopback() {
+		t.Fatalf("PublicIP = %v, want the loopback address of the test client", ip)
+	}
+
+	// A wrong token only gets the fallback page, never the address.
+	tr.probeToken = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	if _, err := tr.PublicIP(context.Background()); err == nil {
+		t.Fatal("expected error with a wrong token")
+	}
+}
@@ -36,6 +36,7 @@ type HTTP2Stream struct {
 
 	mu       sync.Mutex
 	r        io.ReadCloser
+	header   http.Header
 	respErr  error
 	respOnce sync.Once
 	closed   bool
@@ -149,44 +150,59 @@ func (s *HTTP2Stream) MarkBootstrapSent() {
 	s.bootstrapSentAt.Store(time.Now().UnixNano())
 }
 
+// awaitResponse waits for the response to the request, once.
+func (s *HTTP2Stream) awaitResponse() {
+	s.respOnce.Do(func() {
+		res := <-s.respCh
+		s.mu.Lock()
+		if res.err != nil {
+			s.respErr = res.err
+		} else {
+			s.r = res.resp.Body
+			s.header = res.resp.Header
+			// Response headers arrived: with MarkBootstrapSent stamped
+			// (bootstrap record flushed) this is the pure path RTT —
+			// the server commits the response before dialing the origin.
+			if t0 := s.bootstrapSentAt.Load(); t0 > 0 {
+				stats.RecordRTT(time.Since(time.Unix(0, t0)))
+			}
+		}
+		// If Close() ran while we were blocked waiting for the response, the
+		// response body just arrived but nobody will ever read or close it.
+		// Close it now to release the HTTP/2 stream and its buffers, and
+		// surface a closed error to the caller.
+		if s.closed && s.r != nil {
+			_ = s.r.Close()
+			s.r = nil
+			if s.respErr == nil {
+				s.respErr = io.ErrClosedPipe
+			}
+		}
+		s.mu.Unlock()
+	})
+}
+
+// ResponseHeader waits for the server's response and returns its header,
+// or the error failing the request, such as a HandshakeRejectedError.
+func (s *HTTP2Stream) ResponseHeader() (http.Header, error) {
+	s.awaitResponse()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.respErr != nil {
+		return nil, s.respErr
+	}
+	return s.header, nil
+}
+
 func (s *HTTP2Stream) Read(p []byte) (int, error) {
 	s.mu.Lock()
 	if s.closed {
 		s.mu.Unlock()
 		return 0, io.ErrClosedPipe
 	}
-	needResp := s.r == nil && s.respErr == nil
 	s.mu.Unlock()
 
-	if needResp {
-		s.respOnce.Do(func() {
-			res := <-s.respCh
-			s.mu.Lock()
-			if res.err != nil {
-				s.respErr = res.err
-			} else {
-				s.r = res.resp.Body
-				// Response headers arrived: with MarkBootstrapSent stamped
-				// (bootstrap record flushed) this is the pure path RTT —
-				// the server commits the response before dialing the origin.
-				if t0 := s.bootstrapSentAt.Load(); t0 > 0 {
-					stats.RecordRTT(time.Since(time.Unix(0, t0)))
-				}
-			}
-			// If Close() ran while we were blocked waiting for the response, the
-			// response body just arrived but nobody will ever read or close it.
-			// Close it now to release the HTTP/2 stream and its buffers, and
-			// surface a closed error to the caller.
-			if s.closed && s.r != nil {
-				_ = s.r.Close()
-				s.r = nil
-				if s.respErr == nil {
-					s.respErr = io.ErrClosedPipe
-				}
-			}
-			s.mu.Unlock()
-		})
-	}
+	s.awaitResponse()
 
 	s.mu.Lock()
 	r := s.r
@@ -0,0 +1,205 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/relay"
+	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/stats"
+	"github.com/nange/easyss/v3/transport"
+	"github.com/nange/easyss/v3/util/bytespool"
+)
+
+var errLocalConnClosed = errors.New("local connection closed")
+
+// Relay carries localConn over the session of a stream to target with
+// method, until either side finishes or neither sends for idleTimeout.
+func (s *Session) Relay(target string, method protocol.Method, shaperCfg shaper.Config, idleTimeout time.Duration, localConn net.Conn) error {
+	w, err := s.Writer(method)
+	if err != nil {
+		s.Stream.Close() //nolint:errcheck
+		return err
+	}
+	tx := shaper.New(w, shaperCfg)
+	defer tx.Close() //nolint:errcheck
+
+	rx, err := s.Reader(method)
+	if err != nil {
+		s.Stream.Close() //nolint:errcheck
+		return err
+	}
+	return Relay(target, localConn, tx, rx, s.Stream, idleTimeout)
+}
+
+// Relay copies between localConn and a stream, sending through tx and
+// receiving from rx, until either side finishes or neither sends for
+// idleTimeout. Both are closed when it returns.
+func Relay(target string, localConn net.Conn, tx shaper.Shaper, rx *crypto.DecryptedReader, stream transport.Stream, idleTimeout time.Duration) error {
+	m := stats.NewStreamMeter("client", target)
+	defer m.Close()
+
+	closeAll := func() {
+		_ = stream.Close()
+		_ = localConn.Close()
+	}
+
+	result := relay.Bidirectional(idleTimeout, closeAll,
+		func(signal func()) error { return copyLocalToRemote(localConn, tx, signal) },
+		func(signal func()) error { return copyRemoteToLocal(rx, localConn, signal, m) },
+	)
+
+	if result.TimedOut {
+		log.Debug("[STREAM] idle timeout", "timeout", idleTimeout)
+		return fmt.Errorf("%w after %v", ErrStreamIdleTimeout, idleTimeout)
+	}
+
+	if result.Err != nil && !errors.Is(result.Err, errLocalConnClosed) && !errors.Is(result.Err, io.ErrClosedPipe) {
+		log.Debug("[STREAM] relay copy error", "err", result.Err)
+		return result.Err
+	}
+	return nil
+}
+
+func copyLocalToRemote(src net.Conn, tx shaper.Shaper, signalActivity func()) error {
+	buf := bytespool.Get(config.TCPStreamBufferSize)
+	defer bytespool.MustPut(buf)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			signalActivity()
+			stats.RecordRawBytesSent(n)
+			if pErr := tx.PushData(buf[:n]); pErr != nil {
+				_ = tx.Flush()
+				if errors.Is(pErr, io.ErrClosedPipe) {
+					return nil
+				}
+				return pErr
+			}
+		}
+		if err != nil {
+			finFrame := protocol.NewFrameFIN()
+			_ = tx.PushFrame(finFrame)
+			_ = tx.Flush()
+			signalActivity()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if isLocalConnClosedError(err) {
+				log.Debug("[STREAM] local connection closed", "err", err)
+				return errLocalConnClosed
+			}
+			log.Debug("[STREAM] local read error", "err", err)
+			return err
+		}
+	}
+}
+
+func copyRemoteToLocal(rx *crypto.DecryptedReader, dst net.Conn, signalActivity func(), m *stats.StreamMeter) error {
+	type frameItem struct {
+		data []byte
+		fin  bool
+		rst  bool
+	}
+
+	ch := make(chan frameItem, 64)
+	readDone := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(ch)
+		first := true
+		for {
+			frame, err := rx.ReadFrame()
+			if first {
+				first = false
+				err = ClassifyFirstReadError(err)
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					readDone <- nil
+				} else {
+					log.Debug("[STREAM] remote read error", "err", err)
+					readDone <- err
+				}
+				return
+			}
+
+			switch frame.Type {
+			case protocol.FrameDATA:
+				signalActivity()
+				if len(frame.Payload) > 0 {
+					select {
+					case ch <- frameItem{data: frame.Payload}:
+					case <-done:
+						readDone <- nil
+						return
+					}
+				}
+			case protocol.FrameFIN:
+				signalActivity()
+				select {
+				case ch <- frameItem{fin: true}:
+				case <-done:
+				}
+				readDone <- nil
+				return
+			case protocol.FrameRST:
+				select {
+				case ch <- frameItem{rst: true}:
+				case <-done:
+				}
+				readDone <- nil
+				return
+			case protocol.FramePADDING, protocol.FrameCOVER:
+				continue
+			}
+		}
+	}()
+
+	for item := range ch {
+		if item.rst {
+			return fmt.Errorf("%w", ErrStreamReset)
+		}
+		if item.fin {
+			return nil
+		}
+		m.SetState("write_local")
+		if _, wErr := dst.Write(item.data); wErr != nil {
+			if isLocalConnClosedError(wErr) {
+				log.Debug("[STREAM] local connection closed", "err", wErr)
+				return errLocalConnClosed
+			}
+			return wErr
+		}
+		stats.RecordRawBytesRecv(len(item.data))
+		m.Add(len(item.data), "read_remote")
+	}
+
+	return <-readDone
+}
+
+func isLocalConnClosedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "use of closed network connection") ||
+		strings.Contains(msg, "connection reset by peer") ||
+		strings.Contains(msg, "forcibly closed by the remote host") ||
+		strings.Contains(msg, "software caused connection abort") ||
+		strings.Contains(msg, "connection was aborted") ||
+		strings.Contains(msg, "broken pipe")
+}
@@ -0,0 +1,216 @@
+// Package tunnel opens the encrypted streams of the Easyss protocol over a
+// transport. It is shared by the client and by servers chaining their
+// streams to another Easyss server.
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/transport"
+)
+
+var ErrStreamIdleTimeout = errors.New("stream idle timeout")
+
+var ErrStreamReset = errors.New("stream reset by peer")
+
+// ErrServerRejectedHandshake reports that the server answered the bootstrap
+// with a non-encrypted payload (typically a camouflaged fallback page after a
+// handshake decrypt failure), i.e. the handshake was rejected before any
+// session records were exchanged. Common cause: master key mismatch.
+var ErrServerRejectedHandshake = errors.New("handshake rejected by server")
+
+// Session is a stream whose bootstrap record, carrying the handshake, was
+// sent to the server.
+type Session struct {
+	Stream   transport.Stream
+	endpoint string
+	keys     *crypto.StreamKeys
+	salt     []byte
+}
+
+// Open opens a stream of proto to target on endpoint and sends the
+// handshake with extraFrames in its bootstrap record.
+func Open(ctx context.Context, tr transport.Transport, masterKey []byte, endpoint string, proto protocol.Proto, target string, method protocol.Method, extraFrames []protocol.Frame) (*Session, error) {
+	hsFrame := protocol.NewFrameHANDSHAKE(protocol.Handshake{
+		Version: protocol.Version3,
+		Proto:   proto,
+		Method:  method,
+		Target:  target,
+	})
+	frames := append([]protocol.Frame{hsFrame}, extraFrames...)
+
+	// Add random padding to obscure the target hostname length in the
+	// bootstrap record. Without this, the first record ciphertext length
+	// directly correlates with len(target).
+	if padFrame, ok := shaper.BuildPaddingFrame(encodedLen(frames)); ok {
+		frames = append(frames, padFrame)
+	}
+
+	plaintext := protocol.EncodeFrames(frames)
+
+	const maxRetries = 2
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		salt, err := crypto.GenerateSalt()
+		if err != nil {
+			return nil, fmt.Errorf("generate salt: %w", err)
+		}
+		saltB64 := base64.RawURLEncoding.EncodeToString(salt)
+
+		stream, err := tr.Open(ctx, transport.OpenRequest{
+			Endpoint:     endpoint,
+			Salt:         saltB64,
+			HighPriority: isInteractivePort(target),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("transport open: %w", err)
+		}
+
+		sk, err := crypto.NewStreamKeys(masterKey, salt, endpoint)
+		if err != nil {
+			stream.Close() //nolint:errcheck
+			return nil, fmt.Errorf("stream keys: %w", err)
+		}
+
+		bootstrapEnc, bootstrapCounter, err := sk.Encryptor("c2s", "bootstrap", protocol.MethodAES256GCM)
+		if err != nil {
+			stream.Close() //nolint:errcheck
+			return nil, fmt.Errorf("bootstrap encryptor: %w", err)
+		}
+		aad := crypto.BuildAAD(endpoint, salt, "c2s", "bootstrap", protocol.MethodAES256GCM)
+		rw := crypto.NewRecordWriter(stream, bootstrapEnc, bootstrapCounter, aad)
+
+		if err := rw.WriteRecord(plaintext); err != nil {
+			stream.Close() //nolint:errcheck
+			if attempt < maxRetries-1 && errors.Is(err, io.ErrClosedPipe) {
+				log.Debug("[STREAM] handshake retry", "attempt", attempt+1, "target", target, "err", err)
+				continue
+			}
+			return nil, fmt.Errorf("write handshake: %w", err)
+		}
+		rw.Flush()
+
+		// Stamp the moment the bootstrap record left the client: the server
+		// answers with the response headers before dialing the origin, so the
+		// transport records the pure client<->server path RTT when they
+		// arrive (see HTTP2Stream.MarkBootstrapSent).
+		if m, ok := stream.(interface{ MarkBootstrapSent() }); ok {
+			m.MarkBootstrapSent()
+		}
+
+		return &Session{Stream: stream, endpoint: endpoint, keys: sk, salt: salt}, nil
+	}
+
+	// Unreachable: the loop always returns inside the body.
+	return nil, fmt.Errorf("write handshake: max retries exceeded")
+}
+
+// Dial is Open waiting for the server to accept the handshake, so that an
+// unreachable or rejecting server fails the dial. ctx only bounds the dial,
+// the stream outlives it.
+func Dial(ctx context.Context, tr transport.Transport, masterKey []byte, endpoint string, proto protocol.Proto, target string, method protocol.Method, extraFrames []protocol.Frame) (*Session, error) {
+	s, err := Open(context.WithoutCancel(ctx), tr, masterKey, endpoint, proto, target, method, extraFrames)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.accepted(ctx); err != nil {
+		s.Stream.Close() //nolint:errcheck
+		return nil, err
+	}
+	return s, nil
+}
+
+// accepted waits for the server's response to the bootstrap record. The
+// server commits its response once the handshake is accepted, before it
+// dials the target; a rejection is answered with an error status or the
+// fallback page. Streams not exposing their response are taken as accepted.
+func (s *Session) accepted(ctx context.Context) error {
+	r, ok := s.Stream.(interface{ ResponseHeader() (http.Header, error) })
+	if !ok {
+		return nil
+	}
+	stop := context.AfterFunc(ctx, func() { _ = s.Stream.Close() })
+	header, err := r.ResponseHeader()
+	if !stop() {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if ct := header.Get("Content-Type"); ct != "application/octet-stream" {
+		return fmt.Errorf("%w: server returned %q content (check master_key or server config)", ErrServerRejectedHandshake, ct)
+	}
+	return nil
+}
+
+// Writer returns the writer of the client's session records.
+func (s *Session) Writer(method protocol.Method) (*crypto.RecordWriter, error) {
+	aad := crypto.BuildAAD(s.endpoint, s.salt, "c2s", "session", method)
+	enc, counter, err := s.keys.Encryptor("c2s", "session", method)
+	if err != nil {
+		return nil, fmt.Errorf("c2s session encryptor: %w", err)
+	}
+	return crypto.NewRecordWriter(s.Stream, enc, counter, aad), nil
+}
+
+// Reader returns the reader of the server's session records.
+func (s *Session) Reader(method protocol.Method) (*crypto.DecryptedReader, error) {
+	aad := crypto.BuildAAD(s.endpoint, s.salt, "s2c", "session", method)
+	enc, counter, err := s.keys.Encryptor("s2c", "session", method)
+	if err != nil {
+		return nil, fmt.Errorf("s2c session encryptor: %w", err)
+	}
+	return crypto.NewDecryptedReader(s.Stream, aad, enc, counter), nil
+}
+
+// ClassifyFirstReadError maps first-record read failures caused by a
+// non-encrypted server response (e.g. a fallback page after the handshake was
+// rejected) to ErrServerRejectedHandshake with a diagnostic hint. Only the
+// very first read is classified: a failure mid-stream means real stream
+// corruption, not a handshake rejection.
+func ClassifyFirstReadError(err error) error {
+	if err == nil || errors.Is(err, ErrServerRejectedHandshake) {
+		return err
+	}
+	if transport.IsHandshakeRejected(err) {
+		return err
+	}
+	msg := err.Error()
+	for _, pat := range []string{"crypto: ciphertext exceeds max", "crypto: zero-length ciphertext", "crypto: decrypt record"} {
+		if strings.Contains(msg, pat) {
+			return fmt.Errorf("%w: server returned a non-encrypted payload (check master_key or server config)", ErrServerRejectedHandshake)
+		}
+	}
+	return err
+}
+
+// encodedLen returns the total wire size of a list of frames (headers + payloads).
+func encodedLen(frames []protocol.Frame) int {
+	total := 0
+	for _, f := range frames {
+		total += f.EncodedLen()
+	}
+	return total
+}
+
+func isInteractivePort(target string) bool {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	switch port {
+	case "22", "80", "443", "8080", "8443":
+		return true
+	}
+	return false
+}
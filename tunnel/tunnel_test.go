@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/nange/easyss/v3/transport"
+)
+
+func TestClassifyFirstReadError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{
+			name: "nil",
+			err:  nil,
+			want: nil,
+		},
+		{
+			name: "ciphertext exceeds max maps to rejection",
+			err:  fmt.Errorf("crypto: ciphertext exceeds max %d, got %d", 65552, 3940676),
+			want: ErrServerRejectedHandshake,
+		},
+		{
+			name: "zero-length ciphertext maps to rejection",
+			err:  errors.New("crypto: zero-length ciphertext"),
+			want: ErrServerRejectedHandshake,
+		},
+		{
+			name: "decrypt failure maps to rejection",
+			err:  fmt.Errorf("crypto: decrypt record: %w", errors.New("cipher: message authentication failed")),
+			want: ErrServerRejectedHandshake,
+		},
+		{
+			name: "transport rejection passes through",
+			err:  &transport.HandshakeRejectedError{StatusCode: 408, Status: "408 Request Timeout"},
+			want: &transport.HandshakeRejectedError{},
+		},
+		{
+			name: "already-classified rejection passes through",
+			err:  fmt.Errorf("wrapped: %w", ErrServerRejectedHandshake),
+			want: ErrServerRejectedHandshake,
+		},
+		{
+			name: "connection loss is not a rejection",
+			err:  errors.New("crypto: read cipher_len: http2: client connection lost"),
+			want: nil,
+		},
+		{
+			name: "EOF is not a rejection",
+			err:  io.EOF,
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyFirstReadError(tt.err)
+			switch tt.want {
+			case nil:
+				if tt.err == nil {
+					if got != nil {
+						t.Fatalf("ClassifyFirstReadError(nil) = %v, want nil", got)
+					}
+					return
+				}
+				if got == nil || errors.Is(got, ErrServerRejectedHandshake) || transport.IsHandshakeRejected(got) {
+					t.Fatalf("ClassifyFirstReadError(%v) = %v, want the original error unchanged", tt.err, got)
+				}
+				if got.Error() != tt.err.Error() {
+					t.Fatalf("ClassifyFirstReadError(%v) = %v, want the original error unchanged", tt.err, got)
+				}
+			case ErrServerRejectedHandshake:
+				if !errors.Is(got, ErrServerRejectedHandshake) {
+					t.Fatalf("ClassifyFirstReadError(%v) = %v, want ErrServerRejectedHandshake", tt.err, got)
+				}
+			default:
+				if !transport.IsHandshakeRejected(got) {
+					t.Fatalf("ClassifyFirstReadError(%v) = %v, want HandshakeRejectedError", tt.err, got)
+				}
+			}
+		})
+	}
+}
+
+func TestIsLocalConnClosedError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil error", nil, false},
+		{"net.ErrClosed", net.ErrClosed, true},
+		{"io.ErrClosedPipe", io.ErrClosedPipe, true},
+		{"use of closed network connection", errors.New("use of closed network connection"), true},
+		{"Use Of Closed Network Connection", errors.New("Use Of Closed Network Connection"), true}, // 大小写不敏感
+		{"connection reset by peer", errors.New("connection reset by peer"), true},
+		{"forcibly closed by the remote host", errors.New("forcibly closed by the remote host"), true},
+		{"software caused connection abort", errors.New("software caused connection abort"), true},
+		{"connection was aborted", errors.New("connection was aborted"), true},
+		{"broken pipe", errors.New("broken pipe"), true},
+		{"normal error", errors.New("some other error"), false},
+		{"io.EOF", io.EOF, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := isLocalConnClosedError(tt.err)
+			if got != tt.want {
+				t.Errorf("isLocalConnClosedError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
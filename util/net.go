@@ -112,6 +112,20 @@ func IsIPV6Addr(addr string) bool {
 	return IsIPV6(host)
 }
 
+// BindPeerIP returns the peer IP a SOCKS5 BIND for addr is restricted to,
+// nil when any peer may connect (unspecified host or a domain).
+func BindPeerIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
 func GetInterfaceIP(name string) (string, error) {
 	iface, err := net.InterfaceByName(name)
 	if err != nil {
@@ -2,6 +2,7 @@ package util
 
 import (
 	"context"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -282,3 +283,26 @@ func TestMapKeys(t *testing.T) {
 		}
 	})
 }
+
+func TestBindPeerIP(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		want string
+	}{
+		{"IPv4 地址", "192.0.2.1:21", "192.0.2.1"},
+		{"IPv6 地址", "[2001:db8::1]:0", "2001:db8::1"},
+		{"未指定地址", "0.0.0.0:0", ""},
+		{"IPv6 未指定地址", "[::]:0", ""},
+		{"域名", "ftp.example.com:21", ""},
+		{"无端口", "192.0.2.1", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BindPeerIP(tt.addr)
+			if (got == nil) != (tt.want == "") || (got != nil && !got.Equal(net.ParseIP(tt.want))) {
+				t.Fatalf("BindPeerIP(%q) = %v, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}